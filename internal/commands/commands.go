@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/service/user/userexport"
+	"sso-v2/internal/service/user/userimport"
+)
+
+// Deps carries the services the operator commands run against
+type Deps struct {
+	UserSvc    user.UserSVC
+	SessionSvc session.SessionSVC
+	GroupSvc   group.GroupSVC
+	AuditSvc   audit.AuditSVC
+	LoginSvc   loginhistory.LoginHistorySVC
+}
+
+type commandFunc func(args []string, deps Deps, out io.Writer) error
+
+var registry = map[string]commandFunc{
+	"migrate-usernames": migrateUsernames,
+	"index-users":       indexUsers,
+	"import-users":      importUsers,
+	"export-users":      exportUsers,
+	"subject-access":    subjectAccess,
+}
+
+// Run executes the operator command named by the first argument, writing its output to out
+func Run(args []string, deps Deps, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("no command given")
+	}
+	cmd, ok := registry[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd(args[1:], deps, out)
+}
+
+func migrateUsernames(args []string, deps Deps, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate-usernames", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "move records to their normalized keys instead of only reporting")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	report, err := deps.UserSvc.MigrateUsernames(*apply)
+	if err == nil && *apply {
+		err = migrateUserState(report.Migrated, deps)
+	}
+	if report != nil {
+		encodeErr := writeJSON(out, report)
+		if err == nil {
+			err = encodeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(report.Collisions) > 0 {
+		return fmt.Errorf("%d username collisions need manual resolution", len(report.Collisions))
+	}
+	return nil
+}
+
+// migrateUserState moves what other services keep under a migrated user's old key to the normalized one, the same
+// steps a rename takes.  The records have already moved, so every user is attempted and the first failure is returned
+// for the operator to follow up.
+func migrateUserState(migrated map[string]string, deps Deps) error {
+	steps := []struct {
+		name string
+		move func(string, string) (int, error)
+	}{
+		{"sessions", deps.SessionSvc.RenameUser},
+		{"groups", deps.GroupSvc.RenameUser},
+		{"audit history", deps.AuditSvc.RenameUser},
+		{"login history", deps.LoginSvc.RenameUser},
+	}
+	var firstErr error
+	for from, to := range migrated {
+		for _, step := range steps {
+			_, err := step.move(from, to)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("moving %v of %v: %v", step.name, from, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func indexUsers(args []string, deps Deps, out io.Writer) error {
+	indexed, err := deps.UserSvc.IndexUsers()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "indexed %d users\n", indexed)
+	return err
+}
+
+func importUsers(args []string, deps Deps, out io.Writer) error {
+	flags := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	formatName := flags.String("format", "", "input format: csv, jsonl or htpasswd")
+	dryRun := flags.Bool("dry-run", false, "validate every row without creating any users")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	format, ok := userimport.ParseFormat(*formatName)
+	if !ok {
+		return fmt.Errorf("unknown import format %q", *formatName)
+	}
+	if flags.NArg() != 1 {
+		return errors.New("import-users needs exactly one input file")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := userimport.Run(deps.UserSvc, format, file, *dryRun)
+	if err != nil {
+		return err
+	}
+	err = writeJSON(out, report)
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d rows failed to import", report.Failed)
+	}
+	return nil
+}
+
+func exportUsers(args []string, deps Deps, out io.Writer) error {
+	flags := flag.NewFlagSet("export-users", flag.ContinueOnError)
+	includeCredentials := flags.Bool("include-credentials", false, "include password hashes, authenticator secrets and recovery code hashes")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	_, err = userexport.WriteJSONL(deps.UserSvc, out, *includeCredentials)
+	return err
+}
+
+func subjectAccess(args []string, deps Deps, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("subject-access needs exactly one username")
+	}
+
+	report, err := userexport.SubjectAccessReport(userexport.Sources{
+		User:    deps.UserSvc,
+		Session: deps.SessionSvc,
+		Group:   deps.GroupSvc,
+		Audit:   deps.AuditSvc,
+		Logins:  deps.LoginSvc,
+	}, args[0])
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, report)
+}
+
+func writeJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -7,7 +7,55 @@ import "time"
 type Datasource interface {
 	GetKey(key string) (string, error)
 	SetKey(key string, val string, timeout time.Duration) error
+	// SetKeyIfAbsent only writes the key if it doesn't already exist, reporting whether it was written
+	SetKeyIfAbsent(key string, val string, timeout time.Duration) (bool, error)
 	DelKey(key string) error
+	// TakeKey atomically reads and deletes a key, returning an empty string if it didn't exist
+	TakeKey(key string) (string, error)
+	// RenameKeyIfAbsent atomically moves a key to newKey, keeping its value and expiry, as long as newKey doesn't
+	// already exist.  It reports whether the key was moved.
+	RenameKeyIfAbsent(key string, newKey string) (bool, error)
+	// ScanKeys walks the keyspace incrementally, returning keys matching a glob pattern and the cursor to resume from.
+	// A returned cursor of 0 means the iteration is complete.
+	ScanKeys(cursor int64, match string, count int64) (nextCursor int64, keys []string, err error)
+	// AddIndexMember adds a member to a sorted index, members are kept in byte order
+	AddIndexMember(key string, member string) error
+	RemoveIndexMember(key string, member string) error
+	// RangeIndex pages through a sorted index, returning up to count members starting with prefix that sort after the
+	// member given as after.  An empty after starts from the beginning.
+	RangeIndex(key string, prefix string, after string, count int64) ([]string, error)
+	// PushListItem prepends an item to a list, trimming it to the newest maxLen items.  A maxLen of 0 keeps everything.
+	PushListItem(key string, item string, maxLen int64) error
+	// GetListItems returns the list items from start to stop inclusive, newest first.  A stop of -1 means the end.
+	GetListItems(key string, start int64, stop int64) ([]string, error)
+	AddSetMember(key string, member string) error
+	GetSetMembers(key string) ([]string, error)
+	RemoveSetMember(key string, member string) error
+}
+
+// scanBatchSize is the number of keys ScanAll asks for at a time
+const scanBatchSize = 100
+
+// ScanAll calls visit with every key matching a glob pattern.  A key may be visited more than once if the keyspace
+// changes during the walk.
+func ScanAll(ds Datasource, match string, visit func(key string) error) error {
+	var cursor int64
+	for {
+		next, keys, err := ds.ScanKeys(cursor, match, scanBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err = visit(key)
+			if err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
 }
 
 type KeyNotFoundError string
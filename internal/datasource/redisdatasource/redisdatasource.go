@@ -54,6 +54,14 @@ func (ds *RedisDataSource) SetKey(key string, val string, timeout time.Duration)
 	return err
 }
 
+func (ds *RedisDataSource) SetKeyIfAbsent(key string, val string, timeout time.Duration) (bool, error) {
+	set, err := ds.cli.SetNX(key, val, timeout).Result()
+	if err != nil {
+		log.Print("error writing key: " + err.Error())
+	}
+	return set, err
+}
+
 func (ds *RedisDataSource) DelKey(key string) error {
 	err := ds.cli.Del(key).Err()
 	if err != nil {
@@ -61,3 +69,122 @@ func (ds *RedisDataSource) DelKey(key string) error {
 	}
 	return err
 }
+
+func (ds *RedisDataSource) RenameKeyIfAbsent(key string, newKey string) (bool, error) {
+	renamed, err := ds.cli.RenameNX(key, newKey).Result()
+	if err != nil {
+		log.Print("error renaming key: " + err.Error())
+	}
+	return renamed, err
+}
+
+func (ds *RedisDataSource) TakeKey(key string) (string, error) {
+	multi := ds.cli.Multi()
+	defer multi.Close()
+
+	var get *redis.StringCmd
+	_, err := multi.Exec(func() error {
+		get = multi.Get(key)
+		multi.Del(key)
+		return nil
+	})
+	// As with GetKey a missing key isn't an error, the caller just gets an empty value
+	if err == redis.Nil {
+		err = nil
+	}
+
+	if err != nil {
+		log.Print("error taking key: " + err.Error())
+		return "", err
+	}
+	return get.Val(), nil
+}
+
+func (ds *RedisDataSource) ScanKeys(cursor int64, match string, count int64) (nextCursor int64, keys []string, err error) {
+	nextCursor, keys, err = ds.cli.Scan(cursor, match, count).Result()
+	if err != nil {
+		log.Print("error scanning keys: " + err.Error())
+	}
+	return nextCursor, keys, err
+}
+
+func (ds *RedisDataSource) AddIndexMember(key string, member string) error {
+	//every member scores 0 so the sorted set orders them lexicographically
+	err := ds.cli.ZAdd(key, redis.Z{Score: 0, Member: member}).Err()
+	if err != nil {
+		log.Print("error adding index member: " + err.Error())
+	}
+	return err
+}
+
+func (ds *RedisDataSource) RemoveIndexMember(key string, member string) error {
+	err := ds.cli.ZRem(key, member).Err()
+	if err != nil {
+		log.Print("error removing index member: " + err.Error())
+	}
+	return err
+}
+
+func (ds *RedisDataSource) RangeIndex(key string, prefix string, after string, count int64) ([]string, error) {
+	opt := redis.ZRangeByScore{Min: "-", Max: "+", Count: count}
+	if prefix != "" {
+		//0xff never appears in UTF-8, so it sorts after anything else starting with the prefix
+		opt.Min = "[" + prefix
+		opt.Max = "[" + prefix + "\xff"
+	}
+	if after != "" && after >= prefix {
+		opt.Min = "(" + after
+	}
+
+	members, err := ds.cli.ZRangeByLex(key, opt).Result()
+	if err != nil {
+		log.Print("error ranging index: " + err.Error())
+	}
+	return members, err
+}
+
+func (ds *RedisDataSource) PushListItem(key string, item string, maxLen int64) error {
+	multi := ds.cli.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		multi.LPush(key, item)
+		multi.LTrim(key, 0, maxLen-1)
+		return nil
+	})
+	if err != nil {
+		log.Print("error pushing list item: " + err.Error())
+	}
+	return err
+}
+
+func (ds *RedisDataSource) GetListItems(key string, start int64, stop int64) ([]string, error) {
+	items, err := ds.cli.LRange(key, start, stop).Result()
+	if err != nil {
+		log.Print("error getting list items: " + err.Error())
+	}
+	return items, err
+}
+
+func (ds *RedisDataSource) AddSetMember(key string, member string) error {
+	err := ds.cli.SAdd(key, member).Err()
+	if err != nil {
+		log.Print("error adding set member: " + err.Error())
+	}
+	return err
+}
+
+func (ds *RedisDataSource) GetSetMembers(key string) ([]string, error) {
+	members, err := ds.cli.SMembers(key).Result()
+	if err != nil {
+		log.Print("error getting set members: " + err.Error())
+	}
+	return members, err
+}
+
+func (ds *RedisDataSource) RemoveSetMember(key string, member string) error {
+	err := ds.cli.SRem(key, member).Err()
+	if err != nil {
+		log.Print("error removing set member: " + err.Error())
+	}
+	return err
+}
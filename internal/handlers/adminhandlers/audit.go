@@ -0,0 +1,27 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/audit"
+)
+
+type adminEventsResponse struct {
+	Events []audit.Event `json:"events"`
+}
+
+// ListAdminEventsHandler returns the admin log newest first
+func ListAdminEventsHandler(auditSVC audit.AuditSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		events, err := auditSVC.AdminEvents()
+		if err != nil {
+			log.Printf("error fetching admin log: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching admin log"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, adminEventsResponse{Events: events})
+	}
+}
@@ -0,0 +1,107 @@
+package adminhandlers
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/handlers/userhandlers"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/serviceaccount"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"strings"
+)
+
+const (
+	AdminTokenHeader = "X-Admin-Token"
+	// TokenActor names requests made with the admin token in the admin log, a colon keeps it apart from usernames
+	TokenActor = "admin:token"
+)
+
+// RequireAdmin guards the admin routes.  Requests must carry the configured token in an X-Admin-Token header, an
+// X-Session-Id header for a session whose user currently holds rbac.AdminPermission, or a service account key scoped
+// to it as a bearer token.  An empty token disables token access.  Whoever made the request is named for the admin log.
+func RequireAdmin(token string, sessionSVC session.SessionSVC, accountSVC serviceaccount.ServiceAccountSVC, userSVC user.UserSVC, rbacSVC rbac.RbacSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		supplied := ctx.Request.Header.Get(AdminTokenHeader)
+		if supplied != "" && token != "" && subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1 {
+			handlers.SetAuditActor(ctx, TokenActor)
+			ctx.Next()
+			return
+		}
+
+		if sessionId := ctx.Request.Header.Get(userhandlers.SessionIdHeader); sessionId != "" {
+			sess, err := sessionSVC.GetSessionById(sessionId)
+			if err != nil && err != session.SessionNotFoundError {
+				log.Printf("error looking up session: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error looking up session"})
+				ctx.Abort()
+				return
+			}
+			admin := false
+			if err == nil {
+				admin, err = sessionIsAdmin(sess, userSVC, rbacSVC)
+			}
+			if err != nil {
+				log.Printf("error resolving session permissions: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error looking up session"})
+				ctx.Abort()
+				return
+			}
+			if admin {
+				handlers.SetAuditActor(ctx, sess.Username)
+				ctx.Next()
+				return
+			}
+		}
+
+		if key := handlers.APIKey(ctx); key != "" {
+			apiKey, err := accountSVC.Authenticate(key)
+			if err != nil && err != serviceaccount.InvalidAPIKey {
+				log.Printf("error checking API key: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error checking API key"})
+				ctx.Abort()
+				return
+			}
+			if err == nil && rbac.Grants(apiKey.Scopes, rbac.AdminPermission) {
+				handlers.SetAuditActor(ctx, serviceaccount.Principal(apiKey.Account))
+				ctx.Next()
+				return
+			}
+		}
+
+		ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "admin token or session required"})
+		ctx.Abort()
+	}
+}
+
+// sessionIsAdmin reports whether the session may use the admin routes.  A user session's permissions are a snapshot
+// from login, so they're resolved again from the user's current roles and state; losing the role or the role losing
+// the permission takes effect at once.  A service account session holds its key's scopes, which can't change and go
+// away with the key.
+func sessionIsAdmin(sess *session.SessionData, userSVC user.UserSVC, rbacSVC rbac.RbacSVC) (bool, error) {
+	if sess.PasswordChangeRequired {
+		return false, nil
+	}
+	if strings.HasPrefix(sess.Username, serviceaccount.PrincipalPrefix) {
+		return rbac.Grants(sess.Permissions, rbac.AdminPermission), nil
+	}
+
+	userDat, err := userSVC.GetUser(sess.Username)
+	if err == user.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if userDat.LoginError() != nil {
+		return false, nil
+	}
+	permissions, err := rbacSVC.PermissionsFor(userDat.Roles)
+	if err != nil {
+		return false, err
+	}
+	return rbac.Grants(permissions, rbac.AdminPermission), nil
+}
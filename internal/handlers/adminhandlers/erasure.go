@@ -0,0 +1,73 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/erasure"
+	"sso-v2/internal/service/user"
+)
+
+// EraseUserHandler erases the user in the path and returns the erasure receipt
+func EraseUserHandler(erasureSVC erasure.ErasureSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		//the path names the user, the admin log only gets their pseudonym once the erasure has gone through
+		handlers.SetAuditTarget(ctx, "")
+		receipt, err := erasureSVC.Erase(ctx.Param("username"), erasure.RequestedByAdmin)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == erasure.ErasureInProgress {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error erasing user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error erasing user"})
+			return
+		}
+		handlers.SetAuditTarget(ctx, receipt.Subject)
+		ctx.JSON(http.StatusOK, receipt)
+	}
+}
+
+type listErasuresResponse struct {
+	Receipts    []erasure.Receipt `json:"receipts"`
+	ChainIntact bool              `json:"chainIntact"`
+}
+
+// ListErasuresHandler returns the erasure receipts newest first and whether their hash chain is intact.  With
+// ?username= only the receipts for that user's pseudonym are returned.
+func ListErasuresHandler(erasureSVC erasure.ErasureSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		receipts, intact, err := erasureSVC.Receipts()
+		if err != nil {
+			log.Printf("error listing erasure receipts: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing erasures"})
+			return
+		}
+
+		if username := ctx.Request.URL.Query().Get("username"); username != "" {
+			pseudonym, err := erasureSVC.Pseudonym(username)
+			if err == user.NotFound {
+				ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid username"})
+				return
+			}
+			if err != nil {
+				log.Printf("error computing pseudonym: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing erasures"})
+				return
+			}
+			matching := []erasure.Receipt{}
+			for _, receipt := range receipts {
+				if receipt.Subject == pseudonym {
+					matching = append(matching, receipt)
+				}
+			}
+			receipts = matching
+		}
+		ctx.JSON(http.StatusOK, listErasuresResponse{Receipts: receipts, ChainIntact: intact})
+	}
+}
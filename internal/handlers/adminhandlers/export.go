@@ -0,0 +1,42 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/service/user/userexport"
+)
+
+// ExportUsersHandler streams every user as JSON lines.  Credentials are left out unless ?includeCredentials=true.
+func ExportUsersHandler(userSVC user.UserSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		includeCredentials := ctx.Request.URL.Query().Get("includeCredentials") == "true"
+
+		ctx.Writer.Header().Set("Content-Type", "application/x-ndjson")
+		ctx.Writer.WriteHeader(http.StatusOK)
+		//the status is already sent once lines are streaming, so a failure part way can only cut the export short
+		_, err := userexport.WriteJSONL(userSVC, ctx.Writer, includeCredentials)
+		if err != nil {
+			log.Printf("error exporting users: %v", err.Error())
+		}
+	}
+}
+
+// SubjectAccessReportHandler returns everything stored about the user in the path, see userexport.SubjectAccessReport
+func SubjectAccessReportHandler(src userexport.Sources) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		report, err := userexport.SubjectAccessReport(src, ctx.Param("username"))
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error building subject access report: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error building report"})
+			return
+		}
+		ctx.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,118 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/user"
+)
+
+func ListGroupsHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		groups, err := groupSVC.ListGroups()
+		if err != nil {
+			log.Printf("error listing groups: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing groups"})
+			return
+		}
+		ctx.JSON(http.StatusOK, groups)
+	}
+}
+
+func GetGroupHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		g, err := groupSVC.GetGroup(ctx.Param("group"))
+		if err == group.GroupNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error fetching group: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching group"})
+			return
+		}
+		ctx.JSON(http.StatusOK, *g)
+	}
+}
+
+type saveGroupRequest struct {
+	Description string `json:"description"`
+}
+
+// SaveGroupHandler creates the group in the path or updates its description
+func SaveGroupHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &saveGroupRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		err = groupSVC.SaveGroup(group.Group{Name: ctx.Param("group"), Description: requestData.Description})
+		if err == group.InvalidGroupName {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error saving group: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error saving group"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+func DeleteGroupHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return groupMembershipHandler("error deleting group", func(ctx *gin.Context) error {
+		return groupSVC.DeleteGroup(ctx.Param("group"))
+	})
+}
+
+func AddGroupUserHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return groupMembershipHandler("error adding group member", func(ctx *gin.Context) error {
+		return groupSVC.AddUser(ctx.Param("group"), ctx.Param("member"))
+	})
+}
+
+func RemoveGroupUserHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return groupMembershipHandler("error removing group member", func(ctx *gin.Context) error {
+		return groupSVC.RemoveUser(ctx.Param("group"), ctx.Param("member"))
+	})
+}
+
+func AddSubgroupHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return groupMembershipHandler("error adding subgroup", func(ctx *gin.Context) error {
+		return groupSVC.AddSubgroup(ctx.Param("group"), ctx.Param("member"))
+	})
+}
+
+func RemoveSubgroupHandler(groupSVC group.GroupSVC) gin.HandlerFunc {
+	return groupMembershipHandler("error removing subgroup", func(ctx *gin.Context) error {
+		return groupSVC.RemoveSubgroup(ctx.Param("group"), ctx.Param("member"))
+	})
+}
+
+// groupMembershipHandler runs a group change taking no body, mapping the group service errors onto responses
+func groupMembershipHandler(failureMessage string, action func(ctx *gin.Context) error) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := action(ctx)
+		if err == group.GroupNotFound || err == user.NotFound {
+			ctx.JSON(http.StatusNotFound, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == group.GroupCycle {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("%v: %v", failureMessage, err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: failureMessage})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
@@ -0,0 +1,93 @@
+package adminhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestAddSubgroupHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		addErr         error
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "OK",
+			wantStatusCode: 204,
+		},
+		{
+			name:           "cycle",
+			addErr:         group.GroupCycle,
+			wantStatusCode: 409,
+			wantBody:       `{"message":"group would contain itself"}`,
+		},
+		{
+			name:           "unknown group",
+			addErr:         group.GroupNotFound,
+			wantStatusCode: 404,
+			wantBody:       `{"message":"group not found"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			groupSvc.EXPECT().AddSubgroup("staff", "emea").Return(tt.addErr)
+
+			router := apitest.BuildTestRouter("PUT", "/v1/admin/groups/:group/groups/:member", AddSubgroupHandler(groupSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/admin/groups/staff/groups/emea", nil))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.wantBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAddGroupUserHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		addErr         error
+		wantStatusCode int
+	}{
+		{
+			name:           "OK",
+			wantStatusCode: 204,
+		},
+		{
+			name:           "unknown user",
+			addErr:         user.NotFound,
+			wantStatusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			groupSvc.EXPECT().AddUser("staff", "joehrke").Return(tt.addErr)
+
+			router := apitest.BuildTestRouter("PUT", "/v1/admin/groups/:group/users/:member", AddGroupUserHandler(groupSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/admin/groups/staff/users/joehrke", nil))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/service/user/userimport"
+)
+
+// MaxImportSize caps the body of an import request, larger files should go through the import-users command
+const MaxImportSize = 32 << 20
+
+// ImportUsersHandler creates users from the request body, which is in the format named by ?format= (csv, jsonl or
+// htpasswd).  With ?dryRun=true every row is validated but nothing is written.  Rows that fail don't stop the
+// import, they're listed in the report.
+func ImportUsersHandler(userSVC user.UserSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		params := ctx.Request.URL.Query()
+		format, ok := userimport.ParseFormat(params.Get("format"))
+		if !ok {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "format must be csv, jsonl or htpasswd"})
+			return
+		}
+
+		body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, MaxImportSize)
+		report, err := userimport.Run(userSVC, format, body, params.Get("dryRun") == "true")
+		if err != nil {
+			log.Printf("error reading import: %v", err.Error())
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,66 @@
+package adminhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestImportUsersHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		requestBody    string
+		expectImport   bool
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "OK",
+			query:          "?format=htpasswd&dryRun=true",
+			requestBody:    "joehrke:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+			expectImport:   true,
+			wantStatusCode: 200,
+			wantBody:       `{"dryRun":true,"imported":1,"failed":0,"errors":[]}`,
+		},
+		{
+			name:           "unknown format",
+			query:          "?format=xml",
+			wantStatusCode: 400,
+			wantBody:       `{"message":"format must be csv, jsonl or htpasswd"}`,
+		},
+		{
+			name:           "bad header",
+			query:          "?format=csv",
+			requestBody:    "user,hash\n",
+			wantStatusCode: 400,
+			wantBody:       `{"message":"unknown column \"user\""}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			if tt.expectImport {
+				userSvc.EXPECT().ImportUser(user.ImportRecord{Username: "joehrke", PasswordHash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}, true).Return(nil)
+			}
+
+			router := apitest.BuildTestRouter("POST", "/v1/admin/imports", ImportUsersHandler(userSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/imports"+tt.query, strings.NewReader(tt.requestBody)))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.wantBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
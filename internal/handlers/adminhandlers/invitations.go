@@ -0,0 +1,92 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/invitation"
+	"time"
+)
+
+func ListInvitationsHandler(invitationSVC invitation.InvitationSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		invitations, err := invitationSVC.ListInvitations()
+		if err != nil {
+			log.Printf("error listing invitations: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing invitations"})
+			return
+		}
+		ctx.JSON(http.StatusOK, invitations)
+	}
+}
+
+type createInvitationRequest struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+	// MaxUses is how many registrations the invitation allows, 1 when left out and 0 for no limit
+	MaxUses *int `json:"maxUses"`
+	// ExpiresIn is the invitation's lifetime in seconds, 0 for one that doesn't expire
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type createInvitationResponse struct {
+	Token string `json:"token"`
+	invitation.Invitation
+}
+
+// CreateInvitationHandler issues an invitation to register.  The response is the only time the token is shown.
+func CreateInvitationHandler(invitationSVC invitation.InvitationSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &createInvitationRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.ExpiresIn < 0 {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "expiresIn can't be negative"})
+			return
+		}
+		maxUses := 1
+		if requestData.MaxUses != nil {
+			maxUses = *requestData.MaxUses
+		}
+
+		tok, inv, err := invitationSVC.CreateInvitation(requestData.Email, requestData.Roles, maxUses, time.Duration(requestData.ExpiresIn)*time.Second)
+		if err == invitation.InvalidMaxUses || err == invitation.InvalidEmail || err == invitation.UnknownRole {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error creating invitation: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating invitation"})
+			return
+		}
+		handlers.SetAuditTarget(ctx, ctx.Request.URL.Path+"/"+inv.Id)
+		ctx.JSON(http.StatusCreated, createInvitationResponse{Token: tok, Invitation: *inv})
+	}
+}
+
+// RevokeInvitationHandler deletes the invitation in the path, users that already registered with it keep their
+// accounts
+func RevokeInvitationHandler(invitationSVC invitation.InvitationSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := invitationSVC.RevokeInvitation(ctx.Param("invitationId"))
+		if err == invitation.InvitationNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == invitation.InvitationBusy {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error revoking invitation: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error revoking invitation"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
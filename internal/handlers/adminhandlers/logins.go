@@ -0,0 +1,39 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/user"
+)
+
+type loginsResponse struct {
+	Logins []loginhistory.Login `json:"logins"`
+}
+
+// GetLoginHistoryHandler returns the recent authentication attempts against the user in the path, newest first
+func GetLoginHistoryHandler(userSVC user.UserSVC, loginSVC loginhistory.LoginHistorySVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		u, err := userSVC.GetUser(ctx.Param("username"))
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error looking up user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching login history"})
+			return
+		}
+
+		logins, err := loginSVC.LoginsFor(u.Username)
+		if err != nil {
+			log.Printf("error fetching login history: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching login history"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, loginsResponse{Logins: logins})
+	}
+}
@@ -0,0 +1,49 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/rename"
+	"sso-v2/internal/service/user"
+)
+
+type renameRequest struct {
+	Username string `json:"username"`
+}
+
+// RenameUserHandler changes the username of the user in the path and returns what moved with them
+func RenameUserHandler(renameSVC rename.RenameSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &renameRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		result, err := renameSVC.Rename(ctx.Param("username"), requestData.Username)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == user.InvalidUsername {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.UsernameTaken {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error renaming user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error renaming user"})
+			return
+		}
+		handlers.SetAuditUser(ctx, result.To)
+		handlers.SetAuditDetail(ctx, "renamed from "+result.From)
+		ctx.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,101 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/user"
+)
+
+func ListRolesHandler(rbacSVC rbac.RbacSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		roles, err := rbacSVC.ListRoles()
+		if err != nil {
+			log.Printf("error listing roles: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing roles"})
+			return
+		}
+		ctx.JSON(http.StatusOK, roles)
+	}
+}
+
+type saveRoleRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+// SaveRoleHandler creates the role in the path or replaces its permissions.  Sessions pick up the change at their
+// next login.
+func SaveRoleHandler(rbacSVC rbac.RbacSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &saveRoleRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		err = rbacSVC.SaveRole(rbac.Role{Name: ctx.Param("role"), Permissions: requestData.Permissions})
+		if err == rbac.InvalidRoleName || err == rbac.InvalidPermission {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error saving role: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error saving role"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+func DeleteRoleHandler(rbacSVC rbac.RbacSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := rbacSVC.DeleteRole(ctx.Param("role"))
+		if err == rbac.RoleNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error deleting role: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error deleting role"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+type assignRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// AssignRolesHandler replaces the roles of the user in the path
+func AssignRolesHandler(rbacSVC rbac.RbacSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &assignRolesRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		err = rbacSVC.AssignRoles(ctx.Param("username"), requestData.Roles)
+		if err == rbac.RoleNotFound {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error assigning roles: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error assigning roles"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
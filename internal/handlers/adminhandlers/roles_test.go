@@ -0,0 +1,105 @@
+package adminhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestSaveRoleHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		expectSave     bool
+		saveErr        error
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "OK",
+			requestBody:    `{"permissions":["tickets:read"]}`,
+			expectSave:     true,
+			wantStatusCode: 204,
+		},
+		{
+			name:           "invalid permission",
+			requestBody:    `{"permissions":["tickets:read"]}`,
+			expectSave:     true,
+			saveErr:        rbac.InvalidPermission,
+			wantStatusCode: 400,
+			wantBody:       `{"message":"invalid permission"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			if tt.expectSave {
+				rbacSvc.EXPECT().SaveRole(rbac.Role{Name: "support", Permissions: []string{"tickets:read"}}).Return(tt.saveErr)
+			}
+
+			router := apitest.BuildTestRouter("PUT", "/v1/admin/roles/:role", SaveRoleHandler(rbacSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/admin/roles/support", strings.NewReader(tt.requestBody)))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.wantBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAssignRolesHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		assignErr      error
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "OK",
+			wantStatusCode: 204,
+		},
+		{
+			name:           "unknown role",
+			assignErr:      rbac.RoleNotFound,
+			wantStatusCode: 400,
+			wantBody:       `{"message":"role not found"}`,
+		},
+		{
+			name:           "unknown user",
+			assignErr:      user.NotFound,
+			wantStatusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			rbacSvc.EXPECT().AssignRoles("joehrke", []string{"support"}).Return(tt.assignErr)
+
+			router := apitest.BuildTestRouter("PUT", "/v1/admin/users/:username/roles", AssignRolesHandler(rbacSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/admin/users/joehrke/roles", strings.NewReader(`{"roles":["support"]}`)))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.wantBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/serviceaccount"
+	"time"
+)
+
+func ListServiceAccountsHandler(accountSVC serviceaccount.ServiceAccountSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		accounts, err := accountSVC.ListAccounts()
+		if err != nil {
+			log.Printf("error listing service accounts: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing service accounts"})
+			return
+		}
+		ctx.JSON(http.StatusOK, accounts)
+	}
+}
+
+type serviceAccountResponse struct {
+	serviceaccount.ServiceAccount
+	Keys []serviceaccount.APIKey `json:"keys"`
+}
+
+// GetServiceAccountHandler returns the account in the path with its keys, without their secrets
+func GetServiceAccountHandler(accountSVC serviceaccount.ServiceAccountSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		acct, err := accountSVC.GetAccount(ctx.Param("account"))
+		if err == serviceaccount.AccountNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error fetching service account: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching service account"})
+			return
+		}
+		keys, err := accountSVC.ListKeys(acct.Name)
+		if err != nil {
+			log.Printf("error listing API keys: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching service account"})
+			return
+		}
+		ctx.JSON(http.StatusOK, serviceAccountResponse{ServiceAccount: *acct, Keys: keys})
+	}
+}
+
+type saveServiceAccountRequest struct {
+	Description string `json:"description"`
+}
+
+// SaveServiceAccountHandler creates the account in the path or updates its description
+func SaveServiceAccountHandler(accountSVC serviceaccount.ServiceAccountSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &saveServiceAccountRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		err = accountSVC.SaveAccount(serviceaccount.ServiceAccount{Name: ctx.Param("account"), Description: requestData.Description})
+		if err == serviceaccount.InvalidAccountName {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error saving service account: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error saving service account"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+// DeleteServiceAccountHandler removes the account in the path, revoking its keys and ending its sessions
+func DeleteServiceAccountHandler(accountSVC serviceaccount.ServiceAccountSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := accountSVC.DeleteAccount(ctx.Param("account"))
+		if err == serviceaccount.AccountNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error deleting service account: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error deleting service account"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+type createKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is the key's lifetime in seconds, 0 for a key that doesn't expire
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type createKeyResponse struct {
+	Key string `json:"key"`
+	serviceaccount.APIKey
+}
+
+// CreateAPIKeyHandler issues a key for the account in the path.  The response is the only time the key is shown.
+func CreateAPIKeyHandler(accountSVC serviceaccount.ServiceAccountSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &createKeyRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.ExpiresIn < 0 {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "expiresIn can't be negative"})
+			return
+		}
+
+		key, info, err := accountSVC.CreateKey(ctx.Param("account"), requestData.Name, requestData.Scopes, time.Duration(requestData.ExpiresIn)*time.Second)
+		if err == serviceaccount.AccountNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == serviceaccount.InvalidScopes {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error creating API key: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating API key"})
+			return
+		}
+		handlers.SetAuditTarget(ctx, ctx.Request.URL.Path+"/"+info.Id)
+		ctx.JSON(http.StatusCreated, createKeyResponse{Key: key, APIKey: *info})
+	}
+}
+
+// RevokeAPIKeyHandler deletes a key of the account in the path and ends the sessions created with it
+func RevokeAPIKeyHandler(accountSVC serviceaccount.ServiceAccountSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := accountSVC.RevokeKey(ctx.Param("account"), ctx.Param("keyId"))
+		if err == serviceaccount.APIKeyNotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error revoking API key: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error revoking API key"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
@@ -0,0 +1,210 @@
+package adminhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"strconv"
+	"strings"
+)
+
+// SetUserStateHandler moves the user in the path to state.  Any state other than active also revokes all of the
+// user's live sessions.
+func SetUserStateHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC, state user.UserState) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := ctx.Param("username")
+
+		err := userSVC.SetState(username, state)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error setting user state: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error updating user"})
+			return
+		}
+
+		if state != user.StateActive && !revokeSessions(ctx, sessionSVC, username) {
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+// ForcePasswordChangeHandler makes the user in the path choose a new password at their next login.  Sessions they
+// already hold are left alone.
+func ForcePasswordChangeHandler(userSVC user.UserSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := userSVC.UpdateUser(ctx.Param("username"), func(u *user.UserData) error {
+			u.MustChangePassword = true
+			return nil
+		})
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error forcing password change: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error updating user"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+// DeleteUserHandler hard-deletes the user in the path, dropping their group memberships so a later user with the same
+// name doesn't inherit them, and revokes their sessions.  With ?soft=true the record is kept as a tombstone in the
+// deleted state so the username can't be registered again.  Either way the user's outstanding tokens and MFA records
+// go first, a reset or login link issued to them must not work for whoever holds the name next.
+func DeleteUserHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC, groupSVC group.GroupSVC, auditSVC audit.AuditSVC, loginSVC loginhistory.LoginHistorySVC, tokenSVC token.TokenSVC, mfaSVC mfa.MfaSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := ctx.Param("username")
+		soft := ctx.Request.URL.Query().Get("soft") == "true"
+
+		if !revokeCredentials(ctx, tokenSVC, mfaSVC, username) {
+			return
+		}
+
+		var err error
+		if soft {
+			err = userSVC.SetState(username, user.StateDeleted)
+		} else {
+			err = userSVC.DeleteUser(username)
+			if err == nil {
+				err = groupSVC.RemoveUserFromAll(username)
+			}
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error deleting user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error deleting user"})
+			return
+		}
+
+		if !revokeSessions(ctx, sessionSVC, username) {
+			return
+		}
+		if !soft && !purgeHistory(ctx, auditSVC, loginSVC, username) {
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+// revokeCredentials deletes the user's outstanding tokens and MFA challenges and used code records.  On failure the
+// response has already been written and false is returned.
+func revokeCredentials(ctx *gin.Context, tokenSVC token.TokenSVC, mfaSVC mfa.MfaSVC, username string) bool {
+	//tokens are issued to the canonical name, a name that doesn't normalize can't belong to a user
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+		return false
+	}
+	_, err = tokenSVC.RevokeTokensFor(username)
+	if err == nil {
+		_, err = mfaSVC.PurgeUser(username)
+	}
+	if err != nil {
+		log.Printf("error revoking user credentials: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error deleting user"})
+		return false
+	}
+	return true
+}
+
+// purgeHistory deletes a removed user's audit and login history, so whoever takes the name next doesn't inherit it.
+// On failure the error response has already been written and false is returned.
+func purgeHistory(ctx *gin.Context, auditSVC audit.AuditSVC, loginSVC loginhistory.LoginHistorySVC, username string) bool {
+	//history is kept under the canonical name, like sessions
+	username, _ = user.NormalizeUsername(username)
+	_, err := loginSVC.PurgeUser(username)
+	if err == nil {
+		_, err = auditSVC.PurgeUser(username)
+	}
+	if err != nil {
+		log.Printf("error purging user history: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error deleting user"})
+		return false
+	}
+	return true
+}
+
+// revokeSessions destroys every session belonging to the user.  On failure the error response has already been written
+// and false is returned.
+func revokeSessions(ctx *gin.Context, sessionSVC session.SessionSVC, username string) bool {
+	//sessions are indexed by the canonical name, the service has already rejected anything that doesn't normalize
+	username, _ = user.NormalizeUsername(username)
+	err := sessionSVC.DestroySessionsForUser(username, "")
+	if err != nil {
+		log.Printf("error revoking sessions: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error revoking sessions"})
+		return false
+	}
+	return true
+}
+
+type listUsersResponse struct {
+	Users      []user.ExportedUser `json:"users"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+// attributeFilterPrefix marks query parameters filtering on a profile attribute, e.g. ?attr.department=sales
+const attributeFilterPrefix = "attr."
+
+// ListUsersHandler pages through accounts in username order.  The query takes prefix, state, limit, cursor (the
+// nextCursor of the previous page) and attr.<name> filters.
+func ListUsersHandler(userSVC user.UserSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		params := ctx.Request.URL.Query()
+		query := user.UserQuery{
+			Prefix: params.Get("prefix"),
+			State:  user.UserState(params.Get("state")),
+			Cursor: params.Get("cursor"),
+		}
+		if raw := params.Get("limit"); raw != "" {
+			limit, err := strconv.Atoi(raw)
+			if err != nil || limit < 1 {
+				ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid limit"})
+				return
+			}
+			query.Limit = limit
+		}
+		for name, values := range params {
+			if strings.HasPrefix(name, attributeFilterPrefix) && len(values) > 0 {
+				if query.Attributes == nil {
+					query.Attributes = make(map[string]string)
+				}
+				query.Attributes[strings.TrimPrefix(name, attributeFilterPrefix)] = values[0]
+			}
+		}
+
+		page, err := userSVC.ListUsers(query)
+		if _, invalid := err.(user.AttributeError); invalid || err == user.InvalidState {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error listing users: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error listing users"})
+			return
+		}
+
+		resp := listUsersResponse{Users: []user.ExportedUser{}, NextCursor: page.NextCursor}
+		for i := range page.Users {
+			resp.Users = append(resp.Users, page.Users[i].Export(false))
+		}
+		ctx.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,491 @@
+package adminhandlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_audit"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/gen/mocks/mock_serviceaccount"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/handlers/userhandlers"
+	"sso-v2/internal/service/serviceaccount"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/token/tokensvc"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		sessionId      string
+		principal      string
+		roles          []string
+		state          user.UserState
+		permissions    []string
+		restricted     bool
+		apiKey         string
+		keyScopes      []string
+		keyErr         error
+		wantStatusCode int
+	}{
+		{
+			name:           "missing credentials",
+			wantStatusCode: 401,
+		},
+		{
+			name:           "wrong token",
+			token:          "guess",
+			wantStatusCode: 401,
+		},
+		{
+			name:           "token",
+			token:          "s3cret",
+			wantStatusCode: 204,
+		},
+		{
+			name:           "session without permission",
+			sessionId:      "sess-1",
+			permissions:    []string{"billing:read"},
+			wantStatusCode: 401,
+		},
+		{
+			name:           "admin session",
+			sessionId:      "sess-1",
+			roles:          []string{"admin"},
+			permissions:    []string{"sso:*"},
+			wantStatusCode: 204,
+		},
+		{
+			name:           "admin role since removed",
+			sessionId:      "sess-1",
+			permissions:    []string{"billing:read"},
+			wantStatusCode: 401,
+		},
+		{
+			name:           "admin since disabled",
+			sessionId:      "sess-1",
+			roles:          []string{"admin"},
+			state:          user.StateDisabled,
+			wantStatusCode: 401,
+		},
+		{
+			name:           "restricted session",
+			sessionId:      "sess-1",
+			restricted:     true,
+			wantStatusCode: 401,
+		},
+		{
+			name:           "service account session",
+			sessionId:      "sess-1",
+			principal:      "svc:ops",
+			permissions:    []string{"sso:admin"},
+			wantStatusCode: 204,
+		},
+		{
+			name:           "invalid API key",
+			apiKey:         "sso_0011223344556677_guess",
+			keyErr:         serviceaccount.InvalidAPIKey,
+			wantStatusCode: 401,
+		},
+		{
+			name:           "API key without scope",
+			apiKey:         "sso_0011223344556677_secret",
+			keyScopes:      []string{"billing:read"},
+			wantStatusCode: 401,
+		},
+		{
+			name:           "admin API key",
+			apiKey:         "sso_0011223344556677_secret",
+			keyScopes:      []string{"sso:admin"},
+			wantStatusCode: 204,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			accountSvc := mock_serviceaccount.NewMockServiceAccountSVC(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			if tt.sessionId != "" {
+				username := "joehrke"
+				if tt.principal != "" {
+					username = tt.principal
+				}
+				//the session's own permission snapshot is only trusted for service accounts
+				access := session.Access{Permissions: []string{"sso:admin"}, PasswordChangeRequired: tt.restricted}
+				if tt.principal != "" {
+					access.Permissions = tt.permissions
+				}
+				sessionSvc.EXPECT().GetSessionById(tt.sessionId).Return(&session.SessionData{Id: tt.sessionId, Username: username, Access: access}, nil)
+				if tt.principal == "" && !tt.restricted {
+					userSvc.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke", Roles: tt.roles, State: tt.state}, nil)
+					if tt.state == "" {
+						rbacSvc.EXPECT().PermissionsFor(tt.roles).Return(tt.permissions, nil)
+					}
+				}
+			}
+			if tt.apiKey != "" {
+				var key *serviceaccount.APIKey
+				if tt.keyErr == nil {
+					key = &serviceaccount.APIKey{Id: "0011223344556677", Account: "billing", Scopes: tt.keyScopes}
+				}
+				accountSvc.EXPECT().Authenticate(tt.apiKey).Return(key, tt.keyErr)
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/admin", RequireAdmin("s3cret", sessionSvc, accountSvc, userSvc, rbacSvc), func(ctx *gin.Context) {
+				ctx.Data(204, gin.MIMEPlain, nil)
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/admin", nil)
+			if tt.token != "" {
+				req.Header.Set(AdminTokenHeader, tt.token)
+			}
+			if tt.sessionId != "" {
+				req.Header.Set("X-Session-Id", tt.sessionId)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.apiKey)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestSetUserStateHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		state            user.UserState
+		setErr           error
+		expectRevoke     bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:         "disable",
+			state:        user.StateDisabled,
+			expectRevoke: true,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+			},
+		},
+		{
+			name:  "enable",
+			state: user.StateActive,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+			},
+		},
+		{
+			name:   "unknown user",
+			state:  user.StateDisabled,
+			setErr: user.NotFound,
+			expectedResponse: expectedResponse{
+				statusCode: 404,
+			},
+		},
+		{
+			name:   "datastore failure",
+			state:  user.StateLocked,
+			setErr: errors.New("some redis error"),
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error updating user"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			userSvc.EXPECT().SetState("JOehrke", tt.state).Return(tt.setErr)
+			if tt.expectRevoke {
+				sessionSvc.EXPECT().DestroySessionsForUser("joehrke", "").Return(nil)
+			}
+
+			router := apitest.BuildTestRouter("POST", "/v1/admin/users/:username/state", SetUserStateHandler(userSvc, sessionSvc, tt.state))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/users/JOehrke/state", nil))
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestForcePasswordChangeHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		updateErr      error
+		wantStatusCode int
+	}{
+		{name: "OK", wantStatusCode: 204},
+		{name: "unknown user", updateErr: user.NotFound, wantStatusCode: 404},
+		{name: "datastore failure", updateErr: errors.New("some redis error"), wantStatusCode: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			userSvc.EXPECT().UpdateUser("joehrke", gomock.Any()).DoAndReturn(func(username string, update func(u *user.UserData) error) error {
+				if tt.updateErr != nil {
+					return tt.updateErr
+				}
+				u := &user.UserData{Username: username}
+				if err := update(u); err != nil || !u.MustChangePassword {
+					t.Errorf("update didn't force a password change: %+v, %v", u, err)
+				}
+				return nil
+			})
+
+			router := apitest.BuildTestRouter("POST", "/v1/admin/users/:username/forcePasswordChange", ForcePasswordChangeHandler(userSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/users/joehrke/forcePasswordChange", nil))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestDeleteUserHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectHard     bool
+		deleteErr      error
+		expectRevoke   bool
+		wantStatusCode int
+	}{
+		{
+			name:           "hard delete",
+			expectHard:     true,
+			expectRevoke:   true,
+			wantStatusCode: 204,
+		},
+		{
+			name:           "soft delete",
+			query:          "?soft=true",
+			expectRevoke:   true,
+			wantStatusCode: 204,
+		},
+		{
+			name:           "unknown user",
+			expectHard:     true,
+			deleteErr:      user.NotFound,
+			wantStatusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+			loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+
+			tokenSvc.EXPECT().RevokeTokensFor("joehrke").Return(1, nil)
+			mfaSvc.EXPECT().PurgeUser("joehrke").Return(2, nil)
+			if tt.expectHard {
+				userSvc.EXPECT().DeleteUser("joehrke").Return(tt.deleteErr)
+				if tt.deleteErr == nil {
+					groupSvc.EXPECT().RemoveUserFromAll("joehrke").Return(nil)
+				}
+			} else {
+				userSvc.EXPECT().SetState("joehrke", user.StateDeleted).Return(tt.deleteErr)
+			}
+			if tt.expectRevoke {
+				sessionSvc.EXPECT().DestroySessionsForUser("joehrke", "").Return(nil)
+			}
+			if tt.expectHard && tt.deleteErr == nil {
+				loginSvc.EXPECT().PurgeUser("joehrke").Return(3, nil)
+				auditSvc.EXPECT().PurgeUser("joehrke").Return(5, nil)
+			}
+
+			router := apitest.BuildTestRouter("DELETE", "/v1/admin/users/:username", DeleteUserHandler(userSvc, sessionSvc, groupSvc, auditSvc, loginSvc, tokenSvc, mfaSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/admin/users/joehrke"+tt.query, nil))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestListUsersHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectList     bool
+		wantQuery      user.UserQuery
+		page           *user.UserPage
+		listErr        error
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:       "OK",
+			query:      "?prefix=jo&limit=1&attr.department=sales",
+			expectList: true,
+			wantQuery:  user.UserQuery{Prefix: "jo", Limit: 1, Attributes: map[string]string{"department": "sales"}},
+			page: &user.UserPage{
+				Users:      []user.UserData{{Username: "joehrke", HashedPass: "hash", Attributes: map[string]interface{}{"department": "sales"}}},
+				NextCursor: "joehrke",
+			},
+			wantStatusCode: 200,
+			wantBody:       `{"users":[{"username":"joehrke","emailVerified":false,"state":"active","mfaEnabled":false,"attributes":{"department":"sales"}}],"nextCursor":"joehrke"}`,
+		},
+		{
+			name:           "empty",
+			expectList:     true,
+			page:           &user.UserPage{},
+			wantStatusCode: 200,
+			wantBody:       `{"users":[]}`,
+		},
+		{
+			name:           "unknown attribute",
+			query:          "?attr.team=x",
+			expectList:     true,
+			wantQuery:      user.UserQuery{Attributes: map[string]string{"team": "x"}},
+			listErr:        user.AttributeError("unknown attribute team"),
+			wantStatusCode: 400,
+			wantBody:       `{"message":"unknown attribute team"}`,
+		},
+		{
+			name:           "bad limit",
+			query:          "?limit=abc",
+			wantStatusCode: 400,
+			wantBody:       `{"message":"invalid limit"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			if tt.expectList {
+				userSvc.EXPECT().ListUsers(tt.wantQuery).Return(tt.page, tt.listErr)
+			}
+
+			router := apitest.BuildTestRouter("GET", "/v1/admin/users", ListUsersHandler(userSvc))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/users"+tt.query, nil))
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.wantBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDeleteUserHandler_RevokesResetTokens(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	userSvc := mock_user.NewMockUserSVC(ctrl)
+	sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+	groupSvc := mock_group.NewMockGroupSVC(ctrl)
+	auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+	loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+	mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+
+	//a real token service over a map, so the token issued before the delete is the one redeemed after it
+	keys := map[string]string{}
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().SetKey(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(key string, val string, _ time.Duration) error {
+		keys[key] = val
+		return nil
+	})
+	ds.EXPECT().ScanKeys(int64(0), "token_*", gomock.Any()).DoAndReturn(func(int64, string, int64) (int64, []string, error) {
+		found := []string{}
+		for key := range keys {
+			found = append(found, key)
+		}
+		return 0, found, nil
+	})
+	ds.EXPECT().GetKey(gomock.Any()).DoAndReturn(func(key string) (string, error) { return keys[key], nil }).AnyTimes()
+	ds.EXPECT().DelKey(gomock.Any()).DoAndReturn(func(key string) error {
+		delete(keys, key)
+		return nil
+	}).AnyTimes()
+	ds.EXPECT().TakeKey(gomock.Any()).DoAndReturn(func(key string) (string, error) {
+		val := keys[key]
+		delete(keys, key)
+		return val, nil
+	})
+	tokenSvc := tokensvc.NewTokenSvc(ds)
+
+	tok, err := tokenSvc.IssueToken(token.PasswordResetPurpose, "joehrke", time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() unexpected error = %v", err)
+	}
+
+	mfaSvc.EXPECT().PurgeUser("joehrke").Return(0, nil)
+	userSvc.EXPECT().DeleteUser("joehrke").Return(nil)
+	groupSvc.EXPECT().RemoveUserFromAll("joehrke").Return(nil)
+	sessionSvc.EXPECT().DestroySessionsForUser("joehrke", "").Return(nil)
+	loginSvc.EXPECT().PurgeUser("joehrke").Return(0, nil)
+	auditSvc.EXPECT().PurgeUser("joehrke").Return(0, nil)
+
+	router := gin.New()
+	router.DELETE("/v1/admin/users/:username", DeleteUserHandler(userSvc, sessionSvc, groupSvc, auditSvc, loginSvc, tokenSvc, mfaSvc))
+	router.POST("/v1/users/resetPassword", userhandlers.ResetPasswordHandler(userSvc, tokenSvc, sessionSvc))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/admin/users/joehrke", nil))
+	if w.Code != 204 {
+		t.Fatalf("delete status code -- got: %v, wanted: 204", w.Code)
+	}
+
+	//the name has been registered again, the old token must not reach the new account; no password is set on it
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/users/resetPassword", strings.NewReader(`{"token":"`+tok+`","newPassword":"hunter22hunter22"}`)))
+	ctrl.Finish()
+	if w.Code != 400 {
+		t.Errorf("reset status code -- got: %v, wanted: 400", w.Code)
+	}
+}
@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+// APIKey returns the service account key sent as "Authorization: Bearer <key>", or an empty string without one
+func APIKey(ctx *gin.Context) string {
+	authorization := ctx.Request.Header.Get("Authorization")
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len("Bearer "):])
+}
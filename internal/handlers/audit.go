@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/user"
+	"time"
+)
+
+const (
+	// AuditUserKey is the context key handlers store the user they acted on under, for routes without a :username
+	AuditUserKey = "auditUser"
+	// AuditFailedKey marks a request that was answered normally but still failed, like a rejected password
+	AuditFailedKey = "auditFailed"
+	// AuditDetailKey is the context key handlers store a short note on what the request did under
+	AuditDetailKey = "auditDetail"
+	// AuditActorKey is the context key the admin guard stores who made the request under, see AdminAudited
+	AuditActorKey = "auditActor"
+	// AuditTargetKey is the context key admin handlers store what they acted on under when the path won't do
+	AuditTargetKey = "auditTarget"
+)
+
+// SetAuditUser names the user the current request acted on when the path doesn't, see Audited
+func SetAuditUser(ctx *gin.Context, username string) {
+	ctx.Set(AuditUserKey, username)
+}
+
+// SetAuditFailed records the current request as failed whatever status it is answered with, see Audited
+func SetAuditFailed(ctx *gin.Context) {
+	ctx.Set(AuditFailedKey, true)
+}
+
+// SetAuditDetail attaches a short note to the current request's event, like the name a user was renamed from.  It is
+// dropped along with client IPs if the user is erased, so it mustn't be needed to make sense of the history.
+func SetAuditDetail(ctx *gin.Context, detail string) {
+	ctx.Set(AuditDetailKey, detail)
+}
+
+// SetAuditActor names who made the current admin request, see AdminAudited
+func SetAuditActor(ctx *gin.Context, actor string) {
+	ctx.Set(AuditActorKey, actor)
+}
+
+// SetAuditTarget replaces the request path as what the current admin request acted on, see AdminAudited
+func SetAuditTarget(ctx *gin.Context, target string) {
+	ctx.Set(AuditTargetKey, target)
+}
+
+// Audited wraps handler so an event of eventType is recorded once it has run.  The user is the :username in the path
+// or whoever the handler named with SetAuditUser.  Requests that never identify a user, or are answered with 404
+// because there is no such user, aren't recorded.
+func Audited(auditSVC audit.AuditSVC, eventType string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		handler(ctx)
+
+		status := ctx.Writer.Status()
+		if status == http.StatusNotFound {
+			return
+		}
+		username := ctx.Param("username")
+		if named, ok := ctx.Get(AuditUserKey); ok {
+			username, _ = named.(string)
+		}
+		username, err := user.NormalizeUsername(username)
+		if err != nil {
+			return
+		}
+
+		_, failed := ctx.Get(AuditFailedKey)
+		detail := ""
+		if noted, ok := ctx.Get(AuditDetailKey); ok {
+			detail, _ = noted.(string)
+		}
+		err = auditSVC.Record(username, audit.Event{
+			Time:    time.Now().UTC(),
+			Type:    eventType,
+			Success: status < 400 && !failed,
+			Status:  status,
+			IP:      ctx.ClientIP(),
+			Detail:  detail,
+		})
+		if err != nil {
+			log.Printf("error recording audit event: %v", err.Error())
+		}
+	}
+}
+
+// AdminAudited wraps an admin handler so an event of eventType is added to the admin log once it has run, for admin
+// requests that change something other than a single user's account.  The target is the request path unless the
+// handler named another with SetAuditTarget, and the actor is whoever the admin guard named with SetAuditActor.
+// Every request is recorded, whatever it was answered with.
+func AdminAudited(auditSVC audit.AuditSVC, eventType string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		handler(ctx)
+
+		target := ctx.Request.URL.Path
+		if named, ok := ctx.Get(AuditTargetKey); ok {
+			target, _ = named.(string)
+		}
+		actor := ""
+		if named, ok := ctx.Get(AuditActorKey); ok {
+			actor, _ = named.(string)
+		}
+
+		status := ctx.Writer.Status()
+		_, failed := ctx.Get(AuditFailedKey)
+		err := auditSVC.RecordAdmin(audit.Event{
+			Time:    time.Now().UTC(),
+			Type:    eventType,
+			Success: status < 400 && !failed,
+			Status:  status,
+			IP:      ctx.ClientIP(),
+			Target:  target,
+			Actor:   actor,
+		})
+		if err != nil {
+			log.Printf("error recording admin audit event: %v", err.Error())
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_audit"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/test/apitest"
+	"testing"
+)
+
+func TestAudited(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		handler     gin.HandlerFunc
+		wantUser    string
+		wantSuccess bool
+		wantDetail  string
+		wantStatus  int
+	}{
+		{
+			name:        "user in path",
+			url:         "/v1/users/Joehrke",
+			handler:     func(ctx *gin.Context) { ctx.Data(204, gin.MIMEPlain, nil) },
+			wantUser:    "joehrke",
+			wantSuccess: true,
+			wantStatus:  204,
+		},
+		{
+			name:       "error status",
+			url:        "/v1/users/joehrke",
+			handler:    func(ctx *gin.Context) { ctx.Data(403, gin.MIMEPlain, nil) },
+			wantUser:   "joehrke",
+			wantStatus: 403,
+		},
+		{
+			name: "named by handler and failed",
+			url:  "/v1/users/doAuth",
+			handler: func(ctx *gin.Context) {
+				SetAuditUser(ctx, "joehrke")
+				SetAuditFailed(ctx)
+				ctx.Data(200, gin.MIMEPlain, nil)
+			},
+			wantUser:   "joehrke",
+			wantStatus: 200,
+		},
+		{
+			name: "renamed with detail",
+			url:  "/v1/users/joehrke",
+			handler: func(ctx *gin.Context) {
+				SetAuditUser(ctx, "jhrke")
+				SetAuditDetail(ctx, "renamed from joehrke")
+				ctx.Data(200, gin.MIMEPlain, nil)
+			},
+			wantUser:    "jhrke",
+			wantSuccess: true,
+			wantDetail:  "renamed from joehrke",
+			wantStatus:  200,
+		},
+		{
+			name:    "unknown user",
+			url:     "/v1/users/nobody",
+			handler: func(ctx *gin.Context) { ctx.Data(404, gin.MIMEPlain, nil) },
+		},
+		{
+			name:    "no valid user",
+			url:     "/v1/users/no%20body",
+			handler: func(ctx *gin.Context) { ctx.Data(400, gin.MIMEPlain, nil) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+			if tt.wantUser != "" {
+				auditSvc.EXPECT().Record(tt.wantUser, gomock.Any()).DoAndReturn(func(username string, event audit.Event) error {
+					if event.Type != audit.EventLogin || event.Success != tt.wantSuccess || event.Status != tt.wantStatus || event.Detail != tt.wantDetail {
+						t.Errorf("Record() got event %+v, want success %v and status %v", event, tt.wantSuccess, tt.wantStatus)
+					}
+					return nil
+				})
+			}
+
+			router := apitest.BuildTestRouter("POST", "/v1/users/:username", Audited(auditSvc, audit.EventLogin, tt.handler))
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", tt.url, nil))
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestAdminAudited(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     gin.HandlerFunc
+		wantTarget  string
+		wantSuccess bool
+		wantStatus  int
+	}{
+		{
+			name: "path target",
+			handler: func(ctx *gin.Context) {
+				SetAuditActor(ctx, "joehrke")
+				ctx.Data(204, gin.MIMEPlain, nil)
+			},
+			wantTarget:  "/v1/admin/groups/eng",
+			wantSuccess: true,
+			wantStatus:  204,
+		},
+		{
+			name: "named target",
+			handler: func(ctx *gin.Context) {
+				SetAuditActor(ctx, "joehrke")
+				SetAuditTarget(ctx, "erased:abc")
+				ctx.Data(200, gin.MIMEPlain, nil)
+			},
+			wantTarget:  "erased:abc",
+			wantSuccess: true,
+			wantStatus:  200,
+		},
+		{
+			name: "not found",
+			handler: func(ctx *gin.Context) {
+				SetAuditActor(ctx, "joehrke")
+				ctx.Data(404, gin.MIMEPlain, nil)
+			},
+			wantTarget: "/v1/admin/groups/eng",
+			wantStatus: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+			auditSvc.EXPECT().RecordAdmin(gomock.Any()).DoAndReturn(func(event audit.Event) error {
+				if event.Type != audit.EventGroupSave || event.Success != tt.wantSuccess || event.Status != tt.wantStatus || event.Target != tt.wantTarget || event.Actor != "joehrke" {
+					t.Errorf("RecordAdmin() got event %+v, want target %v, success %v and status %v", event, tt.wantTarget, tt.wantSuccess, tt.wantStatus)
+				}
+				return nil
+			})
+
+			router := apitest.BuildTestRouter("PUT", "/v1/admin/groups/:group", AdminAudited(auditSvc, audit.EventGroupSave, tt.handler))
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/admin/groups/eng", nil))
+			ctrl.Finish()
+		})
+	}
+}
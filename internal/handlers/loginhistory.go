@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/user"
+	"time"
+)
+
+// LoginKey is the context key handlers store the outcome of an authentication attempt under, see LoginRecorded
+const LoginKey = "login"
+
+// SetLogin records the factor, result and any session created by the current authentication attempt, see
+// LoginRecorded
+func SetLogin(ctx *gin.Context, factor string, result string, sessionId string) {
+	ctx.Set(LoginKey, loginhistory.Login{Factor: factor, Result: result, SessionId: sessionId})
+}
+
+// LoginRecorded wraps an authentication handler so the attempt it reported with SetLogin is added to the login history
+// of the user it named with SetAuditUser.  Attempts that never get as far as an outcome, like requests for unknown
+// users or ones that failed with an error, aren't recorded.
+func LoginRecorded(loginSVC loginhistory.LoginHistorySVC, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		handler(ctx)
+
+		outcome, ok := ctx.Get(LoginKey)
+		if !ok {
+			return
+		}
+		named, _ := ctx.Get(AuditUserKey)
+		username, _ := named.(string)
+		username, err := user.NormalizeUsername(username)
+		if err != nil {
+			return
+		}
+
+		login, _ := outcome.(loginhistory.Login)
+		login.Time = time.Now().UTC()
+		login.IP = ctx.ClientIP()
+		login.UserAgent = ctx.Request.UserAgent()
+		err = loginSVC.Record(username, login)
+		if err != nil {
+			log.Printf("error recording login: %v", err.Error())
+		}
+	}
+}
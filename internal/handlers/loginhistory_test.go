@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/test/apitest"
+	"testing"
+)
+
+func TestLoginRecorded(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   gin.HandlerFunc
+		wantUser  string
+		wantLogin loginhistory.Login
+	}{
+		{
+			name: "session created",
+			handler: func(ctx *gin.Context) {
+				SetAuditUser(ctx, "Joehrke")
+				SetLogin(ctx, loginhistory.FactorPassword, loginhistory.ResultSuccess, "sess-1")
+				ctx.Data(200, gin.MIMEPlain, nil)
+			},
+			wantUser: "joehrke",
+			wantLogin: loginhistory.Login{
+				Factor:    loginhistory.FactorPassword,
+				Result:    loginhistory.ResultSuccess,
+				SessionId: "sess-1",
+				IP:        "203.0.113.7",
+				UserAgent: "test-agent",
+			},
+		},
+		{
+			name: "failed factor",
+			handler: func(ctx *gin.Context) {
+				SetAuditUser(ctx, "joehrke")
+				SetLogin(ctx, loginhistory.FactorTOTP, loginhistory.ResultFailure, "")
+				ctx.Data(200, gin.MIMEPlain, nil)
+			},
+			wantUser: "joehrke",
+			wantLogin: loginhistory.Login{
+				Factor:    loginhistory.FactorTOTP,
+				Result:    loginhistory.ResultFailure,
+				IP:        "203.0.113.7",
+				UserAgent: "test-agent",
+			},
+		},
+		{
+			name: "no outcome",
+			handler: func(ctx *gin.Context) {
+				SetAuditUser(ctx, "joehrke")
+				ctx.Data(500, gin.MIMEPlain, nil)
+			},
+		},
+		{
+			name: "no user",
+			handler: func(ctx *gin.Context) {
+				SetLogin(ctx, loginhistory.FactorPassword, loginhistory.ResultFailure, "")
+				ctx.Data(200, gin.MIMEPlain, nil)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+			if tt.wantUser != "" {
+				loginSvc.EXPECT().Record(tt.wantUser, gomock.Any()).DoAndReturn(func(username string, login loginhistory.Login) error {
+					if login.Time.IsZero() {
+						t.Error("Record() got a login without a time")
+					}
+					login.Time = tt.wantLogin.Time
+					if login != tt.wantLogin {
+						t.Errorf("Record() got login %+v, want %+v", login, tt.wantLogin)
+					}
+					return nil
+				})
+			}
+
+			router := apitest.BuildTestRouter("POST", "/v1/users/doAuth", LoginRecorded(loginSvc, tt.handler))
+			req := httptest.NewRequest("POST", "/v1/users/doAuth", nil)
+			req.Header.Set("User-Agent", "test-agent")
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			ctrl.Finish()
+		})
+	}
+}
@@ -2,34 +2,196 @@ package routes
 
 import (
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/handlers/adminhandlers"
 	"sso-v2/internal/handlers/sessionhandlers"
 	"sso-v2/internal/handlers/userhandlers"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/erasure"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/invitation"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/oidc"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/rename"
+	"sso-v2/internal/service/serviceaccount"
 	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
 	"sso-v2/internal/service/user"
+	"sso-v2/internal/service/user/userexport"
 )
 
-func BuildRouter(ginMode string, usersvc user.UserSVC, sessionsvc session.SessionSVC) *gin.Engine {
+// Config holds the behavioural switches for the HTTP layer
+type Config struct {
+	// EnumerationProtection hides whether a username already exists from the user creation endpoint
+	EnumerationProtection bool
+	// PasswordResetURL is an optional link template for reset messages, {token} is replaced with the reset token
+	PasswordResetURL string
+	// AdminToken grants access to the admin routes, when it's empty only admin sessions can use them
+	AdminToken string
+	// RegistrationMode is one of the invitation registration modes, empty leaves registration open
+	RegistrationMode string
+	// LoginLinks turns on passwordless login with single-use links delivered through the notifier
+	LoginLinks bool
+	// LoginLinkURL is an optional link template for login link messages, {token} is replaced with the login token
+	LoginLinkURL string
+	// OidcReturnURL is an optional frontend page the OpenID Connect callback redirects to with the outcome in the URL
+	// fragment, without it the callback answers with JSON
+	OidcReturnURL string
+}
+
+// Services bundles the service layer dependencies the handlers are built from
+type Services struct {
+	User           user.UserSVC
+	Session        session.SessionSVC
+	Token          token.TokenSVC
+	Notifier       notify.Notifier
+	Mfa            mfa.MfaSVC
+	Rbac           rbac.RbacSVC
+	Group          group.GroupSVC
+	Audit          audit.AuditSVC
+	LoginHistory   loginhistory.LoginHistorySVC
+	Erasure        erasure.ErasureSVC
+	Rename         rename.RenameSVC
+	Oidc           oidc.OidcSVC
+	ServiceAccount serviceaccount.ServiceAccountSVC
+	Invitation     invitation.InvitationSVC
+}
+
+func BuildRouter(ginMode string, cfg Config, svcs Services) *gin.Engine {
 	gin.SetMode(ginMode)
 	router := gin.Default()
 	router.Use(gin.Logger())
 
 	//V1 routes
+	audited := func(eventType string, handler gin.HandlerFunc) gin.HandlerFunc {
+		return handlers.Audited(svcs.Audit, eventType, handler)
+	}
+	//login routes are audited like any other and also recorded in the user's login history
+	auditedLogin := func(eventType string, handler gin.HandlerFunc) gin.HandlerFunc {
+		return audited(eventType, handlers.LoginRecorded(svcs.LoginHistory, handler))
+	}
+	//admin changes that aren't to one user's account go to the admin log instead
+	adminAudited := func(eventType string, handler gin.HandlerFunc) gin.HandlerFunc {
+		return handlers.AdminAudited(svcs.Audit, eventType, handler)
+	}
+
 	v1 := router.Group("/v1")
 	{
+		starter := userhandlers.SessionStarter{User: svcs.User, Session: svcs.Session, Rbac: svcs.Rbac, Group: svcs.Group}
+		registration := userhandlers.Registration{Mode: cfg.RegistrationMode, Invitations: svcs.Invitation, Rbac: svcs.Rbac}
+
 		//User Routes
 		usrs := v1.Group("/users")
 		{
-			usrs.POST("/", userhandlers.CreateUserHandler(usersvc))
-			usrs.POST("/doAuth", userhandlers.AuthUserHandler(usersvc, sessionsvc))
+			usrs.POST("/", audited(audit.EventCreate, userhandlers.CreateUserHandler(svcs.User, svcs.Token, svcs.Notifier, cfg.EnumerationProtection, registration)))
+			//static POST routes share the :username segment, see paramSwitch
+			static := map[string]gin.HandlerFunc{
+				"doAuth":         auditedLogin(audit.EventLogin, userhandlers.AuthUserHandler(svcs.User, svcs.Mfa, starter)),
+				"doAuthMfa":      auditedLogin(audit.EventMfaChallenge, userhandlers.CompleteMfaChallengeHandler(svcs.User, svcs.Mfa, starter)),
+				"forgotPassword": audited(audit.EventPasswordResetRequest, userhandlers.RequestPasswordResetHandler(svcs.User, svcs.Token, svcs.Notifier, cfg.PasswordResetURL)),
+				"resetPassword":  audited(audit.EventPasswordReset, userhandlers.ResetPasswordHandler(svcs.User, svcs.Token, svcs.Session)),
+				"verifyEmail":    audited(audit.EventEmailVerify, userhandlers.VerifyEmailHandler(svcs.User, svcs.Token)),
+			}
+			if cfg.LoginLinks {
+				static["requestLoginLink"] = audited(audit.EventLoginLinkRequest, userhandlers.RequestLoginLinkHandler(svcs.User, svcs.Token, svcs.Notifier, cfg.LoginLinkURL))
+				static["doAuthLink"] = auditedLogin(audit.EventLinkLogin, userhandlers.LinkAuthHandler(svcs.User, svcs.Token, svcs.Mfa, starter))
+			}
+			usrs.POST("/:username", paramSwitch("username", static))
+			usrs.GET("/:username", userhandlers.GetUserHandler(svcs.User, svcs.Session))
+			//erasure isn't audited, recording it would recreate the history it just pseudonymized
+			usrs.DELETE("/:username", userhandlers.EraseUserHandler(svcs.Erasure, svcs.Session))
+			usrs.PATCH("/:username", audited(audit.EventProfileUpdate, userhandlers.UpdateUserHandler(svcs.User, svcs.Session)))
+			usrs.GET("/:username/groups", userhandlers.GetUserGroupsHandler(svcs.Group, svcs.Session))
+			usrs.GET("/:username/logins", userhandlers.GetLoginHistoryHandler(svcs.LoginHistory, svcs.Session))
+			usrs.POST("/:username/password", audited(audit.EventPasswordChange, userhandlers.ChangePasswordHandler(svcs.User, svcs.Session)))
+			usrs.PUT("/:username/username", audited(audit.EventRename, userhandlers.RenameUserHandler(svcs.Rename, svcs.Session)))
+			usrs.PUT("/:username/email", audited(audit.EventEmailChange, userhandlers.SetEmailHandler(svcs.User, svcs.Session, svcs.Token, svcs.Notifier)))
+			usrs.POST("/:username/totp", audited(audit.EventTOTPEnroll, userhandlers.BeginTOTPEnrollmentHandler(svcs.Mfa, svcs.Session)))
+			usrs.POST("/:username/totp/confirm", audited(audit.EventTOTPConfirm, userhandlers.ConfirmTOTPEnrollmentHandler(svcs.Mfa, svcs.Session)))
+			usrs.DELETE("/:username/totp", audited(audit.EventTOTPDisable, userhandlers.DisableTOTPHandler(svcs.Mfa, svcs.Session)))
+			usrs.POST("/:username/recoveryCodes", audited(audit.EventRecoveryCodes, userhandlers.RegenerateRecoveryCodesHandler(svcs.Mfa, svcs.Session)))
+			usrs.POST("/:username/identities/:provider", userhandlers.BeginOidcLinkHandler(svcs.Oidc, svcs.Session))
+			usrs.DELETE("/:username/identities/:provider", audited(audit.EventIdentityUnlink, userhandlers.UnlinkIdentityHandler(svcs.User, svcs.Session)))
+		}
+		//Federated login routes
+		federated := v1.Group("/oidc")
+		{
+			federated.GET("/:provider/login", userhandlers.BeginOidcLoginHandler(svcs.Oidc))
+			federated.GET("/:provider/callback", auditedLogin(audit.EventFederatedLogin, userhandlers.OidcCallbackHandler(svcs.Oidc, svcs.Mfa, starter, cfg.OidcReturnURL)))
 		}
 		//Session routes
 		sess := v1.Group("/sessions")
 		{
-			sess.GET("/:sessionId", sessionhandlers.GetSessionDataHandler(sessionsvc))
-			sess.PUT("/:sessionId", sessionhandlers.SetSessionDataHandler(sessionsvc))
-			sess.DELETE("/:sessionId", sessionhandlers.DestroySessionHandler(sessionsvc))
+			sess.POST("/", sessionhandlers.CreateServiceSessionHandler(svcs.ServiceAccount, svcs.Session))
+			sess.GET("/:sessionId", sessionhandlers.GetSessionDataHandler(svcs.Session))
+			sess.GET("/:sessionId/permissions/:permission", sessionhandlers.CheckPermissionHandler(svcs.Session, svcs.User, svcs.Rbac))
+			sess.PUT("/:sessionId", sessionhandlers.SetSessionDataHandler(svcs.Session))
+			sess.DELETE("/:sessionId", sessionhandlers.DestroySessionHandler(svcs.Session))
+		}
+		//Admin routes
+		admin := v1.Group("/admin", adminhandlers.RequireAdmin(cfg.AdminToken, svcs.Session, svcs.ServiceAccount, svcs.User, svcs.Rbac))
+		{
+			admin.GET("/users", adminhandlers.ListUsersHandler(svcs.User))
+			admin.POST("/imports", adminAudited(audit.EventImport, adminhandlers.ImportUsersHandler(svcs.User)))
+			admin.GET("/export", adminhandlers.ExportUsersHandler(svcs.User))
+			admin.GET("/users/:username/report", adminhandlers.SubjectAccessReportHandler(userexport.Sources{
+				User:    svcs.User,
+				Session: svcs.Session,
+				Group:   svcs.Group,
+				Audit:   svcs.Audit,
+				Logins:  svcs.LoginHistory,
+			}))
+			admin.GET("/users/:username/logins", adminhandlers.GetLoginHistoryHandler(svcs.User, svcs.LoginHistory))
+			admin.POST("/users/:username/disable", audited(audit.EventDisable, adminhandlers.SetUserStateHandler(svcs.User, svcs.Session, user.StateDisabled)))
+			admin.POST("/users/:username/lock", audited(audit.EventLock, adminhandlers.SetUserStateHandler(svcs.User, svcs.Session, user.StateLocked)))
+			admin.POST("/users/:username/enable", audited(audit.EventEnable, adminhandlers.SetUserStateHandler(svcs.User, svcs.Session, user.StateActive)))
+			admin.POST("/users/:username/forcePasswordChange", audited(audit.EventForcePasswordChange, adminhandlers.ForcePasswordChangeHandler(svcs.User)))
+			admin.DELETE("/users/:username", audited(audit.EventDelete, adminhandlers.DeleteUserHandler(svcs.User, svcs.Session, svcs.Group, svcs.Audit, svcs.LoginHistory, svcs.Token, svcs.Mfa)))
+			admin.POST("/users/:username/rename", audited(audit.EventRename, adminhandlers.RenameUserHandler(svcs.Rename)))
+			admin.POST("/users/:username/erase", adminAudited(audit.EventErase, adminhandlers.EraseUserHandler(svcs.Erasure)))
+			admin.GET("/erasures", adminhandlers.ListErasuresHandler(svcs.Erasure))
+			admin.GET("/audit", adminhandlers.ListAdminEventsHandler(svcs.Audit))
+			admin.PUT("/users/:username/roles", audited(audit.EventRolesAssign, adminhandlers.AssignRolesHandler(svcs.Rbac)))
+			admin.GET("/roles", adminhandlers.ListRolesHandler(svcs.Rbac))
+			admin.PUT("/roles/:role", adminAudited(audit.EventRoleSave, adminhandlers.SaveRoleHandler(svcs.Rbac)))
+			admin.DELETE("/roles/:role", adminAudited(audit.EventRoleDelete, adminhandlers.DeleteRoleHandler(svcs.Rbac)))
+			admin.GET("/groups", adminhandlers.ListGroupsHandler(svcs.Group))
+			admin.GET("/groups/:group", adminhandlers.GetGroupHandler(svcs.Group))
+			admin.PUT("/groups/:group", adminAudited(audit.EventGroupSave, adminhandlers.SaveGroupHandler(svcs.Group)))
+			admin.DELETE("/groups/:group", adminAudited(audit.EventGroupDelete, adminhandlers.DeleteGroupHandler(svcs.Group)))
+			admin.PUT("/groups/:group/users/:member", adminAudited(audit.EventGroupUserAdd, adminhandlers.AddGroupUserHandler(svcs.Group)))
+			admin.DELETE("/groups/:group/users/:member", adminAudited(audit.EventGroupUserRemove, adminhandlers.RemoveGroupUserHandler(svcs.Group)))
+			admin.PUT("/groups/:group/groups/:member", adminAudited(audit.EventSubgroupAdd, adminhandlers.AddSubgroupHandler(svcs.Group)))
+			admin.DELETE("/groups/:group/groups/:member", adminAudited(audit.EventSubgroupRemove, adminhandlers.RemoveSubgroupHandler(svcs.Group)))
+			admin.GET("/serviceAccounts", adminhandlers.ListServiceAccountsHandler(svcs.ServiceAccount))
+			admin.GET("/serviceAccounts/:account", adminhandlers.GetServiceAccountHandler(svcs.ServiceAccount))
+			admin.PUT("/serviceAccounts/:account", adminAudited(audit.EventServiceAccountSave, adminhandlers.SaveServiceAccountHandler(svcs.ServiceAccount)))
+			admin.DELETE("/serviceAccounts/:account", adminAudited(audit.EventServiceAccountDelete, adminhandlers.DeleteServiceAccountHandler(svcs.ServiceAccount)))
+			admin.POST("/serviceAccounts/:account/keys", adminAudited(audit.EventAPIKeyCreate, adminhandlers.CreateAPIKeyHandler(svcs.ServiceAccount)))
+			admin.DELETE("/serviceAccounts/:account/keys/:keyId", adminAudited(audit.EventAPIKeyRevoke, adminhandlers.RevokeAPIKeyHandler(svcs.ServiceAccount)))
+			admin.GET("/invitations", adminhandlers.ListInvitationsHandler(svcs.Invitation))
+			admin.POST("/invitations", adminAudited(audit.EventInvitationCreate, adminhandlers.CreateInvitationHandler(svcs.Invitation)))
+			admin.DELETE("/invitations/:invitationId", adminAudited(audit.EventInvitationRevoke, adminhandlers.RevokeInvitationHandler(svcs.Invitation)))
 		}
 	}
 
 	return router
 }
+
+// paramSwitch dispatches on the value of a path parameter.  The router can't register a static segment next to a
+// wildcard at the same depth (e.g. /users/doAuth alongside /users/:username/password), so static routes at that depth
+// are registered through the wildcard and picked out here.  Unknown values are a 404.
+func paramSwitch(param string, routes map[string]gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		handler, ok := routes[ctx.Param(param)]
+		if !ok {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		handler(ctx)
+	}
+}
@@ -6,7 +6,12 @@ import (
 	"log"
 	"net/http"
 	"sso-v2/internal/handlers"
+	"sso-v2/internal/handlers/userhandlers"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/serviceaccount"
 	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"strings"
 )
 
 func GetSessionDataHandler(svc session.SessionSVC) gin.HandlerFunc {
@@ -27,6 +32,11 @@ func GetSessionDataHandler(svc session.SessionSVC) gin.HandlerFunc {
 			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error locating session"})
 			return
 		}
+		//a restricted session is only good for changing the password, other services mustn't take it as a login
+		if sessionData.PasswordChangeRequired {
+			ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "password change required"})
+			return
+		}
 
 		ctx.JSON(http.StatusOK, *sessionData)
 	}
@@ -57,6 +67,20 @@ func SetSessionDataHandler(svc session.SessionSVC) gin.HandlerFunc {
 		}
 
 		fmt.Println(sessionId)
+		sessionData, err := svc.GetSessionById(sessionId)
+		if err == session.SessionNotFoundError {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error looking up session: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error locating session"})
+			return
+		}
+		if sessionData.PasswordChangeRequired {
+			ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "password change required"})
+			return
+		}
 		err = svc.SetSessionBodyById(sessionId, requestData.SessionVars)
 		if err == session.SessionNotFoundError {
 			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
@@ -81,3 +105,95 @@ func DestroySessionHandler(svc session.SessionSVC) gin.HandlerFunc {
 		ctx.Data(http.StatusOK, gin.MIMEPlain, nil)
 	}
 }
+
+type permissionResponse struct {
+	Allowed bool `json:"allowed"`
+}
+
+// CheckPermissionHandler reports whether a session holds a permission, so services relying on this one for login
+// don't each have to interpret roles themselves.  A user's permissions come from their current roles rather than the
+// snapshot taken at login, so a role change or a blocked account takes effect on sessions that are already live.
+func CheckPermissionHandler(svc session.SessionSVC, userSVC user.UserSVC, rbacSVC rbac.RbacSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		sessionData, err := svc.GetSessionById(ctx.Param("sessionId"))
+		if err == session.SessionNotFoundError {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error looking up session: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error locating session"})
+			return
+		}
+
+		permissions, err := sessionPermissions(sessionData, userSVC, rbacSVC)
+		if err != nil {
+			log.Printf("error resolving permissions: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error checking permission"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, permissionResponse{Allowed: rbac.Grants(permissions, ctx.Param("permission"))})
+	}
+}
+
+// sessionPermissions returns what the session may do now.  A service account session holds its key's scopes, which
+// are fixed when it is created; a user session gets whatever the user's roles grant, and nothing if the user is gone,
+// can't log in or still has to change their password.
+func sessionPermissions(sess *session.SessionData, userSVC user.UserSVC, rbacSVC rbac.RbacSVC) ([]string, error) {
+	if sess.PasswordChangeRequired {
+		return nil, nil
+	}
+	if strings.HasPrefix(sess.Username, serviceaccount.PrincipalPrefix) {
+		return sess.Permissions, nil
+	}
+
+	userDat, err := userSVC.GetUser(sess.Username)
+	if err == user.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userDat.LoginError() != nil {
+		return nil, nil
+	}
+	return rbacSVC.PermissionsFor(userDat.Roles)
+}
+
+type createSessionResponse struct {
+	AuthOk bool `json:"authOk"`
+}
+
+// CreateServiceSessionHandler exchanges a service account's API key, sent as a bearer token, for a session.  The
+// session belongs to serviceaccount.Principal of the account and holds the key's scopes as its permissions.
+func CreateServiceSessionHandler(accountSVC serviceaccount.ServiceAccountSVC, svc session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := handlers.APIKey(ctx)
+		if key == "" {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "API key required"})
+			return
+		}
+		apiKey, err := accountSVC.Authenticate(key)
+		if err == serviceaccount.InvalidAPIKey {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error checking API key: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating session"})
+			return
+		}
+
+		//the key id and expiry live in the access snapshot, which unlike the session vars the holder can't rewrite
+		access := session.Access{Permissions: apiKey.Scopes, APIKeyId: apiKey.Id, ExpiresAt: apiKey.ExpiresAt}
+		sessionId, err := svc.CreateSession(serviceaccount.Principal(apiKey.Account), map[string]string{}, access)
+		if err != nil {
+			log.Printf("error creating session: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating session"})
+			return
+		}
+		ctx.Header(userhandlers.SessionIdHeader, sessionId)
+		ctx.JSON(http.StatusOK, createSessionResponse{AuthOk: true})
+	}
+}
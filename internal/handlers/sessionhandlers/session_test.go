@@ -5,8 +5,13 @@ import (
 	"github.com/golang/mock/gomock"
 	"net/http"
 	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/gen/mocks/mock_serviceaccount"
 	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/serviceaccount"
 	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
 	"sso-v2/internal/test/apitest"
 	"strings"
 	"testing"
@@ -117,6 +122,29 @@ func TestGetSessionDataHandler(t *testing.T) {
 				jsonBody:   `{"id":"asdf-1234","username":"joehrke","sessionVars":{"test":"val"}}`,
 			},
 		},
+		{
+			name:   "restricted session",
+			route:  "/session/:sessionId",
+			method: "GET",
+			requestData: requestData{
+				route:    "/session/asdf-1234",
+				jsonBody: "",
+			},
+			getSessionByIdRequest: getSessionByIdRequest{
+				expected:    true,
+				requestedId: "asdf-1234",
+				sessionData: &session.SessionData{
+					Id:       "asdf-1234",
+					Username: "joehrke",
+					Access:   session.Access{PasswordChangeRequired: true},
+				},
+				err: nil,
+			},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 403,
+				jsonBody:   `{"message":"password change required"}`,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -144,6 +172,11 @@ func TestGetSessionDataHandler(t *testing.T) {
 }
 
 func TestSetSessionDataHandler(t *testing.T) {
+	type getSessionByIdRequest struct {
+		expected    bool
+		sessionData *session.SessionData
+		err         error
+	}
 	type setSessionRequest struct {
 		expected    bool
 		sessionId   string
@@ -159,12 +192,13 @@ func TestSetSessionDataHandler(t *testing.T) {
 		jsonBody string
 	}
 	tests := []struct {
-		name                 string
-		route                string
-		method               string
-		requestData          requestData
-		setSessionRequest    setSessionRequest
-		expectedHttpResponse expectedHttpResponse
+		name                  string
+		route                 string
+		method                string
+		requestData           requestData
+		getSessionByIdRequest getSessionByIdRequest
+		setSessionRequest     setSessionRequest
+		expectedHttpResponse  expectedHttpResponse
 	}{
 		{
 			name:   "no session ID passed",
@@ -203,19 +237,32 @@ func TestSetSessionDataHandler(t *testing.T) {
 				route:    "/session/asdf-1234",
 				jsonBody: `{"sessionVars":{"test":"val"}}`,
 			},
-			setSessionRequest: setSessionRequest{
-				expected:  true,
-				sessionId: "asdf-1234",
-				sessionBody: map[string]string{
-					"test": "val",
-				},
-				err: session.SessionNotFoundError,
+			getSessionByIdRequest: getSessionByIdRequest{
+				expected: true,
+				err:      session.SessionNotFoundError,
 			},
 			expectedHttpResponse: expectedHttpResponse{
 				statusCode: 404,
 				jsonBody:   "",
 			},
 		},
+		{
+			name:   "restricted session",
+			route:  "/session/:sessionId",
+			method: "PUT",
+			requestData: requestData{
+				route:    "/session/asdf-1234",
+				jsonBody: `{"sessionVars":{"test":"val"}}`,
+			},
+			getSessionByIdRequest: getSessionByIdRequest{
+				expected:    true,
+				sessionData: &session.SessionData{Id: "asdf-1234", Access: session.Access{PasswordChangeRequired: true}},
+			},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 403,
+				jsonBody:   `{"message":"password change required"}`,
+			},
+		},
 		{
 			name:   "OK",
 			route:  "/session/:sessionId",
@@ -224,6 +271,10 @@ func TestSetSessionDataHandler(t *testing.T) {
 				route:    "/session/asdf-1234",
 				jsonBody: `{"sessionVars":{"test":"val"}}`,
 			},
+			getSessionByIdRequest: getSessionByIdRequest{
+				expected:    true,
+				sessionData: &session.SessionData{Id: "asdf-1234"},
+			},
 			setSessionRequest: setSessionRequest{
 				expected:  true,
 				sessionId: "asdf-1234",
@@ -242,6 +293,9 @@ func TestSetSessionDataHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			if tt.getSessionByIdRequest.expected {
+				sessionSvc.EXPECT().GetSessionById("asdf-1234").Return(tt.getSessionByIdRequest.sessionData, tt.getSessionByIdRequest.err)
+			}
 			if tt.setSessionRequest.expected {
 				sessionSvc.EXPECT().SetSessionBodyById(tt.setSessionRequest.sessionId, tt.setSessionRequest.sessionBody).Return(tt.setSessionRequest.err)
 			}
@@ -331,3 +385,246 @@ func TestDestroySessionHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckPermissionHandler(t *testing.T) {
+	type expectedHttpResponse struct {
+		statusCode int
+		jsonBody   string
+	}
+	tests := []struct {
+		name                 string
+		permission           string
+		sessionData          *session.SessionData
+		err                  error
+		userData             *user.UserData
+		userErr              error
+		expectRoles          bool
+		rolePermissions      []string
+		expectedHttpResponse expectedHttpResponse
+	}{
+		{
+			name:       "session not found",
+			permission: "tickets:read",
+			err:        session.SessionNotFoundError,
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 404,
+				jsonBody:   "",
+			},
+		},
+		{
+			name:            "granted",
+			permission:      "tickets:read",
+			sessionData:     &session.SessionData{Id: "asdf-1234", Username: "joehrke"},
+			userData:        &user.UserData{Username: "joehrke", Roles: []string{"support"}},
+			expectRoles:     true,
+			rolePermissions: []string{"tickets:read"},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":true}`,
+			},
+		},
+		{
+			name:            "granted by wildcard",
+			permission:      "tickets:write",
+			sessionData:     &session.SessionData{Id: "asdf-1234", Username: "joehrke"},
+			userData:        &user.UserData{Username: "joehrke", Roles: []string{"support"}},
+			expectRoles:     true,
+			rolePermissions: []string{"tickets:*"},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":true}`,
+			},
+		},
+		{
+			name:            "not granted",
+			permission:      "billing:read",
+			sessionData:     &session.SessionData{Id: "asdf-1234", Username: "joehrke"},
+			userData:        &user.UserData{Username: "joehrke", Roles: []string{"support"}},
+			expectRoles:     true,
+			rolePermissions: []string{"tickets:*"},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":false}`,
+			},
+		},
+		{
+			name:            "role removed since login",
+			permission:      "tickets:read",
+			sessionData:     &session.SessionData{Id: "asdf-1234", Username: "joehrke", Access: session.Access{Permissions: []string{"tickets:*"}}},
+			userData:        &user.UserData{Username: "joehrke"},
+			expectRoles:     true,
+			rolePermissions: []string{},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":false}`,
+			},
+		},
+		{
+			name:        "user disabled since login",
+			permission:  "tickets:read",
+			sessionData: &session.SessionData{Id: "asdf-1234", Username: "joehrke", Access: session.Access{Permissions: []string{"tickets:*"}}},
+			userData:    &user.UserData{Username: "joehrke", Roles: []string{"support"}, State: user.StateDisabled},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":false}`,
+			},
+		},
+		{
+			name:        "user deleted since login",
+			permission:  "tickets:read",
+			sessionData: &session.SessionData{Id: "asdf-1234", Username: "joehrke", Access: session.Access{Permissions: []string{"tickets:*"}}},
+			userErr:     user.NotFound,
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":false}`,
+			},
+		},
+		{
+			name:        "user lookup error",
+			permission:  "tickets:read",
+			sessionData: &session.SessionData{Id: "asdf-1234", Username: "joehrke"},
+			userErr:     errors.New("some redis error"),
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 500,
+				jsonBody:   `{"message":"error checking permission"}`,
+			},
+		},
+		{
+			name:        "restricted session",
+			permission:  "tickets:read",
+			sessionData: &session.SessionData{Id: "asdf-1234", Username: "joehrke", Access: session.Access{Permissions: []string{"tickets:*"}, PasswordChangeRequired: true}},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":false}`,
+			},
+		},
+		{
+			name:        "service account holds its scopes",
+			permission:  "tickets:read",
+			sessionData: &session.SessionData{Id: "asdf-1234", Username: serviceaccount.Principal("ci"), Access: session.Access{Permissions: []string{"tickets:read"}}},
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"allowed":true}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			sessionSvc.EXPECT().GetSessionById("asdf-1234").Return(tt.sessionData, tt.err)
+			if tt.userData != nil || tt.userErr != nil {
+				userSvc.EXPECT().GetUser("joehrke").Return(tt.userData, tt.userErr)
+			}
+			if tt.expectRoles {
+				rbacSvc.EXPECT().PermissionsFor(tt.userData.Roles).Return(tt.rolePermissions, nil)
+			}
+
+			router := apitest.BuildTestRouter("GET", "/session/:sessionId/permissions/:permission", CheckPermissionHandler(sessionSvc, userSvc, rbacSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/session/asdf-1234/permissions/"+tt.permission, nil)
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedHttpResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedHttpResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedHttpResponse.jsonBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedHttpResponse.jsonBody)
+			}
+		})
+	}
+}
+
+func TestCreateServiceSessionHandler(t *testing.T) {
+	type expectedHttpResponse struct {
+		statusCode int
+		jsonBody   string
+		sessionId  string
+	}
+	tests := []struct {
+		name                 string
+		authorization        string
+		expectAuthenticate   bool
+		apiKey               *serviceaccount.APIKey
+		authErr              error
+		expectCreate         bool
+		expectedHttpResponse expectedHttpResponse
+	}{
+		{
+			name: "no key",
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 401,
+				jsonBody:   `{"message":"API key required"}`,
+			},
+		},
+		{
+			name:               "invalid key",
+			authorization:      "Bearer sso_0011223344556677_guess",
+			expectAuthenticate: true,
+			authErr:            serviceaccount.InvalidAPIKey,
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 401,
+				jsonBody:   `{"message":"invalid or expired API key"}`,
+			},
+		},
+		{
+			name:               "key lookup failure",
+			authorization:      "Bearer sso_0011223344556677_guess",
+			expectAuthenticate: true,
+			authErr:            errors.New("connection refused"),
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 500,
+				jsonBody:   `{"message":"error creating session"}`,
+			},
+		},
+		{
+			name:               "OK",
+			authorization:      "Bearer sso_0011223344556677_secret",
+			expectAuthenticate: true,
+			apiKey:             &serviceaccount.APIKey{Id: "0011223344556677", Account: "billing", Scopes: []string{"billing:*"}},
+			expectCreate:       true,
+			expectedHttpResponse: expectedHttpResponse{
+				statusCode: 200,
+				jsonBody:   `{"authOk":true}`,
+				sessionId:  "asdf-1234",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			accountSvc := mock_serviceaccount.NewMockServiceAccountSVC(ctrl)
+			if tt.expectAuthenticate {
+				accountSvc.EXPECT().Authenticate(strings.TrimPrefix(tt.authorization, "Bearer ")).Return(tt.apiKey, tt.authErr)
+			}
+			if tt.expectCreate {
+				sessionSvc.EXPECT().CreateSession("svc:billing", map[string]string{}, session.Access{Permissions: []string{"billing:*"}, APIKeyId: "0011223344556677"}).Return("asdf-1234", nil)
+			}
+
+			router := apitest.BuildTestRouter("POST", "/session/", CreateServiceSessionHandler(accountSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/session/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedHttpResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedHttpResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedHttpResponse.jsonBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedHttpResponse.jsonBody)
+			}
+			if w.Header().Get("X-Session-Id") != tt.expectedHttpResponse.sessionId {
+				t.Errorf("Unexpected session header -- got: %v, wanted: %v", w.Header().Get("X-Session-Id"), tt.expectedHttpResponse.sessionId)
+			}
+		})
+	}
+}
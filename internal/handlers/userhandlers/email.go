@@ -0,0 +1,140 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"strings"
+	"time"
+)
+
+const EmailVerificationTTL = 24 * time.Hour
+
+type setEmailRequest struct {
+	Email string `json:"email"`
+}
+
+// SetEmailHandler replaces the email address of the user in the path, which must match the caller's session.  The new
+// address starts out unverified and a verification message is sent to it.
+func SetEmailHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC, tokenSVC token.TokenSVC, notifier notify.Notifier) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		requestData := &setEmailRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		email, err := user.NormalizeEmail(requestData.Email)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+
+		err = userSVC.SetEmail(username, email)
+		if err == user.EmailTaken {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error setting email: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error setting email"})
+			return
+		}
+
+		err = sendEmailVerification(tokenSVC, notifier, username, email)
+		if err != nil {
+			log.Printf("error sending email verification: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error sending verification"})
+			return
+		}
+
+		ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+	}
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// VerifyEmailHandler redeems a verification token, marking the address it was sent to as verified
+func VerifyEmailHandler(userSVC user.UserSVC, tokenSVC token.TokenSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &verifyEmailRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Token == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing token"})
+			return
+		}
+
+		subject, err := tokenSVC.ConsumeToken(token.EmailVerificationPurpose, requestData.Token)
+		if err == token.InvalidToken {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error consuming verification token: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error verifying email"})
+			return
+		}
+
+		username, email := splitVerificationSubject(subject)
+		handlers.SetAuditUser(ctx, username)
+		err = userSVC.VerifyEmail(username, email)
+		if err == user.EmailChanged || err == user.NotFound {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error verifying email: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error verifying email"})
+			return
+		}
+
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+// sendEmailVerification issues a verification token bound to both the user and the address, so it can't be used to
+// verify a different address the user switches to later
+func sendEmailVerification(tokenSVC token.TokenSVC, notifier notify.Notifier, username string, email string) error {
+	tok, err := tokenSVC.IssueToken(token.EmailVerificationPurpose, username+" "+email, EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return notifier.Send(notify.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Please confirm this email address for your account.\n\nVerification token: " + tok +
+			"\n\nThis token expires in " + EmailVerificationTTL.String() + ".",
+	})
+}
+
+// splitVerificationSubject undoes the "username email" pairing, usernames can't contain spaces
+func splitVerificationSubject(subject string) (username string, email string) {
+	parts := strings.SplitN(subject, " ", 2)
+	if len(parts) != 2 {
+		return subject, ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,213 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_notify"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestSetEmailHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		sessionIdHeader  string
+		sessionOwner     string
+		expectSet        bool
+		setErr           error
+		expectSend       bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "no session",
+			requestBody: `{"email":"joehrke@example.com"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:            "someone else's session",
+			requestBody:     `{"email":"joehrke@example.com"}`,
+			sessionIdHeader: "sess-1",
+			sessionOwner:    "someoneelse",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:            "invalid address",
+			requestBody:     `{"email":"nope"}`,
+			sessionIdHeader: "sess-1",
+			sessionOwner:    "joehrke",
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid email address"}`,
+			},
+		},
+		{
+			name:            "address taken",
+			requestBody:     `{"email":"joehrke@example.com"}`,
+			sessionIdHeader: "sess-1",
+			sessionOwner:    "joehrke",
+			expectSet:       true,
+			setErr:          user.EmailTaken,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"email address already in use"}`,
+			},
+		},
+		{
+			name:            "OK",
+			requestBody:     `{"email":"JOehrke@example.com"}`,
+			sessionIdHeader: "sess-1",
+			sessionOwner:    "joehrke",
+			expectSet:       true,
+			expectSend:      true,
+			expectedResponse: expectedResponse{
+				statusCode: 202,
+				body:       ``,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "PUT"
+			route := "/v1/users/:username/email"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			notifier := mock_notify.NewMockNotifier(ctrl)
+
+			if tt.sessionIdHeader != "" {
+				sessionSvc.EXPECT().GetSessionById(tt.sessionIdHeader).Return(&session.SessionData{Id: tt.sessionIdHeader, Username: tt.sessionOwner}, nil)
+			}
+			if tt.expectSet {
+				userSvc.EXPECT().SetEmail("joehrke", "joehrke@example.com").Return(tt.setErr)
+			}
+			if tt.expectSend {
+				tokenSvc.EXPECT().IssueToken(token.EmailVerificationPurpose, "joehrke joehrke@example.com", EmailVerificationTTL).Return("verify-tok", nil)
+				notifier.EXPECT().Send(gomock.Any()).Return(nil)
+			}
+
+			router := apitest.BuildTestRouter(method, route, SetEmailHandler(userSvc, sessionSvc, tokenSvc, notifier))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke/email", strings.NewReader(tt.requestBody))
+			if tt.sessionIdHeader != "" {
+				req.Header.Set(SessionIdHeader, tt.sessionIdHeader)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestVerifyEmailHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		expectConsume    bool
+		consumeErr       error
+		expectVerify     bool
+		verifyErr        error
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "missing token",
+			requestBody: `{}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing token"}`,
+			},
+		},
+		{
+			name:          "bad token",
+			requestBody:   `{"token":"verify-tok"}`,
+			expectConsume: true,
+			consumeErr:    token.InvalidToken,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid or expired token"}`,
+			},
+		},
+		{
+			name:          "address changed since token was sent",
+			requestBody:   `{"token":"verify-tok"}`,
+			expectConsume: true,
+			expectVerify:  true,
+			verifyErr:     user.EmailChanged,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid or expired token"}`,
+			},
+		},
+		{
+			name:          "OK",
+			requestBody:   `{"token":"verify-tok"}`,
+			expectConsume: true,
+			expectVerify:  true,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/verifyEmail"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+
+			if tt.expectConsume {
+				tokenSvc.EXPECT().ConsumeToken(token.EmailVerificationPurpose, "verify-tok").Return("joehrke joehrke@example.com", tt.consumeErr)
+			}
+			if tt.expectVerify {
+				userSvc.EXPECT().VerifyEmail("joehrke", "joehrke@example.com").Return(tt.verifyErr)
+			}
+
+			router := apitest.BuildTestRouter(method, url, VerifyEmailHandler(userSvc, tokenSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/erasure"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+)
+
+// EraseUserHandler lets a user erase their own account.  The request must carry ?erase=true and one of the user's
+// sessions, and the erasure receipt is returned.
+func EraseUserHandler(erasureSVC erasure.ErasureSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.URL.Query().Get("erase") != "true" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "erase=true is required"})
+			return
+		}
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		receipt, err := erasureSVC.Erase(username, erasure.RequestedBySelf)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == erasure.ErasureInProgress {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error erasing user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error erasing user"})
+			return
+		}
+		ctx.JSON(http.StatusOK, receipt)
+	}
+}
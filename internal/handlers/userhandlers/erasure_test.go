@@ -0,0 +1,110 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_erasure"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/internal/service/erasure"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestEraseUserHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		query            string
+		sessionIdHeader  string
+		expectErase      bool
+		eraseErr         error
+		expectedResponse expectedResponse
+	}{
+		{
+			name:            "missing erase flag",
+			sessionIdHeader: "sess-1",
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"erase=true is required"}`,
+			},
+		},
+		{
+			name:  "no session",
+			query: "?erase=true",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:            "erasure in progress",
+			query:           "?erase=true",
+			sessionIdHeader: "sess-1",
+			expectErase:     true,
+			eraseErr:        erasure.ErasureInProgress,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"another erasure is in progress"}`,
+			},
+		},
+		{
+			name:            "OK",
+			query:           "?erase=true",
+			sessionIdHeader: "sess-1",
+			expectErase:     true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"id":"r1","erasedAt":"0001-01-01T00:00:00Z","subject":"erased:abc","requestedBy":"self","removed":{"sessions":1},"previousHash":"","hash":"h"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "DELETE"
+			route := "/v1/users/:username"
+
+			ctrl := gomock.NewController(t)
+			erasureSvc := mock_erasure.NewMockErasureSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			if tt.sessionIdHeader != "" && tt.query != "" {
+				sessionSvc.EXPECT().GetSessionById(tt.sessionIdHeader).Return(&session.SessionData{Id: tt.sessionIdHeader, Username: "joehrke"}, nil)
+			}
+			if tt.expectErase {
+				var receipt *erasure.Receipt
+				if tt.eraseErr == nil {
+					receipt = &erasure.Receipt{
+						Id:          "r1",
+						Subject:     "erased:abc",
+						RequestedBy: erasure.RequestedBySelf,
+						Removed:     map[string]int{"sessions": 1},
+						Hash:        "h",
+					}
+				}
+				erasureSvc.EXPECT().Erase("joehrke", erasure.RequestedBySelf).Return(receipt, tt.eraseErr)
+			}
+
+			router := apitest.BuildTestRouter(method, route, EraseUserHandler(erasureSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke"+tt.query, nil)
+			if tt.sessionIdHeader != "" {
+				req.Header.Set(SessionIdHeader, tt.sessionIdHeader)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"strings"
+	"time"
+)
+
+const LoginLinkTTL = 15 * time.Minute
+
+type loginLinkRequest struct {
+	Username string `json:"username"`
+}
+
+// RequestLoginLinkHandler issues a single-use login token and delivers it through the notifier.  If linkURL is set, its
+// {token} placeholder is filled in to build a link for the message.  Like a password reset request, the response is the
+// same whether or not the user exists, failures after the lookup included.
+//
+// The token is an opaque random value stored hashed in the datastore rather than a signed link.  A signed link would
+// need no storage, but it couldn't be spent once or revoked when the user is renamed, deleted or resets their password
+// without keeping a record of it anyway, and it would add a signing key to manage.
+func RequestLoginLinkHandler(userSVC user.UserSVC, tokenSVC token.TokenSVC, notifier notify.Notifier, linkURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &loginLinkRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Username == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing username"})
+			return
+		}
+
+		userDat, err := userSVC.GetUser(requestData.Username)
+		if err == user.NotFound {
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error looking up user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error requesting login link"})
+			return
+		}
+		handlers.SetAuditUser(ctx, userDat.Username)
+		//the link is as good as a password, so it only goes to an address the user has proven is theirs.  Unlike password
+		//resets this doesn't fall back to an email-shaped username, nobody has confirmed that mailbox
+		if userDat.Email == "" || !userDat.EmailVerified {
+			log.Printf("login link requested for user without a verified email address")
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+		//an account that can't log in gets nothing, the response doesn't say so
+		if userDat.LoginError() != nil {
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+
+		tok, err := tokenSVC.IssueToken(token.LoginLinkPurpose, userDat.Username, LoginLinkTTL)
+		if err != nil {
+			log.Printf("error issuing login token: %v", err.Error())
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+
+		err = notifier.Send(notify.Message{
+			To:      userDat.Email,
+			Subject: "Login link",
+			Body:    loginLinkBody(tok, linkURL),
+		})
+		if err != nil {
+			log.Printf("error sending login token: %v", err.Error())
+		}
+
+		ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+	}
+}
+
+func loginLinkBody(tok string, linkURL string) string {
+	body := "A login link was requested for your account.  If this wasn't you, you can ignore this message.\n\n"
+	if linkURL != "" {
+		body += "Log in here: " + strings.Replace(linkURL, "{token}", url.QueryEscape(tok), -1) + "\n\n"
+	}
+	body += "Login token: " + tok + "\n\nThis token expires in " + LoginLinkTTL.String() + " and can only be used once."
+	return body
+}
+
+type linkAuthRequest struct {
+	Token string `json:"token"`
+}
+
+// LinkAuthHandler redeems a login token for a session the same way doAuth does for a password, including the second
+// factor challenge for users who have one
+func LinkAuthHandler(userSVC user.UserSVC, tokenSVC token.TokenSVC, mfaSVC mfa.MfaSVC, starter SessionStarter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &linkAuthRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Token == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing token"})
+			return
+		}
+
+		username, err := tokenSVC.ConsumeToken(token.LoginLinkPurpose, requestData.Token)
+		if err == token.InvalidToken {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error consuming login token: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
+			return
+		}
+
+		userDat, err := userSVC.GetUser(username)
+		if err == user.NotFound {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error loading authorized user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
+			return
+		}
+		handlers.SetAuditUser(ctx, userDat.Username)
+
+		//the account may have been disabled or locked since the link was sent
+		err = userDat.LoginError()
+		if err == user.NotFound {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			handlers.SetLogin(ctx, loginhistory.FactorLoginLink, loginhistory.ResultBlocked, "")
+			ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if resp, ok := completeLogin(ctx, mfaSVC, starter, userDat, loginhistory.FactorLoginLink); ok {
+			ctx.JSON(http.StatusOK, resp)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package userhandlers
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_notify"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLoginLinkHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestBody string
+		userDat     *user.UserData
+		getErr      error
+		expectSend  bool
+		issueErr    error
+		sendErr     error
+		wantStatus  int
+	}{
+		{name: "missing username", requestBody: `{}`, wantStatus: 400},
+		{name: "unknown user", requestBody: `{"username":"nobody"}`, getErr: user.NotFound, wantStatus: 202},
+		{
+			name:        "unverified email",
+			requestBody: `{"username":"joehrke"}`,
+			userDat:     &user.UserData{Username: "joehrke", Email: "joe@example.com"},
+			wantStatus:  202,
+		},
+		{
+			name:        "email username only",
+			requestBody: `{"username":"joe@example.com"}`,
+			userDat:     &user.UserData{Username: "joe@example.com"},
+			wantStatus:  202,
+		},
+		{
+			name:        "locked",
+			requestBody: `{"username":"joehrke"}`,
+			userDat:     &user.UserData{Username: "joehrke", Email: "joe@example.com", EmailVerified: true, State: user.StateLocked},
+			wantStatus:  202,
+		},
+		{
+			name:        "OK",
+			requestBody: `{"username":"joehrke"}`,
+			userDat:     &user.UserData{Username: "joehrke", Email: "joe@example.com", EmailVerified: true},
+			expectSend:  true,
+			wantStatus:  202,
+		},
+		{
+			name:        "token failure looks like success",
+			requestBody: `{"username":"joehrke"}`,
+			userDat:     &user.UserData{Username: "joehrke", Email: "joe@example.com", EmailVerified: true},
+			expectSend:  true,
+			issueErr:    errors.New("some redis error"),
+			wantStatus:  202,
+		},
+		{
+			name:        "delivery failure looks like success",
+			requestBody: `{"username":"joehrke"}`,
+			userDat:     &user.UserData{Username: "joehrke", Email: "joe@example.com", EmailVerified: true},
+			expectSend:  true,
+			sendErr:     errors.New("smtp down"),
+			wantStatus:  202,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/requestLoginLink"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			notifier := mock_notify.NewMockNotifier(ctrl)
+
+			if tt.userDat != nil || tt.getErr != nil {
+				userSvc.EXPECT().GetUser(gomock.Any()).Return(tt.userDat, tt.getErr)
+			}
+			if tt.expectSend {
+				tokenSvc.EXPECT().IssueToken(token.LoginLinkPurpose, "joehrke", LoginLinkTTL).Return("tok", tt.issueErr)
+			}
+			if tt.expectSend && tt.issueErr == nil {
+				notifier.EXPECT().Send(gomock.Any()).DoAndReturn(func(msg notify.Message) error {
+					if msg.To != "joe@example.com" || !strings.Contains(msg.Body, "https://example.com/login?token=tok") {
+						t.Errorf("Send() got %+v", msg)
+					}
+					return tt.sendErr
+				})
+			}
+
+			router := apitest.BuildTestRouter(method, url, RequestLoginLinkHandler(userSvc, tokenSvc, notifier, "https://example.com/login?token={token}"))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatus {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestLinkAuthHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+		sessionId  string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		consumeErr       error
+		userDat          *user.UserData
+		expectChallenge  bool
+		expectSession    bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "missing token",
+			requestBody: `{}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing token"}`,
+			},
+		},
+		{
+			name:        "invalid token",
+			requestBody: `{"token":"tok"}`,
+			consumeErr:  token.InvalidToken,
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"invalid or expired token"}`,
+			},
+		},
+		{
+			name:        "disabled since",
+			requestBody: `{"token":"tok"}`,
+			userDat:     &user.UserData{Username: "joehrke", State: user.StateDisabled},
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"account disabled"}`,
+			},
+		},
+		{
+			name:            "mfa required",
+			requestBody:     `{"token":"tok"}`,
+			userDat:         &user.UserData{Username: "joehrke", TOTP: &user.TOTPSettings{Secret: "s", Confirmed: true}},
+			expectChallenge: true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":false,"mfaRequired":true,"mfaChallenge":"chal"}`,
+			},
+		},
+		{
+			name:          "OK",
+			requestBody:   `{"token":"tok"}`,
+			userDat:       &user.UserData{Username: "joehrke"},
+			expectSession: true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":true}`,
+				sessionId:  "sess-1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/doAuthLink"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+
+			if tt.consumeErr != nil {
+				tokenSvc.EXPECT().ConsumeToken(token.LoginLinkPurpose, "tok").Return("", tt.consumeErr)
+			}
+			if tt.userDat != nil {
+				tokenSvc.EXPECT().ConsumeToken(token.LoginLinkPurpose, "tok").Return("joehrke", nil)
+				userSvc.EXPECT().GetUser("joehrke").Return(tt.userDat, nil)
+			}
+			if tt.expectChallenge {
+				mfaSvc.EXPECT().CreateChallenge("joehrke", loginhistory.FactorLoginLink).Return("chal", nil)
+			}
+			if tt.expectSession {
+				userSvc.EXPECT().SessionVars(gomock.Any()).Return(map[string]string{})
+				rbacSvc.EXPECT().PermissionsFor(gomock.Any()).Return(nil, nil)
+				groupSvc.EXPECT().GroupsForUser("joehrke").Return(nil, nil)
+				sessionSvc.EXPECT().CreateSession("joehrke", map[string]string{}, session.Access{}).Return("sess-1", nil)
+			}
+
+			starter := SessionStarter{User: userSvc, Session: sessionSvc, Rbac: rbacSvc, Group: groupSvc}
+			router := apitest.BuildTestRouter(method, url, LinkAuthHandler(userSvc, tokenSvc, mfaSvc, starter))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+			if w.Header().Get(SessionIdHeader) != tt.expectedResponse.sessionId {
+				t.Errorf("Unexpected session header -- got: %v, wanted: %v", w.Header().Get(SessionIdHeader), tt.expectedResponse.sessionId)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/session"
+)
+
+type loginsResponse struct {
+	Logins []loginhistory.Login `json:"logins"`
+}
+
+// GetLoginHistoryHandler returns the recent authentication attempts against the user in the path, newest first.
+// Requires one of the user's sessions.
+func GetLoginHistoryHandler(loginSVC loginhistory.LoginHistorySVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		logins, err := loginSVC.LoginsFor(username)
+		if err != nil {
+			log.Printf("error fetching login history: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching login history"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, loginsResponse{Logins: logins})
+	}
+}
@@ -0,0 +1,82 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetLoginHistoryHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		sessionOwner     string
+		expectLookup     bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:         "someone else's session",
+			sessionOwner: "someoneelse",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:         "OK",
+			sessionOwner: "joehrke",
+			expectLookup: true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"logins":[{"time":"2020-01-02T03:04:05Z","result":"success","factor":"password","ip":"10.0.0.1","userAgent":"curl/7.64.1","sessionId":"sess-1"}]}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "GET"
+			route := "/v1/users/:username/logins"
+
+			ctrl := gomock.NewController(t)
+			loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			sessionSvc.EXPECT().GetSessionById("sess-1").Return(&session.SessionData{Id: "sess-1", Username: tt.sessionOwner}, nil)
+			if tt.expectLookup {
+				loginSvc.EXPECT().LoginsFor("joehrke").Return([]loginhistory.Login{{
+					Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+					Result:    loginhistory.ResultSuccess,
+					Factor:    loginhistory.FactorPassword,
+					IP:        "10.0.0.1",
+					UserAgent: "curl/7.64.1",
+					SessionId: "sess-1",
+				}}, nil)
+			}
+
+			router := apitest.BuildTestRouter(method, route, GetLoginHistoryHandler(loginSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke/logins", nil)
+			req.Header.Set(SessionIdHeader, "sess-1")
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
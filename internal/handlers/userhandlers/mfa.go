@@ -0,0 +1,215 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+)
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// BeginTOTPEnrollmentHandler generates a new authenticator secret for the user in the path, which must match the
+// caller's session.  The response carries the secret, its otpauth:// URI and a base64 PNG QR code of the URI.
+func BeginTOTPEnrollmentHandler(mfaSVC mfa.MfaSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		enrollment, err := mfaSVC.BeginTOTPEnrollment(username)
+		if err == mfa.AlreadyEnrolled {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error starting totp enrollment: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error enrolling authenticator"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, *enrollment)
+	}
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// ConfirmTOTPEnrollmentHandler turns on two-factor authentication once the user proves their authenticator works.  The
+// response carries the user's recovery codes, which can't be retrieved again.
+func ConfirmTOTPEnrollmentHandler(mfaSVC mfa.MfaSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return totpCodeHandler(sessionSVC, "error confirming authenticator", mfaSVC.ConfirmTOTPEnrollment)
+}
+
+// RegenerateRecoveryCodesHandler replaces the user's recovery codes, invalidating any that are left over
+func RegenerateRecoveryCodesHandler(mfaSVC mfa.MfaSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return totpCodeHandler(sessionSVC, "error regenerating recovery codes", mfaSVC.RegenerateRecoveryCodes)
+}
+
+// DisableTOTPHandler turns off two-factor authentication, a current code is required so a hijacked session alone
+// isn't enough to strip the second factor
+func DisableTOTPHandler(mfaSVC mfa.MfaSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return totpCodeHandler(sessionSVC, "error disabling authenticator", func(username string, code string) ([]string, error) {
+		return nil, mfaSVC.DisableTOTP(username, code)
+	})
+}
+
+// totpCodeHandler runs an action that needs the caller's session and a second factor code.  Actions that hand back
+// recovery codes respond with them, anything else is a 204.
+func totpCodeHandler(sessionSVC session.SessionSVC, failureMessage string, action func(username string, code string) ([]string, error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		requestData := &mfaCodeRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Code == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing code"})
+			return
+		}
+
+		recoveryCodes, err := action(username, requestData.Code)
+		if err == mfa.InvalidCode {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == mfa.NotEnrolled || err == mfa.AlreadyEnrolled {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("%v: %v", failureMessage, err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: failureMessage})
+			return
+		}
+
+		if recoveryCodes == nil {
+			ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+			return
+		}
+		ctx.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+	}
+}
+
+type mfaChallengeRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// CompleteMfaChallengeHandler is the second step of doAuth for users with two-factor authentication.  A correct code
+// for an outstanding challenge creates the session, exactly as doAuth does for users without a second factor.  The
+// code may also be one of the user's recovery codes.
+func CompleteMfaChallengeHandler(userSVC user.UserSVC, mfaSVC mfa.MfaSVC, starter SessionStarter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &mfaChallengeRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Challenge == "" || requestData.Code == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing challenge and/or code"})
+			return
+		}
+
+		result, err := mfaSVC.CompleteChallenge(requestData.Challenge, requestData.Code)
+		factor := loginhistory.FactorTOTP
+		if result != nil && result.Recovery {
+			factor = loginhistory.FactorRecoveryCode
+		}
+		if err == mfa.InvalidCode {
+			handlers.SetAuditUser(ctx, result.Username)
+			handlers.SetAuditFailed(ctx)
+			handlers.SetLogin(ctx, factor, loginhistory.ResultFailure, "")
+			ctx.JSON(http.StatusOK, authResponse{AuthOk: false})
+			return
+		}
+		if err == mfa.InvalidChallenge {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error completing mfa challenge: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
+			return
+		}
+		handlers.SetAuditUser(ctx, result.Username)
+
+		userDat, err := userSVC.GetUser(result.Username)
+		if err == user.NotFound {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: mfa.InvalidChallenge.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error loading authorized user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
+			return
+		}
+
+		//the account may have been disabled, locked or deleted since the first factor
+		err = userDat.LoginError()
+		if err == user.NotFound {
+			ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: mfa.InvalidChallenge.Error()})
+			return
+		}
+		if err != nil {
+			handlers.SetLogin(ctx, factor, loginhistory.ResultBlocked, "")
+			ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		passwordLogin := result.FirstFactor == loginhistory.FactorPassword
+		if resp, ok := startSession(ctx, starter, userDat, factor, passwordLogin); ok {
+			ctx.JSON(http.StatusOK, resp)
+		}
+	}
+}
+
+// requireOwnSession resolves the username in the path and checks the caller holds one of that user's sessions.  On
+// failure the response has already been written and false is returned.
+func requireOwnSession(ctx *gin.Context, sessionSVC session.SessionSVC) (string, bool) {
+	username, err := user.NormalizeUsername(ctx.Param("username"))
+	if err != nil {
+		ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+		return "", false
+	}
+
+	sess, err := sessionOwnedBy(ctx, sessionSVC, username)
+	if err != nil {
+		log.Printf("error looking up session: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error looking up session"})
+		return "", false
+	}
+	if sess == nil {
+		ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "session required"})
+		return "", false
+	}
+	if sess.PasswordChangeRequired {
+		ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "password change required"})
+		return "", false
+	}
+	return username, true
+}
@@ -0,0 +1,375 @@
+package userhandlers
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestBeginTOTPEnrollmentHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		sessionIdHeader  string
+		restricted       bool
+		expectEnroll     bool
+		enrollErr        error
+		expectedResponse expectedResponse
+	}{
+		{
+			name: "no session",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:            "session restricted to a password change",
+			sessionIdHeader: "sess-1",
+			restricted:      true,
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"password change required"}`,
+			},
+		},
+		{
+			name:            "already enrolled",
+			sessionIdHeader: "sess-1",
+			expectEnroll:    true,
+			enrollErr:       mfa.AlreadyEnrolled,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"two-factor authentication already enabled"}`,
+			},
+		},
+		{
+			name:            "OK",
+			sessionIdHeader: "sess-1",
+			expectEnroll:    true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"secret":"JBSWY3DPEHPK3PXP","uri":"otpauth://totp/sso-v2:joehrke?secret=JBSWY3DPEHPK3PXP","qrCode":"iVBORw=="}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			route := "/v1/users/:username/totp"
+
+			ctrl := gomock.NewController(t)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			if tt.sessionIdHeader != "" {
+				sessionSvc.EXPECT().GetSessionById(tt.sessionIdHeader).Return(&session.SessionData{Id: tt.sessionIdHeader, Username: "joehrke", Access: session.Access{PasswordChangeRequired: tt.restricted}}, nil)
+			}
+			if tt.expectEnroll {
+				var enrollment *mfa.TOTPEnrollment
+				if tt.enrollErr == nil {
+					enrollment = &mfa.TOTPEnrollment{
+						Secret: "JBSWY3DPEHPK3PXP",
+						URI:    "otpauth://totp/sso-v2:joehrke?secret=JBSWY3DPEHPK3PXP",
+						QRCode: []byte("\x89PNG"),
+					}
+				}
+				mfaSvc.EXPECT().BeginTOTPEnrollment("joehrke").Return(enrollment, tt.enrollErr)
+			}
+
+			router := apitest.BuildTestRouter(method, route, BeginTOTPEnrollmentHandler(mfaSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke/totp", nil)
+			if tt.sessionIdHeader != "" {
+				req.Header.Set(SessionIdHeader, tt.sessionIdHeader)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestCompleteMfaChallengeHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name                    string
+		requestBody             string
+		expectComplete          bool
+		completeErr             error
+		recovery                bool
+		firstFactor             string
+		storedState             user.UserState
+		expectSession           bool
+		expectedSessionIdHeader string
+		wantLogin               *loginhistory.Login
+		expectedResponse        expectedResponse
+	}{
+		{
+			name:        "missing code",
+			requestBody: `{"challenge":"chal-123"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing challenge and/or code"}`,
+			},
+		},
+		{
+			name:           "wrong code",
+			requestBody:    `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete: true,
+			completeErr:    mfa.InvalidCode,
+			wantLogin:      &loginhistory.Login{Factor: loginhistory.FactorTOTP, Result: loginhistory.ResultFailure},
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":false}`,
+			},
+		},
+		{
+			name:           "expired challenge",
+			requestBody:    `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete: true,
+			completeErr:    mfa.InvalidChallenge,
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"invalid or expired challenge"}`,
+			},
+		},
+		{
+			name:           "odd error",
+			requestBody:    `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete: true,
+			completeErr:    errors.New("some redis error"),
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error authorizing user"}`,
+			},
+		},
+		{
+			name:                    "OK",
+			requestBody:             `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete:          true,
+			expectSession:           true,
+			expectedSessionIdHeader: "asdf-1235",
+			wantLogin:               &loginhistory.Login{Factor: loginhistory.FactorTOTP, Result: loginhistory.ResultSuccess, SessionId: "asdf-1235"},
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":true}`,
+			},
+		},
+		{
+			name:           "disabled since first factor",
+			requestBody:    `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete: true,
+			storedState:    user.StateDisabled,
+			wantLogin:      &loginhistory.Login{Factor: loginhistory.FactorTOTP, Result: loginhistory.ResultBlocked},
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"account disabled"}`,
+			},
+		},
+		{
+			name:                    "OK after login link",
+			requestBody:             `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete:          true,
+			firstFactor:             loginhistory.FactorLoginLink,
+			expectSession:           true,
+			expectedSessionIdHeader: "asdf-1235",
+			wantLogin:               &loginhistory.Login{Factor: loginhistory.FactorTOTP, Result: loginhistory.ResultSuccess, SessionId: "asdf-1235"},
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":true}`,
+			},
+		},
+		{
+			name:                    "OK with recovery code",
+			requestBody:             `{"challenge":"chal-123","code":"000000"}`,
+			expectComplete:          true,
+			recovery:                true,
+			expectSession:           true,
+			expectedSessionIdHeader: "asdf-1235",
+			wantLogin:               &loginhistory.Login{Factor: loginhistory.FactorRecoveryCode, Result: loginhistory.ResultSuccess, SessionId: "asdf-1235"},
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":true}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/doAuthMfa"
+
+			ctrl := gomock.NewController(t)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			if tt.expectComplete {
+				firstFactor := tt.firstFactor
+				if firstFactor == "" {
+					firstFactor = loginhistory.FactorPassword
+				}
+				var result *mfa.ChallengeResult
+				if tt.completeErr == nil || tt.completeErr == mfa.InvalidCode {
+					result = &mfa.ChallengeResult{Username: "joehrke", FirstFactor: firstFactor, Recovery: tt.recovery}
+				}
+				mfaSvc.EXPECT().CompleteChallenge("chal-123", "000000").Return(result, tt.completeErr)
+			}
+			loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+			if tt.wantLogin != nil {
+				loginSvc.EXPECT().Record("joehrke", gomock.Any()).DoAndReturn(func(username string, login loginhistory.Login) error {
+					if login.Factor != tt.wantLogin.Factor || login.Result != tt.wantLogin.Result || login.SessionId != tt.wantLogin.SessionId {
+						t.Errorf("Record() got login %+v, want %+v", login, *tt.wantLogin)
+					}
+					return nil
+				})
+			}
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			if tt.storedState != "" {
+				userSvc.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke", State: tt.storedState}, nil)
+			}
+			if tt.expectSession {
+				found := &user.UserData{Username: "joehrke"}
+				userSvc.EXPECT().GetUser("joehrke").Return(found, nil)
+				if tt.firstFactor == "" {
+					userSvc.EXPECT().PasswordChangeRequired(found).Return(false)
+				}
+				userSvc.EXPECT().SessionVars(found).Return(map[string]string{})
+				rbacSvc.EXPECT().PermissionsFor(nil).Return([]string{}, nil)
+				groupSvc.EXPECT().GroupsForUser("joehrke").Return([]string{}, nil)
+				sessionSvc.EXPECT().CreateSession("joehrke", map[string]string{}, session.Access{Permissions: []string{}, Groups: []string{}}).Return(tt.expectedSessionIdHeader, nil)
+			}
+
+			handler := CompleteMfaChallengeHandler(userSvc, mfaSvc, SessionStarter{User: userSvc, Session: sessionSvc, Rbac: rbacSvc, Group: groupSvc})
+			router := apitest.BuildTestRouter(method, url, handlers.LoginRecorded(loginSvc, handler))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if w.Header().Get(SessionIdHeader) != tt.expectedSessionIdHeader {
+				t.Errorf("Unexpected session id header -- got %v, wanted %v", w.Header().Get(SessionIdHeader), tt.expectedSessionIdHeader)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestRegenerateRecoveryCodesHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		expectRegenerate bool
+		regenerateErr    error
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "missing code",
+			requestBody: `{}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing code"}`,
+			},
+		},
+		{
+			name:             "wrong code",
+			requestBody:      `{"code":"123456"}`,
+			expectRegenerate: true,
+			regenerateErr:    mfa.InvalidCode,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid code"}`,
+			},
+		},
+		{
+			name:             "not enrolled",
+			requestBody:      `{"code":"123456"}`,
+			expectRegenerate: true,
+			regenerateErr:    mfa.NotEnrolled,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"two-factor authentication not enabled"}`,
+			},
+		},
+		{
+			name:             "OK",
+			requestBody:      `{"code":"123456"}`,
+			expectRegenerate: true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"recoveryCodes":["aaaaa-bbbbb","ccccc-ddddd"]}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			route := "/v1/users/:username/recoveryCodes"
+
+			ctrl := gomock.NewController(t)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			sessionSvc.EXPECT().GetSessionById("sess-1").Return(&session.SessionData{Id: "sess-1", Username: "joehrke"}, nil)
+			if tt.expectRegenerate {
+				var codes []string
+				if tt.regenerateErr == nil {
+					codes = []string{"aaaaa-bbbbb", "ccccc-ddddd"}
+				}
+				mfaSvc.EXPECT().RegenerateRecoveryCodes("joehrke", "123456").Return(codes, tt.regenerateErr)
+			}
+
+			router := apitest.BuildTestRouter(method, route, RegenerateRecoveryCodesHandler(mfaSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke/recoveryCodes", strings.NewReader(tt.requestBody))
+			req.Header.Set(SessionIdHeader, "sess-1")
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/oidc"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+)
+
+// OidcBindingCookie holds the browser's half of an OpenID Connect flow.  The callback only completes the flow that was
+// started in the same browser, so a callback URL can't be replayed in someone else's.
+const OidcBindingCookie = "sso_oidc_binding"
+
+// setOidcBinding hands the flow's binding to the browser.  The cookie is only sent back to the /v1/oidc routes and
+// lasts as long as the login state does.
+func setOidcBinding(ctx *gin.Context, binding string, maxAge int) {
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     OidcBindingCookie,
+		Value:    binding,
+		Path:     "/v1/oidc/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// BeginOidcLoginHandler redirects the browser to the identity provider in the path to log in
+func BeginOidcLoginHandler(oidcSVC oidc.OidcSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		authorizationURL, binding, err := oidcSVC.BeginLogin(ctx.Param("provider"), "")
+		if err == oidc.UnknownProvider {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == oidc.ProviderFailure {
+			ctx.JSON(http.StatusBadGateway, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error starting federated login: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error starting login"})
+			return
+		}
+		setOidcBinding(ctx, binding, int(oidc.LoginStateTTL.Seconds()))
+		ctx.Redirect(http.StatusFound, authorizationURL)
+	}
+}
+
+type linkResponse struct {
+	AuthorizationURL string `json:"authorizationUrl,omitempty"`
+	Linked           bool   `json:"linked,omitempty"`
+}
+
+// BeginOidcLinkHandler starts a flow that links an identity at the provider to the user in the path, returning the
+// URL to send the browser to.  Requires one of the user's sessions, and the browser that calls it has to be the one
+// that visits the URL.
+func BeginOidcLinkHandler(oidcSVC oidc.OidcSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		authorizationURL, binding, err := oidcSVC.BeginLogin(ctx.Param("provider"), username)
+		if err == oidc.UnknownProvider {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == oidc.ProviderFailure {
+			ctx.JSON(http.StatusBadGateway, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error starting identity link: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error starting link"})
+			return
+		}
+		setOidcBinding(ctx, binding, int(oidc.LoginStateTTL.Seconds()))
+		ctx.JSON(http.StatusOK, linkResponse{AuthorizationURL: authorizationURL})
+	}
+}
+
+// OidcCallbackHandler is where the provider sends the browser back to.  A login flow ends like AuthUserHandler, with a
+// session or an MFA challenge for the linked local user; a link flow reports the identity as linked.  The session id
+// is in the body as well as the X-Session-Id header.  If returnURL is set the browser is redirected there instead,
+// with the outcome in the URL fragment.
+func OidcCallbackHandler(oidcSVC oidc.OidcSVC, mfaSVC mfa.MfaSVC, starter SessionStarter, returnURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		fail := func(status int, message string) {
+			if returnURL == "" {
+				ctx.JSON(status, handlers.ErrorMessage{Message: message})
+				return
+			}
+			handlers.SetAuditFailed(ctx)
+			oidcReturn(ctx, returnURL, url.Values{"error": {message}})
+		}
+
+		binding := ""
+		if cookie, err := ctx.Request.Cookie(OidcBindingCookie); err == nil {
+			binding = cookie.Value
+		}
+		//the binding is single use like the state it belongs to
+		setOidcBinding(ctx, "", -1)
+
+		params := ctx.Request.URL.Query()
+		if params.Get("error") != "" {
+			fail(http.StatusUnauthorized, "login refused by identity provider")
+			return
+		}
+
+		result, err := oidcSVC.CompleteLogin(ctx.Param("provider"), params.Get("state"), params.Get("code"), binding)
+		switch err {
+		case nil:
+		case oidc.UnknownProvider:
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		case oidc.InvalidState:
+			fail(http.StatusBadRequest, err.Error())
+			return
+		case oidc.InvalidIDToken:
+			fail(http.StatusUnauthorized, err.Error())
+			return
+		case oidc.NotLinked:
+			fail(http.StatusForbidden, err.Error())
+			return
+		case user.IdentityTaken:
+			fail(http.StatusConflict, err.Error())
+			return
+		case oidc.ProviderFailure:
+			fail(http.StatusBadGateway, err.Error())
+			return
+		default:
+			log.Printf("error completing federated login: %v", err.Error())
+			fail(http.StatusInternalServerError, "error authorizing user")
+			return
+		}
+
+		userDat := result.User
+		handlers.SetAuditUser(ctx, userDat.Username)
+		if result.Linked {
+			if returnURL == "" {
+				ctx.JSON(http.StatusOK, linkResponse{Linked: true})
+				return
+			}
+			oidcReturn(ctx, returnURL, url.Values{"linked": {"true"}})
+			return
+		}
+
+		err = userDat.LoginError()
+		if err == user.NotFound {
+			fail(http.StatusForbidden, oidc.NotLinked.Error())
+			return
+		}
+		if err != nil {
+			handlers.SetLogin(ctx, loginhistory.FactorOIDC, loginhistory.ResultBlocked, "")
+			fail(http.StatusForbidden, err.Error())
+			return
+		}
+		resp, ok := completeLogin(ctx, mfaSVC, starter, userDat, loginhistory.FactorOIDC)
+		if !ok {
+			return
+		}
+		resp.SessionId = ctx.Writer.Header().Get(SessionIdHeader)
+		if returnURL == "" {
+			ctx.JSON(http.StatusOK, resp)
+			return
+		}
+
+		outcome := url.Values{}
+		if resp.SessionId != "" {
+			outcome.Set("sessionId", resp.SessionId)
+		}
+		if resp.PasswordChangeRequired {
+			outcome.Set("passwordChangeRequired", "true")
+		}
+		if resp.MfaRequired {
+			outcome.Set("mfaChallenge", resp.MfaChallenge)
+		}
+		oidcReturn(ctx, returnURL, outcome)
+	}
+}
+
+// oidcReturn sends the browser back to the frontend.  The outcome goes in the fragment, which browsers don't send on to
+// servers or in the Referer header.
+func oidcReturn(ctx *gin.Context, returnURL string, outcome url.Values) {
+	ctx.Redirect(http.StatusFound, returnURL+"#"+outcome.Encode())
+}
+
+// UnlinkIdentityHandler removes the user's identity at the provider in the path.  Requires one of the user's sessions.
+func UnlinkIdentityHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		err := userSVC.UnlinkIdentity(username, ctx.Param("provider"))
+		if err == user.NotFound || err == user.IdentityNotLinked {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error unlinking identity: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error unlinking identity"})
+			return
+		}
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
@@ -0,0 +1,187 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_oidc"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/oidc"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestOidcCallbackHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+		sessionId  string
+		location   string
+	}
+	tests := []struct {
+		name             string
+		query            string
+		noCookie         bool
+		returnURL        string
+		expectComplete   bool
+		result           *oidc.LoginResult
+		completeErr      error
+		expectSession    bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:  "refused at provider",
+			query: "?error=access_denied&state=abc",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"login refused by identity provider"}`,
+			},
+		},
+		{
+			name:           "not linked",
+			query:          "?state=abc&code=xyz",
+			expectComplete: true,
+			completeErr:    oidc.NotLinked,
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"no account is linked to this identity"}`,
+			},
+		},
+		{
+			name:           "invalid state",
+			query:          "?state=abc&code=xyz",
+			expectComplete: true,
+			completeErr:    oidc.InvalidState,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid or expired login state"}`,
+			},
+		},
+		{
+			name:           "no binding cookie",
+			query:          "?state=abc&code=xyz",
+			noCookie:       true,
+			expectComplete: true,
+			completeErr:    oidc.InvalidState,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid or expired login state"}`,
+			},
+		},
+		{
+			name:           "disabled user",
+			query:          "?state=abc&code=xyz",
+			expectComplete: true,
+			result:         &oidc.LoginResult{User: &user.UserData{Username: "joehrke", State: user.StateDisabled}},
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"account disabled"}`,
+			},
+		},
+		{
+			name:           "linked",
+			query:          "?state=abc&code=xyz",
+			expectComplete: true,
+			result:         &oidc.LoginResult{User: &user.UserData{Username: "joehrke"}, Linked: true},
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"linked":true}`,
+			},
+		},
+		{
+			name:           "OK",
+			query:          "?state=abc&code=xyz",
+			expectComplete: true,
+			result:         &oidc.LoginResult{User: &user.UserData{Username: "joehrke"}},
+			expectSession:  true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":true,"sessionId":"sess-1"}`,
+				sessionId:  "sess-1",
+			},
+		},
+		{
+			name:           "OK with return URL",
+			query:          "?state=abc&code=xyz",
+			returnURL:      "https://app.example.com/login",
+			expectComplete: true,
+			result:         &oidc.LoginResult{User: &user.UserData{Username: "joehrke"}},
+			expectSession:  true,
+			expectedResponse: expectedResponse{
+				statusCode: 302,
+				sessionId:  "sess-1",
+				location:   "https://app.example.com/login#sessionId=sess-1",
+			},
+		},
+		{
+			name:           "not linked with return URL",
+			query:          "?state=abc&code=xyz",
+			returnURL:      "https://app.example.com/login",
+			expectComplete: true,
+			completeErr:    oidc.NotLinked,
+			expectedResponse: expectedResponse{
+				statusCode: 302,
+				location:   "https://app.example.com/login#error=no+account+is+linked+to+this+identity",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "GET"
+			route := "/v1/oidc/:provider/callback"
+
+			ctrl := gomock.NewController(t)
+			oidcSvc := mock_oidc.NewMockOidcSVC(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+
+			binding := "bnd"
+			if tt.noCookie {
+				binding = ""
+			}
+			if tt.expectComplete {
+				oidcSvc.EXPECT().CompleteLogin("corp", "abc", "xyz", binding).Return(tt.result, tt.completeErr)
+			}
+			if tt.expectSession {
+				userSvc.EXPECT().SessionVars(gomock.Any()).Return(map[string]string{})
+				rbacSvc.EXPECT().PermissionsFor(gomock.Any()).Return(nil, nil)
+				groupSvc.EXPECT().GroupsForUser("joehrke").Return(nil, nil)
+				sessionSvc.EXPECT().CreateSession("joehrke", map[string]string{}, session.Access{}).Return("sess-1", nil)
+			}
+
+			starter := SessionStarter{User: userSvc, Session: sessionSvc, Rbac: rbacSvc, Group: groupSvc}
+			router := apitest.BuildTestRouter(method, route, OidcCallbackHandler(oidcSvc, mfaSvc, starter, tt.returnURL))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/oidc/corp/callback"+tt.query, nil)
+			if !tt.noCookie {
+				req.AddCookie(&http.Cookie{Name: OidcBindingCookie, Value: binding})
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if tt.expectedResponse.location != "" && w.Header().Get("Location") != tt.expectedResponse.location {
+				t.Errorf("Unexpected location -- got: %v, wanted: %v", w.Header().Get("Location"), tt.expectedResponse.location)
+			}
+			if tt.expectedResponse.location == "" && strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+			if w.Header().Get(SessionIdHeader) != tt.expectedResponse.sessionId {
+				t.Errorf("Unexpected session header -- got: %v, wanted: %v", w.Header().Get(SessionIdHeader), tt.expectedResponse.sessionId)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"strings"
+	"time"
+)
+
+type changePasswordRequest struct {
+	CurrentPassword         string `json:"currentPassword"`
+	NewPassword             string `json:"newPassword"`
+	InvalidateOtherSessions bool   `json:"invalidateOtherSessions"`
+}
+
+// ChangePasswordHandler sets a new password for the user in the path.  The caller proves they are that user either with
+// an X-Session-Id header for one of the user's sessions or by supplying the current password.  A former name left
+// behind by a rename is resolved to the current one first, so every step acts on the same record.
+func ChangePasswordHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, err := user.NormalizeUsername(ctx.Param("username"))
+		if err != nil {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+
+		requestData := &changePasswordRequest{}
+		err = ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.NewPassword == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing new password"})
+			return
+		}
+
+		userDat, err := userSVC.GetUser(username)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error looking up user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+			return
+		}
+		username = userDat.Username
+
+		sess, err := sessionOwnedBy(ctx, sessionSVC, username)
+		if err != nil {
+			log.Printf("error looking up session: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+			return
+		}
+		sessionId := ""
+		if sess != nil {
+			sessionId = sess.Id
+		}
+		if sess == nil {
+			if requestData.CurrentPassword == "" {
+				ctx.JSON(http.StatusUnauthorized, handlers.ErrorMessage{Message: "current password or session required"})
+				return
+			}
+			authed, err := userSVC.AuthUser(username, requestData.CurrentPassword)
+			//an account that can't log in can't change its password either
+			if err == user.EmailNotVerified {
+				ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "email address not verified"})
+				return
+			}
+			if _, blocked := err.(user.AccountStateError); blocked {
+				ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "not authorized to change password"})
+				return
+			}
+			if err != nil && err != user.NotFound {
+				log.Printf("error authorizing user: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+				return
+			}
+			if !authed {
+				ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "not authorized to change password"})
+				return
+			}
+		}
+
+		err = userSVC.CheckPasswordReuse(username, requestData.NewPassword)
+		if err == user.PasswordReused {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error checking password history: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+			return
+		}
+
+		hashedPass, err := userSVC.EncryptPassword(requestData.NewPassword)
+		if err != nil {
+			log.Printf("error hashing password: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+			return
+		}
+
+		err = userSVC.SetPassword(username, hashedPass)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error setting password: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+			return
+		}
+
+		if requestData.InvalidateOtherSessions {
+			//the session used to authorize the change, if any, survives so the caller stays logged in
+			err = sessionSVC.DestroySessionsForUser(username, sessionId)
+			if err != nil {
+				log.Printf("error invalidating sessions: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error invalidating sessions"})
+				return
+			}
+		}
+		//a restricted session has done its job, the user logs in again with the new password for a normal one
+		if sess != nil && sess.PasswordChangeRequired {
+			err = sessionSVC.DestroySession(sessionId)
+			if err != nil {
+				log.Printf("error destroying restricted session: %v", err.Error())
+				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error changing password"})
+				return
+			}
+		}
+
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
+
+// sessionOwnedBy returns the session named by the request's X-Session-Id if it is live and belongs to username, or
+// nil if there is no such header or the session belongs to somebody else
+func sessionOwnedBy(ctx *gin.Context, sessionSVC session.SessionSVC, username string) (*session.SessionData, error) {
+	sessionId := ctx.Request.Header.Get(SessionIdHeader)
+	if sessionId == "" {
+		return nil, nil
+	}
+
+	sess, err := sessionSVC.GetSessionById(sessionId)
+	if err == session.SessionNotFoundError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.Username != username {
+		return nil, nil
+	}
+	return sess, nil
+}
+
+const PasswordResetTTL = 30 * time.Minute
+
+type forgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+// RequestPasswordResetHandler issues a single-use reset token and delivers it through the notifier.  The response is
+// the same whether or not the user exists so the endpoint can't be used to discover accounts: failures after the lookup
+// are only logged, and the notifier is expected to queue the message rather than hold the request open on the mail
+// transport, so a known user's response takes no longer than an unknown one's.  If resetURL is set, its {token}
+// placeholder is filled in to build a link for the message.
+func RequestPasswordResetHandler(userSVC user.UserSVC, tokenSVC token.TokenSVC, notifier notify.Notifier, resetURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &forgotPasswordRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Username == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing username"})
+			return
+		}
+
+		userDat, err := userSVC.GetUser(requestData.Username)
+		if err == user.NotFound {
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error looking up user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error requesting password reset"})
+			return
+		}
+		handlers.SetAuditUser(ctx, userDat.Username)
+		//without a verified address there's nowhere safe to send the token
+		recipient := userDat.ContactAddress()
+		if recipient == "" {
+			log.Printf("password reset requested for user without a contact address")
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+
+		tok, err := tokenSVC.IssueToken(token.PasswordResetPurpose, userDat.Username, PasswordResetTTL)
+		if err != nil {
+			log.Printf("error issuing reset token: %v", err.Error())
+			ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+			return
+		}
+
+		err = notifier.Send(notify.Message{
+			To:      recipient,
+			Subject: "Password reset",
+			Body:    passwordResetBody(tok, resetURL),
+		})
+		if err != nil {
+			log.Printf("error sending reset token: %v", err.Error())
+		}
+
+		ctx.Data(http.StatusAccepted, gin.MIMEPlain, nil)
+	}
+}
+
+func passwordResetBody(tok string, resetURL string) string {
+	body := "A password reset was requested for your account.  If this wasn't you, you can ignore this message.\n\n"
+	if resetURL != "" {
+		body += "Reset your password here: " + strings.Replace(resetURL, "{token}", url.QueryEscape(tok), -1) + "\n\n"
+	}
+	body += "Reset token: " + tok + "\n\nThis token expires in " + PasswordResetTTL.String() + " and can only be used once."
+	return body
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ResetPasswordHandler redeems a reset token for a new password.  All of the user's sessions are destroyed since a
+// reset usually means the old password can't be trusted.
+func ResetPasswordHandler(userSVC user.UserSVC, tokenSVC token.TokenSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestData := &resetPasswordRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+		if requestData.Token == "" || requestData.NewPassword == "" {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "missing token and/or new password"})
+			return
+		}
+
+		username, err := tokenSVC.ConsumeToken(token.PasswordResetPurpose, requestData.Token)
+		if err == token.InvalidToken {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error consuming reset token: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error resetting password"})
+			return
+		}
+		handlers.SetAuditUser(ctx, username)
+
+		//the token is already used up, a reused password means asking for a new one
+		err = userSVC.CheckPasswordReuse(username, requestData.NewPassword)
+		if err == user.PasswordReused {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error checking password history: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error resetting password"})
+			return
+		}
+
+		hashedPass, err := userSVC.EncryptPassword(requestData.NewPassword)
+		if err != nil {
+			log.Printf("error hashing password: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error resetting password"})
+			return
+		}
+
+		err = userSVC.SetPassword(username, hashedPass)
+		if err == user.NotFound {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			log.Printf("error setting password: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error resetting password"})
+			return
+		}
+
+		err = sessionSVC.DestroySessionsForUser(username, "")
+		if err != nil {
+			log.Printf("error invalidating sessions: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error invalidating sessions"})
+			return
+		}
+
+		ctx.Data(http.StatusNoContent, gin.MIMEPlain, nil)
+	}
+}
@@ -0,0 +1,554 @@
+package userhandlers
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_notify"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestChangePasswordHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	type sessionLookup struct {
+		expected bool
+		sess     *session.SessionData
+		err      error
+	}
+	type authCall struct {
+		expected bool
+		authed   bool
+		err      error
+	}
+	tests := []struct {
+		name             string
+		path             string
+		requestBody      string
+		sessionIdHeader  string
+		expectLookup     bool
+		lookupName       string
+		lookupErr        error
+		sessionLookup    sessionLookup
+		authCall         authCall
+		reuseErr         error
+		expectPassUpdate bool
+		setPasswordErr   error
+		expectInvalidate bool
+		expectedKeepId   string
+		expectDestroy    bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "invalid username",
+			path:        "/v1/users/bad%20name/password",
+			requestBody: `{"currentPassword":"old","newPassword":"new"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 404,
+				body:       ``,
+			},
+		},
+		{
+			name:        "missing new password",
+			path:        "/v1/users/joehrke/password",
+			requestBody: `{"currentPassword":"old"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing new password"}`,
+			},
+		},
+		{
+			name:         "no proof of identity",
+			path:         "/v1/users/joehrke/password",
+			expectLookup: true,
+			requestBody:  `{"newPassword":"new"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"current password or session required"}`,
+			},
+		},
+		{
+			name:         "wrong current password",
+			path:         "/v1/users/joehrke/password",
+			expectLookup: true,
+			requestBody:  `{"currentPassword":"old","newPassword":"new"}`,
+			authCall:     authCall{expected: true, authed: false},
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"not authorized to change password"}`,
+			},
+		},
+		{
+			name:         "auth error",
+			path:         "/v1/users/joehrke/password",
+			expectLookup: true,
+			requestBody:  `{"currentPassword":"old","newPassword":"new"}`,
+			authCall:     authCall{expected: true, err: errors.New("some redis error")},
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error changing password"}`,
+			},
+		},
+		{
+			name:         "email not verified",
+			path:         "/v1/users/joehrke/password",
+			expectLookup: true,
+			requestBody:  `{"currentPassword":"old","newPassword":"new"}`,
+			authCall:     authCall{expected: true, err: user.EmailNotVerified},
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"email address not verified"}`,
+			},
+		},
+		{
+			name:            "session for another user",
+			path:            "/v1/users/joehrke/password",
+			expectLookup:    true,
+			requestBody:     `{"newPassword":"new"}`,
+			sessionIdHeader: "sess-1",
+			sessionLookup: sessionLookup{
+				expected: true,
+				sess:     &session.SessionData{Id: "sess-1", Username: "someoneelse"},
+			},
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"current password or session required"}`,
+			},
+		},
+		{
+			name:             "current password OK",
+			path:             "/v1/users/joehrke/password",
+			expectLookup:     true,
+			requestBody:      `{"currentPassword":"old","newPassword":"new"}`,
+			authCall:         authCall{expected: true, authed: true},
+			expectPassUpdate: true,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+		{
+			name:         "recently used password",
+			path:         "/v1/users/joehrke/password",
+			expectLookup: true,
+			requestBody:  `{"currentPassword":"old","newPassword":"new"}`,
+			authCall:     authCall{expected: true, authed: true},
+			reuseErr:     user.PasswordReused,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"password was used recently"}`,
+			},
+		},
+		{
+			name:             "user vanished",
+			path:             "/v1/users/joehrke/password",
+			expectLookup:     true,
+			requestBody:      `{"currentPassword":"old","newPassword":"new"}`,
+			authCall:         authCall{expected: true, authed: true},
+			expectPassUpdate: true,
+			setPasswordErr:   user.NotFound,
+			expectedResponse: expectedResponse{
+				statusCode: 404,
+				body:       ``,
+			},
+		},
+		{
+			name:             "current password OK invalidating sessions",
+			path:             "/v1/users/joehrke/password",
+			expectLookup:     true,
+			requestBody:      `{"currentPassword":"old","newPassword":"new","invalidateOtherSessions":true}`,
+			authCall:         authCall{expected: true, authed: true},
+			expectPassUpdate: true,
+			expectInvalidate: true,
+			expectedKeepId:   "",
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+		{
+			name:            "own session OK invalidating other sessions",
+			path:            "/v1/users/joehrke/password",
+			expectLookup:    true,
+			requestBody:     `{"newPassword":"new","invalidateOtherSessions":true}`,
+			sessionIdHeader: "sess-1",
+			sessionLookup: sessionLookup{
+				expected: true,
+				sess:     &session.SessionData{Id: "sess-1", Username: "joehrke"},
+			},
+			expectPassUpdate: true,
+			expectInvalidate: true,
+			expectedKeepId:   "sess-1",
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+		{
+			name:            "restricted session is used up",
+			path:            "/v1/users/joehrke/password",
+			expectLookup:    true,
+			requestBody:     `{"newPassword":"new"}`,
+			sessionIdHeader: "sess-1",
+			sessionLookup: sessionLookup{
+				expected: true,
+				sess:     &session.SessionData{Id: "sess-1", Username: "joehrke", Access: session.Access{PasswordChangeRequired: true}},
+			},
+			expectPassUpdate: true,
+			expectDestroy:    true,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+		{
+			name:         "unknown user",
+			path:         "/v1/users/joehrke/password",
+			requestBody:  `{"currentPassword":"old","newPassword":"new"}`,
+			expectLookup: true,
+			lookupErr:    user.NotFound,
+			expectedResponse: expectedResponse{
+				statusCode: 404,
+				body:       ``,
+			},
+		},
+		{
+			name:         "lookup error",
+			path:         "/v1/users/joehrke/password",
+			requestBody:  `{"currentPassword":"old","newPassword":"new"}`,
+			expectLookup: true,
+			lookupErr:    errors.New("some redis error"),
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error changing password"}`,
+			},
+		},
+		{
+			name:             "former name acts on the renamed user",
+			path:             "/v1/users/joe/password",
+			requestBody:      `{"currentPassword":"old","newPassword":"new","invalidateOtherSessions":true}`,
+			expectLookup:     true,
+			lookupName:       "joe",
+			authCall:         authCall{expected: true, authed: true},
+			expectPassUpdate: true,
+			expectInvalidate: true,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			route := "/v1/users/:username/password"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			if tt.expectLookup {
+				lookupName := tt.lookupName
+				if lookupName == "" {
+					lookupName = "joehrke"
+				}
+				var found *user.UserData
+				if tt.lookupErr == nil {
+					found = &user.UserData{Username: "joehrke"}
+				}
+				userSvc.EXPECT().GetUser(lookupName).Return(found, tt.lookupErr)
+			}
+			if tt.sessionLookup.expected {
+				sessionSvc.EXPECT().GetSessionById(tt.sessionIdHeader).Return(tt.sessionLookup.sess, tt.sessionLookup.err)
+			}
+			if tt.authCall.expected {
+				userSvc.EXPECT().AuthUser("joehrke", "old").Return(tt.authCall.authed, tt.authCall.err)
+			}
+			if tt.expectPassUpdate || tt.reuseErr != nil {
+				userSvc.EXPECT().CheckPasswordReuse("joehrke", "new").Return(tt.reuseErr)
+			}
+			if tt.expectPassUpdate {
+				userSvc.EXPECT().EncryptPassword("new").Return("encryptedPass", nil)
+				userSvc.EXPECT().SetPassword("joehrke", "encryptedPass").Return(tt.setPasswordErr)
+			}
+			if tt.expectInvalidate {
+				sessionSvc.EXPECT().DestroySessionsForUser("joehrke", tt.expectedKeepId).Return(nil)
+			}
+			if tt.expectDestroy {
+				sessionSvc.EXPECT().DestroySession(tt.sessionIdHeader).Return(nil)
+			}
+
+			router := apitest.BuildTestRouter(method, route, ChangePasswordHandler(userSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, tt.path, strings.NewReader(tt.requestBody))
+			if tt.sessionIdHeader != "" {
+				req.Header.Set(SessionIdHeader, tt.sessionIdHeader)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestRequestPasswordResetHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		expectLookup     bool
+		foundUser        *user.UserData
+		lookupErr        error
+		expectIssue      bool
+		issueErr         error
+		expectSend       bool
+		sendErr          error
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "missing username",
+			requestBody: `{}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing username"}`,
+			},
+		},
+		{
+			name:         "unknown user looks like success",
+			requestBody:  `{"username":"joehrke"}`,
+			expectLookup: true,
+			lookupErr:    user.NotFound,
+			expectedResponse: expectedResponse{
+				statusCode: 202,
+				body:       ``,
+			},
+		},
+		{
+			name:         "no contact address looks like success",
+			requestBody:  `{"username":"joehrke"}`,
+			expectLookup: true,
+			foundUser:    &user.UserData{Username: "joehrke", Email: "joehrke@example.com"},
+			expectedResponse: expectedResponse{
+				statusCode: 202,
+				body:       ``,
+			},
+		},
+		{
+			name:         "lookup failure",
+			requestBody:  `{"username":"joehrke"}`,
+			expectLookup: true,
+			lookupErr:    errors.New("some redis error"),
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error requesting password reset"}`,
+			},
+		},
+		{
+			name:         "token failure looks like success",
+			requestBody:  `{"username":"joehrke"}`,
+			expectLookup: true,
+			expectIssue:  true,
+			issueErr:     errors.New("some redis error"),
+			expectedResponse: expectedResponse{
+				statusCode: 202,
+				body:       ``,
+			},
+		},
+		{
+			name:         "delivery failure looks like success",
+			requestBody:  `{"username":"joehrke"}`,
+			expectLookup: true,
+			expectIssue:  true,
+			expectSend:   true,
+			sendErr:      errors.New("smtp down"),
+			expectedResponse: expectedResponse{
+				statusCode: 202,
+				body:       ``,
+			},
+		},
+		{
+			name:         "OK",
+			requestBody:  `{"username":"joehrke"}`,
+			expectLookup: true,
+			expectIssue:  true,
+			expectSend:   true,
+			expectedResponse: expectedResponse{
+				statusCode: 202,
+				body:       ``,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/forgotPassword"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			notifier := mock_notify.NewMockNotifier(ctrl)
+
+			if tt.expectLookup {
+				found := tt.foundUser
+				if found == nil && tt.lookupErr == nil {
+					found = &user.UserData{Username: "joehrke", Email: "joehrke@example.com", EmailVerified: true}
+				}
+				userSvc.EXPECT().GetUser("joehrke").Return(found, tt.lookupErr)
+			}
+			if tt.expectIssue {
+				tokenSvc.EXPECT().IssueToken(token.PasswordResetPurpose, "joehrke", PasswordResetTTL).Return("reset-tok", tt.issueErr)
+			}
+			if tt.expectSend {
+				notifier.EXPECT().Send(gomock.Any()).DoAndReturn(func(msg notify.Message) error {
+					if msg.To != "joehrke@example.com" || !strings.Contains(msg.Body, "https://example.com/reset?t=reset-tok") {
+						t.Errorf("Unexpected message -- got: %v", msg)
+					}
+					return tt.sendErr
+				})
+			}
+
+			router := apitest.BuildTestRouter(method, url, RequestPasswordResetHandler(userSvc, tokenSvc, notifier, "https://example.com/reset?t={token}"))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		expectConsume    bool
+		consumeErr       error
+		reuseErr         error
+		expectPassUpdate bool
+		setPasswordErr   error
+		expectInvalidate bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "missing token",
+			requestBody: `{"newPassword":"new"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"missing token and/or new password"}`,
+			},
+		},
+		{
+			name:          "bad token",
+			requestBody:   `{"token":"reset-tok","newPassword":"new"}`,
+			expectConsume: true,
+			consumeErr:    token.InvalidToken,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid or expired token"}`,
+			},
+		},
+		{
+			name:          "recently used password",
+			requestBody:   `{"token":"reset-tok","newPassword":"new"}`,
+			expectConsume: true,
+			reuseErr:      user.PasswordReused,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"password was used recently"}`,
+			},
+		},
+		{
+			name:             "user deleted since token issued",
+			requestBody:      `{"token":"reset-tok","newPassword":"new"}`,
+			expectConsume:    true,
+			expectPassUpdate: true,
+			setPasswordErr:   user.NotFound,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid or expired token"}`,
+			},
+		},
+		{
+			name:             "OK",
+			requestBody:      `{"token":"reset-tok","newPassword":"new"}`,
+			expectConsume:    true,
+			expectPassUpdate: true,
+			expectInvalidate: true,
+			expectedResponse: expectedResponse{
+				statusCode: 204,
+				body:       ``,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/resetPassword"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			if tt.expectConsume {
+				tokenSvc.EXPECT().ConsumeToken(token.PasswordResetPurpose, "reset-tok").Return("joehrke", tt.consumeErr)
+			}
+			if tt.expectPassUpdate || tt.reuseErr != nil {
+				userSvc.EXPECT().CheckPasswordReuse("joehrke", "new").Return(tt.reuseErr)
+			}
+			if tt.expectPassUpdate {
+				userSvc.EXPECT().EncryptPassword("new").Return("encryptedPass", nil)
+				userSvc.EXPECT().SetPassword("joehrke", "encryptedPass").Return(tt.setPasswordErr)
+			}
+			if tt.expectInvalidate {
+				sessionSvc.EXPECT().DestroySessionsForUser("joehrke", "").Return(nil)
+			}
+
+			router := apitest.BuildTestRouter(method, url, ResetPasswordHandler(userSvc, tokenSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
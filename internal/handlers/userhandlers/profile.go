@@ -0,0 +1,127 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+)
+
+// profileResponse is the public view of a user, it never includes credentials or second factor secrets
+type profileResponse struct {
+	Username      string                 `json:"username"`
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"emailVerified"`
+	MfaEnabled    bool                   `json:"mfaEnabled"`
+	Attributes    map[string]interface{} `json:"attributes"`
+	Roles         []string               `json:"roles,omitempty"`
+}
+
+func newProfileResponse(u *user.UserData) profileResponse {
+	attrs := u.Attributes
+	if attrs == nil {
+		attrs = make(map[string]interface{})
+	}
+	return profileResponse{
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		MfaEnabled:    u.MFAEnabled(),
+		Attributes:    attrs,
+		Roles:         u.Roles,
+	}
+}
+
+// GetUserHandler returns the profile of the user in the path, which must match the caller's session
+func GetUserHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		userDat, err := userSVC.GetUser(username)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error fetching user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error fetching user"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, newProfileResponse(userDat))
+	}
+}
+
+type updateUserRequest struct {
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// UpdateUserHandler merges the attributes in the body into the profile of the user in the path, which must match the
+// caller's session.  A null attribute value removes it.
+func UpdateUserHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		requestData := &updateUserRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		userDat, err := userSVC.UpdateAttributes(username, requestData.Attributes)
+		if _, invalid := err.(user.AttributeError); invalid {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if _, taken := err.(user.AttributeTakenError); taken {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("error updating user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error updating user"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, newProfileResponse(userDat))
+	}
+}
+
+type groupsResponse struct {
+	Groups []string `json:"groups"`
+}
+
+// GetUserGroupsHandler lists every group the user in the path belongs to, directly or through nested groups.  The
+// user must match the caller's session.
+func GetUserGroupsHandler(groupSVC group.GroupSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+
+		groups, err := groupSVC.GroupsForUser(username)
+		if err != nil {
+			log.Printf("error resolving groups: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error resolving groups"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, groupsResponse{Groups: groups})
+	}
+}
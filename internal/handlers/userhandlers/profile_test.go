@@ -0,0 +1,156 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestGetUserHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		sessionOwner     string
+		expectLookup     bool
+		expectedResponse expectedResponse
+	}{
+		{
+			name:         "someone else's session",
+			sessionOwner: "someoneelse",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:         "OK",
+			sessionOwner: "joehrke",
+			expectLookup: true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"username":"joehrke","email":"joe@example.com","emailVerified":true,"mfaEnabled":false,"attributes":{"displayName":"Joe"}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "GET"
+			route := "/v1/users/:username"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			sessionSvc.EXPECT().GetSessionById("sess-1").Return(&session.SessionData{Id: "sess-1", Username: tt.sessionOwner}, nil)
+			if tt.expectLookup {
+				userSvc.EXPECT().GetUser("joehrke").Return(&user.UserData{
+					Username:      "joehrke",
+					HashedPass:    "hash",
+					Email:         "joe@example.com",
+					EmailVerified: true,
+					Attributes:    map[string]interface{}{"displayName": "Joe"},
+				}, nil)
+			}
+
+			router := apitest.BuildTestRouter(method, route, GetUserHandler(userSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke", nil)
+			req.Header.Set(SessionIdHeader, "sess-1")
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
+
+func TestUpdateUserHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		requestBody      string
+		patch            map[string]interface{}
+		updateErr        error
+		expectedResponse expectedResponse
+	}{
+		{
+			name:        "invalid attribute",
+			requestBody: `{"attributes":{"employeeId":"e-13"}}`,
+			patch:       map[string]interface{}{"employeeId": "e-13"},
+			updateErr:   user.AttributeError("attribute employeeId is read only"),
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"attribute employeeId is read only"}`,
+			},
+		},
+		{
+			name:        "unique attribute taken",
+			requestBody: `{"attributes":{"badge":"b-2"}}`,
+			patch:       map[string]interface{}{"badge": "b-2"},
+			updateErr:   user.AttributeTakenError("attribute badge already in use"),
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"attribute badge already in use"}`,
+			},
+		},
+		{
+			name:        "OK",
+			requestBody: `{"attributes":{"displayName":"Joe","age":null}}`,
+			patch:       map[string]interface{}{"displayName": "Joe", "age": nil},
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"username":"joehrke","emailVerified":false,"mfaEnabled":false,"attributes":{"displayName":"Joe"}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "PATCH"
+			route := "/v1/users/:username"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			sessionSvc.EXPECT().GetSessionById("sess-1").Return(&session.SessionData{Id: "sess-1", Username: "joehrke"}, nil)
+			var updated *user.UserData
+			if tt.updateErr == nil {
+				updated = &user.UserData{Username: "joehrke", Attributes: map[string]interface{}{"displayName": "Joe"}}
+			}
+			userSvc.EXPECT().UpdateAttributes("joehrke", tt.patch).Return(updated, tt.updateErr)
+
+			router := apitest.BuildTestRouter(method, route, UpdateUserHandler(userSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke", strings.NewReader(tt.requestBody))
+			req.Header.Set(SessionIdHeader, "sess-1")
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
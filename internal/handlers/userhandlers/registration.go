@@ -0,0 +1,59 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/invitation"
+	"sso-v2/internal/service/rbac"
+)
+
+// Registration decides who may use the public registration route.  The zero Registration is open.
+type Registration struct {
+	// Mode is one of the invitation registration modes
+	Mode        string
+	Invitations invitation.InvitationSVC
+	Rbac        rbac.RbacSVC
+}
+
+// allowed checks the registration mode lets the request register, writing the response if it doesn't
+func (r Registration) allowed(ctx *gin.Context, token string) bool {
+	if r.Mode == invitation.RegistrationClosed {
+		ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "registration is closed"})
+		return false
+	}
+	if token == "" && r.Mode == invitation.RegistrationInvite {
+		ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "an invitation is required to register"})
+		return false
+	}
+	return true
+}
+
+// redeem takes a use of the invitation the request carries, if any, writing the response if it can't be used.  The
+// email address is the one bound to the invitation when the request left it out.
+func (r Registration) redeem(ctx *gin.Context, token string, email string) (inv *invitation.Invitation, boundEmail string, ok bool) {
+	if token == "" {
+		return nil, email, true
+	}
+
+	inv, err := r.Invitations.Redeem(token, email)
+	if err == invitation.InvalidInvitation || err == invitation.EmailMismatch {
+		ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+		return nil, "", false
+	}
+	if err == invitation.InvitationBusy {
+		ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+		return nil, "", false
+	}
+	if err != nil {
+		log.Printf("error redeeming invitation: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating user"})
+		return nil, "", false
+	}
+	//leaving the address out takes the one the invitation is bound to
+	if email == "" {
+		email = inv.Email
+	}
+	return inv, email, true
+}
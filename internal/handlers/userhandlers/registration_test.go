@@ -0,0 +1,138 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_invitation"
+	"sso-v2/gen/mocks/mock_notify"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/invitation"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestCreateUserHandler_Registration(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		requestBody string
+		redeemEmail string
+		redeemed    *invitation.Invitation
+		redeemErr   error
+		wantEmail   string
+		createErr   error
+		wantRelease bool
+		wantRoles   []string
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:        "Closed",
+			mode:        invitation.RegistrationClosed,
+			requestBody: `{"username":"joehrke","password":"asdf","invitation":"inv_tok"}`,
+			wantStatus:  403,
+			wantBody:    `{"message":"registration is closed"}`,
+		},
+		{
+			name:        "Invite_Without_Invitation",
+			mode:        invitation.RegistrationInvite,
+			requestBody: `{"username":"joehrke","password":"asdf"}`,
+			wantStatus:  403,
+			wantBody:    `{"message":"an invitation is required to register"}`,
+		},
+		{
+			name:        "Invalid_Invitation",
+			mode:        invitation.RegistrationInvite,
+			requestBody: `{"username":"joehrke","password":"asdf","invitation":"inv_tok"}`,
+			redeemErr:   invitation.InvalidInvitation,
+			wantStatus:  400,
+			wantBody:    `{"message":"invalid or expired invitation"}`,
+		},
+		{
+			name:        "Email_Mismatch",
+			mode:        invitation.RegistrationInvite,
+			requestBody: `{"username":"joehrke","password":"asdf","email":"eve@example.com","invitation":"inv_tok"}`,
+			redeemEmail: "eve@example.com",
+			redeemErr:   invitation.EmailMismatch,
+			wantStatus:  400,
+			wantBody:    `{"message":"invitation is for a different email address"}`,
+		},
+		{
+			name:        "Bound_Email_And_Roles",
+			mode:        invitation.RegistrationInvite,
+			requestBody: `{"username":"joehrke","password":"asdf","invitation":"inv_tok"}`,
+			redeemed:    &invitation.Invitation{Id: "inv1", Email: "joe@example.com", Roles: []string{"editor"}},
+			wantEmail:   "joe@example.com",
+			wantRoles:   []string{"editor"},
+			wantStatus:  201,
+		},
+		{
+			name:        "Open_With_Invitation",
+			mode:        invitation.RegistrationOpen,
+			requestBody: `{"username":"joehrke","password":"asdf","invitation":"inv_tok"}`,
+			redeemed:    &invitation.Invitation{Id: "inv1"},
+			wantStatus:  201,
+		},
+		{
+			name:        "Failed_Creation_Releases",
+			mode:        invitation.RegistrationInvite,
+			requestBody: `{"username":"joehrke","password":"asdf","invitation":"inv_tok"}`,
+			redeemed:    &invitation.Invitation{Id: "inv1", Roles: []string{"editor"}},
+			createErr:   user.UsernameTaken,
+			wantRelease: true,
+			wantStatus:  409,
+			wantBody:    `{"message":"username already taken"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			url := "/v1/users/"
+
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			notifier := mock_notify.NewMockNotifier(ctrl)
+			invitationSvc := mock_invitation.NewMockInvitationSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+
+			if tt.redeemed != nil || tt.redeemErr != nil {
+				userSvc.EXPECT().EncryptPassword("asdf").Return("encryptedPass", nil)
+				invitationSvc.EXPECT().Redeem("inv_tok", tt.redeemEmail).Return(tt.redeemed, tt.redeemErr)
+			}
+			if tt.redeemed != nil {
+				userSvc.EXPECT().CreateUser("joehrke", "encryptedPass", tt.wantEmail, nil).Return(tt.createErr)
+			}
+			if tt.wantRelease {
+				invitationSvc.EXPECT().Release(tt.redeemed.Id).Return(nil)
+			}
+			if tt.wantRoles != nil {
+				rbacSvc.EXPECT().AssignRoles("joehrke", tt.wantRoles).Return(nil)
+			}
+			if tt.wantEmail != "" {
+				tokenSvc.EXPECT().IssueToken(token.EmailVerificationPurpose, "joehrke "+tt.wantEmail, EmailVerificationTTL).Return("verify-tok", nil)
+				notifier.EXPECT().Send(gomock.Any()).Return(nil)
+			}
+
+			registration := Registration{Mode: tt.mode, Invitations: invitationSvc, Rbac: rbacSvc}
+			router := apitest.BuildTestRouter(method, url, CreateUserHandler(userSvc, tokenSvc, notifier, false, registration))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.wantStatus {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.wantStatus)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.wantBody {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
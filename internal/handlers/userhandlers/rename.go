@@ -0,0 +1,55 @@
+package userhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/rename"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+)
+
+type renameRequest struct {
+	Username string `json:"username"`
+}
+
+// RenameUserHandler lets a user change their own username.  Their sessions follow them to the new name and the
+// old one keeps working as an alias for the configured grace period.
+func RenameUserHandler(renameSVC rename.RenameSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, ok := requireOwnSession(ctx, sessionSVC)
+		if !ok {
+			return
+		}
+		requestData := &renameRequest{}
+		err := ctx.BindJSON(requestData)
+		if err != nil {
+			log.Printf("error binding request body: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error processing body"})
+			return
+		}
+
+		result, err := renameSVC.Rename(username, requestData.Username)
+		if err == user.NotFound {
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+		if err == user.InvalidUsername {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err == user.UsernameTaken {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("error renaming user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error renaming user"})
+			return
+		}
+		handlers.SetAuditUser(ctx, result.To)
+		handlers.SetAuditDetail(ctx, "renamed from "+result.From)
+		ctx.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,103 @@
+package userhandlers
+
+import (
+	"github.com/golang/mock/gomock"
+	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_rename"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/internal/service/rename"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/apitest"
+	"strings"
+	"testing"
+)
+
+func TestRenameUserHandler(t *testing.T) {
+	type expectedResponse struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name             string
+		sessionIdHeader  string
+		expectRename     bool
+		renameErr        error
+		expectedResponse expectedResponse
+	}{
+		{
+			name: "no session",
+			expectedResponse: expectedResponse{
+				statusCode: 401,
+				body:       `{"message":"session required"}`,
+			},
+		},
+		{
+			name:            "taken",
+			sessionIdHeader: "sess-1",
+			expectRename:    true,
+			renameErr:       user.UsernameTaken,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"username already taken"}`,
+			},
+		},
+		{
+			name:            "invalid",
+			sessionIdHeader: "sess-1",
+			expectRename:    true,
+			renameErr:       user.InvalidUsername,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid username"}`,
+			},
+		},
+		{
+			name:            "OK",
+			sessionIdHeader: "sess-1",
+			expectRename:    true,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"from":"joehrke","to":"jhrke","moved":{"sessions":1,"user":1}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "PUT"
+			route := "/v1/users/:username/username"
+
+			ctrl := gomock.NewController(t)
+			renameSvc := mock_rename.NewMockRenameSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+
+			if tt.sessionIdHeader != "" {
+				sessionSvc.EXPECT().GetSessionById(tt.sessionIdHeader).Return(&session.SessionData{Id: tt.sessionIdHeader, Username: "joehrke"}, nil)
+			}
+			if tt.expectRename {
+				var result *rename.Result
+				if tt.renameErr == nil {
+					result = &rename.Result{From: "joehrke", To: "jhrke", Moved: map[string]int{"user": 1, "sessions": 1}}
+				}
+				renameSvc.EXPECT().Rename("joehrke", "JHrke").Return(result, tt.renameErr)
+			}
+
+			router := apitest.BuildTestRouter(method, route, RenameUserHandler(renameSvc, sessionSvc))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/v1/users/joehrke/username", strings.NewReader(`{"username":"JHrke"}`))
+			if tt.sessionIdHeader != "" {
+				req.Header.Set(SessionIdHeader, tt.sessionIdHeader)
+			}
+			router.ServeHTTP(w, req)
+
+			ctrl.Finish()
+			if w.Code != tt.expectedResponse.statusCode {
+				t.Errorf("Unexpected status code -- got: %v, wanted: %v", w.Code, tt.expectedResponse.statusCode)
+			}
+			if strings.TrimSuffix(w.Body.String(), "\n") != tt.expectedResponse.body {
+				t.Errorf("Unexpected body -- got: %v, wanted: %v", w.Body.String(), tt.expectedResponse.body)
+			}
+		})
+	}
+}
@@ -5,7 +5,13 @@ import (
 	"log"
 	"net/http"
 	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/rbac"
 	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
 
 	"sso-v2/internal/service/user"
 )
@@ -13,17 +19,31 @@ import (
 const SessionIdHeader = "X-Session-Id"
 
 type userRequestBody struct {
-	Username string
-	Password string
+	Username   string
+	Password   string
+	Email      string
+	Attributes map[string]interface{}
+	// Invitation is the token of an invitation to register with, see Registration
+	Invitation string
 }
 
-func CreateUserHandler(svc user.UserSVC) gin.HandlerFunc {
+// CreateUserHandler registers a new user. With enumerationProtection enabled a taken username or email is reported
+// exactly like any other creation failure, otherwise it is returned as a 409 so clients can prompt for a different one.
+// If an email address is given a verification message is sent to it.  The notifier is expected to deliver in the
+// background (see asyncnotifier), so with enumerationProtection a new name doesn't take measurably longer than a taken
+// one.  Whether an invitation is needed depends on the registration mode, a user registering with one is given its
+// roles.
+func CreateUserHandler(svc user.UserSVC, tokenSVC token.TokenSVC, notifier notify.Notifier, enumerationProtection bool, registration Registration) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		userData, done := bindRequestData(ctx)
 		if done {
 			return
 		}
+		if !registration.allowed(ctx, userData.Invitation) {
+			return
+		}
 
+		//The password is always hashed before the username is checked so a collision costs the same time as a success
 		hashedPass, err := svc.EncryptPassword(userData.Password)
 		if err != nil {
 			log.Printf("error hashing password: %v", err.Error())
@@ -31,47 +51,209 @@ func CreateUserHandler(svc user.UserSVC) gin.HandlerFunc {
 			return
 		}
 
-		err = svc.CreateUser(userData.Username, hashedPass)
+		inv, email, ok := registration.redeem(ctx, userData.Invitation, userData.Email)
+		if !ok {
+			return
+		}
+		userData.Email = email
+
+		err = svc.CreateUser(userData.Username, hashedPass, userData.Email, userData.Attributes)
+		if err != nil && inv != nil {
+			//the registration didn't happen, so it mustn't count against the invitation
+			releaseErr := registration.Invitations.Release(inv.Id)
+			if releaseErr != nil {
+				log.Printf("error releasing invitation: %v", releaseErr.Error())
+			}
+		}
+		if _, invalidAttr := err.(user.AttributeError); invalidAttr || err == user.InvalidUsername || err == user.InvalidEmail {
+			ctx.JSON(http.StatusBadRequest, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
+		_, attrTaken := err.(user.AttributeTakenError)
+		taken := attrTaken || err == user.UsernameTaken || err == user.EmailTaken
+		if taken && !enumerationProtection {
+			ctx.JSON(http.StatusConflict, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
 		if err != nil {
+			if !taken {
+				log.Printf("error creating user: %v", err.Error())
+			}
 			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating user"})
 			return
 		}
+
+		username, _ := user.NormalizeUsername(userData.Username)
+		handlers.SetAuditUser(ctx, username)
+
+		//the account is usable without its roles, an admin can assign them if this fails
+		if inv != nil && len(inv.Roles) > 0 {
+			err = registration.Rbac.AssignRoles(username, inv.Roles)
+			if err != nil {
+				log.Printf("error assigning invitation roles: %v", err.Error())
+			}
+		}
+
+		//the account exists at this point, a failed send can be retried by setting the email again
+		if userData.Email != "" {
+			email, _ := user.NormalizeEmail(userData.Email)
+			err = sendEmailVerification(tokenSVC, notifier, username, email)
+			if err != nil {
+				log.Printf("error sending email verification: %v", err.Error())
+			}
+		}
 		ctx.Data(http.StatusCreated, gin.MIMEPlain, nil)
 	}
 }
 
 type authResponse struct {
 	AuthOk bool `json:"authOk"`
+	// MfaRequired means the password was accepted but MfaChallenge must be completed with a second factor
+	MfaRequired  bool   `json:"mfaRequired,omitempty"`
+	MfaChallenge string `json:"mfaChallenge,omitempty"`
+	// PasswordChangeRequired means the session can only be used to change the password, see SessionStarter.Start
+	PasswordChangeRequired bool `json:"passwordChangeRequired,omitempty"`
+	// SessionId repeats the X-Session-Id header for browser flows that can't read response headers
+	SessionId string `json:"sessionId,omitempty"`
 }
 
-func AuthUserHandler(userSVC user.UserSVC, sessionSVC session.SessionSVC) gin.HandlerFunc {
+// AuthUserHandler checks a username and password.  Users without a second factor get a session straight away, users
+// with one get a short-lived challenge to complete at doAuthMfa instead.
+func AuthUserHandler(userSVC user.UserSVC, mfaSVC mfa.MfaSVC, starter SessionStarter) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		userData, done := bindRequestData(ctx)
 		if done {
 			return
 		}
 
+		//sessions are keyed to the canonical username, invalid names fall through to the service as an unknown user
+		if username, err := user.NormalizeUsername(userData.Username); err == nil {
+			userData.Username = username
+		}
+
 		authed, err := userSVC.AuthUser(userData.Username, userData.Password)
+		if err != user.NotFound {
+			handlers.SetAuditUser(ctx, userData.Username)
+		}
 		//This only logs and sends an error if we got some other error than the user just not being found
 		//User not found is an expected and acceptable edge case we wouldn't want to page on
+		if err == user.EmailNotVerified {
+			handlers.SetLogin(ctx, loginhistory.FactorPassword, loginhistory.ResultBlocked, "")
+			ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: "email address not verified"})
+			return
+		}
+		if _, blocked := err.(user.AccountStateError); blocked {
+			handlers.SetLogin(ctx, loginhistory.FactorPassword, loginhistory.ResultBlocked, "")
+			ctx.JSON(http.StatusForbidden, handlers.ErrorMessage{Message: err.Error()})
+			return
+		}
 		if err != nil && err != user.NotFound {
 			log.Printf("error authorizing user: %v", err.Error())
 			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
 			return
 		}
 
-		if authed {
-			sessionId, err := sessionSVC.CreateSession(userData.Username, make(map[string]string))
-			if err != nil {
-				log.Printf("error creating new user: %v", err.Error())
-				ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating session"})
-				return
-			}
-			ctx.Header(SessionIdHeader, sessionId)
+		if !authed {
+			handlers.SetAuditFailed(ctx)
+			handlers.SetLogin(ctx, loginhistory.FactorPassword, loginhistory.ResultFailure, "")
+			ctx.JSON(http.StatusOK, authResponse{AuthOk: false})
+			return
 		}
 
-		ctx.JSON(http.StatusOK, authResponse{AuthOk: authed})
+		userDat, err := userSVC.GetUser(userData.Username)
+		if err != nil {
+			log.Printf("error loading authorized user: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
+			return
+		}
+		if resp, ok := completeLogin(ctx, mfaSVC, starter, userDat, loginhistory.FactorPassword); ok {
+			ctx.JSON(http.StatusOK, resp)
+		}
+	}
+}
+
+// completeLogin finishes a successful first factor.  Users without a second factor get a session straight away, users
+// with one get a short-lived challenge to complete at doAuthMfa instead.  factor is recorded in the login history.
+// The caller writes the returned response; on failure the error response has already been written and ok is false.
+func completeLogin(ctx *gin.Context, mfaSVC mfa.MfaSVC, starter SessionStarter, userDat *user.UserData, factor string) (*authResponse, bool) {
+	if userDat.MFAEnabled() {
+		challenge, err := mfaSVC.CreateChallenge(userDat.Username, factor)
+		if err != nil {
+			log.Printf("error creating mfa challenge: %v", err.Error())
+			ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error authorizing user"})
+			return nil, false
+		}
+		handlers.SetLogin(ctx, factor, loginhistory.ResultMfaRequired, "")
+		return &authResponse{AuthOk: false, MfaRequired: true, MfaChallenge: challenge}, true
+	}
+
+	return startSession(ctx, starter, userDat, factor, factor == loginhistory.FactorPassword)
+}
+
+// startSession opens the user's session and builds the login's response, recording the last factor used in the login
+// history.  passwordLogin is whether the first factor was the password, see SessionStarter.Start.  On failure the
+// error response has already been written and ok is false.
+func startSession(ctx *gin.Context, starter SessionStarter, userDat *user.UserData, factor string, passwordLogin bool) (*authResponse, bool) {
+	restricted, ok := starter.Start(ctx, userDat, passwordLogin)
+	if !ok {
+		return nil, false
+	}
+	result := loginhistory.ResultSuccess
+	if restricted {
+		result = loginhistory.ResultPasswordChangeRequired
+	}
+	handlers.SetLogin(ctx, factor, result, ctx.Writer.Header().Get(SessionIdHeader))
+	return &authResponse{AuthOk: true, PasswordChangeRequired: restricted}, true
+}
+
+// SessionStarter holds the services needed to open a session for a fully authenticated user
+type SessionStarter struct {
+	User    user.UserSVC
+	Session session.SessionSVC
+	Rbac    rbac.RbacSVC
+	Group   group.GroupSVC
+}
+
+// Start creates a session seeded with the user's session attributes and a snapshot of their roles, permissions and
+// groups, and sets the X-Session-Id header.  When the user logged in with their password and has to change it, they
+// get a session restricted to doing that instead, and restricted is true.  Logins that didn't use the password, like
+// OpenID Connect and login links, aren't held up by its expiry.  On failure the error response has already been
+// written and ok is false.
+func (s SessionStarter) Start(ctx *gin.Context, userDat *user.UserData, passwordLogin bool) (restricted bool, ok bool) {
+	if passwordLogin && s.User.PasswordChangeRequired(userDat) {
+		return true, s.create(ctx, userDat, session.Access{PasswordChangeRequired: true})
+	}
+
+	permissions, err := s.Rbac.PermissionsFor(userDat.Roles)
+	if err != nil {
+		log.Printf("error resolving permissions: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating session"})
+		return false, false
+	}
+	groups, err := s.Group.GroupsForUser(userDat.Username)
+	if err != nil {
+		log.Printf("error resolving groups: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating session"})
+		return false, false
+	}
+
+	access := session.Access{
+		Roles:       userDat.Roles,
+		Permissions: permissions,
+		Groups:      groups,
+	}
+	return false, s.create(ctx, userDat, access)
+}
+
+func (s SessionStarter) create(ctx *gin.Context, userDat *user.UserData, access session.Access) bool {
+	sessionId, err := s.Session.CreateSession(userDat.Username, s.User.SessionVars(userDat), access)
+	if err != nil {
+		log.Printf("error creating new session: %v", err.Error())
+		ctx.JSON(http.StatusInternalServerError, handlers.ErrorMessage{Message: "error creating session"})
+		return false
 	}
+	ctx.Header(SessionIdHeader, sessionId)
+	return true
 }
 
 func bindRequestData(ctx *gin.Context) (*userRequestBody, bool) {
@@ -4,8 +4,18 @@ import (
 	"errors"
 	"github.com/golang/mock/gomock"
 	"net/http/httptest"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_notify"
+	"sso-v2/gen/mocks/mock_rbac"
 	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
 	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/handlers"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
 	"sso-v2/internal/service/user"
 	"sso-v2/internal/test/apitest"
 	"strings"
@@ -22,13 +32,18 @@ func TestCreateUserHandler(t *testing.T) {
 		err      error
 	}
 	tests := []struct {
-		name             string
-		requestBody      string
-		username         string
-		password         string
-		expectSvcCall    bool
-		expectedResponse expectedResponse
-		hashPassCall     hashPassCall
+		name                  string
+		requestBody           string
+		username              string
+		password              string
+		email                 string
+		attributes            map[string]interface{}
+		expectSvcCall         bool
+		expectVerification    bool
+		createErr             error
+		enumerationProtection bool
+		expectedResponse      expectedResponse
+		hashPassCall          hashPassCall
 	}{
 		{
 			name:          "missing everything",
@@ -87,6 +102,140 @@ func TestCreateUserHandler(t *testing.T) {
 				err:      nil,
 			},
 		},
+		{
+			name:               "OK with email",
+			expectSvcCall:      true,
+			expectVerification: true,
+			username:           "joehrke",
+			password:           "asdf",
+			email:              "joehrke@example.com",
+			requestBody:        `{"username":"joehrke","password":"asdf","email":"joehrke@example.com"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 201,
+				body:       ``,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:          "email taken",
+			expectSvcCall: true,
+			username:      "joehrke",
+			password:      "asdf",
+			email:         "joehrke@example.com",
+			requestBody:   `{"username":"joehrke","password":"asdf","email":"joehrke@example.com"}`,
+			createErr:     user.EmailTaken,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"email address already in use"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:          "invalid username",
+			expectSvcCall: true,
+			username:      "j oehrke",
+			password:      "asdf",
+			requestBody:   `{"username":"j oehrke","password":"asdf"}`,
+			createErr:     user.InvalidUsername,
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"invalid username"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:          "username taken",
+			expectSvcCall: true,
+			username:      "joehrke",
+			password:      "asdf",
+			requestBody:   `{"username":"joehrke","password":"asdf"}`,
+			createErr:     user.UsernameTaken,
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"username already taken"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:                  "username taken with enumeration protection",
+			expectSvcCall:         true,
+			username:              "joehrke",
+			password:              "asdf",
+			requestBody:           `{"username":"joehrke","password":"asdf"}`,
+			createErr:             user.UsernameTaken,
+			enumerationProtection: true,
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error creating user"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:          "invalid attribute",
+			expectSvcCall: true,
+			username:      "joehrke",
+			password:      "asdf",
+			attributes:    map[string]interface{}{"displayName": 12.0},
+			requestBody:   `{"username":"joehrke","password":"asdf","attributes":{"displayName":12}}`,
+			createErr:     user.AttributeError("attribute displayName must be a string"),
+			expectedResponse: expectedResponse{
+				statusCode: 400,
+				body:       `{"message":"attribute displayName must be a string"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:          "unique attribute taken",
+			expectSvcCall: true,
+			username:      "joehrke",
+			password:      "asdf",
+			attributes:    map[string]interface{}{"employeeId": "e-12"},
+			requestBody:   `{"username":"joehrke","password":"asdf","attributes":{"employeeId":"e-12"}}`,
+			createErr:     user.AttributeTakenError("attribute employeeId already in use"),
+			expectedResponse: expectedResponse{
+				statusCode: 409,
+				body:       `{"message":"attribute employeeId already in use"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
+		{
+			name:                  "datastore failure with enumeration protection",
+			expectSvcCall:         true,
+			username:              "joehrke",
+			password:              "asdf",
+			requestBody:           `{"username":"joehrke","password":"asdf"}`,
+			createErr:             errors.New("some redis error"),
+			enumerationProtection: true,
+			expectedResponse: expectedResponse{
+				statusCode: 500,
+				body:       `{"message":"error creating user"}`,
+			},
+			hashPassCall: hashPassCall{
+				expected: true,
+				err:      nil,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -101,10 +250,17 @@ func TestCreateUserHandler(t *testing.T) {
 			}
 
 			if tt.expectSvcCall {
-				userSvc.EXPECT().CreateUser(tt.username, "encryptedPass")
+				userSvc.EXPECT().CreateUser(tt.username, "encryptedPass", tt.email, tt.attributes).Return(tt.createErr)
+			}
+
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			notifier := mock_notify.NewMockNotifier(ctrl)
+			if tt.expectVerification {
+				tokenSvc.EXPECT().IssueToken(token.EmailVerificationPurpose, tt.username+" "+tt.email, EmailVerificationTTL).Return("verify-tok", nil)
+				notifier.EXPECT().Send(gomock.Any()).Return(nil)
 			}
 
-			router := apitest.BuildTestRouter(method, url, CreateUserHandler(userSvc))
+			router := apitest.BuildTestRouter(method, url, CreateUserHandler(userSvc, tokenSvc, notifier, tt.enumerationProtection, Registration{}))
 
 			w := httptest.NewRecorder()
 			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
@@ -141,6 +297,10 @@ func TestAuthUserHandler(t *testing.T) {
 		expectSessionSvcCall    bool
 		expectedSessionIdHeader string
 		expectedSessionSvcError error
+		mfaEnabled              bool
+		passwordExpired         bool
+		expectChallenge         bool
+		wantResult              string
 	}{
 		{
 			name:                 "missing everything",
@@ -174,6 +334,7 @@ func TestAuthUserHandler(t *testing.T) {
 		},
 		{
 			name:              "Auth Failed user found",
+			wantResult:        loginhistory.ResultFailure,
 			expectUserSvcCall: true,
 			username:          "joehrke",
 			password:          "asdf",
@@ -220,8 +381,43 @@ func TestAuthUserHandler(t *testing.T) {
 			},
 			expectSessionSvcCall: false,
 		},
+		{
+			name:              "Auth Failed email not verified",
+			wantResult:        loginhistory.ResultBlocked,
+			expectUserSvcCall: true,
+			username:          "joehrke",
+			password:          "asdf",
+			requestBody:       `{"username":"joehrke","password":"asdf"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"email address not verified"}`,
+			},
+			userSvcAuthResponse: userSvcAuthResponse{
+				authed: false,
+				err:    user.EmailNotVerified,
+			},
+			expectSessionSvcCall: false,
+		},
+		{
+			name:              "Auth Failed account disabled",
+			wantResult:        loginhistory.ResultBlocked,
+			expectUserSvcCall: true,
+			username:          "joehrke",
+			password:          "asdf",
+			requestBody:       `{"username":"joehrke","password":"asdf"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 403,
+				body:       `{"message":"account disabled"}`,
+			},
+			userSvcAuthResponse: userSvcAuthResponse{
+				authed: false,
+				err:    user.AccountDisabled,
+			},
+			expectSessionSvcCall: false,
+		},
 		{
 			name:              "Auth Success",
+			wantResult:        loginhistory.ResultSuccess,
 			expectUserSvcCall: true,
 			username:          "joehrke",
 			password:          "asdf",
@@ -238,6 +434,44 @@ func TestAuthUserHandler(t *testing.T) {
 			expectedSessionIdHeader: "asdf-1235",
 			expectedSessionSvcError: nil,
 		},
+		{
+			name:              "Auth Success With Expired Password",
+			wantResult:        loginhistory.ResultPasswordChangeRequired,
+			expectUserSvcCall: true,
+			username:          "joehrke",
+			password:          "asdf",
+			requestBody:       `{"username":"joehrke","password":"asdf"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":true,"passwordChangeRequired":true}`,
+			},
+			userSvcAuthResponse: userSvcAuthResponse{
+				authed: true,
+				err:    nil,
+			},
+			expectSessionSvcCall:    true,
+			passwordExpired:         true,
+			expectedSessionIdHeader: "asdf-1235",
+		},
+		{
+			name:              "Auth Success With MFA",
+			wantResult:        loginhistory.ResultMfaRequired,
+			expectUserSvcCall: true,
+			username:          "joehrke",
+			password:          "asdf",
+			requestBody:       `{"username":"joehrke","password":"asdf"}`,
+			expectedResponse: expectedResponse{
+				statusCode: 200,
+				body:       `{"authOk":false,"mfaRequired":true,"mfaChallenge":"chal-123"}`,
+			},
+			userSvcAuthResponse: userSvcAuthResponse{
+				authed: true,
+				err:    nil,
+			},
+			mfaEnabled:           true,
+			expectChallenge:      true,
+			expectSessionSvcCall: false,
+		},
 		{
 			name:              "Auth Success With Session Create Error",
 			expectUserSvcCall: true,
@@ -268,12 +502,48 @@ func TestAuthUserHandler(t *testing.T) {
 				userSvc.EXPECT().AuthUser(tt.username, tt.password).Return(tt.userSvcAuthResponse.authed, tt.userSvcAuthResponse.err)
 			}
 
+			if tt.userSvcAuthResponse.authed {
+				found := &user.UserData{Username: tt.username, Roles: []string{"support"}}
+				if tt.mfaEnabled {
+					found.TOTP = &user.TOTPSettings{Secret: "JBSWY3DPEHPK3PXP", Confirmed: true}
+				}
+				userSvc.EXPECT().GetUser(tt.username).Return(found, nil)
+			}
+
 			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
 			if tt.expectSessionSvcCall {
-				sessionSvc.EXPECT().CreateSession(tt.username, gomock.Any()).Return(tt.expectedSessionIdHeader, tt.expectedSessionSvcError)
+				sessionVars := map[string]string{"displayName": "Joe"}
+				userSvc.EXPECT().PasswordChangeRequired(gomock.Any()).Return(tt.passwordExpired)
+				userSvc.EXPECT().SessionVars(gomock.Any()).Return(sessionVars)
+				//a restricted session carries none of the user's access
+				access := session.Access{PasswordChangeRequired: true}
+				if !tt.passwordExpired {
+					rbacSvc.EXPECT().PermissionsFor([]string{"support"}).Return([]string{"tickets:read"}, nil)
+					groupSvc.EXPECT().GroupsForUser(tt.username).Return([]string{"emea", "staff"}, nil)
+					access = session.Access{Roles: []string{"support"}, Permissions: []string{"tickets:read"}, Groups: []string{"emea", "staff"}}
+				}
+				sessionSvc.EXPECT().CreateSession(tt.username, sessionVars, access).Return(tt.expectedSessionIdHeader, tt.expectedSessionSvcError)
+			}
+
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+			if tt.expectChallenge {
+				mfaSvc.EXPECT().CreateChallenge(tt.username, loginhistory.FactorPassword).Return("chal-123", nil)
+			}
+
+			loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+			if tt.wantResult != "" {
+				loginSvc.EXPECT().Record(tt.username, gomock.Any()).DoAndReturn(func(username string, login loginhistory.Login) error {
+					if login.Factor != loginhistory.FactorPassword || login.Result != tt.wantResult || login.SessionId != tt.expectedSessionIdHeader {
+						t.Errorf("Record() got login %+v, want result %v and session %v", login, tt.wantResult, tt.expectedSessionIdHeader)
+					}
+					return nil
+				})
 			}
 
-			router := apitest.BuildTestRouter(method, url, AuthUserHandler(userSvc, sessionSvc))
+			handler := AuthUserHandler(userSvc, mfaSvc, SessionStarter{User: userSvc, Session: sessionSvc, Rbac: rbacSvc, Group: groupSvc})
+			router := apitest.BuildTestRouter(method, url, handlers.LoginRecorded(loginSvc, handler))
 
 			w := httptest.NewRecorder()
 			req := httptest.NewRequest(method, url, strings.NewReader(tt.requestBody))
@@ -0,0 +1,94 @@
+package audit
+
+import "time"
+
+//go:generate mockgen -source=auditsvc.go -destination=../../../gen/mocks/mock_audit/auditsvc.go -self_package=../pkg/audit
+
+// MaxEventsPerUser is how much history is kept for each user, older events are dropped as new ones arrive
+const MaxEventsPerUser = 1000
+
+// MaxAdminEvents is how much of the admin log is kept, older events are dropped as new ones arrive
+const MaxAdminEvents = 10000
+
+// Event types recorded against a user
+const (
+	EventCreate               = "user.create"
+	EventLogin                = "login"
+	EventMfaChallenge         = "login.mfa"
+	EventFederatedLogin       = "login.oidc"
+	EventLoginLinkRequest     = "login.linkRequest"
+	EventLinkLogin            = "login.link"
+	EventIdentityUnlink       = "identity.unlink"
+	EventPasswordChange       = "password.change"
+	EventPasswordResetRequest = "password.resetRequest"
+	EventPasswordReset        = "password.reset"
+	EventEmailChange          = "email.change"
+	EventEmailVerify          = "email.verify"
+	EventProfileUpdate        = "profile.update"
+	EventTOTPEnroll           = "mfa.enroll"
+	EventTOTPConfirm          = "mfa.confirm"
+	EventTOTPDisable          = "mfa.disable"
+	EventRecoveryCodes        = "mfa.recoveryCodes"
+	EventDisable              = "admin.disable"
+	EventLock                 = "admin.lock"
+	EventEnable               = "admin.enable"
+	EventDelete               = "admin.delete"
+	EventRolesAssign          = "admin.roles"
+	EventForcePasswordChange  = "admin.forcePasswordChange"
+	EventRename               = "user.rename"
+)
+
+// Event types recorded in the admin log, for admin requests that don't act on a single user's history
+const (
+	EventImport               = "admin.import"
+	EventErase                = "admin.erase"
+	EventRoleSave             = "admin.roleSave"
+	EventRoleDelete           = "admin.roleDelete"
+	EventGroupSave            = "admin.groupSave"
+	EventGroupDelete          = "admin.groupDelete"
+	EventGroupUserAdd         = "admin.groupUserAdd"
+	EventGroupUserRemove      = "admin.groupUserRemove"
+	EventSubgroupAdd          = "admin.subgroupAdd"
+	EventSubgroupRemove       = "admin.subgroupRemove"
+	EventServiceAccountSave   = "admin.serviceAccountSave"
+	EventServiceAccountDelete = "admin.serviceAccountDelete"
+	EventAPIKeyCreate         = "admin.apiKeyCreate"
+	EventAPIKeyRevoke         = "admin.apiKeyRevoke"
+	EventInvitationCreate     = "admin.invitationCreate"
+	EventInvitationRevoke     = "admin.invitationRevoke"
+)
+
+// Event is one request that acted on a user, successful or not
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Success bool      `json:"success"`
+	// Status is the HTTP status the request was answered with
+	Status int    `json:"status"`
+	IP     string `json:"ip,omitempty"`
+	// Detail adds context some event types need, like the name a renamed user had before
+	Detail string `json:"detail,omitempty"`
+	// Target and Actor are only set in the admin log: what the request acted on and the administrator who made it
+	Target string `json:"target,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+}
+
+type AuditSVC interface {
+	Record(username string, event Event) error
+	// EventsFor returns the user's recorded history, newest first
+	EventsFor(username string) ([]Event, error)
+	// Pseudonymize moves the user's history under pseudonym with client IPs and details removed, returning how many
+	// events moved
+	Pseudonymize(username string, pseudonym string) (int, error)
+	// PurgeUser deletes the user's history, returning how many events were removed
+	PurgeUser(username string) (int, error)
+	// RenameUser moves the user's history to their new username, returning how many events moved
+	RenameUser(username string, newUsername string) (int, error)
+	// PseudonymizeAdmin replaces the username with pseudonym wherever it is the actor or a segment of the target in the
+	// admin log, dropping the client IP of events the user made, and returns how many events changed
+	PseudonymizeAdmin(username string, pseudonym string) (int, error)
+	// RecordAdmin adds an event to the admin log
+	RecordAdmin(event Event) error
+	// AdminEvents returns the admin log, newest first
+	AdminEvents() ([]Event, error)
+}
@@ -0,0 +1,175 @@
+package auditsvc
+
+import (
+	"encoding/json"
+	"log"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/user"
+	"strings"
+)
+
+// adminAuditKey holds the admin log, it has no underscore so it can't meet a user's audit key
+const adminAuditKey = "adminaudit"
+
+type AuditSVCImpl struct {
+	ds datasource.Datasource
+}
+
+func NewAuditSvc(ds datasource.Datasource) audit.AuditSVC {
+	return &AuditSVCImpl{ds: ds}
+}
+
+func (svc *AuditSVCImpl) Record(username string, event audit.Event) error {
+	return svc.push(generateAuditKey(username), event, audit.MaxEventsPerUser)
+}
+
+func (svc *AuditSVCImpl) EventsFor(username string) ([]audit.Event, error) {
+	return svc.events(generateAuditKey(username))
+}
+
+func (svc *AuditSVCImpl) RecordAdmin(event audit.Event) error {
+	return svc.push(adminAuditKey, event, audit.MaxAdminEvents)
+}
+
+func (svc *AuditSVCImpl) AdminEvents() ([]audit.Event, error) {
+	return svc.events(adminAuditKey)
+}
+
+func (svc *AuditSVCImpl) PseudonymizeAdmin(username string, pseudonym string) (int, error) {
+	events, err := svc.events(adminAuditKey)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for i := range events {
+		if pseudonymizeAdminEvent(&events[i], username, pseudonym) {
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	//the log is replaced whole, an admin event recorded between reading and rewriting it is lost.  Erasures are rare
+	//and that is the lesser harm next to leaving the name behind.
+	err = svc.ds.DelKey(adminAuditKey)
+	if err != nil {
+		log.Print("error clearing admin log: " + err.Error())
+		return 0, err
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		err = svc.RecordAdmin(events[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return changed, nil
+}
+
+// pseudonymizeAdminEvent swaps the username for pseudonym in the event's actor and target path, reporting whether
+// anything changed.  Path segments are compared normalized, the path is recorded as it was requested.
+func pseudonymizeAdminEvent(event *audit.Event, username string, pseudonym string) bool {
+	changed := false
+	if event.Actor == username {
+		event.Actor = pseudonym
+		event.IP = ""
+		changed = true
+	}
+	segments := strings.Split(event.Target, "/")
+	for i, segment := range segments {
+		if normalized, err := user.NormalizeUsername(segment); err == nil && normalized == username {
+			segments[i] = pseudonym
+			changed = true
+		}
+	}
+	event.Target = strings.Join(segments, "/")
+	return changed
+}
+
+func (svc *AuditSVCImpl) push(key string, event audit.Event, max int64) error {
+	rawEvent, err := json.Marshal(event)
+	if err != nil {
+		log.Print("error marshaling audit event: " + err.Error())
+		return err
+	}
+	return svc.ds.PushListItem(key, string(rawEvent), max)
+}
+
+func (svc *AuditSVCImpl) events(key string) ([]audit.Event, error) {
+	rawEvents, err := svc.ds.GetListItems(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]audit.Event, 0, len(rawEvents))
+	for _, rawEvent := range rawEvents {
+		event := audit.Event{}
+		err = json.Unmarshal([]byte(rawEvent), &event)
+		if err != nil {
+			log.Print("error unmarshaling audit event: " + err.Error())
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (svc *AuditSVCImpl) Pseudonymize(username string, pseudonym string) (int, error) {
+	//a detail can name the user, like the old name recorded by a rename
+	return svc.move(username, pseudonym, func(event *audit.Event) {
+		event.IP = ""
+		event.Detail = ""
+	})
+}
+
+func (svc *AuditSVCImpl) PurgeUser(username string) (int, error) {
+	rawEvents, err := svc.ds.GetListItems(generateAuditKey(username), 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	err = svc.ds.DelKey(generateAuditKey(username))
+	if err != nil {
+		log.Print("error deleting audit history: " + err.Error())
+		return 0, err
+	}
+	return len(rawEvents), nil
+}
+
+func (svc *AuditSVCImpl) RenameUser(username string, newUsername string) (int, error) {
+	//whatever is already under the new name belonged to someone else, it mustn't be merged into this user's history
+	err := svc.ds.DelKey(generateAuditKey(newUsername))
+	if err != nil {
+		log.Print("error clearing audit history: " + err.Error())
+		return 0, err
+	}
+	return svc.move(username, newUsername, func(event *audit.Event) {})
+}
+
+// move rewrites the user's history under another name, passing each event through change on the way
+func (svc *AuditSVCImpl) move(username string, to string, change func(event *audit.Event)) (int, error) {
+	events, err := svc.EventsFor(username)
+	if err != nil {
+		return 0, err
+	}
+
+	//pushing oldest first keeps the history newest first under its new key
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		change(&event)
+		err = svc.Record(to, event)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = svc.ds.DelKey(generateAuditKey(username))
+	if err != nil {
+		log.Print("error deleting audit history: " + err.Error())
+		return 0, err
+	}
+	return len(events), nil
+}
+
+func generateAuditKey(username string) string {
+	return "audit_" + username
+}
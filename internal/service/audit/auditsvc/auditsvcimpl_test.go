@@ -0,0 +1,180 @@
+package auditsvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/audit"
+	"testing"
+	"time"
+)
+
+func TestAuditSVCImpl_Record(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().PushListItem("audit_joehrke", `{"time":"2020-01-02T03:04:05Z","type":"login","success":true,"status":200,"ip":"10.0.0.1"}`, int64(audit.MaxEventsPerUser)).Return(nil)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	event := audit.Event{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: audit.EventLogin, Success: true, Status: 200, IP: "10.0.0.1"}
+	if err := svc.Record("joehrke", event); err != nil {
+		t.Errorf("Record() unexpected error = %v", err)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_EventsFor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("audit_joehrke", int64(0), int64(-1)).Return([]string{
+		`{"time":"2020-01-02T03:05:00Z","type":"password.change","success":false,"status":403}`,
+		`{"time":"2020-01-02T03:04:05Z","type":"login","success":true,"status":200}`,
+	}, nil)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	got, err := svc.EventsFor("joehrke")
+	if err != nil {
+		t.Fatalf("EventsFor() unexpected error = %v", err)
+	}
+	want := []audit.Event{
+		{Time: time.Date(2020, 1, 2, 3, 5, 0, 0, time.UTC), Type: audit.EventPasswordChange, Status: 403},
+		{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: audit.EventLogin, Success: true, Status: 200},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EventsFor() got = %v, want %v", got, want)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_Pseudonymize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("audit_joehrke", int64(0), int64(-1)).Return([]string{
+		`{"time":"2020-01-02T03:05:00Z","type":"user.rename","success":true,"status":204,"ip":"10.0.0.2","detail":"from jhrke"}`,
+		`{"time":"2020-01-02T03:04:05Z","type":"login","success":true,"status":200,"ip":"10.0.0.1"}`,
+	}, nil)
+	gomock.InOrder(
+		ds.EXPECT().PushListItem("audit_erased:abc", `{"time":"2020-01-02T03:04:05Z","type":"login","success":true,"status":200}`, int64(audit.MaxEventsPerUser)).Return(nil),
+		ds.EXPECT().PushListItem("audit_erased:abc", `{"time":"2020-01-02T03:05:00Z","type":"user.rename","success":true,"status":204}`, int64(audit.MaxEventsPerUser)).Return(nil),
+		ds.EXPECT().DelKey("audit_joehrke").Return(nil),
+	)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	moved, err := svc.Pseudonymize("joehrke", "erased:abc")
+	if err != nil {
+		t.Fatalf("Pseudonymize() unexpected error = %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("Pseudonymize() moved = %v, want 2", moved)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_PurgeUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("audit_joehrke", int64(0), int64(-1)).Return([]string{`{}`, `{}`}, nil)
+	ds.EXPECT().DelKey("audit_joehrke").Return(nil)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	removed, err := svc.PurgeUser("joehrke")
+	if err != nil || removed != 2 {
+		t.Errorf("PurgeUser() = %v, %v, want 2, nil", removed, err)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_RenameUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("audit_joehrke", int64(0), int64(-1)).Return([]string{
+		`{"time":"2020-01-02T03:04:05Z","type":"login","success":true,"status":200,"ip":"10.0.0.1"}`,
+	}, nil)
+	gomock.InOrder(
+		ds.EXPECT().DelKey("audit_jhrke").Return(nil),
+		ds.EXPECT().PushListItem("audit_jhrke", `{"time":"2020-01-02T03:04:05Z","type":"login","success":true,"status":200,"ip":"10.0.0.1"}`, int64(audit.MaxEventsPerUser)).Return(nil),
+		ds.EXPECT().DelKey("audit_joehrke").Return(nil),
+	)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	moved, err := svc.RenameUser("joehrke", "jhrke")
+	if err != nil || moved != 1 {
+		t.Errorf("RenameUser() = %v, %v, want 1 event", moved, err)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_RecordAdmin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().PushListItem("adminaudit", `{"time":"2020-01-02T03:04:05Z","type":"admin.groupSave","success":true,"status":204,"ip":"10.0.0.1","target":"/v1/admin/groups/eng","actor":"joehrke"}`, int64(audit.MaxAdminEvents)).Return(nil)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	event := audit.Event{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: audit.EventGroupSave, Success: true, Status: 204, IP: "10.0.0.1", Target: "/v1/admin/groups/eng", Actor: "joehrke"}
+	if err := svc.RecordAdmin(event); err != nil {
+		t.Errorf("RecordAdmin() unexpected error = %v", err)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_AdminEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("adminaudit", int64(0), int64(-1)).Return([]string{
+		`{"time":"2020-01-02T03:04:05Z","type":"admin.roleDelete","success":false,"status":409,"target":"/v1/admin/roles/ops","actor":"svc:deploy"}`,
+	}, nil)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	got, err := svc.AdminEvents()
+	if err != nil {
+		t.Fatalf("AdminEvents() unexpected error = %v", err)
+	}
+	want := []audit.Event{
+		{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: audit.EventRoleDelete, Status: 409, Target: "/v1/admin/roles/ops", Actor: "svc:deploy"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AdminEvents() got = %v, want %v", got, want)
+	}
+	ctrl.Finish()
+}
+
+func TestAuditSVCImpl_PseudonymizeAdmin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("adminaudit", int64(0), int64(-1)).Return([]string{
+		`{"time":"2020-01-02T03:06:00Z","type":"admin.roleSave","success":true,"status":204,"ip":"10.0.0.3","target":"/v1/admin/roles/ops","actor":"joehrke"}`,
+		`{"time":"2020-01-02T03:05:00Z","type":"admin.groupUserAdd","success":true,"status":204,"ip":"10.0.0.2","target":"/v1/admin/groups/eng/users/JoeHrke","actor":"bob"}`,
+		`{"time":"2020-01-02T03:04:05Z","type":"admin.groupSave","success":true,"status":204,"ip":"10.0.0.1","target":"/v1/admin/groups/eng","actor":"bob"}`,
+	}, nil)
+	gomock.InOrder(
+		ds.EXPECT().DelKey("adminaudit").Return(nil),
+		ds.EXPECT().PushListItem("adminaudit", `{"time":"2020-01-02T03:04:05Z","type":"admin.groupSave","success":true,"status":204,"ip":"10.0.0.1","target":"/v1/admin/groups/eng","actor":"bob"}`, int64(audit.MaxAdminEvents)).Return(nil),
+		ds.EXPECT().PushListItem("adminaudit", `{"time":"2020-01-02T03:05:00Z","type":"admin.groupUserAdd","success":true,"status":204,"ip":"10.0.0.2","target":"/v1/admin/groups/eng/users/erased:abc","actor":"bob"}`, int64(audit.MaxAdminEvents)).Return(nil),
+		ds.EXPECT().PushListItem("adminaudit", `{"time":"2020-01-02T03:06:00Z","type":"admin.roleSave","success":true,"status":204,"target":"/v1/admin/roles/ops","actor":"erased:abc"}`, int64(audit.MaxAdminEvents)).Return(nil),
+	)
+
+	svc := &AuditSVCImpl{
+		ds: ds,
+	}
+	changed, err := svc.PseudonymizeAdmin("joehrke", "erased:abc")
+	if err != nil {
+		t.Fatalf("PseudonymizeAdmin() unexpected error = %v", err)
+	}
+	if changed != 2 {
+		t.Errorf("PseudonymizeAdmin() changed = %v, want 2", changed)
+	}
+	ctrl.Finish()
+}
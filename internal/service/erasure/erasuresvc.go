@@ -0,0 +1,41 @@
+package erasure
+
+import "time"
+
+//go:generate mockgen -source=erasuresvc.go -destination=../../../gen/mocks/mock_erasure/erasuresvc.go -self_package=../pkg/erasure
+
+// Requesters of an erasure
+const (
+	RequestedBySelf  = "self"
+	RequestedByAdmin = "admin"
+)
+
+// Receipt records that a user was erased without naming them.  Subject is the user's pseudonym, which can be
+// recomputed from the username to find the receipt.  Each receipt carries the hash of the one before it, so removing
+// or altering a receipt breaks the chain for every later one.
+type Receipt struct {
+	Id          string    `json:"id"`
+	ErasedAt    time.Time `json:"erasedAt"`
+	Subject     string    `json:"subject"`
+	RequestedBy string    `json:"requestedBy"`
+	// Removed counts what was deleted or pseudonymized in each place the user appeared
+	Removed      map[string]int `json:"removed"`
+	PreviousHash string         `json:"previousHash"`
+	Hash         string         `json:"hash"`
+}
+
+type ErasureSVC interface {
+	// Erase removes every trace of the user: the record and its indexes, sessions, group memberships, outstanding
+	// tokens, MFA state and login history.  Their audit history is kept under their pseudonym with client IPs and notes removed.
+	Erase(username string, requestedBy string) (*Receipt, error)
+	// Pseudonym returns the subject receipts and pseudonymized audit history use for a username
+	Pseudonym(username string) (string, error)
+	// Receipts returns every receipt newest first, reporting whether the hash chain linking them is intact
+	Receipts() (receipts []Receipt, intact bool, err error)
+}
+
+type ErasureError string
+
+func (e ErasureError) Error() string { return string(e) }
+
+const ErasureInProgress = ErasureError("another erasure is in progress")
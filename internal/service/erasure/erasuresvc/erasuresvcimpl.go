@@ -0,0 +1,242 @@
+package erasuresvc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/google/uuid"
+	"log"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/erasure"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+	"time"
+)
+
+const (
+	receiptListKey = "erasure_receipts"
+	// pseudonymKeyKey holds the HMAC key pseudonyms are derived with, it's generated on first use
+	pseudonymKeyKey = "erasure_pseudonymkey"
+	lockKey         = "erasure_lock"
+	lockTTL         = 30 * time.Second
+
+	// pseudonymPrefix can't appear in a username, so a pseudonym never collides with one
+	pseudonymPrefix = "erased:"
+)
+
+// Services are everywhere a username can be stored
+type Services struct {
+	User    user.UserSVC
+	Session session.SessionSVC
+	Group   group.GroupSVC
+	Token   token.TokenSVC
+	Mfa     mfa.MfaSVC
+	Audit   audit.AuditSVC
+	Logins  loginhistory.LoginHistorySVC
+}
+
+type ErasureSVCImpl struct {
+	ds   datasource.Datasource
+	svcs Services
+	now  func() time.Time
+}
+
+func NewErasureSvc(ds datasource.Datasource, svcs Services) erasure.ErasureSVC {
+	return &ErasureSVCImpl{
+		ds:   ds,
+		svcs: svcs,
+		now:  time.Now,
+	}
+}
+
+func (svc *ErasureSVCImpl) Erase(username string, requestedBy string) (*erasure.Receipt, error) {
+	u, err := svc.svcs.User.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	username = u.Username
+	pseudonym, err := svc.Pseudonym(username)
+	if err != nil {
+		return nil, err
+	}
+
+	//receipts are chained, so only one erasure may append at a time
+	id := uuid.New().String()
+	locked, err := svc.ds.SetKeyIfAbsent(lockKey, id, lockTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, erasure.ErasureInProgress
+	}
+	defer svc.unlock(id)
+
+	removed := make(map[string]int)
+	sessionIds, err := svc.svcs.Session.GetSessionIdsForUser(username)
+	if err != nil {
+		return nil, err
+	}
+	removed["sessions"] = len(sessionIds)
+	err = svc.svcs.Session.DestroySessionsForUser(username, "")
+	if err != nil {
+		return nil, err
+	}
+	err = svc.svcs.Group.RemoveUserFromAll(username)
+	if err != nil {
+		return nil, err
+	}
+	removed["tokens"], err = svc.svcs.Token.RevokeTokensFor(username)
+	if err != nil {
+		return nil, err
+	}
+	removed["mfa"], err = svc.svcs.Mfa.PurgeUser(username)
+	if err != nil {
+		return nil, err
+	}
+	removed["auditEvents"], err = svc.svcs.Audit.Pseudonymize(username, pseudonym)
+	if err != nil {
+		return nil, err
+	}
+	removed["adminEvents"], err = svc.svcs.Audit.PseudonymizeAdmin(username, pseudonym)
+	if err != nil {
+		return nil, err
+	}
+	removed["logins"], err = svc.svcs.Logins.PurgeUser(username)
+	if err != nil {
+		return nil, err
+	}
+	removed["aliases"], err = svc.svcs.User.DropAliases(username)
+	if err != nil {
+		return nil, err
+	}
+	//the record goes last so a failed erasure can be retried
+	err = svc.svcs.User.DeleteUser(username)
+	if err != nil {
+		return nil, err
+	}
+	removed["user"] = 1
+
+	receipt := &erasure.Receipt{
+		Id:          id,
+		ErasedAt:    svc.now().UTC(),
+		Subject:     pseudonym,
+		RequestedBy: requestedBy,
+		Removed:     removed,
+	}
+	err = svc.appendReceipt(receipt)
+	if err != nil {
+		log.Printf("error writing erasure receipt: %v", err.Error())
+		return nil, err
+	}
+	return receipt, nil
+}
+
+func (svc *ErasureSVCImpl) Pseudonym(username string) (string, error) {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return "", user.NotFound
+	}
+	key, err := svc.pseudonymKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(username))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (svc *ErasureSVCImpl) Receipts() ([]erasure.Receipt, bool, error) {
+	rawReceipts, err := svc.ds.GetListItems(receiptListKey, 0, -1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	receipts := make([]erasure.Receipt, 0, len(rawReceipts))
+	for _, rawReceipt := range rawReceipts {
+		receipt := erasure.Receipt{}
+		err = json.Unmarshal([]byte(rawReceipt), &receipt)
+		if err != nil {
+			log.Printf("error unmarshaling erasure receipt: %v", err.Error())
+			return nil, false, err
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	//walk oldest to newest, each receipt must hash correctly and point at the one before it
+	intact := true
+	previous := ""
+	for i := len(receipts) - 1; i >= 0; i-- {
+		if receipts[i].PreviousHash != previous || hashReceipt(receipts[i]) != receipts[i].Hash {
+			intact = false
+			break
+		}
+		previous = receipts[i].Hash
+	}
+	return receipts, intact, nil
+}
+
+// appendReceipt links receipt to the newest one, hashes it and stores it
+func (svc *ErasureSVCImpl) appendReceipt(receipt *erasure.Receipt) error {
+	newest, err := svc.ds.GetListItems(receiptListKey, 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(newest) > 0 {
+		previous := erasure.Receipt{}
+		err = json.Unmarshal([]byte(newest[0]), &previous)
+		if err != nil {
+			return err
+		}
+		receipt.PreviousHash = previous.Hash
+	}
+	receipt.Hash = hashReceipt(*receipt)
+
+	rawReceipt, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	return svc.ds.PushListItem(receiptListKey, string(rawReceipt), 0)
+}
+
+// hashReceipt is the sha256 of the receipt's JSON with the hash itself left out
+func hashReceipt(receipt erasure.Receipt) string {
+	receipt.Hash = ""
+	rawReceipt, _ := json.Marshal(receipt)
+	sum := sha256.Sum256(rawReceipt)
+	return hex.EncodeToString(sum[:])
+}
+
+func (svc *ErasureSVCImpl) pseudonymKey() ([]byte, error) {
+	raw := make([]byte, sha256.Size)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	//whichever key is written first wins, so concurrent first uses agree
+	_, err = svc.ds.SetKeyIfAbsent(pseudonymKeyKey, hex.EncodeToString(raw), 0)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := svc.ds.GetKey(pseudonymKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(stored)
+}
+
+func (svc *ErasureSVCImpl) unlock(id string) {
+	holder, err := svc.ds.GetKey(lockKey)
+	if err == nil && holder == id {
+		err = svc.ds.DelKey(lockKey)
+	}
+	if err != nil {
+		log.Printf("error releasing erasure lock: %v", err.Error())
+	}
+}
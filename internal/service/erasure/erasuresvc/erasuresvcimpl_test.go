@@ -0,0 +1,180 @@
+package erasuresvc
+
+import (
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_audit"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/erasure"
+	"sso-v2/internal/service/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPseudonymKey = "000102030405060708090a0b0c0d0e0f"
+
+func TestErasureSVCImpl_Erase(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	userSvc := mock_user.NewMockUserSVC(ctrl)
+	sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+	groupSvc := mock_group.NewMockGroupSVC(ctrl)
+	tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+	mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+	auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+	loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+
+	userSvc.EXPECT().GetUser("JoeHrke").Return(&user.UserData{Username: "joehrke"}, nil)
+	ds.EXPECT().SetKeyIfAbsent(pseudonymKeyKey, gomock.Any(), time.Duration(0)).Return(false, nil)
+	ds.EXPECT().GetKey(pseudonymKeyKey).Return(testPseudonymKey, nil)
+	var lockId string
+	ds.EXPECT().SetKeyIfAbsent(lockKey, gomock.Any(), lockTTL).DoAndReturn(func(key string, val string, timeout time.Duration) (bool, error) {
+		lockId = val
+		return true, nil
+	})
+	sessionSvc.EXPECT().GetSessionIdsForUser("joehrke").Return([]string{"s1", "s2"}, nil)
+	sessionSvc.EXPECT().DestroySessionsForUser("joehrke", "").Return(nil)
+	groupSvc.EXPECT().RemoveUserFromAll("joehrke").Return(nil)
+	tokenSvc.EXPECT().RevokeTokensFor("joehrke").Return(1, nil)
+	mfaSvc.EXPECT().PurgeUser("joehrke").Return(0, nil)
+	var pseudonym string
+	auditSvc.EXPECT().Pseudonymize("joehrke", gomock.Any()).DoAndReturn(func(username string, p string) (int, error) {
+		pseudonym = p
+		return 3, nil
+	})
+	auditSvc.EXPECT().PseudonymizeAdmin("joehrke", gomock.Any()).DoAndReturn(func(username string, p string) (int, error) {
+		if p != pseudonym {
+			t.Errorf("PseudonymizeAdmin() pseudonym = %v, want %v", p, pseudonym)
+		}
+		return 2, nil
+	})
+	loginSvc.EXPECT().PurgeUser("joehrke").Return(4, nil)
+	userSvc.EXPECT().DropAliases("joehrke").Return(1, nil)
+	userSvc.EXPECT().DeleteUser("joehrke").Return(nil)
+	ds.EXPECT().GetListItems(receiptListKey, int64(0), int64(0)).Return([]string{`{"hash":"prev"}`}, nil)
+	var stored string
+	ds.EXPECT().PushListItem(receiptListKey, gomock.Any(), int64(0)).DoAndReturn(func(key string, item string, maxLen int64) error {
+		stored = item
+		return nil
+	})
+	ds.EXPECT().GetKey(lockKey).DoAndReturn(func(key string) (string, error) { return lockId, nil })
+	ds.EXPECT().DelKey(lockKey).Return(nil)
+
+	svc := &ErasureSVCImpl{
+		ds:   ds,
+		svcs: Services{User: userSvc, Session: sessionSvc, Group: groupSvc, Token: tokenSvc, Mfa: mfaSvc, Audit: auditSvc, Logins: loginSvc},
+		now:  func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+	receipt, err := svc.Erase("JoeHrke", erasure.RequestedBySelf)
+	if err != nil {
+		t.Fatalf("Erase() unexpected error = %v", err)
+	}
+	if !strings.HasPrefix(receipt.Subject, pseudonymPrefix) || receipt.Subject != pseudonym {
+		t.Errorf("Erase() subject = %v, audit pseudonym %v", receipt.Subject, pseudonym)
+	}
+	if strings.Contains(stored, "joehrke") {
+		t.Errorf("Erase() receipt names the user: %v", stored)
+	}
+	if receipt.PreviousHash != "prev" || receipt.Hash != hashReceipt(*receipt) {
+		t.Errorf("Erase() receipt not chained: %+v", receipt)
+	}
+	want := map[string]int{"sessions": 2, "tokens": 1, "mfa": 0, "auditEvents": 3, "adminEvents": 2, "logins": 4, "aliases": 1, "user": 1}
+	for name, count := range want {
+		if receipt.Removed[name] != count {
+			t.Errorf("Erase() removed[%v] = %v, want %v", name, receipt.Removed[name], count)
+		}
+	}
+	ctrl.Finish()
+}
+
+func TestErasureSVCImpl_Erase_InProgress(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	userSvc := mock_user.NewMockUserSVC(ctrl)
+
+	userSvc.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke"}, nil)
+	ds.EXPECT().SetKeyIfAbsent(pseudonymKeyKey, gomock.Any(), time.Duration(0)).Return(false, nil)
+	ds.EXPECT().GetKey(pseudonymKeyKey).Return(testPseudonymKey, nil)
+	ds.EXPECT().SetKeyIfAbsent(lockKey, gomock.Any(), lockTTL).Return(false, nil)
+
+	svc := &ErasureSVCImpl{
+		ds:   ds,
+		svcs: Services{User: userSvc},
+		now:  time.Now,
+	}
+	_, err := svc.Erase("joehrke", erasure.RequestedByAdmin)
+	if err != erasure.ErasureInProgress {
+		t.Errorf("Erase() error = %v, want %v", err, erasure.ErasureInProgress)
+	}
+	ctrl.Finish()
+}
+
+func TestErasureSVCImpl_Receipts(t *testing.T) {
+	first := erasure.Receipt{Id: "1", Subject: "erased:a", RequestedBy: erasure.RequestedBySelf}
+	first.Hash = hashReceipt(first)
+	second := erasure.Receipt{Id: "2", Subject: "erased:b", RequestedBy: erasure.RequestedByAdmin, PreviousHash: first.Hash}
+	second.Hash = hashReceipt(second)
+	tampered := second
+	tampered.Subject = "erased:c"
+	dropped := second
+	dropped.PreviousHash = "elsewhere"
+	dropped.Hash = hashReceipt(dropped)
+
+	tests := []struct {
+		name       string
+		receipts   []erasure.Receipt
+		wantIntact bool
+	}{
+		{
+			name:       "Empty",
+			wantIntact: true,
+		},
+		{
+			name:       "Intact",
+			receipts:   []erasure.Receipt{second, first},
+			wantIntact: true,
+		},
+		{
+			name:     "Tampered",
+			receipts: []erasure.Receipt{tampered, first},
+		},
+		{
+			name:     "Receipt_Removed",
+			receipts: []erasure.Receipt{dropped, first},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			raw := []string{}
+			for _, receipt := range tt.receipts {
+				item, _ := json.Marshal(receipt)
+				raw = append(raw, string(item))
+			}
+			ds.EXPECT().GetListItems(receiptListKey, int64(0), int64(-1)).Return(raw, nil)
+
+			svc := &ErasureSVCImpl{
+				ds: ds,
+			}
+			got, intact, err := svc.Receipts()
+			if err != nil {
+				t.Fatalf("Receipts() unexpected error = %v", err)
+			}
+			if len(got) != len(tt.receipts) {
+				t.Errorf("Receipts() got %v receipts, want %v", len(got), len(tt.receipts))
+			}
+			if intact != tt.wantIntact {
+				t.Errorf("Receipts() intact = %v, want %v", intact, tt.wantIntact)
+			}
+			ctrl.Finish()
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package group
+
+import (
+	"strings"
+	"unicode"
+)
+
+//go:generate mockgen -source=groupsvc.go -destination=../../../gen/mocks/mock_group/groupsvc.go -self_package=../pkg/group
+
+const MaxGroupNameLength = 64
+
+// Group is a named set of users and other groups, members of a nested group are members of every group containing it
+type Group struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Users       []string `json:"users,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+}
+
+type GroupSVC interface {
+	// SaveGroup creates the group or updates its description, members are managed separately
+	SaveGroup(g Group) error
+	// GetGroup returns the group with its direct members
+	GetGroup(name string) (*Group, error)
+	// ListGroups returns every group without members
+	ListGroups() ([]Group, error)
+	DeleteGroup(name string) error
+	AddUser(group string, username string) error
+	RemoveUser(group string, username string) error
+	// AddSubgroup makes child a member of parent, refusing anything that would make a group contain itself
+	AddSubgroup(parent string, child string) error
+	RemoveSubgroup(parent string, child string) error
+	// GroupsForUser resolves every group the user belongs to, directly or through nested groups, in sorted order
+	GroupsForUser(username string) ([]string, error)
+	// RemoveUserFromAll drops the user from every group they are a direct member of
+	RemoveUserFromAll(username string) error
+	// RenameUser moves the user's direct memberships to their new username, returning how many groups were updated
+	RenameUser(username string, newUsername string) (int, error)
+}
+
+type GroupError string
+
+func (e GroupError) Error() string { return string(e) }
+
+const (
+	GroupNotFound    = GroupError("group not found")
+	InvalidGroupName = GroupError("invalid group name")
+	GroupCycle       = GroupError("group would contain itself")
+)
+
+// ValidGroupName reports whether name can be used for a group, names are limited to ASCII letters, digits and a few
+// separators so they're safe in datastore keys and URL paths
+func ValidGroupName(name string) bool {
+	if name == "" || len(name) > MaxGroupNameLength {
+		return false
+	}
+	for _, r := range name {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,338 @@
+package groupsvc
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/user"
+)
+
+const groupIndexKey = "groups"
+
+// Membership is kept in both directions as sets: a group's direct users and subgroups, and for resolution, each user's
+// direct groups and each group's direct parents
+type GroupSVCImpl struct {
+	ds      datasource.Datasource
+	userSvc user.UserSVC
+}
+
+func NewGroupSvc(ds datasource.Datasource, userSvc user.UserSVC) group.GroupSVC {
+	return &GroupSVCImpl{
+		ds:      ds,
+		userSvc: userSvc,
+	}
+}
+
+func (svc *GroupSVCImpl) SaveGroup(g group.Group) error {
+	if !group.ValidGroupName(g.Name) {
+		return group.InvalidGroupName
+	}
+
+	rawGroup, err := json.Marshal(group.Group{Name: g.Name, Description: g.Description})
+	if err != nil {
+		log.Print("error marshaling group: " + err.Error())
+		return err
+	}
+	err = svc.ds.SetKey(generateGroupKey(g.Name), string(rawGroup), 0)
+	if err != nil {
+		log.Print("error writing group: " + err.Error())
+		return err
+	}
+	err = svc.ds.AddSetMember(groupIndexKey, g.Name)
+	if err != nil {
+		log.Print("error indexing group: " + err.Error())
+	}
+	return err
+}
+
+func (svc *GroupSVCImpl) GetGroup(name string) (*group.Group, error) {
+	g, err := svc.loadGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	g.Users, err = svc.sortedMembers(generateGroupUsersKey(name))
+	if err != nil {
+		return nil, err
+	}
+	g.Groups, err = svc.sortedMembers(generateGroupGroupsKey(name))
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (svc *GroupSVCImpl) ListGroups() ([]group.Group, error) {
+	names, err := svc.sortedMembers(groupIndexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []group.Group{}
+	for _, name := range names {
+		g, err := svc.loadGroup(name)
+		if err == group.GroupNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *g)
+	}
+	return groups, nil
+}
+
+func (svc *GroupSVCImpl) DeleteGroup(name string) error {
+	g, err := svc.GetGroup(name)
+	if err != nil {
+		return err
+	}
+	parents, err := svc.sortedMembers(generateGroupParentsKey(name))
+	if err != nil {
+		return err
+	}
+
+	//unhook the group from both sides of every membership before dropping its own keys
+	for _, username := range g.Users {
+		err = svc.ds.RemoveSetMember(generateUserGroupsKey(username), name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, child := range g.Groups {
+		err = svc.ds.RemoveSetMember(generateGroupParentsKey(child), name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, parent := range parents {
+		err = svc.ds.RemoveSetMember(generateGroupGroupsKey(parent), name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{generateGroupUsersKey(name), generateGroupGroupsKey(name), generateGroupParentsKey(name), generateGroupKey(name)} {
+		err = svc.ds.DelKey(key)
+		if err != nil {
+			log.Print("error deleting group: " + err.Error())
+			return err
+		}
+	}
+	return svc.ds.RemoveSetMember(groupIndexKey, name)
+}
+
+func (svc *GroupSVCImpl) AddUser(groupName string, username string) error {
+	_, err := svc.loadGroup(groupName)
+	if err != nil {
+		return err
+	}
+	u, err := svc.userSvc.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	err = svc.ds.AddSetMember(generateGroupUsersKey(groupName), u.Username)
+	if err != nil {
+		log.Print("error adding group member: " + err.Error())
+		return err
+	}
+	return svc.ds.AddSetMember(generateUserGroupsKey(u.Username), groupName)
+}
+
+func (svc *GroupSVCImpl) RemoveUser(groupName string, username string) error {
+	_, err := svc.loadGroup(groupName)
+	if err != nil {
+		return err
+	}
+	username, err = user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	err = svc.ds.RemoveSetMember(generateGroupUsersKey(groupName), username)
+	if err != nil {
+		log.Print("error removing group member: " + err.Error())
+		return err
+	}
+	return svc.ds.RemoveSetMember(generateUserGroupsKey(username), groupName)
+}
+
+func (svc *GroupSVCImpl) AddSubgroup(parent string, child string) error {
+	_, err := svc.loadGroup(parent)
+	if err != nil {
+		return err
+	}
+	_, err = svc.loadGroup(child)
+	if err != nil {
+		return err
+	}
+
+	//child may not already contain parent, which is the case exactly when child is parent or one of its ancestors
+	ancestors, err := svc.resolveAncestors([]string{parent})
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range ancestors {
+		if ancestor == child {
+			return group.GroupCycle
+		}
+	}
+
+	err = svc.ds.AddSetMember(generateGroupGroupsKey(parent), child)
+	if err != nil {
+		log.Print("error adding subgroup: " + err.Error())
+		return err
+	}
+	return svc.ds.AddSetMember(generateGroupParentsKey(child), parent)
+}
+
+func (svc *GroupSVCImpl) RemoveSubgroup(parent string, child string) error {
+	_, err := svc.loadGroup(parent)
+	if err != nil {
+		return err
+	}
+
+	err = svc.ds.RemoveSetMember(generateGroupGroupsKey(parent), child)
+	if err != nil {
+		log.Print("error removing subgroup: " + err.Error())
+		return err
+	}
+	return svc.ds.RemoveSetMember(generateGroupParentsKey(child), parent)
+}
+
+func (svc *GroupSVCImpl) GroupsForUser(username string) ([]string, error) {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return nil, user.NotFound
+	}
+	direct, err := svc.sortedMembers(generateUserGroupsKey(username))
+	if err != nil {
+		return nil, err
+	}
+	return svc.resolveAncestors(direct)
+}
+
+func (svc *GroupSVCImpl) RemoveUserFromAll(username string) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+	direct, err := svc.sortedMembers(generateUserGroupsKey(username))
+	if err != nil {
+		return err
+	}
+
+	for _, groupName := range direct {
+		err = svc.ds.RemoveSetMember(generateGroupUsersKey(groupName), username)
+		if err != nil {
+			log.Print("error removing group member: " + err.Error())
+			return err
+		}
+	}
+	return svc.ds.DelKey(generateUserGroupsKey(username))
+}
+
+func (svc *GroupSVCImpl) RenameUser(username string, newUsername string) (int, error) {
+	direct, err := svc.sortedMembers(generateUserGroupsKey(username))
+	if err != nil {
+		return 0, err
+	}
+
+	//the new name is added before the old one is removed, so a failure part way leaves the user in the group
+	for _, groupName := range direct {
+		err = svc.ds.AddSetMember(generateGroupUsersKey(groupName), newUsername)
+		if err == nil {
+			err = svc.ds.AddSetMember(generateUserGroupsKey(newUsername), groupName)
+		}
+		if err == nil {
+			err = svc.ds.RemoveSetMember(generateGroupUsersKey(groupName), username)
+		}
+		if err != nil {
+			log.Print("error moving group member: " + err.Error())
+			return 0, err
+		}
+	}
+	return len(direct), svc.ds.DelKey(generateUserGroupsKey(username))
+}
+
+// resolveAncestors walks up the parent links from start, returning start and every group above it in sorted order.
+// Groups are only visited once so a cycle written outside AddSubgroup can't loop forever.
+func (svc *GroupSVCImpl) resolveAncestors(start []string) ([]string, error) {
+	visited := make(map[string]bool)
+	queue := append([]string{}, start...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if visited[name] {
+			continue
+		}
+		visited[name] = true
+
+		parents, err := svc.ds.GetSetMembers(generateGroupParentsKey(name))
+		if err != nil {
+			log.Print("error fetching group parents: " + err.Error())
+			return nil, err
+		}
+		queue = append(queue, parents...)
+	}
+
+	resolved := make([]string, 0, len(visited))
+	for name := range visited {
+		resolved = append(resolved, name)
+	}
+	sort.Strings(resolved)
+	return resolved, nil
+}
+
+func (svc *GroupSVCImpl) loadGroup(name string) (*group.Group, error) {
+	if !group.ValidGroupName(name) {
+		return nil, group.GroupNotFound
+	}
+	rawGroup, err := svc.ds.GetKey(generateGroupKey(name))
+	if err != nil {
+		log.Print("error fetching group: " + err.Error())
+		return nil, err
+	}
+	if rawGroup == "" {
+		return nil, group.GroupNotFound
+	}
+
+	g := &group.Group{}
+	err = json.Unmarshal([]byte(rawGroup), g)
+	if err != nil {
+		log.Print("error unmarshaling group: " + err.Error())
+		return nil, err
+	}
+	return g, nil
+}
+
+func (svc *GroupSVCImpl) sortedMembers(key string) ([]string, error) {
+	members, err := svc.ds.GetSetMembers(key)
+	if err != nil {
+		log.Print("error fetching set members: " + err.Error())
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func generateGroupKey(name string) string {
+	return "group_" + name
+}
+
+func generateGroupUsersKey(name string) string {
+	return "groupusers_" + name
+}
+
+func generateGroupGroupsKey(name string) string {
+	return "groupgroups_" + name
+}
+
+func generateGroupParentsKey(name string) string {
+	return "groupparents_" + name
+}
+
+func generateUserGroupsKey(username string) string {
+	return "usergroups_" + username
+}
@@ -0,0 +1,162 @@
+package groupsvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/group"
+	"testing"
+)
+
+func TestGroupSVCImpl_AddSubgroup(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    string
+		child     string
+		ancestors map[string][]string
+		wantAdd   bool
+		wantErr   error
+	}{
+		{
+			name:      "HappyPath",
+			parent:    "staff",
+			child:     "emea",
+			ancestors: map[string][]string{"staff": {"everyone"}},
+			wantAdd:   true,
+		},
+		{
+			name:    "Self",
+			parent:  "staff",
+			child:   "staff",
+			wantErr: group.GroupCycle,
+		},
+		{
+			name:      "Indirect_Cycle",
+			parent:    "emea",
+			child:     "everyone",
+			ancestors: map[string][]string{"emea": {"staff"}, "staff": {"everyone"}},
+			wantErr:   group.GroupCycle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(gomock.Any()).Return(`{"name":"x"}`, nil).AnyTimes()
+			ds.EXPECT().GetSetMembers(gomock.Any()).DoAndReturn(func(key string) ([]string, error) {
+				return tt.ancestors[key[len("groupparents_"):]], nil
+			}).AnyTimes()
+			if tt.wantAdd {
+				ds.EXPECT().AddSetMember("groupgroups_"+tt.parent, tt.child).Return(nil)
+				ds.EXPECT().AddSetMember("groupparents_"+tt.child, tt.parent).Return(nil)
+			}
+
+			svc := &GroupSVCImpl{
+				ds: ds,
+			}
+			if err := svc.AddSubgroup(tt.parent, tt.child); err != tt.wantErr {
+				t.Errorf("AddSubgroup() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestGroupSVCImpl_GroupsForUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		sets       map[string][]string
+		wantGroups []string
+	}{
+		{
+			name:       "No_Groups",
+			sets:       map[string][]string{},
+			wantGroups: []string{},
+		},
+		{
+			name: "Nested",
+			sets: map[string][]string{
+				"usergroups_joehrke":   {"support", "emea"},
+				"groupparents_emea":    {"staff"},
+				"groupparents_staff":   {"everyone"},
+				"groupparents_support": {"staff"},
+			},
+			wantGroups: []string{"emea", "everyone", "staff", "support"},
+		},
+		{
+			name: "Stored_Cycle",
+			sets: map[string][]string{
+				"usergroups_joehrke": {"a"},
+				"groupparents_a":     {"b"},
+				"groupparents_b":     {"a"},
+			},
+			wantGroups: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetSetMembers(gomock.Any()).DoAndReturn(func(key string) ([]string, error) {
+				return append([]string{}, tt.sets[key]...), nil
+			}).AnyTimes()
+
+			svc := &GroupSVCImpl{
+				ds: ds,
+			}
+			got, err := svc.GroupsForUser("Joehrke")
+			if err != nil {
+				t.Fatalf("GroupsForUser() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantGroups) {
+				t.Errorf("GroupsForUser() got = %v, want %v", got, tt.wantGroups)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestGroupSVCImpl_DeleteGroup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey("group_staff").Return(`{"name":"staff"}`, nil)
+	ds.EXPECT().GetSetMembers("groupusers_staff").Return([]string{"joehrke"}, nil)
+	ds.EXPECT().GetSetMembers("groupgroups_staff").Return([]string{"emea"}, nil)
+	ds.EXPECT().GetSetMembers("groupparents_staff").Return([]string{"everyone"}, nil)
+	ds.EXPECT().RemoveSetMember("usergroups_joehrke", "staff").Return(nil)
+	ds.EXPECT().RemoveSetMember("groupparents_emea", "staff").Return(nil)
+	ds.EXPECT().RemoveSetMember("groupgroups_everyone", "staff").Return(nil)
+	for _, key := range []string{"groupusers_staff", "groupgroups_staff", "groupparents_staff", "group_staff"} {
+		ds.EXPECT().DelKey(key).Return(nil)
+	}
+	ds.EXPECT().RemoveSetMember(groupIndexKey, "staff").Return(nil)
+
+	svc := &GroupSVCImpl{
+		ds: ds,
+	}
+	if err := svc.DeleteGroup("staff"); err != nil {
+		t.Errorf("DeleteGroup() error = %v", err)
+	}
+	ctrl.Finish()
+}
+
+func TestGroupSVCImpl_RenameUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetSetMembers("usergroups_joehrke").Return([]string{"staff", "admins"}, nil)
+	for _, name := range []string{"admins", "staff"} {
+		ds.EXPECT().AddSetMember("groupusers_"+name, "jhrke").Return(nil)
+		ds.EXPECT().AddSetMember("usergroups_jhrke", name).Return(nil)
+		ds.EXPECT().RemoveSetMember("groupusers_"+name, "joehrke").Return(nil)
+	}
+	ds.EXPECT().DelKey("usergroups_joehrke").Return(nil)
+
+	svc := &GroupSVCImpl{
+		ds: ds,
+	}
+	moved, err := svc.RenameUser("joehrke", "jhrke")
+	if err != nil || moved != 2 {
+		t.Errorf("RenameUser() = %v, %v, want 2 groups", moved, err)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,65 @@
+package invitation
+
+import "time"
+
+//go:generate mockgen -source=invitationsvc.go -destination=../../../gen/mocks/mock_invitation/invitationsvc.go -self_package=../pkg/invitation
+
+// TokenPrefix starts every invitation token, tokens are inv_<invitation id>_<secret>
+const TokenPrefix = "inv_"
+
+// Registration modes decide who may create an account through the public registration route
+const (
+	// RegistrationOpen lets anyone register, an invitation is optional and only adds its roles
+	RegistrationOpen = "open"
+	// RegistrationInvite requires an invitation to register
+	RegistrationInvite = "invite"
+	// RegistrationClosed turns public registration off, accounts can only be imported by an admin
+	RegistrationClosed = "closed"
+)
+
+// ValidRegistrationMode reports whether mode is one of the registration modes
+func ValidRegistrationMode(mode string) bool {
+	return mode == RegistrationOpen || mode == RegistrationInvite || mode == RegistrationClosed
+}
+
+// Invitation describes an invitation to register without its secret, which is only ever returned by
+// CreateInvitation
+type Invitation struct {
+	Id string `json:"id"`
+	// Email binds the invitation to an address, registrations with it must use that address
+	Email string `json:"email,omitempty"`
+	// Roles are assigned to every user that registers with the invitation
+	Roles []string `json:"roles,omitempty"`
+	// MaxUses is how many registrations the invitation allows, 0 for no limit
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type InvitationSVC interface {
+	// CreateInvitation issues an invitation.  A maxUses of 0 allows any number of registrations and a ttl of 0 or less
+	// creates one that doesn't expire.  The returned token is the only copy of its secret, only a hash is stored.
+	CreateInvitation(email string, roles []string, maxUses int, ttl time.Duration) (token string, inv *Invitation, err error)
+	ListInvitations() ([]Invitation, error)
+	RevokeInvitation(id string) error
+	// Redeem takes one use of the invitation for a registration with the given email address.  An empty address is
+	// accepted for a bound invitation, the registration then takes the invitation's.
+	Redeem(token string, email string) (*Invitation, error)
+	// Release gives back a use taken by Redeem when the registration it was taken for failed
+	Release(id string) error
+}
+
+type InvitationError string
+
+func (e InvitationError) Error() string { return string(e) }
+
+const (
+	InvitationNotFound = InvitationError("invitation not found")
+	InvalidInvitation  = InvitationError("invalid or expired invitation")
+	EmailMismatch      = InvitationError("invitation is for a different email address")
+	InvitationBusy     = InvitationError("invitation is being redeemed, try again")
+	InvalidMaxUses     = InvitationError("maxUses can't be negative")
+	InvalidEmail       = InvitationError("invalid email")
+	UnknownRole        = InvitationError("invitation names a role that doesn't exist")
+)
@@ -0,0 +1,359 @@
+package invitationsvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/invitation"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/user"
+	"strings"
+	"time"
+)
+
+const (
+	invitationIndexKey = "invitations"
+	idBytes            = 8
+	secretBytes        = 32
+	// lockTTL bounds how long a crashed redemption can keep an invitation busy
+	lockTTL = 10 * time.Second
+)
+
+// storedInvitation is an invitation's description alongside the hash of its secret
+type storedInvitation struct {
+	invitation.Invitation
+	Hash string `json:"hash"`
+}
+
+type InvitationSVCImpl struct {
+	ds      datasource.Datasource
+	rbacSVC rbac.RbacSVC
+	now     func() time.Time
+}
+
+func NewInvitationSvc(ds datasource.Datasource, rbacSVC rbac.RbacSVC) invitation.InvitationSVC {
+	return &InvitationSVCImpl{
+		ds:      ds,
+		rbacSVC: rbacSVC,
+		now:     time.Now,
+	}
+}
+
+func (svc *InvitationSVCImpl) CreateInvitation(email string, roles []string, maxUses int, ttl time.Duration) (string, *invitation.Invitation, error) {
+	if maxUses < 0 {
+		return "", nil, invitation.InvalidMaxUses
+	}
+	if email != "" {
+		normalized, err := user.NormalizeEmail(email)
+		if err != nil {
+			return "", nil, invitation.InvalidEmail
+		}
+		email = normalized
+	}
+	err := svc.checkRoles(roles)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rawId, err := randomBytes(idBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomBytes(secretBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(rawId)
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	inv := invitation.Invitation{
+		Id:        id,
+		Email:     email,
+		Roles:     roles,
+		MaxUses:   maxUses,
+		CreatedAt: svc.now().UTC(),
+	}
+	if ttl > 0 {
+		expiresAt := inv.CreatedAt.Add(ttl)
+		inv.ExpiresAt = &expiresAt
+	} else {
+		ttl = 0
+	}
+	rawInvitation, err := json.Marshal(storedInvitation{Invitation: inv, Hash: hashSecret(encodedSecret)})
+	if err != nil {
+		log.Print("error marshaling invitation: " + err.Error())
+		return "", nil, err
+	}
+	written, err := svc.ds.SetKeyIfAbsent(generateInvitationKey(id), string(rawInvitation), ttl)
+	if err != nil {
+		log.Print("error writing invitation: " + err.Error())
+		return "", nil, err
+	}
+	if !written {
+		log.Print("generated invitation id already exists")
+		return "", nil, errors.New("generated invitation id already exists")
+	}
+	err = svc.ds.AddSetMember(invitationIndexKey, id)
+	if err != nil {
+		log.Print("error indexing invitation: " + err.Error())
+		return "", nil, err
+	}
+
+	return invitation.TokenPrefix + id + "_" + encodedSecret, &inv, nil
+}
+
+func (svc *InvitationSVCImpl) ListInvitations() ([]invitation.Invitation, error) {
+	ids, err := svc.ds.GetSetMembers(invitationIndexKey)
+	if err != nil {
+		log.Print("error fetching invitations: " + err.Error())
+		return nil, err
+	}
+
+	invitations := []invitation.Invitation{}
+	for _, id := range ids {
+		stored, err := svc.load(id)
+		if err == invitation.InvitationNotFound {
+			//expired invitations drop out of the datastore on their own, only their index entry is left to tidy
+			err = svc.ds.RemoveSetMember(invitationIndexKey, id)
+			if err != nil {
+				log.Print("error unindexing invitation: " + err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, stored.Invitation)
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].CreatedAt.Before(invitations[j].CreatedAt) })
+	return invitations, nil
+}
+
+func (svc *InvitationSVCImpl) RevokeInvitation(id string) error {
+	if !validId(id) {
+		return invitation.InvitationNotFound
+	}
+	//a redemption running alongside would write the invitation back after it was deleted
+	holder, err := svc.lock(id)
+	if err != nil {
+		return err
+	}
+	defer svc.unlock(id, holder)
+
+	_, err = svc.load(id)
+	if err != nil {
+		return err
+	}
+	err = svc.ds.DelKey(generateInvitationKey(id))
+	if err != nil {
+		log.Print("error deleting invitation: " + err.Error())
+		return err
+	}
+	err = svc.ds.RemoveSetMember(invitationIndexKey, id)
+	if err != nil {
+		log.Print("error unindexing invitation: " + err.Error())
+	}
+	return err
+}
+
+func (svc *InvitationSVCImpl) Redeem(token string, email string) (*invitation.Invitation, error) {
+	id, secret, ok := parseToken(token)
+	if !ok {
+		return nil, invitation.InvalidInvitation
+	}
+
+	//the use count is read and written back, so only one redemption of an invitation may run at a time
+	holder, err := svc.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer svc.unlock(id, holder)
+
+	stored, err := svc.load(id)
+	if err == invitation.InvitationNotFound {
+		return nil, invitation.InvalidInvitation
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(stored.Hash)) != 1 {
+		return nil, invitation.InvalidInvitation
+	}
+	now := svc.now().UTC()
+	if stored.ExpiresAt != nil && !now.Before(*stored.ExpiresAt) {
+		return nil, invitation.InvalidInvitation
+	}
+	if stored.MaxUses > 0 && stored.Uses >= stored.MaxUses {
+		return nil, invitation.InvalidInvitation
+	}
+	if stored.Email != "" && email != "" {
+		normalized, err := user.NormalizeEmail(email)
+		if err != nil || normalized != stored.Email {
+			return nil, invitation.EmailMismatch
+		}
+	}
+
+	stored.Uses++
+	err = svc.save(stored, now)
+	if err != nil {
+		return nil, err
+	}
+	return &stored.Invitation, nil
+}
+
+func (svc *InvitationSVCImpl) Release(id string) error {
+	holder, err := svc.lock(id)
+	if err != nil {
+		return err
+	}
+	defer svc.unlock(id, holder)
+
+	stored, err := svc.load(id)
+	if err == invitation.InvitationNotFound {
+		//revoked or expired in the meantime, there's nothing to give the use back to
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stored.Uses == 0 {
+		return nil
+	}
+	stored.Uses--
+	return svc.save(stored, svc.now().UTC())
+}
+
+func (svc *InvitationSVCImpl) checkRoles(roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	existing, err := svc.rbacSVC.ListRoles()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, role := range existing {
+		names[role.Name] = true
+	}
+	for _, role := range roles {
+		if !names[role] {
+			return invitation.UnknownRole
+		}
+	}
+	return nil
+}
+
+func (svc *InvitationSVCImpl) load(id string) (*storedInvitation, error) {
+	rawInvitation, err := svc.ds.GetKey(generateInvitationKey(id))
+	if err != nil {
+		log.Print("error fetching invitation: " + err.Error())
+		return nil, err
+	}
+	if rawInvitation == "" {
+		return nil, invitation.InvitationNotFound
+	}
+	stored := &storedInvitation{}
+	err = json.Unmarshal([]byte(rawInvitation), stored)
+	if err != nil {
+		log.Print("error unmarshaling invitation: " + err.Error())
+		return nil, err
+	}
+	return stored, nil
+}
+
+// save writes back a changed invitation, keeping whatever is left of its lifetime.  One that has run out is left for
+// the datastore to expire.
+func (svc *InvitationSVCImpl) save(stored *storedInvitation, now time.Time) error {
+	var ttl time.Duration
+	if stored.ExpiresAt != nil {
+		ttl = stored.ExpiresAt.Sub(now)
+		if ttl <= 0 {
+			return nil
+		}
+	}
+	rawInvitation, err := json.Marshal(stored)
+	if err != nil {
+		log.Print("error marshaling invitation: " + err.Error())
+		return err
+	}
+	err = svc.ds.SetKey(generateInvitationKey(stored.Id), string(rawInvitation), ttl)
+	if err != nil {
+		log.Print("error writing invitation: " + err.Error())
+	}
+	return err
+}
+
+func (svc *InvitationSVCImpl) lock(id string) (string, error) {
+	holder := uuid.New().String()
+	locked, err := svc.ds.SetKeyIfAbsent(generateLockKey(id), holder, lockTTL)
+	if err != nil {
+		log.Print("error locking invitation: " + err.Error())
+		return "", err
+	}
+	if !locked {
+		return "", invitation.InvitationBusy
+	}
+	return holder, nil
+}
+
+func (svc *InvitationSVCImpl) unlock(id string, holder string) {
+	current, err := svc.ds.GetKey(generateLockKey(id))
+	if err == nil && current == holder {
+		err = svc.ds.DelKey(generateLockKey(id))
+	}
+	if err != nil {
+		log.Printf("error releasing invitation lock: %v", err.Error())
+	}
+}
+
+// parseToken splits a presented token into its invitation id and secret.  The id is hex, so the first underscore
+// after the prefix ends it even though the base64url secret may contain more.
+func parseToken(token string) (id string, secret string, ok bool) {
+	if !strings.HasPrefix(token, invitation.TokenPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, invitation.TokenPrefix), "_", 2)
+	if len(parts) != 2 || !validId(parts[0]) || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func validId(id string) bool {
+	if len(id) != 2*idBytes {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) ([]byte, error) {
+	raw := make([]byte, n)
+	_, err := rand.Read(raw)
+	if err != nil {
+		log.Print("error generating invitation: " + err.Error())
+		return nil, err
+	}
+	return raw, nil
+}
+
+func generateInvitationKey(id string) string {
+	return "invitation_" + id
+}
+
+func generateLockKey(id string) string {
+	return "invitationlock_" + id
+}
@@ -0,0 +1,172 @@
+package invitationsvc
+
+import (
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_rbac"
+	"sso-v2/internal/service/invitation"
+	"sso-v2/internal/service/rbac"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvitationSVCImpl_CreateInvitation(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name      string
+		email     string
+		roles     []string
+		maxUses   int
+		wantEmail string
+		wantErr   error
+	}{
+		{name: "Bound_Email", email: "Joe@Example.com", roles: []string{"editor"}, maxUses: 1, wantEmail: "joe@example.com"},
+		{name: "Unbound_Unlimited"},
+		{name: "Negative_Uses", maxUses: -1, wantErr: invitation.InvalidMaxUses},
+		{name: "Invalid_Email", email: "not an email", wantErr: invitation.InvalidEmail},
+		{name: "Unknown_Role", roles: []string{"editor", "owner"}, wantErr: invitation.UnknownRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			rbacSvc := mock_rbac.NewMockRbacSVC(ctrl)
+			if len(tt.roles) > 0 {
+				rbacSvc.EXPECT().ListRoles().Return([]rbac.Role{{Name: "editor"}}, nil)
+			}
+			var stored storedInvitation
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKeyIfAbsent(gomock.Any(), gomock.Any(), time.Hour).DoAndReturn(func(key string, val string, timeout time.Duration) (bool, error) {
+					if err := json.Unmarshal([]byte(val), &stored); err != nil {
+						t.Fatal(err)
+					}
+					if key != generateInvitationKey(stored.Id) {
+						t.Errorf("CreateInvitation() stored under %v, want %v", key, generateInvitationKey(stored.Id))
+					}
+					return true, nil
+				})
+				ds.EXPECT().AddSetMember(invitationIndexKey, gomock.Any()).Return(nil)
+			}
+
+			svc := &InvitationSVCImpl{ds: ds, rbacSVC: rbacSvc, now: func() time.Time { return now }}
+			tok, inv, err := svc.CreateInvitation(tt.email, tt.roles, tt.maxUses, time.Hour)
+			if err != tt.wantErr {
+				t.Fatalf("CreateInvitation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				id, secret, ok := parseToken(tok)
+				if !ok || id != inv.Id || !strings.HasPrefix(tok, invitation.TokenPrefix) {
+					t.Errorf("CreateInvitation() returned malformed token %v for id %v", tok, inv.Id)
+				}
+				if stored.Hash != hashSecret(secret) {
+					t.Errorf("CreateInvitation() stored hash %v doesn't match the secret", stored.Hash)
+				}
+				if inv.Email != tt.wantEmail || stored.Email != tt.wantEmail {
+					t.Errorf("CreateInvitation() email = %v, want %v", inv.Email, tt.wantEmail)
+				}
+				if inv.ExpiresAt == nil || !inv.ExpiresAt.Equal(now.Add(time.Hour)) {
+					t.Errorf("CreateInvitation() expiry = %v, want %v", inv.ExpiresAt, now.Add(time.Hour))
+				}
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestInvitationSVCImpl_Redeem(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	const id = "0011223344556677"
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+	storeInvitation := func(inv invitation.Invitation) string {
+		inv.Id = id
+		raw, _ := json.Marshal(storedInvitation{Invitation: inv, Hash: hashSecret("secret")})
+		return string(raw)
+	}
+	tests := []struct {
+		name     string
+		token    string
+		email    string
+		busy     bool
+		stored   string
+		wantSave time.Duration
+		wantUses int
+		wantErr  error
+	}{
+		{name: "Valid", token: "inv_" + id + "_secret", stored: storeInvitation(invitation.Invitation{MaxUses: 2, Uses: 1}), wantUses: 2},
+		{name: "Valid_Expiring", token: "inv_" + id + "_secret", stored: storeInvitation(invitation.Invitation{ExpiresAt: &later}), wantSave: time.Hour, wantUses: 1},
+		{name: "Bound_Email", token: "inv_" + id + "_secret", email: "Joe@Example.com", stored: storeInvitation(invitation.Invitation{Email: "joe@example.com"}), wantUses: 1},
+		{name: "Bound_Email_Omitted", token: "inv_" + id + "_secret", stored: storeInvitation(invitation.Invitation{Email: "joe@example.com"}), wantUses: 1},
+		{name: "Email_Mismatch", token: "inv_" + id + "_secret", email: "eve@example.com", stored: storeInvitation(invitation.Invitation{Email: "joe@example.com"}), wantErr: invitation.EmailMismatch},
+		{name: "Wrong_Secret", token: "inv_" + id + "_guess", stored: storeInvitation(invitation.Invitation{}), wantErr: invitation.InvalidInvitation},
+		{name: "Expired", token: "inv_" + id + "_secret", stored: storeInvitation(invitation.Invitation{ExpiresAt: &earlier}), wantErr: invitation.InvalidInvitation},
+		{name: "Used_Up", token: "inv_" + id + "_secret", stored: storeInvitation(invitation.Invitation{MaxUses: 1, Uses: 1}), wantErr: invitation.InvalidInvitation},
+		{name: "Revoked", token: "inv_" + id + "_secret", wantErr: invitation.InvalidInvitation},
+		{name: "Busy", token: "inv_" + id + "_secret", busy: true, wantErr: invitation.InvitationBusy},
+		{name: "Malformed", token: "inv_nothex_secret", wantErr: invitation.InvalidInvitation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.token != "inv_nothex_secret" {
+				var holder string
+				ds.EXPECT().SetKeyIfAbsent(generateLockKey(id), gomock.Any(), lockTTL).DoAndReturn(func(key string, val string, timeout time.Duration) (bool, error) {
+					holder = val
+					return !tt.busy, nil
+				})
+				if !tt.busy {
+					ds.EXPECT().GetKey(generateInvitationKey(id)).Return(tt.stored, nil)
+					ds.EXPECT().GetKey(generateLockKey(id)).DoAndReturn(func(key string) (string, error) { return holder, nil })
+					ds.EXPECT().DelKey(generateLockKey(id)).Return(nil)
+				}
+			}
+			var saved storedInvitation
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKey(generateInvitationKey(id), gomock.Any(), tt.wantSave).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+					return json.Unmarshal([]byte(val), &saved)
+				})
+			}
+
+			svc := &InvitationSVCImpl{ds: ds, now: func() time.Time { return now }}
+			inv, err := svc.Redeem(tt.token, tt.email)
+			if err != tt.wantErr {
+				t.Fatalf("Redeem() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (inv.Uses != tt.wantUses || saved.Uses != tt.wantUses || saved.Hash != hashSecret("secret")) {
+				t.Errorf("Redeem() uses = %v, saved %+v, want %v uses", inv.Uses, saved, tt.wantUses)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestInvitationSVCImpl_Release(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	const id = "0011223344556677"
+
+	var holder string
+	ds.EXPECT().SetKeyIfAbsent(generateLockKey(id), gomock.Any(), lockTTL).DoAndReturn(func(key string, val string, timeout time.Duration) (bool, error) {
+		holder = val
+		return true, nil
+	})
+	ds.EXPECT().GetKey(generateInvitationKey(id)).Return(`{"id":"`+id+`","maxUses":1,"uses":1,"hash":"h"}`, nil)
+	ds.EXPECT().SetKey(generateInvitationKey(id), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+		if !strings.Contains(val, `"uses":0`) || !strings.Contains(val, `"hash":"h"`) {
+			t.Errorf("Release() saved %v, want the use given back", val)
+		}
+		return nil
+	})
+	ds.EXPECT().GetKey(generateLockKey(id)).DoAndReturn(func(key string) (string, error) { return holder, nil })
+	ds.EXPECT().DelKey(generateLockKey(id)).Return(nil)
+
+	svc := &InvitationSVCImpl{ds: ds, now: time.Now}
+	err := svc.Release(id)
+	if err != nil {
+		t.Errorf("Release() unexpected error = %v", err)
+	}
+	ctrl.Finish()
+}
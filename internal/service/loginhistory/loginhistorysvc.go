@@ -0,0 +1,52 @@
+package loginhistory
+
+import "time"
+
+//go:generate mockgen -source=loginhistorysvc.go -destination=../../../gen/mocks/mock_loginhistory/loginhistorysvc.go -self_package=../pkg/loginhistory
+
+// MaxLoginsPerUser is how many authentication attempts are kept for each user, older ones are dropped as new ones arrive
+const MaxLoginsPerUser = 100
+
+// Factors an attempt was made with
+const (
+	FactorPassword     = "password"
+	FactorTOTP         = "totp"
+	FactorRecoveryCode = "recoveryCode"
+	FactorOIDC         = "oidc"
+	FactorLoginLink    = "loginLink"
+)
+
+// Results of an attempt
+const (
+	// ResultSuccess means a session was created
+	ResultSuccess = "success"
+	// ResultPasswordChangeRequired means a session restricted to changing the password was created
+	ResultPasswordChangeRequired = "passwordChangeRequired"
+	// ResultMfaRequired means the factor was right and a second one was asked for
+	ResultMfaRequired = "mfaRequired"
+	// ResultFailure means the factor was wrong
+	ResultFailure = "failure"
+	// ResultBlocked means the factor was right but the account can't log in in its current state
+	ResultBlocked = "blocked"
+)
+
+// Login is one authentication attempt against a user
+type Login struct {
+	Time      time.Time `json:"time"`
+	Result    string    `json:"result"`
+	Factor    string    `json:"factor"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	// SessionId is the session the attempt created, if any
+	SessionId string `json:"sessionId,omitempty"`
+}
+
+type LoginHistorySVC interface {
+	Record(username string, login Login) error
+	// LoginsFor returns the user's recorded attempts, newest first
+	LoginsFor(username string) ([]Login, error)
+	// PurgeUser deletes the user's login history, returning how many attempts were removed
+	PurgeUser(username string) (int, error)
+	// RenameUser moves the user's login history to their new username, returning how many attempts moved
+	RenameUser(username string, newUsername string) (int, error)
+}
@@ -0,0 +1,90 @@
+package loginhistorysvc
+
+import (
+	"encoding/json"
+	"log"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/loginhistory"
+)
+
+type LoginHistorySVCImpl struct {
+	ds datasource.Datasource
+}
+
+func NewLoginHistorySvc(ds datasource.Datasource) loginhistory.LoginHistorySVC {
+	return &LoginHistorySVCImpl{ds: ds}
+}
+
+func (svc *LoginHistorySVCImpl) Record(username string, login loginhistory.Login) error {
+	rawLogin, err := json.Marshal(login)
+	if err != nil {
+		log.Print("error marshaling login: " + err.Error())
+		return err
+	}
+	return svc.ds.PushListItem(generateLoginsKey(username), string(rawLogin), loginhistory.MaxLoginsPerUser)
+}
+
+func (svc *LoginHistorySVCImpl) LoginsFor(username string) ([]loginhistory.Login, error) {
+	rawLogins, err := svc.ds.GetListItems(generateLoginsKey(username), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	logins := make([]loginhistory.Login, 0, len(rawLogins))
+	for _, rawLogin := range rawLogins {
+		login := loginhistory.Login{}
+		err = json.Unmarshal([]byte(rawLogin), &login)
+		if err != nil {
+			log.Print("error unmarshaling login: " + err.Error())
+			return nil, err
+		}
+		logins = append(logins, login)
+	}
+	return logins, nil
+}
+
+func (svc *LoginHistorySVCImpl) PurgeUser(username string) (int, error) {
+	rawLogins, err := svc.ds.GetListItems(generateLoginsKey(username), 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	err = svc.ds.DelKey(generateLoginsKey(username))
+	if err != nil {
+		log.Print("error deleting login history: " + err.Error())
+		return 0, err
+	}
+	return len(rawLogins), nil
+}
+
+func (svc *LoginHistorySVCImpl) RenameUser(username string, newUsername string) (int, error) {
+	rawLogins, err := svc.ds.GetListItems(generateLoginsKey(username), 0, -1)
+	if err != nil {
+		return 0, err
+	}
+
+	//attempts already under the new name belonged to someone else, they mustn't be merged into this user's history
+	err = svc.ds.DelKey(generateLoginsKey(newUsername))
+	if err != nil {
+		log.Print("error clearing login history: " + err.Error())
+		return 0, err
+	}
+
+	//pushing oldest first keeps the history newest first under its new key
+	for i := len(rawLogins) - 1; i >= 0; i-- {
+		err = svc.ds.PushListItem(generateLoginsKey(newUsername), rawLogins[i], loginhistory.MaxLoginsPerUser)
+		if err != nil {
+			log.Print("error moving login: " + err.Error())
+			return 0, err
+		}
+	}
+	err = svc.ds.DelKey(generateLoginsKey(username))
+	if err != nil {
+		log.Print("error deleting login history: " + err.Error())
+		return 0, err
+	}
+	return len(rawLogins), nil
+}
+
+func generateLoginsKey(username string) string {
+	return "logins_" + username
+}
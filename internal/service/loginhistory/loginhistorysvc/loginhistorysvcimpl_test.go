@@ -0,0 +1,94 @@
+package loginhistorysvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/loginhistory"
+	"testing"
+	"time"
+)
+
+func TestLoginHistorySVCImpl_Record(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().PushListItem("logins_joehrke", `{"time":"2020-01-02T03:04:05Z","result":"success","factor":"password","ip":"10.0.0.1","userAgent":"curl/7.64.1","sessionId":"sess-1"}`, int64(loginhistory.MaxLoginsPerUser)).Return(nil)
+
+	svc := &LoginHistorySVCImpl{
+		ds: ds,
+	}
+	login := loginhistory.Login{
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Result:    loginhistory.ResultSuccess,
+		Factor:    loginhistory.FactorPassword,
+		IP:        "10.0.0.1",
+		UserAgent: "curl/7.64.1",
+		SessionId: "sess-1",
+	}
+	if err := svc.Record("joehrke", login); err != nil {
+		t.Errorf("Record() unexpected error = %v", err)
+	}
+	ctrl.Finish()
+}
+
+func TestLoginHistorySVCImpl_LoginsFor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("logins_joehrke", int64(0), int64(-1)).Return([]string{
+		`{"time":"2020-01-02T03:05:00Z","result":"success","factor":"totp","sessionId":"sess-1"}`,
+		`{"time":"2020-01-02T03:04:05Z","result":"mfaRequired","factor":"password"}`,
+	}, nil)
+
+	svc := &LoginHistorySVCImpl{
+		ds: ds,
+	}
+	got, err := svc.LoginsFor("joehrke")
+	if err != nil {
+		t.Fatalf("LoginsFor() unexpected error = %v", err)
+	}
+	want := []loginhistory.Login{
+		{Time: time.Date(2020, 1, 2, 3, 5, 0, 0, time.UTC), Result: loginhistory.ResultSuccess, Factor: loginhistory.FactorTOTP, SessionId: "sess-1"},
+		{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Result: loginhistory.ResultMfaRequired, Factor: loginhistory.FactorPassword},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoginsFor() got = %v, want %v", got, want)
+	}
+	ctrl.Finish()
+}
+
+func TestLoginHistorySVCImpl_PurgeUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("logins_joehrke", int64(0), int64(-1)).Return([]string{`{}`, `{}`}, nil)
+	ds.EXPECT().DelKey("logins_joehrke").Return(nil)
+
+	svc := &LoginHistorySVCImpl{
+		ds: ds,
+	}
+	removed, err := svc.PurgeUser("joehrke")
+	if err != nil || removed != 2 {
+		t.Errorf("PurgeUser() = %v, %v, want 2, nil", removed, err)
+	}
+	ctrl.Finish()
+}
+
+func TestLoginHistorySVCImpl_RenameUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetListItems("logins_joehrke", int64(0), int64(-1)).Return([]string{`{"result":"failure"}`, `{"result":"success"}`}, nil)
+	gomock.InOrder(
+		ds.EXPECT().DelKey("logins_jhrke").Return(nil),
+		ds.EXPECT().PushListItem("logins_jhrke", `{"result":"success"}`, int64(loginhistory.MaxLoginsPerUser)).Return(nil),
+		ds.EXPECT().PushListItem("logins_jhrke", `{"result":"failure"}`, int64(loginhistory.MaxLoginsPerUser)).Return(nil),
+		ds.EXPECT().DelKey("logins_joehrke").Return(nil),
+	)
+
+	svc := &LoginHistorySVCImpl{
+		ds: ds,
+	}
+	moved, err := svc.RenameUser("joehrke", "jhrke")
+	if err != nil || moved != 2 {
+		t.Errorf("RenameUser() = %v, %v, want 2, nil", moved, err)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,67 @@
+package mfa
+
+import "time"
+
+//go:generate mockgen -source=mfasvc.go -destination=../../../gen/mocks/mock_mfa/mfasvc.go -self_package=../pkg/mfa
+
+const (
+	// ChallengeTTL is how long a user has after a correct password to supply their second factor
+	ChallengeTTL         = 5 * time.Minute
+	MaxChallengeAttempts = 5
+	// RecoveryCodeCount is how many single-use recovery codes are issued at a time
+	RecoveryCodeCount = 10
+)
+
+// TOTPEnrollment is everything an authenticator app needs to be set up, QRCode is a PNG of the URI
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode []byte `json:"qrCode"`
+}
+
+// ChallengeResult is who a challenge was issued for and how it was answered
+type ChallengeResult struct {
+	Username string
+	// FirstFactor is the login factor the user passed to get the challenge, as given to CreateChallenge
+	FirstFactor string
+	// Recovery reports that a recovery code was given instead of an authenticator code
+	Recovery bool
+}
+
+type MfaSVC interface {
+	// BeginTOTPEnrollment generates a new secret for the user, it isn't used for authentication until confirmed
+	BeginTOTPEnrollment(username string) (*TOTPEnrollment, error)
+	// ConfirmTOTPEnrollment enables the pending secret and returns a fresh set of recovery codes, these are the only
+	// time the codes are available in plain text
+	ConfirmTOTPEnrollment(username string, code string) (recoveryCodes []string, err error)
+	// DisableTOTP turns the second factor off, code may be an authenticator code or a recovery code
+	DisableTOTP(username string, code string) error
+	// RegenerateRecoveryCodes replaces all of the user's recovery codes, code may be an authenticator code or a
+	// recovery code
+	RegenerateRecoveryCodes(username string, code string) (recoveryCodes []string, err error)
+	// CreateChallenge starts the second step of authentication for a user who has passed the first, firstFactor is
+	// handed back when the challenge is completed
+	CreateChallenge(username string, firstFactor string) (challenge string, err error)
+	// CompleteChallenge checks a code against an outstanding challenge, returning who it was issued for.  A recovery
+	// code is accepted in place of an authenticator code and is used up.  The result is returned with InvalidCode as
+	// well, so the failed attempt can be attributed.
+	CompleteChallenge(challenge string, code string) (result *ChallengeResult, err error)
+	// PurgeUser deletes the user's outstanding challenges and used code records, returning how many keys were removed.
+	// The authenticator secret and recovery codes live on the user record and go with it.
+	PurgeUser(username string) (int, error)
+	// RenameUser moves the user's used code records to their new username, so a code spent under the old name can't be
+	// replayed under the new one, and drops their outstanding challenges, which name the old username.  It returns how
+	// many keys were moved or dropped.
+	RenameUser(username string, newUsername string) (int, error)
+}
+
+type MfaError string
+
+func (e MfaError) Error() string { return string(e) }
+
+const (
+	AlreadyEnrolled  = MfaError("two-factor authentication already enabled")
+	NotEnrolled      = MfaError("two-factor authentication not enabled")
+	InvalidCode      = MfaError("invalid code")
+	InvalidChallenge = MfaError("invalid or expired challenge")
+)
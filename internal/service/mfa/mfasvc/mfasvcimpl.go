@@ -0,0 +1,379 @@
+package mfasvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"log"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/mfa/totp"
+	"sso-v2/internal/service/user"
+	"strings"
+	"time"
+)
+
+const (
+	challengeBytes = 32
+	qrCodeSize     = 256
+)
+
+type MfaSVCImpl struct {
+	ds      datasource.Datasource
+	userSvc user.UserSVC
+	issuer  string
+	now     func() time.Time
+}
+
+// NewMfaSvc builds the second factor service, issuer is the account name authenticator apps show next to the code
+func NewMfaSvc(ds datasource.Datasource, userSvc user.UserSVC, issuer string) mfa.MfaSVC {
+	return &MfaSVCImpl{
+		ds:      ds,
+		userSvc: userSvc,
+		issuer:  issuer,
+		now:     time.Now,
+	}
+}
+
+type challengeData struct {
+	Username    string    `json:"username"`
+	FirstFactor string    `json:"firstFactor,omitempty"`
+	Attempts    int       `json:"attempts"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func (svc *MfaSVCImpl) BeginTOTPEnrollment(username string) (*mfa.TOTPEnrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Print("error generating totp secret: " + err.Error())
+		return nil, err
+	}
+
+	var account string
+	err = svc.userSvc.UpdateUser(username, func(u *user.UserData) error {
+		if u.MFAEnabled() {
+			return mfa.AlreadyEnrolled
+		}
+		//restarting an unconfirmed enrollment just replaces the pending secret
+		u.TOTP = &user.TOTPSettings{Secret: secret}
+		account = u.Username
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uri := totp.KeyURI(svc.issuer, account, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		log.Print("error rendering totp qr code: " + err.Error())
+		return nil, err
+	}
+
+	return &mfa.TOTPEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: png,
+	}, nil
+}
+
+func (svc *MfaSVCImpl) ConfirmTOTPEnrollment(username string, code string) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Print("error generating recovery codes: " + err.Error())
+		return nil, err
+	}
+
+	err = svc.userSvc.UpdateUser(username, func(u *user.UserData) error {
+		if u.TOTP == nil {
+			return mfa.NotEnrolled
+		}
+		if u.TOTP.Confirmed {
+			return mfa.AlreadyEnrolled
+		}
+		err := svc.checkCode(u, code)
+		if err != nil {
+			return err
+		}
+		u.TOTP.Confirmed = true
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (svc *MfaSVCImpl) DisableTOTP(username string, code string) error {
+	return svc.userSvc.UpdateUser(username, func(u *user.UserData) error {
+		if !u.MFAEnabled() {
+			return mfa.NotEnrolled
+		}
+		err := svc.checkSecondFactor(u, code)
+		if err != nil {
+			return err
+		}
+		u.TOTP = nil
+		u.RecoveryCodes = nil
+		return nil
+	})
+}
+
+func (svc *MfaSVCImpl) RegenerateRecoveryCodes(username string, code string) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Print("error generating recovery codes: " + err.Error())
+		return nil, err
+	}
+
+	err = svc.userSvc.UpdateUser(username, func(u *user.UserData) error {
+		if !u.MFAEnabled() {
+			return mfa.NotEnrolled
+		}
+		err := svc.checkSecondFactor(u, code)
+		if err != nil {
+			return err
+		}
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (svc *MfaSVCImpl) CreateChallenge(username string, firstFactor string) (string, error) {
+	raw := make([]byte, challengeBytes)
+	_, err := rand.Read(raw)
+	if err != nil {
+		log.Print("error generating challenge: " + err.Error())
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+
+	err = svc.storeChallenge(challenge, &challengeData{
+		Username:    username,
+		FirstFactor: firstFactor,
+		ExpiresAt:   svc.now().Add(mfa.ChallengeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// CompleteChallenge takes the challenge before looking at the code, so concurrent attempts can't both count from the
+// same stored state or both use it.  A wrong code puts the challenge back with the miss counted, anything else ends it.
+func (svc *MfaSVCImpl) CompleteChallenge(challenge string, code string) (*mfa.ChallengeResult, error) {
+	rawChallenge, err := svc.ds.TakeKey(generateChallengeKey(challenge))
+	if err != nil {
+		log.Print("error taking challenge: " + err.Error())
+		return nil, err
+	}
+	if rawChallenge == "" {
+		return nil, mfa.InvalidChallenge
+	}
+	chal := &challengeData{}
+	err = json.Unmarshal([]byte(rawChallenge), chal)
+	if err != nil {
+		log.Print("error unmarshaling challenge: " + err.Error())
+		return nil, err
+	}
+
+	result := &mfa.ChallengeResult{Username: chal.Username, FirstFactor: chal.FirstFactor, Recovery: isRecoveryCode(code)}
+	if result.Recovery {
+		//a recovery code is used up, so checking it has to go through a user update
+		err = svc.userSvc.UpdateUser(chal.Username, func(u *user.UserData) error {
+			return svc.checkSecondFactor(u, code)
+		})
+	} else {
+		var u *user.UserData
+		u, err = svc.userSvc.GetUser(chal.Username)
+		if err == nil {
+			err = svc.checkCode(u, code)
+		}
+	}
+	if err == user.NotFound {
+		return nil, mfa.InvalidChallenge
+	}
+	if err == mfa.InvalidCode {
+		//count the miss, and throw the challenge away once it has been guessed at too often
+		chal.Attempts++
+		if chal.Attempts < mfa.MaxChallengeAttempts {
+			err = svc.storeChallenge(challenge, chal)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, mfa.InvalidCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checkSecondFactor accepts either an authenticator code or one of the user's recovery codes, a recovery code is removed
+// from u so the caller must store the user afterwards
+func (svc *MfaSVCImpl) checkSecondFactor(u *user.UserData, code string) error {
+	if isRecoveryCode(code) {
+		err := useRecoveryCode(u, code)
+		if err != nil {
+			return err
+		}
+		return svc.claimRecoveryCode(code)
+	}
+	return svc.checkCode(u, code)
+}
+
+// claimRecoveryCode marks a recovery code as spent.  Dropping it from the user is a read then a write, so two
+// concurrent redemptions could both find it; only the one that claims it first gets through.  The claim never expires,
+// a lost update to the user could otherwise bring the code back.
+func (svc *MfaSVCImpl) claimRecoveryCode(code string) error {
+	fresh, err := svc.ds.SetKeyIfAbsent(generateUsedRecoveryKey(code), "1", 0)
+	if err != nil {
+		log.Print("error recording used recovery code: " + err.Error())
+		return err
+	}
+	if !fresh {
+		return mfa.InvalidCode
+	}
+	return nil
+}
+
+// checkCode validates a TOTP code for the user and burns its time step so the same code can't be replayed
+func (svc *MfaSVCImpl) checkCode(u *user.UserData, code string) error {
+	if u.TOTP == nil {
+		return mfa.NotEnrolled
+	}
+	step, ok := totp.Validate(u.TOTP.Secret, code, svc.now())
+	if !ok {
+		return mfa.InvalidCode
+	}
+
+	//codes stay valid across the whole skew window, so remember the step for at least that long
+	window := time.Duration(2*totp.Skew+1) * totp.StepPeriod
+	fresh, err := svc.ds.SetKeyIfAbsent(generateUsedCodeKey(u.Username, step), "1", window)
+	if err != nil {
+		log.Print("error recording used totp code: " + err.Error())
+		return err
+	}
+	if !fresh {
+		return mfa.InvalidCode
+	}
+	return nil
+}
+
+func (svc *MfaSVCImpl) storeChallenge(challenge string, chal *challengeData) error {
+	ttl := chal.ExpiresAt.Sub(svc.now())
+	if ttl <= 0 {
+		return svc.ds.DelKey(generateChallengeKey(challenge))
+	}
+
+	rawChallenge, err := json.Marshal(chal)
+	if err != nil {
+		log.Print("error marshaling challenge: " + err.Error())
+		return err
+	}
+	err = svc.ds.SetKey(generateChallengeKey(challenge), string(rawChallenge), ttl)
+	if err != nil {
+		log.Print("error writing challenge: " + err.Error())
+	}
+	return err
+}
+
+func (svc *MfaSVCImpl) PurgeUser(username string) (int, error) {
+	purged, err := svc.purgeChallenges(username)
+	if err != nil {
+		return purged, err
+	}
+
+	err = datasource.ScanAll(svc.ds, generateUsedCodeKey(username, "*"), func(key string) error {
+		err := svc.ds.DelKey(key)
+		if err == nil {
+			purged++
+		}
+		return err
+	})
+	if err != nil {
+		log.Print("error purging used codes: " + err.Error())
+	}
+	return purged, err
+}
+
+func (svc *MfaSVCImpl) purgeChallenges(username string) (int, error) {
+	purged := 0
+	//challenges are keyed by a hash of the challenge, only their contents name the user
+	err := datasource.ScanAll(svc.ds, "mfachal_*", func(key string) error {
+		rawChallenge, err := svc.ds.GetKey(key)
+		if err != nil || rawChallenge == "" {
+			return err
+		}
+		chal := &challengeData{}
+		if json.Unmarshal([]byte(rawChallenge), chal) != nil || chal.Username != username {
+			return nil
+		}
+		err = svc.ds.DelKey(key)
+		if err == nil {
+			purged++
+		}
+		return err
+	})
+	if err != nil {
+		log.Print("error purging challenges: " + err.Error())
+	}
+	return purged, err
+}
+
+func (svc *MfaSVCImpl) RenameUser(username string, newUsername string) (int, error) {
+	//a half finished login under the old name would end in a session for a user that no longer exists, so the user
+	//starts it again instead
+	changed, err := svc.purgeChallenges(username)
+	if err != nil {
+		return changed, err
+	}
+
+	prefix := generateUsedCodeKey(username, "")
+	err = datasource.ScanAll(svc.ds, generateUsedCodeKey(username, "*"), func(key string) error {
+		newKey := generateUsedCodeKey(newUsername, strings.TrimPrefix(key, prefix))
+		moved, err := svc.ds.RenameKeyIfAbsent(key, newKey)
+		if err != nil {
+			return err
+		}
+		//the step is already marked used under the new name, which is all the old record would have said
+		if !moved {
+			err = svc.ds.DelKey(key)
+			if err != nil {
+				return err
+			}
+		}
+		changed++
+		return nil
+	})
+	if err != nil {
+		log.Print("error moving used codes: " + err.Error())
+	}
+	return changed, err
+}
+
+func generateChallengeKey(challenge string) string {
+	sum := sha256.Sum256([]byte(challenge))
+	return "mfachal_" + hex.EncodeToString(sum[:])
+}
+
+// generateUsedRecoveryKey is keyed by the code's hash alone, the codes are random enough not to meet another user's
+func generateUsedRecoveryKey(code string) string {
+	return "recoveryused_" + hashRecoveryCode(code)
+}
+
+// generateUsedCodeKey ends the username with a colon, which usernames can't contain, so the keys of one user can be
+// matched without also catching a user whose name merely starts with theirs
+func generateUsedCodeKey(username string, step interface{}) string {
+	return fmt.Sprintf("totpused_%s:%v", username, step)
+}
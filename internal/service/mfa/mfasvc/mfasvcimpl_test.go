@@ -0,0 +1,432 @@
+package mfasvc
+
+import (
+	"bytes"
+	"github.com/golang/mock/gomock"
+	"path"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/mfa/totp"
+	"sso-v2/internal/service/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+var testNow = time.Unix(1600000000, 0)
+
+// expectUpdate wires UpdateUser on the mock to apply the update to a copy of stored, returning the copy so the test
+// can inspect what would have been written
+func expectUpdate(userSvc *mock_user.MockUserSVC, stored user.UserData) *user.UserData {
+	updated := stored
+	userSvc.EXPECT().UpdateUser("joehrke", gomock.Any()).DoAndReturn(func(username string, update func(u *user.UserData) error) error {
+		return update(&updated)
+	})
+	return &updated
+}
+
+func TestMfaSVCImpl_BeginTOTPEnrollment(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  user.UserData
+		wantErr error
+	}{
+		{
+			name:   "HappyPath",
+			stored: user.UserData{Username: "joehrke"},
+		},
+		{
+			name:   "Restart_Unconfirmed",
+			stored: user.UserData{Username: "joehrke", TOTP: &user.TOTPSettings{Secret: testSecret}},
+		},
+		{
+			name:    "Already_Enrolled",
+			stored:  user.UserData{Username: "joehrke", TOTP: &user.TOTPSettings{Secret: testSecret, Confirmed: true}},
+			wantErr: mfa.AlreadyEnrolled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			updated := expectUpdate(userSvc, tt.stored)
+
+			svc := &MfaSVCImpl{
+				userSvc: userSvc,
+				issuer:  "sso-v2",
+				now:     func() time.Time { return testNow },
+			}
+			got, err := svc.BeginTOTPEnrollment("joehrke")
+			if err != tt.wantErr {
+				t.Errorf("BeginTOTPEnrollment() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if updated.TOTP == nil || updated.TOTP.Secret != got.Secret || updated.TOTP.Confirmed {
+				t.Errorf("BeginTOTPEnrollment() stored %v, want pending secret %v", updated.TOTP, got.Secret)
+			}
+			if !strings.HasPrefix(got.URI, "otpauth://totp/sso-v2:joehrke?") {
+				t.Errorf("BeginTOTPEnrollment() unexpected uri %v", got.URI)
+			}
+			if !bytes.HasPrefix(got.QRCode, []byte("\x89PNG")) {
+				t.Errorf("BeginTOTPEnrollment() qr code isn't a PNG")
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestMfaSVCImpl_ConfirmTOTPEnrollment(t *testing.T) {
+	validCode, _ := totp.CodeAt(testSecret, totp.Step(testNow))
+	tests := []struct {
+		name          string
+		stored        user.UserData
+		code          string
+		expectUseMark bool
+		freshCode     bool
+		wantErr       error
+	}{
+		{
+			name:          "HappyPath",
+			stored:        user.UserData{Username: "joehrke", TOTP: &user.TOTPSettings{Secret: testSecret}},
+			code:          validCode,
+			expectUseMark: true,
+			freshCode:     true,
+		},
+		{
+			name:          "Replayed_Code",
+			stored:        user.UserData{Username: "joehrke", TOTP: &user.TOTPSettings{Secret: testSecret}},
+			code:          validCode,
+			expectUseMark: true,
+			freshCode:     false,
+			wantErr:       mfa.InvalidCode,
+		},
+		{
+			name:    "Wrong_Code",
+			stored:  user.UserData{Username: "joehrke", TOTP: &user.TOTPSettings{Secret: testSecret}},
+			code:    "000000",
+			wantErr: mfa.InvalidCode,
+		},
+		{
+			name:    "Not_Started",
+			stored:  user.UserData{Username: "joehrke"},
+			code:    validCode,
+			wantErr: mfa.NotEnrolled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			updated := expectUpdate(userSvc, tt.stored)
+			if tt.expectUseMark {
+				ds.EXPECT().SetKeyIfAbsent(generateUsedCodeKey("joehrke", totp.Step(testNow)), "1", 90*time.Second).Return(tt.freshCode, nil)
+			}
+
+			svc := &MfaSVCImpl{
+				ds:      ds,
+				userSvc: userSvc,
+				now:     func() time.Time { return testNow },
+			}
+			codes, err := svc.ConfirmTOTPEnrollment("joehrke", tt.code)
+			if err != tt.wantErr {
+				t.Errorf("ConfirmTOTPEnrollment() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if !updated.MFAEnabled() {
+				t.Errorf("ConfirmTOTPEnrollment() didn't enable mfa")
+			}
+			if len(codes) != mfa.RecoveryCodeCount || len(updated.RecoveryCodes) != mfa.RecoveryCodeCount {
+				t.Errorf("ConfirmTOTPEnrollment() issued %v codes and stored %v hashes, want %v", len(codes), len(updated.RecoveryCodes), mfa.RecoveryCodeCount)
+			}
+			for i, code := range codes {
+				if updated.RecoveryCodes[i] != hashRecoveryCode(code) {
+					t.Errorf("ConfirmTOTPEnrollment() stored hash %v doesn't match code %v", updated.RecoveryCodes[i], code)
+				}
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestMfaSVCImpl_RegenerateRecoveryCodes(t *testing.T) {
+	enrolled := user.UserData{
+		Username:      "joehrke",
+		TOTP:          &user.TOTPSettings{Secret: testSecret, Confirmed: true},
+		RecoveryCodes: []string{hashRecoveryCode("aaaaa-bbbbb"), hashRecoveryCode("ccccc-ddddd")},
+	}
+	tests := []struct {
+		name    string
+		stored  user.UserData
+		code    string
+		wantErr error
+	}{
+		{
+			name:   "HappyPath_Recovery_Code",
+			stored: enrolled,
+			code:   "CCCCC DDDDD",
+		},
+		{
+			name:    "Wrong_Recovery_Code",
+			stored:  enrolled,
+			code:    "eeeee-fffff",
+			wantErr: mfa.InvalidCode,
+		},
+		{
+			name:    "Not_Enrolled",
+			stored:  user.UserData{Username: "joehrke"},
+			code:    "aaaaa-bbbbb",
+			wantErr: mfa.NotEnrolled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			updated := expectUpdate(userSvc, tt.stored)
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKeyIfAbsent(generateUsedRecoveryKey(tt.code), "1", time.Duration(0)).Return(true, nil)
+			}
+
+			svc := &MfaSVCImpl{
+				ds:      ds,
+				userSvc: userSvc,
+				now:     func() time.Time { return testNow },
+			}
+			codes, err := svc.RegenerateRecoveryCodes("joehrke", tt.code)
+			if err != tt.wantErr {
+				t.Errorf("RegenerateRecoveryCodes() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if len(codes) != mfa.RecoveryCodeCount || len(updated.RecoveryCodes) != mfa.RecoveryCodeCount {
+				t.Errorf("RegenerateRecoveryCodes() issued %v codes and stored %v hashes, want %v", len(codes), len(updated.RecoveryCodes), mfa.RecoveryCodeCount)
+			}
+			for _, old := range enrolled.RecoveryCodes {
+				for _, hash := range updated.RecoveryCodes {
+					if hash == old {
+						t.Errorf("RegenerateRecoveryCodes() kept an old code")
+					}
+				}
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestMfaSVCImpl_CompleteChallenge(t *testing.T) {
+	validCode, _ := totp.CodeAt(testSecret, totp.Step(testNow))
+	expires := testNow.Add(mfa.ChallengeTTL).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name         string
+		code         string
+		recovery     bool
+		stored       string
+		expectWrite  string
+		wantUsername string
+		wantFactor   string
+		wantErr      error
+	}{
+		{
+			name:         "HappyPath",
+			code:         validCode,
+			stored:       `{"username":"joehrke","firstFactor":"password","attempts":0,"expiresAt":"` + expires + `"}`,
+			wantUsername: "joehrke",
+			wantFactor:   "password",
+		},
+		{
+			name:         "Wrong_Code",
+			code:         "000000",
+			stored:       `{"username":"joehrke","attempts":0,"expiresAt":"` + expires + `"}`,
+			expectWrite:  `{"username":"joehrke","attempts":1,"expiresAt":"` + expires + `"}`,
+			wantUsername: "joehrke",
+			wantErr:      mfa.InvalidCode,
+		},
+		{
+			name:         "Wrong_Code_Last_Attempt",
+			code:         "000000",
+			stored:       `{"username":"joehrke","attempts":4,"expiresAt":"` + expires + `"}`,
+			wantUsername: "joehrke",
+			wantErr:      mfa.InvalidCode,
+		},
+		{
+			name:         "HappyPath_Recovery_Code",
+			code:         "AAAAA-BBBBB",
+			recovery:     true,
+			stored:       `{"username":"joehrke","attempts":0,"expiresAt":"` + expires + `"}`,
+			wantUsername: "joehrke",
+		},
+		{
+			name:         "Wrong_Recovery_Code",
+			code:         "eeeee-fffff",
+			recovery:     true,
+			stored:       `{"username":"joehrke","attempts":0,"expiresAt":"` + expires + `"}`,
+			expectWrite:  `{"username":"joehrke","attempts":1,"expiresAt":"` + expires + `"}`,
+			wantUsername: "joehrke",
+			wantErr:      mfa.InvalidCode,
+		},
+		{
+			name:    "Unknown_Challenge",
+			code:    validCode,
+			stored:  "",
+			wantErr: mfa.InvalidChallenge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+
+			stored := user.UserData{
+				Username:      "joehrke",
+				TOTP:          &user.TOTPSettings{Secret: testSecret, Confirmed: true},
+				RecoveryCodes: []string{hashRecoveryCode("ccccc-ddddd"), hashRecoveryCode("aaaaa-bbbbb")},
+			}
+			var updated *user.UserData
+
+			key := generateChallengeKey("chal-123")
+			ds.EXPECT().TakeKey(key).Return(tt.stored, nil)
+			if tt.stored != "" && tt.recovery {
+				updated = expectUpdate(userSvc, stored)
+			} else if tt.stored != "" {
+				userSvc.EXPECT().GetUser("joehrke").Return(&stored, nil)
+			}
+			if tt.wantErr == nil {
+				if tt.recovery {
+					ds.EXPECT().SetKeyIfAbsent(generateUsedRecoveryKey(tt.code), "1", time.Duration(0)).Return(true, nil)
+				} else {
+					ds.EXPECT().SetKeyIfAbsent(generateUsedCodeKey("joehrke", totp.Step(testNow)), "1", gomock.Any()).Return(true, nil)
+				}
+			}
+			if tt.expectWrite != "" {
+				ds.EXPECT().SetKey(key, tt.expectWrite, mfa.ChallengeTTL).Return(nil)
+			}
+
+			svc := &MfaSVCImpl{
+				ds:      ds,
+				userSvc: userSvc,
+				now:     func() time.Time { return testNow },
+			}
+			got, err := svc.CompleteChallenge("chal-123", tt.code)
+			if err != tt.wantErr {
+				t.Errorf("CompleteChallenge() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if tt.stored == "" && got != nil {
+				t.Errorf("CompleteChallenge() got = %+v, want nil", got)
+			}
+			if tt.stored != "" && (got.Username != tt.wantUsername || got.FirstFactor != tt.wantFactor || got.Recovery != tt.recovery) {
+				t.Errorf("CompleteChallenge() got = %+v, want %v, %v, %v", got, tt.wantUsername, tt.wantFactor, tt.recovery)
+			}
+			if tt.recovery && tt.wantErr == nil && (len(updated.RecoveryCodes) != 1 || updated.RecoveryCodes[0] != hashRecoveryCode("ccccc-ddddd")) {
+				t.Errorf("CompleteChallenge() didn't use up the recovery code, left %v", updated.RecoveryCodes)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestMfaSVCImpl_CompleteChallenge_RecoveryCodeRace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	userSvc := mock_user.NewMockUserSVC(ctrl)
+	expires := testNow.Add(mfa.ChallengeTTL).UTC().Format(time.RFC3339)
+
+	//both challenges read the user before either write lands, so each still finds the code on the record
+	stored := user.UserData{
+		Username:      "joehrke",
+		TOTP:          &user.TOTPSettings{Secret: testSecret, Confirmed: true},
+		RecoveryCodes: []string{hashRecoveryCode("aaaaa-bbbbb")},
+	}
+	userSvc.EXPECT().UpdateUser("joehrke", gomock.Any()).DoAndReturn(func(username string, update func(u *user.UserData) error) error {
+		copied := stored
+		return update(&copied)
+	}).Times(2)
+	ds.EXPECT().TakeKey(generateChallengeKey("chal-1")).Return(`{"username":"joehrke","attempts":0,"expiresAt":"`+expires+`"}`, nil)
+	ds.EXPECT().TakeKey(generateChallengeKey("chal-2")).Return(`{"username":"joehrke","attempts":0,"expiresAt":"`+expires+`"}`, nil)
+	claimed := map[string]bool{}
+	ds.EXPECT().SetKeyIfAbsent(generateUsedRecoveryKey("aaaaa-bbbbb"), "1", time.Duration(0)).DoAndReturn(func(key string, val string, timeout time.Duration) (bool, error) {
+		fresh := !claimed[key]
+		claimed[key] = true
+		return fresh, nil
+	}).Times(2)
+	ds.EXPECT().SetKey(generateChallengeKey("chal-2"), gomock.Any(), mfa.ChallengeTTL).Return(nil)
+
+	svc := &MfaSVCImpl{
+		ds:      ds,
+		userSvc: userSvc,
+		now:     func() time.Time { return testNow },
+	}
+	if _, err := svc.CompleteChallenge("chal-1", "aaaaa-bbbbb"); err != nil {
+		t.Fatalf("CompleteChallenge() first redemption error = %v", err)
+	}
+	if _, err := svc.CompleteChallenge("chal-2", "AAAAA BBBBB"); err != mfa.InvalidCode {
+		t.Errorf("CompleteChallenge() second redemption error = %v, want %v", err, mfa.InvalidCode)
+	}
+	ctrl.Finish()
+}
+
+func TestMfaSVCImpl_PurgeUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().ScanKeys(int64(0), "mfachal_*", gomock.Any()).Return(int64(0), []string{"mfachal_1", "mfachal_2"}, nil)
+	ds.EXPECT().GetKey("mfachal_1").Return(`{"username":"bob","attempts":0}`, nil)
+	ds.EXPECT().GetKey("mfachal_2").Return(`{"username":"bob_x","attempts":0}`, nil)
+	ds.EXPECT().DelKey("mfachal_1").Return(nil)
+	//bob_x's name starts with bob and an underscore, the pattern mustn't reach their used codes
+	ds.EXPECT().ScanKeys(int64(0), "totpused_bob:*", gomock.Any()).Return(int64(0), []string{generateUsedCodeKey("bob", 53333333)}, nil)
+	ds.EXPECT().DelKey("totpused_bob:53333333").Return(nil)
+
+	svc := &MfaSVCImpl{
+		ds: ds,
+	}
+	purged, err := svc.PurgeUser("bob")
+	if err != nil {
+		t.Fatalf("PurgeUser() unexpected error = %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("PurgeUser() purged = %v, want 2", purged)
+	}
+	if matched, _ := path.Match(generateUsedCodeKey("bob", "*"), generateUsedCodeKey("bob_x", 53333333)); matched {
+		t.Errorf("PurgeUser() pattern matches bob_x's used codes")
+	}
+	ctrl.Finish()
+}
+
+func TestMfaSVCImpl_RenameUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().ScanKeys(int64(0), "mfachal_*", gomock.Any()).Return(int64(0), []string{"mfachal_1"}, nil)
+	ds.EXPECT().GetKey("mfachal_1").Return(`{"username":"bob","attempts":0}`, nil)
+	ds.EXPECT().DelKey("mfachal_1").Return(nil)
+	ds.EXPECT().ScanKeys(int64(0), "totpused_bob:*", gomock.Any()).Return(int64(0), []string{"totpused_bob:53333333", "totpused_bob:53333334"}, nil)
+	ds.EXPECT().RenameKeyIfAbsent("totpused_bob:53333333", "totpused_robert:53333333").Return(true, nil)
+	//already marked used under the new name, the old record just goes
+	ds.EXPECT().RenameKeyIfAbsent("totpused_bob:53333334", "totpused_robert:53333334").Return(false, nil)
+	ds.EXPECT().DelKey("totpused_bob:53333334").Return(nil)
+
+	svc := &MfaSVCImpl{
+		ds: ds,
+	}
+	changed, err := svc.RenameUser("bob", "robert")
+	if err != nil {
+		t.Fatalf("RenameUser() unexpected error = %v", err)
+	}
+	if changed != 3 {
+		t.Errorf("RenameUser() changed = %v, want 3", changed)
+	}
+	ctrl.Finish()
+}
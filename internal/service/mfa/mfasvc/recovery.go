@@ -0,0 +1,67 @@
+package mfasvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/user"
+	"strings"
+)
+
+const (
+	// recoveryCodeBytes of randomness encode to recoveryCodeLength base32 characters, 50 bits per code
+	recoveryCodeBytes  = 7
+	recoveryCodeLength = 10
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns a fresh set of codes formatted for display (e.g. "abcde-fghij") along with the hashes
+// that get stored on the user
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, mfa.RecoveryCodeCount)
+	hashes := make([]string, 0, mfa.RecoveryCodeCount)
+	for i := 0; i < mfa.RecoveryCodeCount; i++ {
+		raw := make([]byte, recoveryCodeBytes)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(raw))[:recoveryCodeLength]
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode strips the separators and case users are likely to mangle when typing a code back in
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// isRecoveryCode tells a recovery code apart from an authenticator code, which is always six digits
+func isRecoveryCode(code string) bool {
+	return len(normalizeRecoveryCode(code)) == recoveryCodeLength
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode removes the matching code from the user, the caller is responsible for storing the user
+func useRecoveryCode(u *user.UserData, code string) error {
+	hash := []byte(hashRecoveryCode(code))
+	for i, stored := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return mfa.InvalidCode
+}
@@ -0,0 +1,93 @@
+// Package totp implements RFC 6238 time-based one-time passwords with the parameters every authenticator app
+// supports: HMAC-SHA1, 6 digits and a 30 second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits     = 6
+	StepPeriod = 30 * time.Second
+	// Skew is how many steps either side of the current one are still accepted to allow for clock drift
+	Skew = 1
+
+	secretBytes = 20
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random shared secret, base32 encoded as authenticator apps expect
+func GenerateSecret() (string, error) {
+	raw := make([]byte, secretBytes)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(raw), nil
+}
+
+// Step returns the RFC 6238 time step counter for t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(StepPeriod/time.Second)
+}
+
+// CodeAt returns the code for a given time step
+func CodeAt(secret string, step int64) (string, error) {
+	key, err := secretEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	//dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, bin%1000000), nil
+}
+
+// Validate checks a code against the steps around t, returning the step it matched so callers can refuse to accept
+// the same step twice
+func Validate(secret string, code string, t time.Time) (step int64, ok bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(t)
+	for s := current - Skew; s <= current+Skew; s++ {
+		expected, err := CodeAt(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// KeyURI builds the otpauth:// URI that authenticator apps import, usually via a QR code
+func KeyURI(issuer string, account string, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(StepPeriod/time.Second)))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
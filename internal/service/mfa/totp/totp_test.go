@@ -0,0 +1,68 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The RFC 6238 appendix B vectors for SHA1 use the ASCII secret "12345678901234567890" and 8 digits, the last six
+// digits of each are what a 6 digit code must produce
+func TestCodeAt_RFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		got, err := CodeAt(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Errorf("CodeAt() unexpected error = %v", err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CodeAt(%v) got = %v, want %v", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret() unexpected error = %v", err)
+	}
+	now := time.Unix(1600000000, 0)
+
+	previous, _ := CodeAt(secret, Step(now)-1)
+	tooOld, _ := CodeAt(secret, Step(now)-2)
+
+	if step, ok := Validate(secret, previous, now); !ok || step != Step(now)-1 {
+		t.Errorf("Validate() should accept the previous step, got step %v ok %v", step, ok)
+	}
+	if _, ok := Validate(secret, tooOld, now); ok {
+		t.Errorf("Validate() should reject codes outside the skew window")
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Errorf("Validate() should reject short codes")
+	}
+}
+
+func TestKeyURI(t *testing.T) {
+	got := KeyURI("sso-v2", "joehrke", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(got, "otpauth://totp/sso-v2:joehrke?") {
+		t.Errorf("KeyURI() unexpected label: %v", got)
+	}
+	for _, want := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=sso-v2", "digits=6", "period=30"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("KeyURI() missing %v: %v", want, got)
+		}
+	}
+}
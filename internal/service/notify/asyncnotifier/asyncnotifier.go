@@ -0,0 +1,50 @@
+package asyncnotifier
+
+import (
+	"log"
+	"sso-v2/internal/service/notify"
+)
+
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 256
+)
+
+// AsyncNotifier queues messages for a pool of workers to hand to the wrapped notifier, so a request never waits on the
+// mail transport.  How long signup or a reset request takes then doesn't give away whether a message went out.  A
+// message that can't be queued or delivered is logged and dropped, Send never fails so a full queue can't show either.
+type AsyncNotifier struct {
+	next  notify.Notifier
+	queue chan notify.Message
+}
+
+// NewAsyncNotifier starts workers goroutines delivering through next, with room for queueSize waiting messages
+func NewAsyncNotifier(next notify.Notifier, workers int, queueSize int) notify.Notifier {
+	n := &AsyncNotifier{
+		next:  next,
+		queue: make(chan notify.Message, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go n.work()
+	}
+	return n
+}
+
+func (n *AsyncNotifier) Send(msg notify.Message) error {
+	select {
+	case n.queue <- msg:
+		return nil
+	default:
+		log.Printf("mail queue full, dropped %q message", msg.Subject)
+		return nil
+	}
+}
+
+func (n *AsyncNotifier) work() {
+	for msg := range n.queue {
+		err := n.next.Send(msg)
+		if err != nil {
+			log.Printf("error delivering %q message: %v", msg.Subject, err.Error())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package asyncnotifier
+
+import (
+	"sso-v2/internal/service/notify"
+	"testing"
+	"time"
+)
+
+// blockingNotifier holds every delivery until release is closed
+type blockingNotifier struct {
+	release   chan struct{}
+	delivered chan notify.Message
+}
+
+func (n *blockingNotifier) Send(msg notify.Message) error {
+	<-n.release
+	n.delivered <- msg
+	return nil
+}
+
+func TestAsyncNotifier_Send(t *testing.T) {
+	next := &blockingNotifier{release: make(chan struct{}), delivered: make(chan notify.Message, 2)}
+	n := NewAsyncNotifier(next, 1, 1)
+
+	//the worker takes the first message and blocks on it, the second waits in the queue and the third has no room
+	if err := n.Send(notify.Message{Subject: "first"}); err != nil {
+		t.Fatalf("Send() unexpected error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(n.(*AsyncNotifier).queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := n.Send(notify.Message{Subject: "second"}); err != nil {
+		t.Fatalf("Send() unexpected error = %v", err)
+	}
+	if err := n.Send(notify.Message{Subject: "third"}); err != nil {
+		t.Errorf("Send() error = %v, a full queue drops the message", err)
+	}
+
+	close(next.release)
+	for _, want := range []string{"first", "second"} {
+		select {
+		case msg := <-next.delivered:
+			if msg.Subject != want {
+				t.Errorf("delivered %v, want %v", msg.Subject, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v message never delivered", want)
+		}
+	}
+	select {
+	case msg := <-next.delivered:
+		t.Errorf("delivered %v, it should have been dropped", msg.Subject)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,26 @@
+package lognotifier
+
+import (
+	"fmt"
+	"sso-v2/internal/service/notify"
+	"strings"
+	"testing"
+)
+
+func TestLogNotifier_Send(t *testing.T) {
+	var logged []string
+	n := &LogNotifier{logf: func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+
+	err := n.Send(notify.Message{To: "joe@example.com", Subject: "Password reset", Body: "Reset token: secret-token"})
+	if err != nil {
+		t.Fatalf("Send() unexpected error = %v", err)
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "Password reset") {
+		t.Errorf("Send() logged %v, want the subject", logged)
+	}
+	if strings.Contains(logged[0], "secret-token") || strings.Contains(logged[0], "joe@example.com") {
+		t.Errorf("Send() logged the message contents: %v", logged[0])
+	}
+}
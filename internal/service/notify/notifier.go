@@ -0,0 +1,14 @@
+package notify
+
+//go:generate mockgen -source=notifier.go -destination=../../../gen/mocks/mock_notify/notifier.go -self_package=../pkg/notify
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages to users, implementations decide how (SMTP, a local outbox, ...)
+type Notifier interface {
+	Send(msg Message) error
+}
@@ -0,0 +1,53 @@
+package outboxnotifier
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sso-v2/internal/service/notify"
+	"sync"
+	"time"
+)
+
+// OutboxNotifier doesn't deliver anything, it appends each message as a line of JSON to a writer so local
+// development and tests can pick tokens and links out of the outbox
+type OutboxNotifier struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type outboxEntry struct {
+	SentAt time.Time `json:"sentAt"`
+	notify.Message
+}
+
+func NewOutboxNotifier(out io.Writer) notify.Notifier {
+	return &OutboxNotifier{out: out}
+}
+
+// NewFileOutbox appends messages to the file at path, creating it if needed
+func NewFileOutbox(path string) (notify.Notifier, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Print("error opening outbox file: " + err.Error())
+		return nil, err
+	}
+	return NewOutboxNotifier(f), nil
+}
+
+func (n *OutboxNotifier) Send(msg notify.Message) error {
+	line, err := json.Marshal(outboxEntry{SentAt: time.Now().UTC(), Message: msg})
+	if err != nil {
+		log.Print("error marshaling outbox message: " + err.Error())
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.out.Write(append(line, '\n'))
+	if err != nil {
+		log.Print("error writing outbox message: " + err.Error())
+	}
+	return err
+}
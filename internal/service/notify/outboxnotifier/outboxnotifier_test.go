@@ -0,0 +1,44 @@
+package outboxnotifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"sso-v2/internal/service/notify"
+	"strings"
+	"testing"
+)
+
+func TestOutboxNotifier_Send(t *testing.T) {
+	out := &bytes.Buffer{}
+	n := NewOutboxNotifier(out)
+
+	msgs := []notify.Message{
+		{To: "joehrke@example.com", Subject: "first", Body: "one"},
+		{To: "joehrke@example.com", Subject: "second", Body: "two"},
+	}
+	for _, msg := range msgs {
+		if err := n.Send(msg); err != nil {
+			t.Errorf("Send() unexpected error = %v", err)
+			return
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(msgs) {
+		t.Errorf("Send() wrote %v lines, want %v", len(lines), len(msgs))
+		return
+	}
+	for i, line := range lines {
+		entry := &outboxEntry{}
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			t.Errorf("Send() wrote unparseable line %v: %v", line, err)
+			continue
+		}
+		if entry.Message != msgs[i] {
+			t.Errorf("Send() got = %v, want %v", entry.Message, msgs[i])
+		}
+		if entry.SentAt.IsZero() {
+			t.Errorf("Send() missing sentAt")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package smtpnotifier
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"sso-v2/internal/service/notify"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+type SMTPNotifier struct {
+	cfg      Config
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewSMTPNotifier(cfg Config) notify.Notifier {
+	return &SMTPNotifier{
+		cfg:      cfg,
+		sendMail: smtp.SendMail,
+	}
+}
+
+func (n *SMTPNotifier) Send(msg notify.Message) error {
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)
+	}
+
+	err := n.sendMail(net.JoinHostPort(n.cfg.Host, n.cfg.Port), auth, n.cfg.From, []string{msg.To}, buildMessage(n.cfg.From, msg, time.Now()))
+	if err != nil {
+		log.Print("error sending mail: " + err.Error())
+	}
+	return err
+}
+
+// buildMessage renders a plain text RFC 5322 message, header values are stripped of line breaks so a message field
+// can't inject extra headers
+func buildMessage(from string, msg notify.Message, now time.Time) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(buf, "To: %s\r\n", headerValue(msg.To))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(msg.Subject)))
+	fmt.Fprintf(buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func headerValue(val string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(val)
+}
@@ -0,0 +1,72 @@
+package smtpnotifier
+
+import (
+	"errors"
+	"net/smtp"
+	"sso-v2/internal/service/notify"
+	"strings"
+	"testing"
+)
+
+func TestSMTPNotifier_Send(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		sendErr  error
+		wantAuth bool
+		wantErr  bool
+	}{
+		{
+			name:     "HappyPath_With_Auth",
+			cfg:      Config{Host: "mail.example.com", Port: "587", Username: "sso", Password: "secret", From: "sso@example.com"},
+			wantAuth: true,
+		},
+		{
+			name:     "HappyPath_No_Auth",
+			cfg:      Config{Host: "localhost", Port: "25", From: "sso@example.com"},
+			wantAuth: false,
+		},
+		{
+			name:    "Send_Error",
+			cfg:     Config{Host: "localhost", Port: "25", From: "sso@example.com"},
+			sendErr: errors.New("connection refused"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAddr string
+			var gotAuth smtp.Auth
+			var gotTo []string
+			var gotMsg string
+			n := &SMTPNotifier{
+				cfg: tt.cfg,
+				sendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+					gotAddr, gotAuth, gotTo, gotMsg = addr, a, to, string(msg)
+					return tt.sendErr
+				},
+			}
+
+			err := n.Send(notify.Message{To: "joehrke@example.com", Subject: "Hi\r\nBcc: evil@example.com", Body: "line one\nline two"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Send() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotAddr != tt.cfg.Host+":"+tt.cfg.Port {
+				t.Errorf("Send() addr = %v", gotAddr)
+			}
+			if (gotAuth != nil) != tt.wantAuth {
+				t.Errorf("Send() auth = %v, wantAuth %v", gotAuth, tt.wantAuth)
+			}
+			if len(gotTo) != 1 || gotTo[0] != "joehrke@example.com" {
+				t.Errorf("Send() to = %v", gotTo)
+			}
+			if strings.Contains(gotMsg, "\r\nBcc:") {
+				t.Errorf("Send() allowed header injection: %v", gotMsg)
+			}
+			if !strings.Contains(gotMsg, "\r\n\r\nline one\r\nline two\r\n") {
+				t.Errorf("Send() unexpected body: %v", gotMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"sso-v2/internal/service/user"
+	"time"
+)
+
+//go:generate mockgen -source=oidcsvc.go -destination=../../../gen/mocks/mock_oidc/oidcsvc.go -self_package=../pkg/oidc
+
+// LoginStateTTL is how long the user has at the provider before the flow has to start over
+const LoginStateTTL = 10 * time.Minute
+
+// DefaultScopes are requested when a provider doesn't list its own
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// ProviderConfig describes an upstream OpenID Connect provider and this service's client registration with it
+type ProviderConfig struct {
+	// Issuer is the provider's issuer URL, its discovery document is read from /.well-known/openid-configuration
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// RedirectURL is the callback registered with the provider, it must reach GET /v1/oidc/{provider}/callback
+	RedirectURL string   `json:"redirectUrl"`
+	Scopes      []string `json:"scopes,omitempty"`
+	// LinkByEmail links a first login to the local user with the same address, as long as both the provider and the
+	// local user have verified it
+	LinkByEmail bool `json:"linkByEmail,omitempty"`
+}
+
+// LoginResult is the outcome of a completed authorization code flow
+type LoginResult struct {
+	User *user.UserData
+	// Linked is set when the flow was started to link the identity to a user rather than to log in
+	Linked bool
+}
+
+type OidcSVC interface {
+	// BeginLogin starts an authorization code flow with PKCE at the provider, returning the URL to send the browser
+	// to and a binding for the browser to hold on to, see CompleteLogin.  With a linkUsername the flow links the
+	// identity to that user instead of logging in.
+	BeginLogin(provider string, linkUsername string) (authorizationURL string, binding string, err error)
+	// CompleteLogin redeems the code the provider returned alongside state, validates the ID token against the
+	// provider's keys and resolves the local user the identity belongs to.  binding must be the one BeginLogin
+	// returned for state, so a callback URL can't be completed by a browser other than the one that started the flow.
+	CompleteLogin(provider string, state string, code string, binding string) (*LoginResult, error)
+}
+
+type OidcError string
+
+func (e OidcError) Error() string {
+	return string(e)
+}
+
+const (
+	UnknownProvider = OidcError("unknown identity provider")
+	InvalidState    = OidcError("invalid or expired login state")
+	InvalidIDToken  = OidcError("invalid ID token")
+	NotLinked       = OidcError("no account is linked to this identity")
+	ProviderFailure = OidcError("identity provider request failed")
+)
+
+// ParseProviders reads a JSON object of provider configurations keyed by provider name
+func ParseProviders(raw []byte) (map[string]ProviderConfig, error) {
+	providers := map[string]ProviderConfig{}
+	err := json.Unmarshal(raw, &providers)
+	if err != nil {
+		return nil, err
+	}
+	for name, cfg := range providers {
+		if !validProviderName(name) {
+			return nil, errors.New("provider names may only contain letters and digits: " + name)
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, errors.New("provider " + name + " needs an issuer, clientId and redirectUrl")
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = DefaultScopes
+			providers[name] = cfg
+		}
+	}
+	return providers, nil
+}
+
+// validProviderName keeps provider names safe to use in paths and datastore keys
+func validProviderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
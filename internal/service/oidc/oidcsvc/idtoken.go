@@ -0,0 +1,195 @@
+package oidcsvc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"sso-v2/internal/service/oidc"
+	"strings"
+	"time"
+)
+
+const (
+	// clockSkew is how far the provider's clock may drift from ours
+	clockSkew = time.Minute
+	// keyRefreshInterval limits how often an unknown key id makes us refetch the provider's keys
+	keyRefreshInterval = time.Minute
+)
+
+type idTokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type idTokenClaims struct {
+	Issuer          string      `json:"iss"`
+	Subject         string      `json:"sub"`
+	Audience        audience    `json:"aud"`
+	AuthorizedParty string      `json:"azp"`
+	Expiry          int64       `json:"exp"`
+	IssuedAt        int64       `json:"iat"`
+	NotBefore       int64       `json:"nbf"`
+	Nonce           string      `json:"nonce"`
+	Email           string      `json:"email"`
+	EmailVerified   lenientBool `json:"email_verified"`
+}
+
+// audience is the aud claim, which may be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(raw []byte) error {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(raw, &list)
+	*a = list
+	return err
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// lenientBool accepts "true" as well as true, some providers send email_verified as a string
+type lenientBool bool
+
+func (b *lenientBool) UnmarshalJSON(raw []byte) error {
+	*b = lenientBool(string(raw) == "true" || string(raw) == `"true"`)
+	return nil
+}
+
+// keySet is a provider's signing keys by key id
+type keySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// verifyIDToken checks the ID token's RS256 signature against the provider's keys and validates its claims
+func (svc *OidcSVCImpl) verifyIDToken(provider string, cfg oidc.ProviderConfig, meta *providerMetadata, rawToken string, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, oidc.InvalidIDToken
+	}
+	header := idTokenHeader{}
+	if decodeSegment(parts[0], &header) != nil {
+		return nil, oidc.InvalidIDToken
+	}
+	//the algorithm is pinned, a token mustn't be able to pick none or a symmetric algorithm for itself
+	if header.Algorithm != "RS256" {
+		return nil, oidc.InvalidIDToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, oidc.InvalidIDToken
+	}
+	key, err := svc.signingKey(provider, meta, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return nil, oidc.InvalidIDToken
+	}
+
+	claims := &idTokenClaims{}
+	if decodeSegment(parts[1], claims) != nil {
+		return nil, oidc.InvalidIDToken
+	}
+	now := svc.now()
+	switch {
+	case claims.Issuer != meta.Issuer,
+		claims.Subject == "",
+		!claims.Audience.contains(cfg.ClientID),
+		len(claims.Audience) > 1 && claims.AuthorizedParty != cfg.ClientID,
+		time.Unix(claims.Expiry, 0).Add(clockSkew).Before(now),
+		time.Unix(claims.IssuedAt, 0).Add(-clockSkew).After(now),
+		claims.NotBefore != 0 && time.Unix(claims.NotBefore, 0).Add(-clockSkew).After(now),
+		claims.Nonce != nonce:
+		return nil, oidc.InvalidIDToken
+	}
+	return claims, nil
+}
+
+// signingKey returns the provider's key with the given id, refetching the key set when the id is unknown in case the
+// provider has rotated its keys
+func (svc *OidcSVCImpl) signingKey(provider string, meta *providerMetadata, keyID string) (*rsa.PublicKey, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	set := svc.keys[provider]
+	if set != nil {
+		if key, ok := set.keys[keyID]; ok {
+			return key, nil
+		}
+		if svc.now().Sub(set.fetched) < keyRefreshInterval {
+			return nil, oidc.InvalidIDToken
+		}
+	}
+
+	fetched, err := svc.fetchKeys(meta.JwksURI)
+	if err != nil {
+		log.Printf("error fetching signing keys for %v: %v", provider, err.Error())
+		return nil, oidc.ProviderFailure
+	}
+	svc.keys[provider] = fetched
+	key, ok := fetched.keys[keyID]
+	if !ok {
+		return nil, oidc.InvalidIDToken
+	}
+	return key, nil
+}
+
+func (svc *OidcSVCImpl) fetchKeys(jwksURI string) (*keySet, error) {
+	doc := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	err := svc.getJSON(jwksURI, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &keySet{keys: make(map[string]*rsa.PublicKey), fetched: svc.now()}
+	for _, jwk := range doc.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+		e, errE := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		set.keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return set, nil
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
@@ -0,0 +1,320 @@
+package oidcsvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/oidc"
+	"sso-v2/internal/service/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	httpTimeout = 10 * time.Second
+	// maxResponseSize bounds what's read from the provider
+	maxResponseSize = 1 << 20
+)
+
+// providerMetadata is the part of a discovery document the flow needs
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// loginState is kept between BeginLogin and CompleteLogin, keyed by a hash of the state parameter
+type loginState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"codeVerifier"`
+	Nonce        string `json:"nonce"`
+	LinkUsername string `json:"linkUsername,omitempty"`
+	// BindingHash is the hash of the binding given to the browser that started the flow
+	BindingHash string `json:"bindingHash"`
+}
+
+type OidcSVCImpl struct {
+	ds        datasource.Datasource
+	userSVC   user.UserSVC
+	providers map[string]oidc.ProviderConfig
+	client    *http.Client
+	now       func() time.Time
+
+	// mu guards the discovery and key caches
+	mu       sync.Mutex
+	metadata map[string]*providerMetadata
+	keys     map[string]*keySet
+}
+
+func NewOidcSvc(ds datasource.Datasource, userSVC user.UserSVC, providers map[string]oidc.ProviderConfig) oidc.OidcSVC {
+	return &OidcSVCImpl{
+		ds:        ds,
+		userSVC:   userSVC,
+		providers: providers,
+		client:    &http.Client{Timeout: httpTimeout},
+		now:       time.Now,
+		metadata:  make(map[string]*providerMetadata),
+		keys:      make(map[string]*keySet),
+	}
+}
+
+func (svc *OidcSVCImpl) BeginLogin(provider string, linkUsername string) (string, string, error) {
+	cfg, ok := svc.providers[provider]
+	if !ok {
+		return "", "", oidc.UnknownProvider
+	}
+	meta, err := svc.discover(provider)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	rawState, err := json.Marshal(loginState{
+		Provider:     provider,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		LinkUsername: linkUsername,
+		BindingHash:  hashBinding(binding),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	err = svc.ds.SetKey(generateStateKey(state), string(rawState), oidc.LoginStateTTL)
+	if err != nil {
+		log.Printf("error storing login state: %v", err.Error())
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {cfg.RedirectURL},
+		"scope":                 {strings.Join(cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + params.Encode(), binding, nil
+}
+
+func (svc *OidcSVCImpl) CompleteLogin(provider string, state string, code string, binding string) (*oidc.LoginResult, error) {
+	cfg, ok := svc.providers[provider]
+	if !ok {
+		return nil, oidc.UnknownProvider
+	}
+	if state == "" || code == "" {
+		return nil, oidc.InvalidState
+	}
+	//the state is used up whatever happens next, so a callback can't be replayed
+	rawState, err := svc.ds.TakeKey(generateStateKey(state))
+	if err != nil {
+		return nil, err
+	}
+	if rawState == "" {
+		return nil, oidc.InvalidState
+	}
+	saved := loginState{}
+	err = json.Unmarshal([]byte(rawState), &saved)
+	if err != nil {
+		log.Printf("error unmarshaling login state: %v", err.Error())
+		return nil, err
+	}
+	if saved.Provider != provider {
+		return nil, oidc.InvalidState
+	}
+	//a state from somebody else's flow, say a link callback an attacker started for their own account, is refused
+	if binding == "" || subtle.ConstantTimeCompare([]byte(hashBinding(binding)), []byte(saved.BindingHash)) != 1 {
+		return nil, oidc.InvalidState
+	}
+
+	meta, err := svc.discover(provider)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, err := svc.exchangeCode(cfg, meta, code, saved.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := svc.verifyIDToken(provider, cfg, meta, rawIDToken, saved.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	identity := user.FederatedIdentity{Provider: provider, Subject: claims.Subject}
+
+	if saved.LinkUsername != "" {
+		err = svc.userSVC.LinkIdentity(saved.LinkUsername, identity)
+		if err != nil {
+			return nil, err
+		}
+		userDat, err := svc.userSVC.GetUser(saved.LinkUsername)
+		if err != nil {
+			return nil, err
+		}
+		return &oidc.LoginResult{User: userDat, Linked: true}, nil
+	}
+
+	userDat, err := svc.userSVC.FindUserByIdentity(identity)
+	if err == user.NotFound && cfg.LinkByEmail && claims.Email != "" && bool(claims.EmailVerified) {
+		userDat, err = svc.linkByEmail(claims.Email, identity)
+	}
+	if err == user.NotFound {
+		return nil, oidc.NotLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &oidc.LoginResult{User: userDat}, nil
+}
+
+// linkByEmail links the identity to the local user holding a verified address the provider also verified
+func (svc *OidcSVCImpl) linkByEmail(email string, identity user.FederatedIdentity) (*user.UserData, error) {
+	userDat, err := svc.userSVC.FindUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	//an unverified local address could have been typed in by anybody, it mustn't hand them this identity's account
+	if !userDat.EmailVerified {
+		return nil, user.NotFound
+	}
+	err = svc.userSVC.LinkIdentity(userDat.Username, identity)
+	if err != nil {
+		return nil, err
+	}
+	return userDat, nil
+}
+
+// discover fetches and caches the provider's discovery document
+func (svc *OidcSVCImpl) discover(provider string) (*providerMetadata, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if meta, ok := svc.metadata[provider]; ok {
+		return meta, nil
+	}
+
+	cfg := svc.providers[provider]
+	meta := &providerMetadata{}
+	err := svc.getJSON(strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", meta)
+	if err != nil {
+		log.Printf("error fetching discovery document for %v: %v", provider, err.Error())
+		return nil, oidc.ProviderFailure
+	}
+	if meta.Issuer != cfg.Issuer || meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JwksURI == "" {
+		log.Printf("discovery document for %v doesn't match its issuer or is incomplete", provider)
+		return nil, oidc.ProviderFailure
+	}
+	svc.metadata[provider] = meta
+	return meta, nil
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchangeCode redeems an authorization code at the token endpoint, returning the raw ID token
+func (svc *OidcSVCImpl) exchangeCode(cfg oidc.ProviderConfig, meta *providerMetadata, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"client_id":     {cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := svc.client.Do(req)
+	if err != nil {
+		log.Printf("error calling token endpoint: %v", err.Error())
+		return "", oidc.ProviderFailure
+	}
+	defer resp.Body.Close()
+	tokens := tokenResponse{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&tokens)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("token endpoint refused the code: status %v, %v %v", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+		return "", oidc.ProviderFailure
+	}
+	if tokens.IDToken == "" {
+		log.Print("token endpoint returned no ID token")
+		return "", oidc.ProviderFailure
+	}
+	return tokens.IDToken, nil
+}
+
+func (svc *OidcSVCImpl) getJSON(target string, dst interface{}) error {
+	resp, err := svc.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned status %v", target, resp.StatusCode)
+	}
+	return json.Unmarshal(body, dst)
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) (string, error) {
+	raw := make([]byte, n)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateStateKey(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return "oidcstate_" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,290 @@
+package oidcsvc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/oidc"
+	"sso-v2/internal/service/user"
+	"testing"
+	"time"
+)
+
+// testProvider is an OpenID provider serving discovery, keys and a token endpoint that issues whatever ID token the
+// test asks for
+type testProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// idToken builds the ID token the token endpoint returns
+	idToken func() string
+	// challenge is the PKCE challenge sent to the authorization endpoint, the token endpoint checks the verifier
+	challenge string
+}
+
+func newTestProvider(t *testing.T, key *rsa.PrivateKey) *testProvider {
+	p := &testProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(providerMetadata{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JwksURI:               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			KeyType: "RSA",
+			KeyID:   "k1",
+			Use:     "sig",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if clientID != "sso" || secret != "client-secret" || r.PostFormValue("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken(), "token_type": "Bearer"})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOidcSVCImpl_Login(t *testing.T) {
+	providerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := newTestProvider(t, providerKey)
+	defer provider.server.Close()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	identity := user.FederatedIdentity{Provider: "corp", Subject: "sub-1"}
+
+	tests := []struct {
+		name         string
+		linkUsername string
+		linkByEmail  bool
+		mutate       func(claims map[string]interface{})
+		signWith     *rsa.PrivateKey
+		alg          string
+		otherBrowser bool
+		expect       func(users *mock_user.MockUserSVC)
+		wantUser     string
+		wantLinked   bool
+		wantErr      error
+	}{
+		{
+			name: "HappyPath",
+			expect: func(users *mock_user.MockUserSVC) {
+				users.EXPECT().FindUserByIdentity(identity).Return(&user.UserData{Username: "joehrke"}, nil)
+			},
+			wantUser: "joehrke",
+		},
+		{
+			name:        "Linked_By_Verified_Email",
+			linkByEmail: true,
+			expect: func(users *mock_user.MockUserSVC) {
+				users.EXPECT().FindUserByIdentity(identity).Return(nil, user.NotFound)
+				users.EXPECT().FindUserByEmail("joe@example.com").Return(&user.UserData{Username: "joehrke", Email: "joe@example.com", EmailVerified: true}, nil)
+				users.EXPECT().LinkIdentity("joehrke", identity).Return(nil)
+			},
+			wantUser: "joehrke",
+		},
+		{
+			name:        "Local_Email_Unverified",
+			linkByEmail: true,
+			expect: func(users *mock_user.MockUserSVC) {
+				users.EXPECT().FindUserByIdentity(identity).Return(nil, user.NotFound)
+				users.EXPECT().FindUserByEmail("joe@example.com").Return(&user.UserData{Username: "joehrke", Email: "joe@example.com"}, nil)
+			},
+			wantErr: oidc.NotLinked,
+		},
+		{
+			name:        "Provider_Email_Unverified",
+			linkByEmail: true,
+			mutate:      func(claims map[string]interface{}) { claims["email_verified"] = false },
+			expect: func(users *mock_user.MockUserSVC) {
+				users.EXPECT().FindUserByIdentity(identity).Return(nil, user.NotFound)
+			},
+			wantErr: oidc.NotLinked,
+		},
+		{
+			name:         "Link_Flow",
+			linkUsername: "joehrke",
+			expect: func(users *mock_user.MockUserSVC) {
+				users.EXPECT().LinkIdentity("joehrke", identity).Return(nil)
+				users.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke"}, nil)
+			},
+			wantUser:   "joehrke",
+			wantLinked: true,
+		},
+		{
+			name:         "Link_Callback_In_Other_Browser",
+			linkUsername: "attacker",
+			otherBrowser: true,
+			wantErr:      oidc.InvalidState,
+		},
+		{
+			name:    "Wrong_Audience",
+			mutate:  func(claims map[string]interface{}) { claims["aud"] = "someone-else" },
+			wantErr: oidc.InvalidIDToken,
+		},
+		{
+			name: "Foreign_Azp",
+			mutate: func(claims map[string]interface{}) {
+				claims["aud"] = []string{"sso", "someone-else"}
+				claims["azp"] = "someone-else"
+			},
+			wantErr: oidc.InvalidIDToken,
+		},
+		{
+			name:    "Wrong_Issuer",
+			mutate:  func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+			wantErr: oidc.InvalidIDToken,
+		},
+		{
+			name:    "Expired",
+			mutate:  func(claims map[string]interface{}) { claims["exp"] = now.Add(-time.Hour).Unix() },
+			wantErr: oidc.InvalidIDToken,
+		},
+		{
+			name:    "Wrong_Nonce",
+			mutate:  func(claims map[string]interface{}) { claims["nonce"] = "replayed" },
+			wantErr: oidc.InvalidIDToken,
+		},
+		{
+			name:     "Bad_Signature",
+			signWith: otherKey,
+			wantErr:  oidc.InvalidIDToken,
+		},
+		{
+			name:    "Symmetric_Algorithm",
+			alg:     "HS256",
+			wantErr: oidc.InvalidIDToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			users := mock_user.NewMockUserSVC(ctrl)
+			if tt.expect != nil {
+				tt.expect(users)
+			}
+
+			var storedKey, storedState string
+			ds.EXPECT().SetKey(gomock.Any(), gomock.Any(), oidc.LoginStateTTL).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+				storedKey, storedState = key, val
+				return nil
+			})
+			ds.EXPECT().TakeKey(gomock.Any()).DoAndReturn(func(key string) (string, error) {
+				if key != storedKey {
+					return "", nil
+				}
+				return storedState, nil
+			})
+
+			svc := NewOidcSvc(ds, users, map[string]oidc.ProviderConfig{"corp": {
+				Issuer:       provider.server.URL,
+				ClientID:     "sso",
+				ClientSecret: "client-secret",
+				RedirectURL:  "https://sso.example.com/v1/oidc/corp/callback",
+				Scopes:       oidc.DefaultScopes,
+				LinkByEmail:  tt.linkByEmail,
+			}}).(*OidcSVCImpl)
+			svc.now = func() time.Time { return now }
+
+			authorizationURL, binding, err := svc.BeginLogin("corp", tt.linkUsername)
+			if err != nil {
+				t.Fatalf("BeginLogin() unexpected error = %v", err)
+			}
+			parsed, _ := url.Parse(authorizationURL)
+			params := parsed.Query()
+			if params.Get("code_challenge_method") != "S256" || params.Get("client_id") != "sso" {
+				t.Errorf("BeginLogin() unexpected parameters %v", params)
+			}
+			provider.challenge = params.Get("code_challenge")
+			provider.idToken = func() string {
+				claims := map[string]interface{}{
+					"iss":            provider.server.URL,
+					"sub":            "sub-1",
+					"aud":            "sso",
+					"exp":            now.Add(5 * time.Minute).Unix(),
+					"iat":            now.Unix(),
+					"nonce":          params.Get("nonce"),
+					"email":          "joe@example.com",
+					"email_verified": true,
+				}
+				if tt.mutate != nil {
+					tt.mutate(claims)
+				}
+				key := providerKey
+				if tt.signWith != nil {
+					key = tt.signWith
+				}
+				alg := "RS256"
+				if tt.alg != "" {
+					alg = tt.alg
+				}
+				return signToken(t, key, alg, claims)
+			}
+
+			if tt.otherBrowser {
+				binding = "attacker-binding"
+			}
+			result, err := svc.CompleteLogin("corp", params.Get("state"), "good-code", binding)
+			if err != tt.wantErr {
+				t.Fatalf("CompleteLogin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (result.User.Username != tt.wantUser || result.Linked != tt.wantLinked) {
+				t.Errorf("CompleteLogin() got %v linked %v, want %v linked %v", result.User.Username, result.Linked, tt.wantUser, tt.wantLinked)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestOidcSVCImpl_CompleteLogin_UnknownState(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().TakeKey(generateStateKey("forged")).Return("", nil)
+
+	svc := NewOidcSvc(ds, nil, map[string]oidc.ProviderConfig{"corp": {Issuer: "https://idp.example.com"}})
+	_, err := svc.CompleteLogin("corp", "forged", "code", "binding")
+	if err != oidc.InvalidState {
+		t.Errorf("CompleteLogin() error = %v, want %v", err, oidc.InvalidState)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,51 @@
+package rbac
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	MaxRoleNameLength   = 64
+	MaxPermissionLength = 128
+)
+
+// ValidRoleName reports whether name can be used as a role, names are limited to ASCII letters, digits and a few
+// separators so they're safe in datastore keys and URL paths
+func ValidRoleName(name string) bool {
+	if name == "" || len(name) > MaxRoleNameLength {
+		return false
+	}
+	for _, r := range name {
+		if r > unicode.MaxASCII {
+			return false
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:", r) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// ValidPermission reports whether p can be granted by a role, permissions are free form apart from whitespace
+func ValidPermission(p string) bool {
+	if p == "" || len(p) > MaxPermissionLength {
+		return false
+	}
+	return strings.IndexFunc(p, unicode.IsSpace) == -1
+}
+
+// Grants reports whether the granted permissions include want.  A granted permission ending in * covers every
+// permission starting with what comes before it, so "billing:*" grants "billing:read" and "*" grants everything.
+func Grants(granted []string, want string) bool {
+	for _, p := range granted {
+		if p == want {
+			return true
+		}
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(want, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package rbac
+
+import "testing"
+
+func TestGrants(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted []string
+		want    string
+		allowed bool
+	}{
+		{
+			name:    "exact",
+			granted: []string{"tickets:read"},
+			want:    "tickets:read",
+			allowed: true,
+		},
+		{
+			name:    "prefix wildcard",
+			granted: []string{"tickets:*"},
+			want:    "tickets:write",
+			allowed: true,
+		},
+		{
+			name:    "everything",
+			granted: []string{"*"},
+			want:    "sso:admin",
+			allowed: true,
+		},
+		{
+			name:    "no match",
+			granted: []string{"tickets:read", "billing:*"},
+			want:    "tickets:write",
+			allowed: false,
+		},
+		{
+			name:    "nothing granted",
+			want:    "tickets:read",
+			allowed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Grants(tt.granted, tt.want); got != tt.allowed {
+				t.Errorf("Grants() = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestValidRoleName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"support":       true,
+		"billing.admin": true,
+		"":              false,
+		"has space":     false,
+		"rôle":          false,
+	} {
+		if got := ValidRoleName(name); got != want {
+			t.Errorf("ValidRoleName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package rbac
+
+//go:generate mockgen -source=rbacsvc.go -destination=../../../gen/mocks/mock_rbac/rbacsvc.go -self_package=../pkg/rbac
+
+// AdminPermission lets a session use the admin routes in place of the admin token
+const AdminPermission = "sso:admin"
+
+// Role is a named set of permissions that can be assigned to users
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type RbacSVC interface {
+	// SaveRole creates the role or replaces its permissions
+	SaveRole(role Role) error
+	ListRoles() ([]Role, error)
+	DeleteRole(name string) error
+	// AssignRoles replaces the user's roles, every role must already exist
+	AssignRoles(username string, roles []string) error
+	// PermissionsFor returns the sorted union of the permissions granted by roles, roles that no longer exist are
+	// skipped
+	PermissionsFor(roles []string) ([]string, error)
+}
+
+type RbacError string
+
+func (e RbacError) Error() string { return string(e) }
+
+const (
+	RoleNotFound      = RbacError("role not found")
+	InvalidRoleName   = RbacError("invalid role name")
+	InvalidPermission = RbacError("invalid permission")
+)
@@ -0,0 +1,200 @@
+package rbacsvc
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/user"
+)
+
+const roleIndexKey = "roles"
+
+type RbacSVCImpl struct {
+	ds      datasource.Datasource
+	userSvc user.UserSVC
+}
+
+func NewRbacSvc(ds datasource.Datasource, userSvc user.UserSVC) rbac.RbacSVC {
+	return &RbacSVCImpl{
+		ds:      ds,
+		userSvc: userSvc,
+	}
+}
+
+func (svc *RbacSVCImpl) SaveRole(role rbac.Role) error {
+	if !rbac.ValidRoleName(role.Name) {
+		return rbac.InvalidRoleName
+	}
+	permissions := []string{}
+	seen := make(map[string]bool)
+	for _, p := range role.Permissions {
+		if !rbac.ValidPermission(p) {
+			return rbac.InvalidPermission
+		}
+		if !seen[p] {
+			seen[p] = true
+			permissions = append(permissions, p)
+		}
+	}
+	sort.Strings(permissions)
+	role.Permissions = permissions
+
+	rawRole, err := json.Marshal(role)
+	if err != nil {
+		log.Print("error marshaling role: " + err.Error())
+		return err
+	}
+	err = svc.ds.SetKey(generateRoleKey(role.Name), string(rawRole), 0)
+	if err != nil {
+		log.Print("error writing role: " + err.Error())
+		return err
+	}
+	err = svc.ds.AddSetMember(roleIndexKey, role.Name)
+	if err != nil {
+		log.Print("error indexing role: " + err.Error())
+	}
+	return err
+}
+
+func (svc *RbacSVCImpl) ListRoles() ([]rbac.Role, error) {
+	names, err := svc.ds.GetSetMembers(roleIndexKey)
+	if err != nil {
+		log.Print("error fetching role index: " + err.Error())
+		return nil, err
+	}
+	sort.Strings(names)
+
+	roles := []rbac.Role{}
+	for _, name := range names {
+		role, err := svc.loadRole(name)
+		if err == rbac.RoleNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, *role)
+	}
+	return roles, nil
+}
+
+func (svc *RbacSVCImpl) DeleteRole(name string) error {
+	_, err := svc.loadRole(name)
+	if err != nil {
+		return err
+	}
+
+	err = svc.ds.DelKey(generateRoleKey(name))
+	if err != nil {
+		log.Print("error deleting role: " + err.Error())
+		return err
+	}
+	err = svc.ds.RemoveSetMember(roleIndexKey, name)
+	if err != nil {
+		log.Print("error removing role from index: " + err.Error())
+		return err
+	}
+
+	//the role is gone so it can't be assigned again, dropping it from users keeps a new role of the same name from
+	//granting them anything
+	err = svc.userSvc.ExportUsers(func(u *user.UserData) error {
+		if !hasRole(u.Roles, name) {
+			return nil
+		}
+		return svc.userSvc.UpdateUser(u.Username, func(u *user.UserData) error {
+			remaining := []string{}
+			for _, role := range u.Roles {
+				if role != name {
+					remaining = append(remaining, role)
+				}
+			}
+			u.Roles = remaining
+			return nil
+		})
+	})
+	if err != nil {
+		log.Print("error removing role from users: " + err.Error())
+	}
+	return err
+}
+
+func (svc *RbacSVCImpl) AssignRoles(username string, roles []string) error {
+	assigned := []string{}
+	seen := make(map[string]bool)
+	for _, name := range roles {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		_, err := svc.loadRole(name)
+		if err != nil {
+			return err
+		}
+		assigned = append(assigned, name)
+	}
+	sort.Strings(assigned)
+
+	return svc.userSvc.UpdateUser(username, func(u *user.UserData) error {
+		u.Roles = assigned
+		return nil
+	})
+}
+
+func (svc *RbacSVCImpl) PermissionsFor(roles []string) ([]string, error) {
+	permissions := []string{}
+	seen := make(map[string]bool)
+	for _, name := range roles {
+		role, err := svc.loadRole(name)
+		if err == rbac.RoleNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range role.Permissions {
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+func (svc *RbacSVCImpl) loadRole(name string) (*rbac.Role, error) {
+	if !rbac.ValidRoleName(name) {
+		return nil, rbac.RoleNotFound
+	}
+	rawRole, err := svc.ds.GetKey(generateRoleKey(name))
+	if err != nil {
+		log.Print("error fetching role: " + err.Error())
+		return nil, err
+	}
+	if rawRole == "" {
+		return nil, rbac.RoleNotFound
+	}
+
+	role := &rbac.Role{}
+	err = json.Unmarshal([]byte(rawRole), role)
+	if err != nil {
+		log.Print("error unmarshaling role: " + err.Error())
+		return nil, err
+	}
+	return role, nil
+}
+
+func hasRole(roles []string, name string) bool {
+	for _, role := range roles {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+func generateRoleKey(name string) string {
+	return "role_" + name
+}
@@ -0,0 +1,169 @@
+package rbacsvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/user"
+	"testing"
+	"time"
+)
+
+func TestRbacSVCImpl_SaveRole(t *testing.T) {
+	tests := []struct {
+		name      string
+		role      rbac.Role
+		wantSaved string
+		wantErr   error
+	}{
+		{
+			name:      "HappyPath",
+			role:      rbac.Role{Name: "support", Permissions: []string{"tickets:write", "tickets:read", "tickets:read"}},
+			wantSaved: `{"name":"support","permissions":["tickets:read","tickets:write"]}`,
+		},
+		{
+			name:      "No_Permissions",
+			role:      rbac.Role{Name: "support"},
+			wantSaved: `{"name":"support","permissions":[]}`,
+		},
+		{
+			name:    "Invalid_Name",
+			role:    rbac.Role{Name: "tech support"},
+			wantErr: rbac.InvalidRoleName,
+		},
+		{
+			name:    "Invalid_Permission",
+			role:    rbac.Role{Name: "support", Permissions: []string{"tickets read"}},
+			wantErr: rbac.InvalidPermission,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.wantSaved != "" {
+				ds.EXPECT().SetKey("role_support", tt.wantSaved, time.Duration(0)).Return(nil)
+				ds.EXPECT().AddSetMember(roleIndexKey, "support").Return(nil)
+			}
+
+			svc := &RbacSVCImpl{
+				ds: ds,
+			}
+			if err := svc.SaveRole(tt.role); err != tt.wantErr {
+				t.Errorf("SaveRole() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestRbacSVCImpl_AssignRoles(t *testing.T) {
+	tests := []struct {
+		name      string
+		roles     []string
+		wantRoles []string
+		wantErr   error
+	}{
+		{
+			name:      "HappyPath",
+			roles:     []string{"support", "billing", "support"},
+			wantRoles: []string{"billing", "support"},
+		},
+		{
+			name:    "Unknown_Role",
+			roles:   []string{"support", "ghost"},
+			wantErr: rbac.RoleNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			ds.EXPECT().GetKey("role_support").Return(`{"name":"support","permissions":[]}`, nil)
+			ds.EXPECT().GetKey("role_billing").Return(`{"name":"billing","permissions":[]}`, nil).AnyTimes()
+			ds.EXPECT().GetKey("role_ghost").Return("", nil).AnyTimes()
+			stored := &user.UserData{Username: "joehrke"}
+			if tt.wantErr == nil {
+				userSvc.EXPECT().UpdateUser("joehrke", gomock.Any()).DoAndReturn(func(username string, update func(u *user.UserData) error) error {
+					return update(stored)
+				})
+			}
+
+			svc := &RbacSVCImpl{
+				ds:      ds,
+				userSvc: userSvc,
+			}
+			err := svc.AssignRoles("joehrke", tt.roles)
+			if err != tt.wantErr {
+				t.Errorf("AssignRoles() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(stored.Roles, tt.wantRoles) {
+				t.Errorf("AssignRoles() stored %v, want %v", stored.Roles, tt.wantRoles)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestRbacSVCImpl_PermissionsFor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey("role_support").Return(`{"name":"support","permissions":["tickets:read","tickets:write"]}`, nil)
+	ds.EXPECT().GetKey("role_billing").Return(`{"name":"billing","permissions":["billing:read","tickets:read"]}`, nil)
+	ds.EXPECT().GetKey("role_deleted").Return("", nil)
+
+	svc := &RbacSVCImpl{
+		ds: ds,
+	}
+	got, err := svc.PermissionsFor([]string{"support", "deleted", "billing"})
+	if err != nil {
+		t.Errorf("PermissionsFor() unexpected error = %v", err)
+	}
+	want := []string{"billing:read", "tickets:read", "tickets:write"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PermissionsFor() got = %v, want %v", got, want)
+	}
+	ctrl.Finish()
+}
+
+func TestRbacSVCImpl_DeleteRole(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey("role_support").Return(`{"name":"support","permissions":[]}`, nil)
+	ds.EXPECT().DelKey("role_support").Return(nil)
+	ds.EXPECT().RemoveSetMember(roleIndexKey, "support").Return(nil)
+	ds.EXPECT().GetKey("role_ghost").Return("", nil)
+	userSvc := mock_user.NewMockUserSVC(ctrl)
+	userSvc.EXPECT().ExportUsers(gomock.Any()).DoAndReturn(func(visit func(u *user.UserData) error) error {
+		for _, u := range []*user.UserData{{Username: "joehrke", Roles: []string{"editor", "support"}}, {Username: "jane", Roles: []string{"editor"}}} {
+			if err := visit(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	userSvc.EXPECT().UpdateUser("joehrke", gomock.Any()).DoAndReturn(func(username string, update func(u *user.UserData) error) error {
+		u := &user.UserData{Username: "joehrke", Roles: []string{"editor", "support"}}
+		err := update(u)
+		if len(u.Roles) != 1 || u.Roles[0] != "editor" {
+			t.Errorf("DeleteRole() left roles %v", u.Roles)
+		}
+		return err
+	})
+
+	svc := &RbacSVCImpl{
+		ds:      ds,
+		userSvc: userSvc,
+	}
+	if err := svc.DeleteRole("support"); err != nil {
+		t.Errorf("DeleteRole() unexpected error = %v", err)
+	}
+	if err := svc.DeleteRole("ghost"); err != rbac.RoleNotFound {
+		t.Errorf("DeleteRole() error = %v, want %v", err, rbac.RoleNotFound)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,18 @@
+package rename
+
+//go:generate mockgen -source=renamesvc.go -destination=../../../gen/mocks/mock_rename/renamesvc.go -self_package=../pkg/rename
+
+// Result records a rename and how much of the user's state followed them to the new name
+type Result struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Moved counts what was moved or, for outstanding tokens, revoked in each place the user appeared
+	Moved map[string]int `json:"moved"`
+}
+
+type RenameSVC interface {
+	// Rename changes the user's username, moving the record, live sessions, group memberships, used MFA codes, audit
+	// and login history to the new name and revoking tokens and MFA challenges issued to the old one.  The old name stays an alias of the new one
+	// for the user service's grace period.
+	Rename(username string, newUsername string) (*Result, error)
+}
@@ -0,0 +1,71 @@
+package renamesvc
+
+import (
+	"log"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/mfa"
+	"sso-v2/internal/service/rename"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/token"
+	"sso-v2/internal/service/user"
+)
+
+// Services are everywhere a username is stored outside the user record
+type Services struct {
+	User    user.UserSVC
+	Session session.SessionSVC
+	Group   group.GroupSVC
+	Token   token.TokenSVC
+	Mfa     mfa.MfaSVC
+	Audit   audit.AuditSVC
+	Logins  loginhistory.LoginHistorySVC
+}
+
+type RenameSVCImpl struct {
+	svcs Services
+}
+
+func NewRenameSvc(svcs Services) rename.RenameSVC {
+	return &RenameSVCImpl{
+		svcs: svcs,
+	}
+}
+
+func (svc *RenameSVCImpl) Rename(username string, newUsername string) (*rename.Result, error) {
+	u, err := svc.svcs.User.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	username = u.Username
+	u, err = svc.svcs.User.RenameUser(username, newUsername)
+	if err != nil {
+		return nil, err
+	}
+	newUsername = u.Username
+
+	//the record has moved and the old name only resolves to the new one now, so the rename can't be retried and the
+	//rest is best effort
+	moved := map[string]int{"user": 1}
+	steps := []struct {
+		name string
+		move func(string, string) (int, error)
+	}{
+		{"sessions", svc.svcs.Session.RenameUser},
+		{"groups", svc.svcs.Group.RenameUser},
+		{"tokens", func(username string, _ string) (int, error) { return svc.svcs.Token.RevokeTokensFor(username) }},
+		{"mfa", svc.svcs.Mfa.RenameUser},
+		{"auditEvents", svc.svcs.Audit.RenameUser},
+		{"logins", svc.svcs.Logins.RenameUser},
+	}
+	for _, step := range steps {
+		count, err := step.move(username, newUsername)
+		if err != nil {
+			log.Printf("error moving %v to renamed user: %v", step.name, err.Error())
+			continue
+		}
+		moved[step.name] = count
+	}
+	return &rename.Result{From: username, To: newUsername, Moved: moved}, nil
+}
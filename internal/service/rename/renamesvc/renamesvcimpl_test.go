@@ -0,0 +1,83 @@
+package renamesvc
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_audit"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_mfa"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_token"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/user"
+	"testing"
+)
+
+func TestRenameSVCImpl_Rename(t *testing.T) {
+	tests := []struct {
+		name      string
+		renameErr error
+		groupErr  error
+		want      map[string]int
+		wantErr   error
+	}{
+		{
+			name: "Renamed",
+			want: map[string]int{"user": 1, "sessions": 2, "groups": 1, "tokens": 1, "mfa": 2, "auditEvents": 3, "logins": 4},
+		},
+		{
+			name:     "Failed_Step_Skipped",
+			groupErr: errors.New("boom"),
+			want:     map[string]int{"user": 1, "sessions": 2, "tokens": 1, "mfa": 2, "auditEvents": 3, "logins": 4},
+		},
+		{name: "Taken", renameErr: user.UsernameTaken, wantErr: user.UsernameTaken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+			groupSvc := mock_group.NewMockGroupSVC(ctrl)
+			tokenSvc := mock_token.NewMockTokenSVC(ctrl)
+			auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+			loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+			mfaSvc := mock_mfa.NewMockMfaSVC(ctrl)
+
+			userSvc.EXPECT().GetUser("JoeHrke").Return(&user.UserData{Username: "joehrke"}, nil)
+			if tt.renameErr != nil {
+				userSvc.EXPECT().RenameUser("joehrke", "JHrke").Return(nil, tt.renameErr)
+			} else {
+				userSvc.EXPECT().RenameUser("joehrke", "JHrke").Return(&user.UserData{Username: "jhrke"}, nil)
+				sessionSvc.EXPECT().RenameUser("joehrke", "jhrke").Return(2, nil)
+				groupSvc.EXPECT().RenameUser("joehrke", "jhrke").Return(1, tt.groupErr)
+				tokenSvc.EXPECT().RevokeTokensFor("joehrke").Return(1, nil)
+				mfaSvc.EXPECT().RenameUser("joehrke", "jhrke").Return(2, nil)
+				auditSvc.EXPECT().RenameUser("joehrke", "jhrke").Return(3, nil)
+				loginSvc.EXPECT().RenameUser("joehrke", "jhrke").Return(4, nil)
+			}
+
+			svc := &RenameSVCImpl{
+				svcs: Services{User: userSvc, Session: sessionSvc, Group: groupSvc, Token: tokenSvc, Mfa: mfaSvc, Audit: auditSvc, Logins: loginSvc},
+			}
+			result, err := svc.Rename("JoeHrke", "JHrke")
+			if err != tt.wantErr {
+				t.Fatalf("Rename() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if result.From != "joehrke" || result.To != "jhrke" {
+					t.Errorf("Rename() = %v -> %v, want joehrke -> jhrke", result.From, result.To)
+				}
+				if len(result.Moved) != len(tt.want) {
+					t.Errorf("Rename() moved = %v, want %v", result.Moved, tt.want)
+				}
+				for name, count := range tt.want {
+					if result.Moved[name] != count {
+						t.Errorf("Rename() moved[%v] = %v, want %v", name, result.Moved[name], count)
+					}
+				}
+			}
+			ctrl.Finish()
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package serviceaccount
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+//go:generate mockgen -source=serviceaccountsvc.go -destination=../../../gen/mocks/mock_serviceaccount/serviceaccountsvc.go -self_package=../pkg/serviceaccount
+
+const (
+	MaxAccountNameLength = 64
+	// KeyPrefix starts every API key, keys are sso_<key id>_<secret>
+	KeyPrefix = "sso_"
+	// PrincipalPrefix is put in front of the account name to make the username of a service account's sessions.  A
+	// colon never appears in usernames, so a service account can't pass for the user of the same name.
+	PrincipalPrefix = "svc:"
+)
+
+// ServiceAccount is a non-human principal that authenticates with API keys instead of a password
+type ServiceAccount struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// APIKey describes a key without its secret, which is only ever returned by CreateKey
+type APIKey struct {
+	Id      string `json:"id"`
+	Account string `json:"account"`
+	Name    string `json:"name,omitempty"`
+	// Scopes are the permissions the key grants, they become the permissions of sessions created with it
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type ServiceAccountSVC interface {
+	// SaveAccount creates the account or updates its description
+	SaveAccount(acct ServiceAccount) error
+	GetAccount(name string) (*ServiceAccount, error)
+	ListAccounts() ([]ServiceAccount, error)
+	// DeleteAccount revokes every key of the account and ends its sessions before removing it
+	DeleteAccount(name string) error
+	// CreateKey issues a key for the account granting scopes.  A ttl of 0 or less creates a key that doesn't expire.  The
+	// returned key is the only copy of its secret, only a hash is stored.
+	CreateKey(account string, name string, scopes []string, ttl time.Duration) (key string, info *APIKey, err error)
+	ListKeys(account string) ([]APIKey, error)
+	// RevokeKey deletes the key and ends the sessions created with it
+	RevokeKey(account string, id string) error
+	// Authenticate resolves a presented key, recording when it was used
+	Authenticate(key string) (*APIKey, error)
+}
+
+type ServiceAccountError string
+
+func (e ServiceAccountError) Error() string { return string(e) }
+
+const (
+	AccountNotFound    = ServiceAccountError("service account not found")
+	InvalidAccountName = ServiceAccountError("invalid service account name")
+	APIKeyNotFound     = ServiceAccountError("API key not found")
+	InvalidAPIKey      = ServiceAccountError("invalid or expired API key")
+	InvalidScopes      = ServiceAccountError("a key needs at least one valid scope")
+)
+
+// ValidAccountName reports whether name can be used for a service account, names are limited to ASCII letters,
+// digits and a few separators so they're safe in datastore keys and URL paths
+func ValidAccountName(name string) bool {
+	if name == "" || len(name) > MaxAccountNameLength {
+		return false
+	}
+	for _, r := range name {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Principal returns the session username of the account's sessions
+func Principal(account string) string {
+	return PrincipalPrefix + account
+}
@@ -0,0 +1,428 @@
+package serviceaccountsvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/rbac"
+	"sso-v2/internal/service/serviceaccount"
+	"sso-v2/internal/service/session"
+	"strings"
+	"time"
+)
+
+const (
+	accountIndexKey = "svcaccts"
+	keyIdBytes      = 8
+	secretBytes     = 32
+	// lastUsedResolution limits how often a busy key's last use is written back
+	lastUsedResolution = time.Minute
+)
+
+// storedKey is a key's description alongside the hash of its secret.  The secret is 256 random bits, so unlike a
+// password it doesn't need a slow hash to resist guessing.
+type storedKey struct {
+	serviceaccount.APIKey
+	Hash string `json:"hash"`
+}
+
+type ServiceAccountSVCImpl struct {
+	ds         datasource.Datasource
+	sessionSVC session.SessionSVC
+	now        func() time.Time
+}
+
+func NewServiceAccountSvc(ds datasource.Datasource, sessionSVC session.SessionSVC) serviceaccount.ServiceAccountSVC {
+	return &ServiceAccountSVCImpl{
+		ds:         ds,
+		sessionSVC: sessionSVC,
+		now:        time.Now,
+	}
+}
+
+func (svc *ServiceAccountSVCImpl) SaveAccount(acct serviceaccount.ServiceAccount) error {
+	if !serviceaccount.ValidAccountName(acct.Name) {
+		return serviceaccount.InvalidAccountName
+	}
+	existing, err := svc.GetAccount(acct.Name)
+	switch err {
+	case nil:
+		acct.CreatedAt = existing.CreatedAt
+	case serviceaccount.AccountNotFound:
+		acct.CreatedAt = svc.now().UTC()
+	default:
+		return err
+	}
+
+	rawAccount, err := json.Marshal(acct)
+	if err != nil {
+		log.Print("error marshaling service account: " + err.Error())
+		return err
+	}
+	err = svc.ds.SetKey(generateAccountKey(acct.Name), string(rawAccount), 0)
+	if err != nil {
+		log.Print("error writing service account: " + err.Error())
+		return err
+	}
+	err = svc.ds.AddSetMember(accountIndexKey, acct.Name)
+	if err != nil {
+		log.Print("error indexing service account: " + err.Error())
+	}
+	return err
+}
+
+func (svc *ServiceAccountSVCImpl) GetAccount(name string) (*serviceaccount.ServiceAccount, error) {
+	if !serviceaccount.ValidAccountName(name) {
+		return nil, serviceaccount.AccountNotFound
+	}
+	rawAccount, err := svc.ds.GetKey(generateAccountKey(name))
+	if err != nil {
+		log.Print("error fetching service account: " + err.Error())
+		return nil, err
+	}
+	if rawAccount == "" {
+		return nil, serviceaccount.AccountNotFound
+	}
+	acct := &serviceaccount.ServiceAccount{}
+	err = json.Unmarshal([]byte(rawAccount), acct)
+	if err != nil {
+		log.Print("error unmarshaling service account: " + err.Error())
+		return nil, err
+	}
+	return acct, nil
+}
+
+func (svc *ServiceAccountSVCImpl) ListAccounts() ([]serviceaccount.ServiceAccount, error) {
+	names, err := svc.sortedMembers(accountIndexKey)
+	if err != nil {
+		return nil, err
+	}
+	accounts := []serviceaccount.ServiceAccount{}
+	for _, name := range names {
+		acct, err := svc.GetAccount(name)
+		if err == serviceaccount.AccountNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, *acct)
+	}
+	return accounts, nil
+}
+
+func (svc *ServiceAccountSVCImpl) DeleteAccount(name string) error {
+	_, err := svc.GetAccount(name)
+	if err != nil {
+		return err
+	}
+	ids, err := svc.sortedMembers(generateAccountKeysKey(name))
+	if err != nil {
+		return err
+	}
+
+	//keys go first so nothing can authenticate as the account while it's being torn down
+	for _, id := range ids {
+		err = svc.deleteKey(name, id)
+		if err != nil {
+			return err
+		}
+	}
+	err = svc.sessionSVC.DestroySessionsForUser(serviceaccount.Principal(name), "")
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{generateAccountKeysKey(name), generateAccountKey(name)} {
+		err = svc.ds.DelKey(key)
+		if err != nil {
+			log.Print("error deleting service account: " + err.Error())
+			return err
+		}
+	}
+	return svc.ds.RemoveSetMember(accountIndexKey, name)
+}
+
+func (svc *ServiceAccountSVCImpl) CreateKey(account string, name string, scopes []string, ttl time.Duration) (string, *serviceaccount.APIKey, error) {
+	_, err := svc.GetAccount(account)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(scopes) == 0 {
+		return "", nil, serviceaccount.InvalidScopes
+	}
+	for _, scope := range scopes {
+		if !rbac.ValidPermission(scope) {
+			return "", nil, serviceaccount.InvalidScopes
+		}
+	}
+
+	rawId, err := randomBytes(keyIdBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomBytes(secretBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(rawId)
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	info := serviceaccount.APIKey{
+		Id:        id,
+		Account:   account,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: svc.now().UTC(),
+	}
+	if ttl > 0 {
+		expiresAt := info.CreatedAt.Add(ttl)
+		info.ExpiresAt = &expiresAt
+	}
+	rawKey, err := json.Marshal(storedKey{APIKey: info, Hash: hashSecret(encodedSecret)})
+	if err != nil {
+		log.Print("error marshaling API key: " + err.Error())
+		return "", nil, err
+	}
+	written, err := svc.ds.SetKeyIfAbsent(generateKeyKey(id), string(rawKey), 0)
+	if err != nil {
+		log.Print("error writing API key: " + err.Error())
+		return "", nil, err
+	}
+	if !written {
+		log.Print("generated API key id already exists")
+		return "", nil, errors.New("generated API key id already exists")
+	}
+	err = svc.ds.AddSetMember(generateAccountKeysKey(account), id)
+	if err != nil {
+		log.Print("error indexing API key: " + err.Error())
+		return "", nil, err
+	}
+
+	return serviceaccount.KeyPrefix + id + "_" + encodedSecret, &info, nil
+}
+
+func (svc *ServiceAccountSVCImpl) ListKeys(account string) ([]serviceaccount.APIKey, error) {
+	_, err := svc.GetAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := svc.sortedMembers(generateAccountKeysKey(account))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []serviceaccount.APIKey{}
+	for _, id := range ids {
+		stored, err := svc.loadKey(id)
+		if err == serviceaccount.APIKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stored.LastUsedAt, err = svc.lastUsed(id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, stored.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (svc *ServiceAccountSVCImpl) RevokeKey(account string, id string) error {
+	stored, err := svc.loadKey(id)
+	if err != nil {
+		return err
+	}
+	if stored.Account != account {
+		return serviceaccount.APIKeyNotFound
+	}
+	err = svc.deleteKey(account, id)
+	if err != nil {
+		return err
+	}
+
+	//sessions carry the key's scopes, so they mustn't outlive it
+	principal := serviceaccount.Principal(account)
+	sessionIds, err := svc.sessionSVC.GetSessionIdsForUser(principal)
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		sess, err := svc.sessionSVC.GetSessionById(sessionId)
+		if err == session.SessionNotFoundError {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if sess.APIKeyId != id {
+			continue
+		}
+		err = svc.sessionSVC.DestroySession(sessionId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *ServiceAccountSVCImpl) Authenticate(key string) (*serviceaccount.APIKey, error) {
+	id, secret, ok := parseKey(key)
+	if !ok {
+		return nil, serviceaccount.InvalidAPIKey
+	}
+	stored, err := svc.loadKey(id)
+	if err == serviceaccount.APIKeyNotFound {
+		return nil, serviceaccount.InvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(stored.Hash)) != 1 {
+		return nil, serviceaccount.InvalidAPIKey
+	}
+	now := svc.now().UTC()
+	if stored.ExpiresAt != nil && !now.Before(*stored.ExpiresAt) {
+		return nil, serviceaccount.InvalidAPIKey
+	}
+
+	stored.LastUsedAt, err = svc.touch(id, now)
+	if err != nil {
+		return nil, err
+	}
+	return &stored.APIKey, nil
+}
+
+// touch records that the key was used now, unless that was already recorded within lastUsedResolution.  The time is
+// kept apart from the key so a write here can't bring back a key that was revoked in the meantime.
+func (svc *ServiceAccountSVCImpl) touch(id string, now time.Time) (*time.Time, error) {
+	last, err := svc.lastUsed(id)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil && now.Sub(*last) < lastUsedResolution {
+		return last, nil
+	}
+	err = svc.ds.SetKey(generateKeyUsedKey(id), now.Format(time.RFC3339), 0)
+	if err != nil {
+		log.Print("error recording API key use: " + err.Error())
+		return nil, err
+	}
+	return &now, nil
+}
+
+func (svc *ServiceAccountSVCImpl) lastUsed(id string) (*time.Time, error) {
+	raw, err := svc.ds.GetKey(generateKeyUsedKey(id))
+	if err != nil {
+		log.Print("error fetching API key use: " + err.Error())
+		return nil, err
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	last, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		log.Print("error parsing API key use: " + err.Error())
+		return nil, err
+	}
+	return &last, nil
+}
+
+func (svc *ServiceAccountSVCImpl) loadKey(id string) (*storedKey, error) {
+	rawKey, err := svc.ds.GetKey(generateKeyKey(id))
+	if err != nil {
+		log.Print("error fetching API key: " + err.Error())
+		return nil, err
+	}
+	if rawKey == "" {
+		return nil, serviceaccount.APIKeyNotFound
+	}
+	stored := &storedKey{}
+	err = json.Unmarshal([]byte(rawKey), stored)
+	if err != nil {
+		log.Print("error unmarshaling API key: " + err.Error())
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (svc *ServiceAccountSVCImpl) deleteKey(account string, id string) error {
+	for _, key := range []string{generateKeyKey(id), generateKeyUsedKey(id)} {
+		err := svc.ds.DelKey(key)
+		if err != nil {
+			log.Print("error deleting API key: " + err.Error())
+			return err
+		}
+	}
+	err := svc.ds.RemoveSetMember(generateAccountKeysKey(account), id)
+	if err != nil {
+		log.Print("error unindexing API key: " + err.Error())
+	}
+	return err
+}
+
+func (svc *ServiceAccountSVCImpl) sortedMembers(key string) ([]string, error) {
+	members, err := svc.ds.GetSetMembers(key)
+	if err != nil {
+		log.Print("error fetching set members: " + err.Error())
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// parseKey splits a presented key into its id and secret.  The id is hex, so the first underscore after the prefix
+// ends it even though the base64url secret may contain more.
+func parseKey(key string) (id string, secret string, ok bool) {
+	if !strings.HasPrefix(key, serviceaccount.KeyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, serviceaccount.KeyPrefix), "_", 2)
+	if len(parts) != 2 || len(parts[0]) != 2*keyIdBytes || parts[1] == "" {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) ([]byte, error) {
+	raw := make([]byte, n)
+	_, err := rand.Read(raw)
+	if err != nil {
+		log.Print("error generating API key: " + err.Error())
+		return nil, err
+	}
+	return raw, nil
+}
+
+func generateAccountKey(name string) string {
+	return "svcacct_" + name
+}
+
+func generateAccountKeysKey(name string) string {
+	return "svcacctkeys_" + name
+}
+
+func generateKeyKey(id string) string {
+	return "apikey_" + id
+}
+
+func generateKeyUsedKey(id string) string {
+	return "apikeyused_" + id
+}
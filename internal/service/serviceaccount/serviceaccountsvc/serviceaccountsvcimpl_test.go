@@ -0,0 +1,170 @@
+package serviceaccountsvc
+
+import (
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/internal/service/serviceaccount"
+	"sso-v2/internal/service/session"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceAccountSVCImpl_CreateKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	ds.EXPECT().GetKey("svcacct_billing").Return(`{"name":"billing"}`, nil)
+	var stored storedKey
+	ds.EXPECT().SetKeyIfAbsent(gomock.Any(), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, timeout time.Duration) (bool, error) {
+		if err := json.Unmarshal([]byte(val), &stored); err != nil {
+			t.Fatal(err)
+		}
+		if key != generateKeyKey(stored.Id) {
+			t.Errorf("CreateKey() stored under %v, want %v", key, generateKeyKey(stored.Id))
+		}
+		return true, nil
+	})
+	ds.EXPECT().AddSetMember("svcacctkeys_billing", gomock.Any()).Return(nil)
+
+	svc := &ServiceAccountSVCImpl{ds: ds, now: func() time.Time { return now }}
+	key, info, err := svc.CreateKey("billing", "nightly", []string{"billing:read"}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateKey() unexpected error = %v", err)
+	}
+	id, secret, ok := parseKey(key)
+	if !ok || id != info.Id || !strings.HasPrefix(key, serviceaccount.KeyPrefix) {
+		t.Errorf("CreateKey() returned malformed key %v for id %v", key, info.Id)
+	}
+	if stored.Hash != hashSecret(secret) || strings.Contains(stored.Hash, secret) {
+		t.Errorf("CreateKey() stored hash %v doesn't match the secret", stored.Hash)
+	}
+	if info.ExpiresAt == nil || !info.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("CreateKey() expiry = %v, want %v", info.ExpiresAt, now.Add(time.Hour))
+	}
+	ctrl.Finish()
+}
+
+func TestServiceAccountSVCImpl_Authenticate(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	const id = "0011223344556677"
+	storeKey := func(expiresAt *time.Time) string {
+		raw, _ := json.Marshal(storedKey{
+			APIKey: serviceaccount.APIKey{Id: id, Account: "billing", Scopes: []string{"billing:read"}, ExpiresAt: expiresAt},
+			Hash:   hashSecret("secret"),
+		})
+		return string(raw)
+	}
+	expired := now.Add(-time.Second)
+
+	tests := []struct {
+		name        string
+		key         string
+		stored      string
+		expectStore bool
+		lastUsed    string
+		expectTouch bool
+		wantErr     error
+	}{
+		{
+			name:        "HappyPath",
+			key:         "sso_" + id + "_secret",
+			stored:      storeKey(nil),
+			expectStore: true,
+			expectTouch: true,
+		},
+		{
+			name:        "Recently_Used",
+			key:         "sso_" + id + "_secret",
+			stored:      storeKey(nil),
+			expectStore: true,
+			lastUsed:    now.Add(-10 * time.Second).Format(time.RFC3339),
+		},
+		{
+			name:        "Wrong_Secret",
+			key:         "sso_" + id + "_guess",
+			stored:      storeKey(nil),
+			expectStore: true,
+			wantErr:     serviceaccount.InvalidAPIKey,
+		},
+		{
+			name:        "Unknown_Key",
+			key:         "sso_" + id + "_secret",
+			expectStore: true,
+			wantErr:     serviceaccount.InvalidAPIKey,
+		},
+		{
+			name:        "Expired",
+			key:         "sso_" + id + "_secret",
+			stored:      storeKey(&expired),
+			expectStore: true,
+			wantErr:     serviceaccount.InvalidAPIKey,
+		},
+		{
+			name:    "Malformed",
+			key:     "sso_not-hex_secret",
+			wantErr: serviceaccount.InvalidAPIKey,
+		},
+		{
+			name:    "Not_An_API_Key",
+			key:     "some-session-id",
+			wantErr: serviceaccount.InvalidAPIKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.expectStore {
+				ds.EXPECT().GetKey("apikey_"+id).Return(tt.stored, nil)
+			}
+			if tt.wantErr == nil {
+				ds.EXPECT().GetKey("apikeyused_"+id).Return(tt.lastUsed, nil)
+			}
+			if tt.expectTouch {
+				ds.EXPECT().SetKey("apikeyused_"+id, now.Format(time.RFC3339), time.Duration(0)).Return(nil)
+			}
+
+			svc := &ServiceAccountSVCImpl{ds: ds, now: func() time.Time { return now }}
+			got, err := svc.Authenticate(tt.key)
+			if err != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Account != "billing" || got.LastUsedAt == nil) {
+				t.Errorf("Authenticate() got %+v", got)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestServiceAccountSVCImpl_RevokeKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	sessions := mock_session.NewMockSessionSVC(ctrl)
+	const id = "0011223344556677"
+
+	ds.EXPECT().GetKey("apikey_"+id).Return(`{"id":"`+id+`","account":"billing"}`, nil)
+	ds.EXPECT().DelKey("apikey_" + id).Return(nil)
+	ds.EXPECT().DelKey("apikeyused_" + id).Return(nil)
+	ds.EXPECT().RemoveSetMember("svcacctkeys_billing", id).Return(nil)
+	sessions.EXPECT().GetSessionIdsForUser("svc:billing").Return([]string{"sess-1", "sess-2"}, nil)
+	sessions.EXPECT().GetSessionById("sess-1").Return(&session.SessionData{Id: "sess-1", Access: session.Access{APIKeyId: id}}, nil)
+	sessions.EXPECT().GetSessionById("sess-2").Return(&session.SessionData{Id: "sess-2", Access: session.Access{APIKeyId: "other"}}, nil)
+	sessions.EXPECT().DestroySession("sess-1").Return(nil)
+
+	svc := NewServiceAccountSvc(ds, sessions)
+	if err := svc.RevokeKey("billing", id); err != nil {
+		t.Errorf("RevokeKey() unexpected error = %v", err)
+	}
+
+	//another account's key is treated as unknown
+	ds.EXPECT().GetKey("apikey_"+id).Return(`{"id":"`+id+`","account":"billing"}`, nil)
+	if err := svc.RevokeKey("reporting", id); err != serviceaccount.APIKeyNotFound {
+		t.Errorf("RevokeKey() error = %v, want %v", err, serviceaccount.APIKeyNotFound)
+	}
+	ctrl.Finish()
+}
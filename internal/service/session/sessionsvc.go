@@ -12,13 +12,33 @@ type SessionData struct {
 	Id          string            `json:"id"`
 	Username    string            `json:"username"`
 	SessionVars map[string]string `json:"sessionVars"`
+	Access
+}
+
+// Access is a snapshot of what the user was entitled to when the session was created
+type Access struct {
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// Groups includes every group the user belongs to, directly or through nested groups
+	Groups []string `json:"groups,omitempty"`
+	// PasswordChangeRequired restricts the session to changing the user's password, it carries no roles, permissions
+	// or groups
+	PasswordChangeRequired bool `json:"passwordChangeRequired,omitempty"`
+	// APIKeyId is the API key a service account session was created with
+	APIKeyId string `json:"apiKeyId,omitempty"`
+	// ExpiresAt ends the session however recently it was used, so it can't outlive what it was created from
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 }
 
 type SessionSVC interface {
 	GetSessionById(id string) (*SessionData, error)
-	CreateSession(username string, sessionBody map[string]string) (sessionId string, err error)
+	CreateSession(username string, sessionBody map[string]string, access Access) (sessionId string, err error)
 	DestroySession(id string) error
 	SetSessionBodyById(id string, body map[string]string) error
+	GetSessionIdsForUser(username string) ([]string, error)
+	DestroySessionsForUser(username string, keepId string) error
+	// RenameUser moves the user's live sessions to their new username, returning how many moved
+	RenameUser(username string, newUsername string) (int, error)
 }
 
 type SessionError string
@@ -6,15 +6,18 @@ import (
 	"log"
 	"sso-v2/internal/datasource"
 	"sso-v2/internal/service/session"
+	"time"
 )
 
 type SessionSVCImpl struct {
-	ds datasource.Datasource
+	ds  datasource.Datasource
+	now func() time.Time
 }
 
 func NewSessionSvc(ds datasource.Datasource) session.SessionSVC {
 	return &SessionSVCImpl{
-		ds: ds,
+		ds:  ds,
+		now: time.Now,
 	}
 }
 
@@ -37,8 +40,14 @@ func (svc *SessionSVCImpl) GetSessionById(id string) (*session.SessionData, erro
 		return nil, err
 	}
 
+	ttl := svc.ttl(sess)
+	if ttl <= 0 {
+		svc.DestroySession(id)
+		return nil, session.SessionNotFoundError
+	}
+
 	//bump sessionhandlers expiration in Redis
-	err = svc.ds.SetKey(generateSessionKey(id), rawSess, session.MAX_SESSION_DURATION)
+	err = svc.ds.SetKey(generateSessionKey(id), rawSess, ttl)
 	if err != nil {
 		log.Print("error resetting sessionhandlers timeout: " + err.Error())
 		return nil, err //returns nil even if sessionhandlers found to ensure no strange behavior
@@ -47,12 +56,13 @@ func (svc *SessionSVCImpl) GetSessionById(id string) (*session.SessionData, erro
 	return sess, nil
 }
 
-func (svc *SessionSVCImpl) CreateSession(username string, sessionBody map[string]string) (sessionId string, err error) {
+func (svc *SessionSVCImpl) CreateSession(username string, sessionBody map[string]string, access session.Access) (sessionId string, err error) {
 	sessionId = generateSessionId()
 	sess := session.SessionData{
 		Id:          sessionId,
 		Username:    username,
 		SessionVars: sessionBody,
+		Access:      access,
 	}
 	rawSess, err := json.Marshal(sess)
 	if err != nil {
@@ -60,12 +70,23 @@ func (svc *SessionSVCImpl) CreateSession(username string, sessionBody map[string
 		return "", err
 	}
 
-	err = svc.ds.SetKey(generateSessionKey(sessionId), string(rawSess), session.MAX_SESSION_DURATION)
+	ttl := svc.ttl(&sess)
+	if ttl <= 0 {
+		return "", session.SessionNotFoundError
+	}
+	err = svc.ds.SetKey(generateSessionKey(sessionId), string(rawSess), ttl)
 	if err != nil {
 		log.Print("error writing key to store: " + err.Error())
 		return "", err
 	}
 
+	//index the session under its user so all of a user's sessions can be found without a keyspace scan
+	err = svc.ds.AddSetMember(generateUserSessionsKey(username), sessionId)
+	if err != nil {
+		log.Print("error indexing session for user: " + err.Error())
+		return "", err
+	}
+
 	return sessionId, nil
 }
 
@@ -97,6 +118,12 @@ func (svc *SessionSVCImpl) SetSessionBodyById(id string, body map[string]string)
 		return err
 	}
 
+	ttl := svc.ttl(sess)
+	if ttl <= 0 {
+		svc.DestroySession(id)
+		return session.SessionNotFoundError
+	}
+
 	//Set the body and remarshal back into a string
 	sess.SessionVars = body
 	sessBytes, err := json.Marshal(sess)
@@ -106,7 +133,7 @@ func (svc *SessionSVCImpl) SetSessionBodyById(id string, body map[string]string)
 	}
 
 	//reset the key
-	err = svc.ds.SetKey(generateSessionKey(id), string(sessBytes), session.MAX_SESSION_DURATION)
+	err = svc.ds.SetKey(generateSessionKey(id), string(sessBytes), ttl)
 	if err != nil {
 		log.Print("error setting key: " + err.Error())
 		return err
@@ -115,6 +142,135 @@ func (svc *SessionSVCImpl) SetSessionBodyById(id string, body map[string]string)
 	return nil
 }
 
+// GetSessionIdsForUser returns the ids of the user's live sessions.  The index isn't updated when sessions expire or
+// are destroyed individually, so stale entries are pruned here as they're found.
+func (svc *SessionSVCImpl) GetSessionIdsForUser(username string) ([]string, error) {
+	indexedIds, err := svc.ds.GetSetMembers(generateUserSessionsKey(username))
+	if err != nil {
+		log.Print("error fetching user session index: " + err.Error())
+		return nil, err
+	}
+
+	liveIds := []string{}
+	for _, id := range indexedIds {
+		rawSess, err := svc.ds.GetKey(generateSessionKey(id))
+		if err != nil {
+			log.Print("error fetching session by key: " + err.Error())
+			return nil, err
+		}
+		if len(rawSess) == 0 {
+			err = svc.ds.RemoveSetMember(generateUserSessionsKey(username), id)
+			if err != nil {
+				log.Print("error pruning user session index: " + err.Error())
+				return nil, err
+			}
+			continue
+		}
+		liveIds = append(liveIds, id)
+	}
+
+	return liveIds, nil
+}
+
+// DestroySessionsForUser destroys every session belonging to the user other than keepId, which may be empty
+func (svc *SessionSVCImpl) DestroySessionsForUser(username string, keepId string) error {
+	indexedIds, err := svc.ds.GetSetMembers(generateUserSessionsKey(username))
+	if err != nil {
+		log.Print("error fetching user session index: " + err.Error())
+		return err
+	}
+
+	for _, id := range indexedIds {
+		if id == keepId {
+			continue
+		}
+		err = svc.DestroySession(id)
+		if err != nil {
+			return err
+		}
+		err = svc.ds.RemoveSetMember(generateUserSessionsKey(username), id)
+		if err != nil {
+			log.Print("error removing session from user index: " + err.Error())
+			return err
+		}
+	}
+
+	//with nothing kept the index goes too, including anything added while the sessions were being destroyed
+	if keepId == "" {
+		err = svc.ds.DelKey(generateUserSessionsKey(username))
+		if err != nil {
+			log.Print("error deleting user session index: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *SessionSVCImpl) RenameUser(username string, newUsername string) (int, error) {
+	indexedIds, err := svc.ds.GetSetMembers(generateUserSessionsKey(username))
+	if err != nil {
+		log.Print("error fetching user session index: " + err.Error())
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range indexedIds {
+		rawSess, err := svc.ds.GetKey(generateSessionKey(id))
+		if err != nil {
+			log.Print("error fetching session by key: " + err.Error())
+			return moved, err
+		}
+		sess := &session.SessionData{}
+		if len(rawSess) > 0 {
+			err = json.Unmarshal([]byte(rawSess), sess)
+			if err != nil {
+				log.Print("error unmarshaling session data: " + err.Error())
+				return moved, err
+			}
+		}
+		//expired sessions are only dropped from the old index, there's nothing to move
+		if ttl := svc.ttl(sess); len(rawSess) > 0 && ttl > 0 {
+			sess.Username = newUsername
+			sessBytes, err := json.Marshal(sess)
+			if err != nil {
+				log.Print("error marshaling session data: " + err.Error())
+				return moved, err
+			}
+			err = svc.ds.SetKey(generateSessionKey(id), string(sessBytes), ttl)
+			if err != nil {
+				log.Print("error setting key: " + err.Error())
+				return moved, err
+			}
+			err = svc.ds.AddSetMember(generateUserSessionsKey(newUsername), id)
+			if err != nil {
+				log.Print("error indexing session for user: " + err.Error())
+				return moved, err
+			}
+			moved++
+		}
+		err = svc.ds.RemoveSetMember(generateUserSessionsKey(username), id)
+		if err != nil {
+			log.Print("error removing session from user index: " + err.Error())
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
+
+// ttl is how long the session may go unused: MAX_SESSION_DURATION, cut short by the session's expiry if it has one.
+// A session past its expiry gets 0 or less and must not be stored again, a zero timeout would keep it forever.
+func (svc *SessionSVCImpl) ttl(sess *session.SessionData) time.Duration {
+	if sess.ExpiresAt == nil {
+		return session.MAX_SESSION_DURATION
+	}
+	remaining := sess.ExpiresAt.Sub(svc.now())
+	if remaining > session.MAX_SESSION_DURATION {
+		return session.MAX_SESSION_DURATION
+	}
+	return remaining
+}
+
 func generateSessionId() string {
 	return uuid.New().String()
 }
@@ -122,3 +278,7 @@ func generateSessionId() string {
 func generateSessionKey(id string) string {
 	return "sess_" + id
 }
+
+func generateUserSessionsKey(username string) string {
+	return "usersess_" + username
+}
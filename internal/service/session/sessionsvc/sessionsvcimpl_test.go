@@ -1,6 +1,7 @@
 package sessionsvc
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang/mock/gomock"
@@ -8,6 +9,7 @@ import (
 	"sso-v2/gen/mocks/mock_datasource"
 	"sso-v2/internal/service/session"
 	"testing"
+	"time"
 )
 
 func Test_generateSessionKey(t *testing.T) {
@@ -76,11 +78,14 @@ func TestSessionSVCImpl_CreateSession(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			ds := mock_datasource.NewMockDatasource(ctrl)
 			ds.EXPECT().SetKey(gomock.Any(), gomock.Any(), session.MAX_SESSION_DURATION).Return(tt.err)
+			if tt.err == nil {
+				ds.EXPECT().AddSetMember(generateUserSessionsKey(tt.args.username), gomock.Any()).Return(nil)
+			}
 
 			svc := &SessionSVCImpl{
 				ds: ds,
 			}
-			gotSessionId, err := svc.CreateSession(tt.args.username, tt.args.sessionBody)
+			gotSessionId, err := svc.CreateSession(tt.args.username, tt.args.sessionBody, session.Access{})
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreateSession() error = %v, wantErr %v", err, tt.wantErr)
@@ -327,3 +332,143 @@ func TestSessionSVCImpl_SetSessionBodyById(t *testing.T) {
 		})
 	}
 }
+
+func TestSessionSVCImpl_GetSessionIdsForUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetSetMembers("usersess_joehrke").Return([]string{"live", "expired"}, nil)
+	ds.EXPECT().GetKey(generateSessionKey("live")).Return(`{"id":"live","username":"joehrke"}`, nil)
+	ds.EXPECT().GetKey(generateSessionKey("expired")).Return("", nil)
+	ds.EXPECT().RemoveSetMember("usersess_joehrke", "expired").Return(nil)
+
+	svc := &SessionSVCImpl{
+		ds: ds,
+	}
+	got, err := svc.GetSessionIdsForUser("joehrke")
+	if err != nil {
+		t.Errorf("GetSessionIdsForUser() unexpected error = %v", err)
+		return
+	}
+	if !reflect.DeepEqual(got, []string{"live"}) {
+		t.Errorf("GetSessionIdsForUser() got = %v, want %v", got, []string{"live"})
+	}
+	ctrl.Finish()
+}
+
+func TestSessionSVCImpl_DestroySessionsForUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		keepId  string
+		dsErr   error
+		wantErr bool
+	}{
+		{
+			name:    "Destroy_All",
+			keepId:  "",
+			wantErr: false,
+		},
+		{
+			name:    "Keep_Current",
+			keepId:  "b",
+			wantErr: false,
+		},
+		{
+			name:    "Redis_Error",
+			keepId:  "",
+			dsErr:   errors.New("test Redis error"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetSetMembers("usersess_joehrke").Return([]string{"a", "b"}, tt.dsErr)
+			if tt.dsErr == nil {
+				for _, id := range []string{"a", "b"} {
+					if id == tt.keepId {
+						continue
+					}
+					ds.EXPECT().DelKey(generateSessionKey(id)).Return(nil)
+					ds.EXPECT().RemoveSetMember("usersess_joehrke", id).Return(nil)
+				}
+				if tt.keepId == "" {
+					ds.EXPECT().DelKey("usersess_joehrke").Return(nil)
+				}
+			}
+
+			svc := &SessionSVCImpl{
+				ds: ds,
+			}
+			if err := svc.DestroySessionsForUser("joehrke", tt.keepId); (err != nil) != tt.wantErr {
+				t.Errorf("DestroySessionsForUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestSessionSVCImpl_RenameUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetSetMembers("usersess_joehrke").Return([]string{"live", "expired"}, nil)
+	ds.EXPECT().GetKey(generateSessionKey("live")).Return(`{"id":"live","username":"joehrke","sessionVars":{"a":"b"},"roles":["admin"]}`, nil)
+	ds.EXPECT().SetKey(generateSessionKey("live"), `{"id":"live","username":"jhrke","sessionVars":{"a":"b"},"roles":["admin"]}`, session.MAX_SESSION_DURATION).Return(nil)
+	ds.EXPECT().AddSetMember("usersess_jhrke", "live").Return(nil)
+	ds.EXPECT().RemoveSetMember("usersess_joehrke", "live").Return(nil)
+	ds.EXPECT().GetKey(generateSessionKey("expired")).Return("", nil)
+	ds.EXPECT().RemoveSetMember("usersess_joehrke", "expired").Return(nil)
+
+	svc := &SessionSVCImpl{
+		ds: ds,
+	}
+	moved, err := svc.RenameUser("joehrke", "jhrke")
+	if err != nil {
+		t.Fatalf("RenameUser() unexpected error = %v", err)
+	}
+	if moved != 1 {
+		t.Errorf("RenameUser() moved = %v, want 1", moved)
+	}
+	ctrl.Finish()
+}
+
+func TestSessionSVCImpl_GetSessionById_Expiry(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	soon := now.Add(10 * time.Minute)
+	later := now.Add(24 * time.Hour)
+	earlier := now.Add(-time.Second)
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		wantTTL   time.Duration
+		wantErr   error
+	}{
+		{name: "No_Expiry", wantTTL: session.MAX_SESSION_DURATION},
+		{name: "Expiry_Far_Off", expiresAt: &later, wantTTL: session.MAX_SESSION_DURATION},
+		{name: "Expiry_Close", expiresAt: &soon, wantTTL: 10 * time.Minute},
+		{name: "Expired", expiresAt: &earlier, wantErr: session.SessionNotFoundError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			raw, _ := json.Marshal(session.SessionData{Id: "12345", Username: "svc:billing", Access: session.Access{APIKeyId: "k1", ExpiresAt: tt.expiresAt}})
+			ds.EXPECT().GetKey(generateSessionKey("12345")).Return(string(raw), nil)
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKey(generateSessionKey("12345"), string(raw), tt.wantTTL).Return(nil)
+			} else {
+				ds.EXPECT().DelKey(generateSessionKey("12345")).Return(nil)
+			}
+
+			svc := &SessionSVCImpl{
+				ds:  ds,
+				now: func() time.Time { return now },
+			}
+			_, err := svc.GetSessionById("12345")
+			if err != tt.wantErr {
+				t.Errorf("GetSessionById() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
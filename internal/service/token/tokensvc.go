@@ -0,0 +1,28 @@
+package token
+
+import "time"
+
+//go:generate mockgen -source=tokensvc.go -destination=../../../gen/mocks/mock_token/tokensvc.go -self_package=../pkg/token
+
+// Purposes keep tokens issued for one flow from being redeemed in another
+const (
+	PasswordResetPurpose     = "pwreset"
+	EmailVerificationPurpose = "emailverify"
+	LoginLinkPurpose         = "loginlink"
+)
+
+type TokenSVC interface {
+	// IssueToken creates a random single-use token bound to a subject (usually a username) that expires after ttl
+	IssueToken(purpose string, subject string, ttl time.Duration) (token string, err error)
+	// ConsumeToken redeems a token, returning its subject.  A token can only ever be consumed once.
+	ConsumeToken(purpose string, token string) (subject string, err error)
+	// RevokeTokensFor deletes every outstanding token whose subject is the username, or starts with it followed by a
+	// space, returning how many were deleted
+	RevokeTokensFor(username string) (int, error)
+}
+
+type TokenError string
+
+func (e TokenError) Error() string { return string(e) }
+
+const InvalidToken = TokenError("invalid or expired token")
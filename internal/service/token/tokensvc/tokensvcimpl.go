@@ -0,0 +1,88 @@
+package tokensvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/token"
+	"strings"
+	"time"
+)
+
+const tokenBytes = 32
+
+type TokenSVCImpl struct {
+	ds datasource.Datasource
+}
+
+func NewTokenSvc(ds datasource.Datasource) token.TokenSVC {
+	return &TokenSVCImpl{ds: ds}
+}
+
+func (svc *TokenSVCImpl) IssueToken(purpose string, subject string, ttl time.Duration) (string, error) {
+	raw := make([]byte, tokenBytes)
+	_, err := rand.Read(raw)
+	if err != nil {
+		log.Print("error generating token: " + err.Error())
+		return "", err
+	}
+	tok := base64.RawURLEncoding.EncodeToString(raw)
+
+	//only a hash of the token is stored so a datastore dump can't be used to redeem outstanding tokens
+	err = svc.ds.SetKey(generateTokenKey(purpose, tok), subject, ttl)
+	if err != nil {
+		log.Print("error writing token: " + err.Error())
+		return "", err
+	}
+
+	return tok, nil
+}
+
+func (svc *TokenSVCImpl) ConsumeToken(purpose string, tok string) (string, error) {
+	if tok == "" {
+		return "", token.InvalidToken
+	}
+
+	//taking the key reads and deletes it in one step so two concurrent redemptions can't both succeed
+	subject, err := svc.ds.TakeKey(generateTokenKey(purpose, tok))
+	if err != nil {
+		log.Print("error consuming token: " + err.Error())
+		return "", err
+	}
+	if subject == "" {
+		return "", token.InvalidToken
+	}
+
+	return subject, nil
+}
+
+func (svc *TokenSVCImpl) RevokeTokensFor(username string) (int, error) {
+	//only hashes of the tokens are stored, so finding a user's means reading every subject
+	revoked := 0
+	err := datasource.ScanAll(svc.ds, "token_*", func(key string) error {
+		subject, err := svc.ds.GetKey(key)
+		if err != nil {
+			return err
+		}
+		if subject != username && !strings.HasPrefix(subject, username+" ") {
+			return nil
+		}
+		err = svc.ds.DelKey(key)
+		if err == nil {
+			revoked++
+		}
+		return err
+	})
+	if err != nil {
+		log.Print("error revoking tokens: " + err.Error())
+	}
+	return revoked, err
+}
+
+func generateTokenKey(purpose string, tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return "token_" + purpose + "_" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,123 @@
+package tokensvc
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/token"
+	"testing"
+	"time"
+)
+
+func TestTokenSVCImpl_IssueToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+
+	var storedKey string
+	ds.EXPECT().SetKey(gomock.Any(), "joehrke", 5*time.Minute).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+		storedKey = key
+		return nil
+	})
+
+	svc := &TokenSVCImpl{
+		ds: ds,
+	}
+	tok, err := svc.IssueToken("test", "joehrke", 5*time.Minute)
+	if err != nil {
+		t.Errorf("IssueToken() unexpected error = %v", err)
+		return
+	}
+	if len(tok) < 43 {
+		t.Errorf("IssueToken() token too short: %v", tok)
+	}
+	if storedKey != generateTokenKey("test", tok) {
+		t.Errorf("IssueToken() stored under %v, want %v", storedKey, generateTokenKey("test", tok))
+	}
+	ctrl.Finish()
+}
+
+func TestTokenSVCImpl_ConsumeToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		expectTake  bool
+		stored      string
+		dsErr       error
+		wantSubject string
+		wantErr     error
+	}{
+		{
+			name:        "HappyPath",
+			token:       "abc",
+			expectTake:  true,
+			stored:      "joehrke",
+			wantSubject: "joehrke",
+		},
+		{
+			name:       "Unknown_Or_Used",
+			token:      "abc",
+			expectTake: true,
+			stored:     "",
+			wantErr:    token.InvalidToken,
+		},
+		{
+			name:    "Empty_Token",
+			token:   "",
+			wantErr: token.InvalidToken,
+		},
+		{
+			name:       "Redis_Error",
+			token:      "abc",
+			expectTake: true,
+			dsErr:      errors.New("test Redis error"),
+			wantErr:    errors.New("test Redis error"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.expectTake {
+				ds.EXPECT().TakeKey(generateTokenKey("test", tt.token)).Return(tt.stored, tt.dsErr)
+			}
+
+			svc := &TokenSVCImpl{
+				ds: ds,
+			}
+			got, err := svc.ConsumeToken("test", tt.token)
+			if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Errorf("ConsumeToken() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.wantSubject {
+				t.Errorf("ConsumeToken() got = %v, want %v", got, tt.wantSubject)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestTokenSVCImpl_RevokeTokensFor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().ScanKeys(int64(0), "token_*", gomock.Any()).Return(int64(7), []string{"token_reset_a", "token_reset_b"}, nil)
+	ds.EXPECT().ScanKeys(int64(7), "token_*", gomock.Any()).Return(int64(0), []string{"token_email_c", "token_verify_d"}, nil)
+	ds.EXPECT().GetKey("token_reset_a").Return("joehrke", nil)
+	ds.EXPECT().GetKey("token_reset_b").Return("joehrke2", nil)
+	ds.EXPECT().GetKey("token_email_c").Return("joehrke joe@example.com", nil)
+	ds.EXPECT().GetKey("token_verify_d").Return("", nil)
+	ds.EXPECT().DelKey("token_reset_a").Return(nil)
+	ds.EXPECT().DelKey("token_email_c").Return(nil)
+
+	svc := &TokenSVCImpl{
+		ds: ds,
+	}
+	revoked, err := svc.RevokeTokensFor("joehrke")
+	if err != nil {
+		t.Fatalf("RevokeTokensFor() unexpected error = %v", err)
+	}
+	if revoked != 2 {
+		t.Errorf("RevokeTokensFor() revoked = %v, want 2", revoked)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,209 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode"
+)
+
+type AttributeType string
+
+const (
+	StringAttribute AttributeType = "string"
+	NumberAttribute AttributeType = "number"
+	BoolAttribute   AttributeType = "bool"
+)
+
+// AttributeDef describes one profile attribute users may carry
+type AttributeDef struct {
+	Type AttributeType `json:"type"`
+	// Required attributes must be given when the user is created and can't be removed afterwards
+	Required bool `json:"required"`
+	// Unique attributes can't hold the same value for two users
+	Unique bool `json:"unique"`
+	// ReadOnly attributes can only be set when the user is created
+	ReadOnly bool `json:"readOnly"`
+	// Session attributes are copied into the session vars of every new session for the user
+	Session bool `json:"session"`
+}
+
+// AttributeSchema maps attribute names to their definitions, attributes not in the schema are rejected
+type AttributeSchema map[string]AttributeDef
+
+type AttributeError string
+
+func (e AttributeError) Error() string {
+	return string(e)
+}
+
+type AttributeTakenError string
+
+func (e AttributeTakenError) Error() string {
+	return string(e)
+}
+
+// ParseAttributeSchema reads a schema from JSON, e.g. {"displayName":{"type":"string","session":true}}.  Names are
+// limited to letters and digits so they can be embedded in datastore keys.
+func ParseAttributeSchema(raw []byte) (AttributeSchema, error) {
+	schema := AttributeSchema{}
+	err := json.Unmarshal(raw, &schema)
+	if err != nil {
+		return nil, err
+	}
+	for name, def := range schema {
+		if !validAttributeName(name) {
+			return nil, fmt.Errorf("invalid attribute name %q", name)
+		}
+		switch def.Type {
+		case StringAttribute, NumberAttribute, BoolAttribute:
+		default:
+			return nil, fmt.Errorf("attribute %v has unknown type %q", name, def.Type)
+		}
+	}
+	return schema, nil
+}
+
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks a full set of attributes for a new user: every attribute must be known and of the right type, and
+// every required attribute must be present.  Nil values count as absent.
+func (s AttributeSchema) Validate(attrs map[string]interface{}) error {
+	for _, name := range s.Names() {
+		if s[name].Required && attrs[name] == nil {
+			return AttributeError(fmt.Sprintf("attribute %v is required", name))
+		}
+	}
+	for name, value := range attrs {
+		if value == nil {
+			continue
+		}
+		err := s.checkValue(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyPatch merges patch into current following JSON merge patch rules, a nil value removes the attribute.  Read only
+// attributes can't be changed and required attributes can't be removed.  The result is a new map, current isn't
+// modified.
+func (s AttributeSchema) ApplyPatch(current map[string]interface{}, patch map[string]interface{}) (map[string]interface{}, error) {
+	updated := make(map[string]interface{}, len(current)+len(patch))
+	for name, value := range current {
+		updated[name] = value
+	}
+
+	for name, value := range patch {
+		def, ok := s[name]
+		if !ok {
+			return nil, AttributeError(fmt.Sprintf("unknown attribute %v", name))
+		}
+		if def.ReadOnly {
+			return nil, AttributeError(fmt.Sprintf("attribute %v is read only", name))
+		}
+		if value == nil {
+			if def.Required {
+				return nil, AttributeError(fmt.Sprintf("attribute %v is required", name))
+			}
+			delete(updated, name)
+			continue
+		}
+		err := s.checkValue(name, value)
+		if err != nil {
+			return nil, err
+		}
+		updated[name] = value
+	}
+	return updated, nil
+}
+
+func (s AttributeSchema) checkValue(name string, value interface{}) error {
+	def, ok := s[name]
+	if !ok {
+		return AttributeError(fmt.Sprintf("unknown attribute %v", name))
+	}
+	valid := false
+	switch value.(type) {
+	case string:
+		valid = def.Type == StringAttribute
+	case float64:
+		valid = def.Type == NumberAttribute
+	case bool:
+		valid = def.Type == BoolAttribute
+	}
+	if !valid {
+		return AttributeError(fmt.Sprintf("attribute %v must be a %v", name, def.Type))
+	}
+	return nil
+}
+
+// SessionVars picks out the attributes marked for copying into sessions, formatted as strings
+func (s AttributeSchema) SessionVars(attrs map[string]interface{}) map[string]string {
+	vars := make(map[string]string)
+	for name, value := range attrs {
+		if def, ok := s[name]; ok && def.Session && value != nil {
+			vars[name] = AttributeString(value)
+		}
+	}
+	return vars
+}
+
+// CoerceStrings converts string values of number and bool attributes to their type, for sources like CSV files where
+// every value arrives as text.  Values that don't parse are left for Validate to reject.
+func (s AttributeSchema) CoerceStrings(attrs map[string]interface{}) map[string]interface{} {
+	coerced := make(map[string]interface{}, len(attrs))
+	for name, value := range attrs {
+		coerced[name] = value
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+		switch s[name].Type {
+		case NumberAttribute:
+			if n, err := strconv.ParseFloat(raw, 64); err == nil {
+				coerced[name] = n
+			}
+		case BoolAttribute:
+			if b, err := strconv.ParseBool(raw); err == nil {
+				coerced[name] = b
+			}
+		}
+	}
+	return coerced
+}
+
+// Names returns the attribute names in the schema in sorted order
+func (s AttributeSchema) Names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AttributeString formats an attribute value the way it appears in session vars and uniqueness indexes
+func AttributeString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,147 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testSchema = AttributeSchema{
+	"displayName": {Type: StringAttribute, Required: true, Session: true},
+	"employeeId":  {Type: StringAttribute, Unique: true, ReadOnly: true},
+	"age":         {Type: NumberAttribute, Session: true},
+	"newsletter":  {Type: BoolAttribute},
+}
+
+func TestParseAttributeSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    AttributeSchema
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			raw:  `{"displayName":{"type":"string","required":true,"session":true},"age":{"type":"number"}}`,
+			want: AttributeSchema{
+				"displayName": {Type: StringAttribute, Required: true, Session: true},
+				"age":         {Type: NumberAttribute},
+			},
+		},
+		{
+			name:    "unknown type",
+			raw:     `{"displayName":{"type":"text"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "name with separator",
+			raw:     `{"display_name":{"type":"string"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			raw:     `displayName`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAttributeSchema([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseAttributeSchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAttributeSchema() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeSchema_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		attrs   map[string]interface{}
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			attrs: map[string]interface{}{"displayName": "Joe", "age": 41.0, "newsletter": true, "employeeId": nil},
+		},
+		{
+			name:    "missing required",
+			attrs:   map[string]interface{}{"age": 41.0},
+			wantErr: AttributeError("attribute displayName is required"),
+		},
+		{
+			name:    "wrong type",
+			attrs:   map[string]interface{}{"displayName": "Joe", "age": "41"},
+			wantErr: AttributeError("attribute age must be a number"),
+		},
+		{
+			name:    "unknown attribute",
+			attrs:   map[string]interface{}{"displayName": "Joe", "shoeSize": 11.0},
+			wantErr: AttributeError("unknown attribute shoeSize"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := testSchema.Validate(tt.attrs); err != tt.wantErr {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAttributeSchema_ApplyPatch(t *testing.T) {
+	current := map[string]interface{}{"displayName": "Joe", "employeeId": "e-12", "age": 41.0}
+	tests := []struct {
+		name    string
+		patch   map[string]interface{}
+		want    map[string]interface{}
+		wantErr error
+	}{
+		{
+			name:  "set and remove",
+			patch: map[string]interface{}{"displayName": "Joseph", "age": nil, "newsletter": false},
+			want:  map[string]interface{}{"displayName": "Joseph", "employeeId": "e-12", "newsletter": false},
+		},
+		{
+			name:    "read only",
+			patch:   map[string]interface{}{"employeeId": "e-13"},
+			wantErr: AttributeError("attribute employeeId is read only"),
+		},
+		{
+			name:    "remove required",
+			patch:   map[string]interface{}{"displayName": nil},
+			wantErr: AttributeError("attribute displayName is required"),
+		},
+		{
+			name:    "wrong type",
+			patch:   map[string]interface{}{"newsletter": "yes"},
+			wantErr: AttributeError("attribute newsletter must be a bool"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testSchema.ApplyPatch(current, tt.patch)
+			if err != tt.wantErr {
+				t.Errorf("ApplyPatch() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ApplyPatch() got = %v, want %v", got, tt.want)
+			}
+			if current["displayName"] != "Joe" || len(current) != 3 {
+				t.Errorf("ApplyPatch() modified the current attributes: %v", current)
+			}
+		})
+	}
+}
+
+func TestAttributeSchema_SessionVars(t *testing.T) {
+	got := testSchema.SessionVars(map[string]interface{}{"displayName": "Joe", "age": 41.5, "employeeId": "e-12"})
+	want := map[string]string{"displayName": "Joe", "age": "41.5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SessionVars() got = %v, want %v", got, want)
+	}
+}
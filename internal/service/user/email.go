@@ -0,0 +1,43 @@
+package user
+
+import (
+	"net/mail"
+	"strings"
+)
+
+type EmailError string
+
+func (e EmailError) Error() string {
+	return string(e)
+}
+
+const (
+	InvalidEmail     = EmailError("invalid email address")
+	EmailTaken       = EmailError("email address already in use")
+	EmailNotVerified = EmailError("email address not verified")
+	// EmailChanged is returned when verifying an address the user no longer has on file
+	EmailChanged = EmailError("email address has changed")
+)
+
+// NormalizeEmail validates a bare address (no display name) and lower cases it so uniqueness checks aren't fooled by
+// case differences
+func NormalizeEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw || addr.Name != "" {
+		return "", InvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// ContactAddress is where messages for the user should be delivered: their verified email, or the username itself
+// when it is an address.  An empty result means the user can't be contacted.
+func (u *UserData) ContactAddress() string {
+	if u.Email != "" && u.EmailVerified {
+		return u.Email
+	}
+	if _, err := NormalizeEmail(u.Username); err == nil {
+		return u.Username
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package user
+
+import "time"
+
+// ExportedUser is a user record as it's shown to operators, in listings, exports and subject access reports.  The
+// credential fields are only filled in when asked for.
+type ExportedUser struct {
+	Username      string                 `json:"username"`
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"emailVerified"`
+	State         UserState              `json:"state"`
+	MFAEnabled    bool                   `json:"mfaEnabled"`
+	Roles         []string               `json:"roles,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	Identities    []FederatedIdentity    `json:"identities,omitempty"`
+	// PasswordChangedAt and MustChangePassword describe the password without revealing it
+	PasswordChangedAt  *time.Time `json:"passwordChangedAt,omitempty"`
+	MustChangePassword bool       `json:"mustChangePassword,omitempty"`
+
+	HashedPass    string   `json:"hashedPass,omitempty"`
+	TOTPSecret    string   `json:"totpSecret,omitempty"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// Export returns the operator view of u, with its password hash, authenticator secret and recovery code hashes only if
+// includeCredentials is set
+func (u *UserData) Export(includeCredentials bool) ExportedUser {
+	exported := ExportedUser{
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		State:         u.CurrentState(),
+		MFAEnabled:    u.MFAEnabled(),
+		Roles:         u.Roles,
+		Attributes:    u.Attributes,
+		Identities:    u.Identities,
+
+		PasswordChangedAt:  u.PasswordChangedAt,
+		MustChangePassword: u.MustChangePassword,
+	}
+	if includeCredentials {
+		exported.HashedPass = u.HashedPass
+		exported.RecoveryCodes = u.RecoveryCodes
+		if u.TOTP != nil {
+			exported.TOTPSecret = u.TOTP.Secret
+		}
+	}
+	return exported
+}
@@ -0,0 +1,29 @@
+package user
+
+// FederatedIdentity is an account at an external identity provider that can log in as a local user
+type FederatedIdentity struct {
+	Provider string `json:"provider"`
+	// Subject is the provider's stable identifier for the account, the ID token's sub claim
+	Subject string `json:"subject"`
+}
+
+// IdentityFor returns the user's identity at provider, or nil if they haven't linked one
+func (u *UserData) IdentityFor(provider string) *FederatedIdentity {
+	for i := range u.Identities {
+		if u.Identities[i].Provider == provider {
+			return &u.Identities[i]
+		}
+	}
+	return nil
+}
+
+type IdentityError string
+
+func (e IdentityError) Error() string {
+	return string(e)
+}
+
+const (
+	IdentityTaken     = IdentityError("identity already linked to another user")
+	IdentityNotLinked = IdentityError("no identity linked for provider")
+)
@@ -0,0 +1,23 @@
+package user
+
+// ImportRecord is an account brought in from another system.  PasswordHash is stored as-is, so it must be in one of
+// the formats AuthUser can check: bcrypt, Apache MD5 ($apr1$), unsalted SHA-1 ({SHA}) or a hash peppered with a
+// configured key ($pepper$).  Legacy formats are replaced with bcrypt the first time the user logs in.
+type ImportRecord struct {
+	Username      string                 `json:"username"`
+	PasswordHash  string                 `json:"passwordHash"`
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"emailVerified,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+}
+
+type PasswordHashError string
+
+func (e PasswordHashError) Error() string {
+	return string(e)
+}
+
+const (
+	MissingPasswordHash     = PasswordHashError("missing password hash")
+	UnsupportedPasswordHash = PasswordHashError("unsupported password hash format")
+)
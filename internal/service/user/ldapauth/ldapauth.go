@@ -0,0 +1,312 @@
+// Package ldapauth authenticates users against an LDAP directory.  It wraps a local user.UserSVC, replacing AuthUser
+// with a search-then-bind against the directory and leaving everything else to the local store, which still holds the
+// user records sessions, roles and profiles are built from.
+package ldapauth
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net"
+	"net/url"
+	"sso-v2/internal/service/user"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultUserFilter finds entries by uid, {username} is replaced with the escaped username
+	DefaultUserFilter = "(uid={username})"
+	DefaultTimeout    = 10 * time.Second
+
+	// dummyHash is compared against when a user isn't in the directory and there's no local fallback, so that answer
+	// costs the same bcrypt work as the local store's not found path.  It matches the local store's bcrypt cost.
+	dummyHash = "$2a$14$fO0OmXwSpwA094kSsI3iR.FhoGe688do4vqu4gFgxoocuWXlE/aL2"
+)
+
+type Config struct {
+	// URL is the directory server, ldap://host:389 or ldaps://host:636
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS before anything is sent
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS connections, nil verifies the server against the system roots
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the account used to search for users, leave them empty to search anonymously
+	BindDN       string
+	BindPassword string
+	// BaseDN is where the search for users starts, the whole subtree below it is searched
+	BaseDN string
+	// UserFilter finds a user's entry, see DefaultUserFilter
+	UserFilter string
+	// EmailAttribute is the directory attribute holding the user's email address, copied to provisioned users
+	EmailAttribute string
+	// Attributes maps local profile attribute names to the directory attributes they're copied from.  They're set when
+	// a user is provisioned and refreshed on every login.
+	Attributes map[string]string
+	// AutoProvision creates a local user the first time somebody in the directory logs in.  Without it directory
+	// users need an existing local user of the same name.
+	AutoProvision bool
+	// LocalFallback checks users the directory doesn't have against the local password store, so local and directory
+	// accounts can be used side by side.  Users the directory does have are only ever checked against it.
+	LocalFallback bool
+	Timeout       time.Duration
+}
+
+type LdapUserSVC struct {
+	user.UserSVC
+	cfg    Config
+	schema user.AttributeSchema
+}
+
+// NewLdapUserSvc returns local with AuthUser backed by the directory.  schema is the local attribute schema, mapped
+// directory values are converted to its types.
+func NewLdapUserSvc(local user.UserSVC, schema user.AttributeSchema, cfg Config) user.UserSVC {
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = DefaultUserFilter
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return &LdapUserSVC{UserSVC: local, cfg: cfg, schema: schema}
+}
+
+type ldapError string
+
+func (e ldapError) Error() string { return string(e) }
+
+const (
+	// notInDirectory means the search found no entry for the username
+	notInDirectory = ldapError("user not in directory")
+	ambiguousUser  = ldapError("user filter matched more than one directory entry")
+)
+
+func (svc *LdapUserSVC) AuthUser(username string, pass string) (bool, error) {
+	normalized, err := user.NormalizeUsername(username)
+	if err != nil {
+		//the local store treats names that can't exist the same way as unknown ones
+		return svc.UserSVC.AuthUser(username, pass)
+	}
+
+	entry, err := svc.authenticate(normalized, pass)
+	if err == notInDirectory {
+		if svc.cfg.LocalFallback {
+			return svc.UserSVC.AuthUser(normalized, pass)
+		}
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(pass))
+		return false, user.NotFound
+	}
+	if err != nil {
+		log.Printf("error authenticating against directory: %v", err.Error())
+		return false, err
+	}
+	if entry == nil {
+		return false, nil
+	}
+	return svc.loginLocalUser(normalized, entry)
+}
+
+// PasswordChangeRequired only applies the local password policy to users the directory doesn't have.  Directory users
+// log in with their directory password, so the local one being old or flagged for a change means nothing.
+func (svc *LdapUserSVC) PasswordChangeRequired(u *user.UserData) bool {
+	if !svc.UserSVC.PasswordChangeRequired(u) {
+		return false
+	}
+	//without the fallback every password login went through the directory
+	if !svc.cfg.LocalFallback {
+		return false
+	}
+
+	conn, err := svc.connect()
+	if err == nil {
+		defer conn.Close()
+		_, err = svc.find(conn, u.Username)
+	}
+	if err == notInDirectory {
+		return true
+	}
+	if err != nil {
+		//a restricted session is the safe answer when the directory can't say
+		log.Printf("error looking up directory user: %v", err.Error())
+		return true
+	}
+	return false
+}
+
+// authenticate finds the user's entry and binds as it, returning the entry if the password is right and nil if it's
+// wrong
+func (svc *LdapUserSVC) authenticate(username string, pass string) (*ldap.Entry, error) {
+	conn, err := svc.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := svc.find(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	//a simple bind with an empty password is an unauthenticated bind, which servers accept for any DN
+	if pass == "" {
+		return nil, nil
+	}
+	err = conn.Bind(entry.DN, pass)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// connect dials the directory and binds as the service account, if one is configured
+func (svc *LdapUserSVC) connect() (*ldap.Conn, error) {
+	conn, err := svc.dial()
+	if err != nil {
+		return nil, err
+	}
+	if svc.cfg.BindDN != "" {
+		err = conn.Bind(svc.cfg.BindDN, svc.cfg.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// find searches for the user's entry with the mapped attributes, the filter has to match exactly one
+func (svc *LdapUserSVC) find(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	attributes := []string{"dn"}
+	if svc.cfg.EmailAttribute != "" {
+		attributes = append(attributes, svc.cfg.EmailAttribute)
+	}
+	for _, ldapName := range svc.cfg.Attributes {
+		attributes = append(attributes, ldapName)
+	}
+	//two results are enough to know the filter isn't unique
+	search := ldap.NewSearchRequest(svc.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2,
+		int(svc.cfg.Timeout/time.Second), false,
+		strings.Replace(svc.cfg.UserFilter, "{username}", ldap.EscapeFilter(username), -1), attributes, nil)
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, ambiguousUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, notInDirectory
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, ambiguousUser
+	}
+}
+
+func (svc *LdapUserSVC) dial() (*ldap.Conn, error) {
+	serverURL, err := url.Parse(svc.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{}
+	if svc.cfg.TLSConfig != nil {
+		tlsConfig = svc.cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverURL.Hostname()
+	}
+
+	conn, err := ldap.DialURL(svc.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: svc.cfg.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(svc.cfg.Timeout)
+
+	if svc.cfg.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// loginLocalUser finishes a directory login against the local user of the same name, provisioning it first if
+// that's enabled
+func (svc *LdapUserSVC) loginLocalUser(username string, entry *ldap.Entry) (bool, error) {
+	attributes := svc.mappedAttributes(entry)
+
+	userDat, err := svc.UserSVC.GetUser(username)
+	if err == user.NotFound && svc.cfg.AutoProvision {
+		err = svc.provision(username, entry, attributes)
+		//a concurrent first login may have provisioned the user already
+		if err != nil && err != user.UsernameTaken {
+			log.Printf("error provisioning directory user: %v", err.Error())
+			return false, err
+		}
+		userDat, err = svc.UserSVC.GetUser(username)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = userDat.LoginError()
+	if err != nil {
+		return false, err
+	}
+
+	if len(attributes) > 0 {
+		_, err = svc.UserSVC.UpdateAttributes(username, attributes)
+		//stale attributes aren't worth failing the login over
+		if err != nil {
+			log.Printf("error refreshing directory attributes: %v", err.Error())
+		}
+	}
+	return true, nil
+}
+
+// provision creates the local user for a directory entry.  The local password is random, so the account can only be
+// logged into through the directory even with LocalFallback on.
+func (svc *LdapUserSVC) provision(username string, entry *ldap.Entry, attributes map[string]interface{}) error {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return err
+	}
+	hashedPass, err := svc.UserSVC.EncryptPassword(hex.EncodeToString(raw))
+	if err != nil {
+		return err
+	}
+
+	record := user.ImportRecord{
+		Username:     username,
+		PasswordHash: hashedPass,
+		Attributes:   attributes,
+	}
+	if svc.cfg.EmailAttribute != "" {
+		//the directory is trusted to hold the user's real address
+		record.Email = entry.GetAttributeValue(svc.cfg.EmailAttribute)
+		record.EmailVerified = record.Email != ""
+	}
+	return svc.UserSVC.ImportUser(record, false)
+}
+
+// mappedAttributes copies the configured directory attributes into local profile attributes.  Attributes missing
+// from the entry are left out rather than cleared.
+func (svc *LdapUserSVC) mappedAttributes(entry *ldap.Entry) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for localName, ldapName := range svc.cfg.Attributes {
+		if value := entry.GetAttributeValue(ldapName); value != "" {
+			attributes[localName] = value
+		}
+	}
+	return svc.schema.CoerceStrings(attributes)
+}
@@ -0,0 +1,240 @@
+package ldapauth
+
+import (
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/test/ldaptest"
+	"testing"
+)
+
+func startDirectory(t *testing.T) *ldaptest.Server {
+	server, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=sso,dc=example,dc=com", Password: "service-secret"},
+		ldaptest.Entry{
+			DN:       "uid=joehrke,ou=people,dc=example,dc=com",
+			Password: "hunter2",
+			Attributes: map[string][]string{
+				"objectClass":      {"person"},
+				"uid":              {"joehrke"},
+				"mail":             {"joe@example.com"},
+				"departmentNumber": {"sales"},
+			},
+		},
+		ldaptest.Entry{DN: "uid=dup,ou=people,dc=example,dc=com", Attributes: map[string][]string{"objectClass": {"person"}, "uid": {"dup"}}},
+		ldaptest.Entry{DN: "uid=dup,ou=contractors,dc=example,dc=com", Attributes: map[string][]string{"objectClass": {"person"}, "uid": {"dup"}}},
+	)
+	if err != nil {
+		t.Fatalf("starting directory: %v", err)
+	}
+	server.RequireBind = true
+	return server
+}
+
+func TestLdapUserSVC_AuthUser(t *testing.T) {
+	directory := startDirectory(t)
+	defer directory.Close()
+
+	tests := []struct {
+		name          string
+		username      string
+		password      string
+		autoProvision bool
+		localFallback bool
+		expect        func(local *mock_user.MockUserSVC)
+		wantAuthed    bool
+		wantErr       error
+	}{
+		{
+			name:     "HappyPath",
+			username: "JoeHrke",
+			password: "hunter2",
+			expect: func(local *mock_user.MockUserSVC) {
+				local.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke"}, nil)
+				local.EXPECT().UpdateAttributes("joehrke", map[string]interface{}{"department": "sales"}).Return(nil, nil)
+			},
+			wantAuthed: true,
+		},
+		{
+			name:     "Wrong_Password",
+			username: "joehrke",
+			password: "hunter3",
+		},
+		{
+			name:     "Empty_Password",
+			username: "joehrke",
+		},
+		{
+			name:     "Locally_Disabled",
+			username: "joehrke",
+			password: "hunter2",
+			expect: func(local *mock_user.MockUserSVC) {
+				local.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke", State: user.StateDisabled}, nil)
+			},
+			wantErr: user.AccountDisabled,
+		},
+		{
+			name:     "No_Local_User",
+			username: "joehrke",
+			password: "hunter2",
+			expect: func(local *mock_user.MockUserSVC) {
+				local.EXPECT().GetUser("joehrke").Return(nil, user.NotFound)
+			},
+			wantErr: user.NotFound,
+		},
+		{
+			name:          "Provisioned",
+			username:      "joehrke",
+			password:      "hunter2",
+			autoProvision: true,
+			expect: func(local *mock_user.MockUserSVC) {
+				gomock.InOrder(
+					local.EXPECT().GetUser("joehrke").Return(nil, user.NotFound),
+					local.EXPECT().EncryptPassword(gomock.Any()).Return("$2a$hash", nil),
+					local.EXPECT().ImportUser(user.ImportRecord{
+						Username:      "joehrke",
+						PasswordHash:  "$2a$hash",
+						Email:         "joe@example.com",
+						EmailVerified: true,
+						Attributes:    map[string]interface{}{"department": "sales"},
+					}, false).Return(nil),
+					local.EXPECT().GetUser("joehrke").Return(&user.UserData{Username: "joehrke"}, nil),
+					local.EXPECT().UpdateAttributes("joehrke", gomock.Any()).Return(nil, nil),
+				)
+			},
+			wantAuthed: true,
+		},
+		{
+			name:     "Not_In_Directory",
+			username: "localonly",
+			password: "secret",
+			wantErr:  user.NotFound,
+		},
+		{
+			name:          "Not_In_Directory_Local_Fallback",
+			username:      "localonly",
+			password:      "secret",
+			localFallback: true,
+			expect: func(local *mock_user.MockUserSVC) {
+				local.EXPECT().AuthUser("localonly", "secret").Return(true, nil)
+			},
+			wantAuthed: true,
+		},
+		{
+			name:          "In_Directory_Skips_Local_Fallback",
+			username:      "joehrke",
+			password:      "local-password",
+			localFallback: true,
+		},
+		{
+			name:     "Ambiguous_Filter",
+			username: "dup",
+			password: "secret",
+			wantErr:  ambiguousUser,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			local := mock_user.NewMockUserSVC(ctrl)
+			if tt.expect != nil {
+				tt.expect(local)
+			}
+
+			svc := NewLdapUserSvc(local, user.AttributeSchema{}, Config{
+				URL:            directory.URL,
+				BindDN:         "cn=sso,dc=example,dc=com",
+				BindPassword:   "service-secret",
+				BaseDN:         "dc=example,dc=com",
+				UserFilter:     "(&(objectClass=*)(uid={username}))",
+				EmailAttribute: "mail",
+				Attributes:     map[string]string{"department": "departmentNumber"},
+				AutoProvision:  tt.autoProvision,
+				LocalFallback:  tt.localFallback,
+			})
+			authed, err := svc.AuthUser(tt.username, tt.password)
+			if err != tt.wantErr {
+				t.Errorf("AuthUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if authed != tt.wantAuthed {
+				t.Errorf("AuthUser() authed = %v, want %v", authed, tt.wantAuthed)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestLdapUserSVC_AuthUser_ServiceAccountRejected(t *testing.T) {
+	directory := startDirectory(t)
+	defer directory.Close()
+
+	ctrl := gomock.NewController(t)
+	svc := NewLdapUserSvc(mock_user.NewMockUserSVC(ctrl), user.AttributeSchema{}, Config{
+		URL:          directory.URL,
+		BindDN:       "cn=sso,dc=example,dc=com",
+		BindPassword: "wrong",
+		BaseDN:       "dc=example,dc=com",
+	})
+	_, err := svc.AuthUser("joehrke", "hunter2")
+	if err == nil || err == user.NotFound {
+		t.Errorf("AuthUser() error = %v, want a directory error", err)
+	}
+	ctrl.Finish()
+}
+
+func TestLdapUserSVC_PasswordChangeRequired(t *testing.T) {
+	directory := startDirectory(t)
+	defer directory.Close()
+
+	tests := []struct {
+		name          string
+		username      string
+		localExpired  bool
+		localFallback bool
+		want          bool
+	}{
+		{
+			name:          "Not_Expired",
+			username:      "localonly",
+			localFallback: true,
+		},
+		{
+			name:         "Directory_Only",
+			username:     "localonly",
+			localExpired: true,
+		},
+		{
+			name:          "Directory_User",
+			username:      "joehrke",
+			localExpired:  true,
+			localFallback: true,
+		},
+		{
+			name:          "Local_User",
+			username:      "localonly",
+			localExpired:  true,
+			localFallback: true,
+			want:          true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			local := mock_user.NewMockUserSVC(ctrl)
+			u := &user.UserData{Username: tt.username}
+			local.EXPECT().PasswordChangeRequired(u).Return(tt.localExpired)
+
+			svc := NewLdapUserSvc(local, user.AttributeSchema{}, Config{
+				URL:           directory.URL,
+				BindDN:        "cn=sso,dc=example,dc=com",
+				BindPassword:  "service-secret",
+				BaseDN:        "dc=example,dc=com",
+				LocalFallback: tt.localFallback,
+			})
+			if got := svc.PasswordChangeRequired(u); got != tt.want {
+				t.Errorf("PasswordChangeRequired() = %v, want %v", got, tt.want)
+			}
+			ctrl.Finish()
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package user
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// UserQuery selects a page of users for ListUsers.  Every filter that is set must match.
+type UserQuery struct {
+	// Prefix matches the start of the normalized username
+	Prefix string
+	// Attributes matches profile attributes by their string form, see AttributeString
+	Attributes map[string]string
+	State      UserState
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor string
+	// Limit is the page size, zero means DefaultPageSize and anything above MaxPageSize is capped
+	Limit int
+}
+
+// UserPage is one page of ListUsers results in username order.  An empty NextCursor means there are no more pages.
+type UserPage struct {
+	Users      []UserData
+	NextCursor string
+}
+
+// PageSize returns the number of users a page for the query should hold
+func (q UserQuery) PageSize() int {
+	if q.Limit <= 0 {
+		return DefaultPageSize
+	}
+	if q.Limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return q.Limit
+}
+
+// Matches reports whether u passes the query's state and attribute filters, the prefix is left to the index
+func (q UserQuery) Matches(u *UserData) bool {
+	if q.State != "" && u.CurrentState() != q.State {
+		return false
+	}
+	for name, want := range q.Attributes {
+		value, ok := u.Attributes[name]
+		if !ok || AttributeString(value) != want {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package user
+
+import "time"
+
+type PasswordError string
+
+func (e PasswordError) Error() string {
+	return string(e)
+}
+
+// PasswordReused is returned for a new password that matches one of the user's recent passwords
+const PasswordReused = PasswordError("password was used recently")
+
+// PasswordExpired reports whether the user has to change their password before they can do anything else, either
+// because an admin forced a change or because it is older than maxAge.  A maxAge of 0 means passwords don't expire,
+// and a password without a change time hasn't started aging yet.
+func (u *UserData) PasswordExpired(maxAge time.Duration, now time.Time) bool {
+	if u.MustChangePassword {
+		return true
+	}
+	if maxAge <= 0 || u.PasswordChangedAt == nil {
+		return false
+	}
+	return now.Sub(*u.PasswordChangedAt) > maxAge
+}
+
+// RecentPasswordHashes returns the hashes of the user's last n passwords, newest first, starting with the current one
+func (u *UserData) RecentPasswordHashes(n int) []string {
+	if n <= 0 || u.HashedPass == "" {
+		return nil
+	}
+	recent := []string{u.HashedPass}
+	for _, hash := range u.PasswordHistory {
+		if len(recent) >= n {
+			break
+		}
+		recent = append(recent, hash)
+	}
+	return recent
+}
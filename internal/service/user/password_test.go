@@ -0,0 +1,55 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserData_PasswordExpired(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	changed := now.Add(-91 * 24 * time.Hour)
+	recent := now.Add(-time.Hour)
+	tests := []struct {
+		name   string
+		user   UserData
+		maxAge time.Duration
+		want   bool
+	}{
+		{name: "no maximum age", user: UserData{PasswordChangedAt: &changed}},
+		{name: "too old", user: UserData{PasswordChangedAt: &changed}, maxAge: 90 * 24 * time.Hour, want: true},
+		{name: "recent", user: UserData{PasswordChangedAt: &recent}, maxAge: 90 * 24 * time.Hour},
+		{name: "never dated", user: UserData{}, maxAge: 90 * 24 * time.Hour},
+		{name: "forced", user: UserData{PasswordChangedAt: &recent, MustChangePassword: true}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.PasswordExpired(tt.maxAge, now); got != tt.want {
+				t.Errorf("PasswordExpired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserData_RecentPasswordHashes(t *testing.T) {
+	u := UserData{HashedPass: "current", PasswordHistory: []string{"previous", "oldest"}}
+	tests := []struct {
+		name string
+		user UserData
+		n    int
+		want []string
+	}{
+		{name: "off", user: u, n: 0},
+		{name: "current only", user: u, n: 1, want: []string{"current"}},
+		{name: "some history", user: u, n: 2, want: []string{"current", "previous"}},
+		{name: "more than kept", user: u, n: 5, want: []string{"current", "previous", "oldest"}},
+		{name: "no password", user: UserData{}, n: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.RecentPasswordHashes(tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RecentPasswordHashes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package user
+
+// UserState is where an account is in its lifecycle, only active users can authenticate
+type UserState string
+
+const (
+	StateActive              UserState = "active"
+	StateDisabled            UserState = "disabled"
+	StateLocked              UserState = "locked"
+	StatePendingVerification UserState = "pendingVerification"
+	// StateDeleted keeps a tombstone so the username can't be registered again, the user is otherwise treated as
+	// though they don't exist
+	StateDeleted UserState = "deleted"
+)
+
+type AccountStateError string
+
+func (e AccountStateError) Error() string {
+	return string(e)
+}
+
+const (
+	AccountDisabled = AccountStateError("account disabled")
+	AccountLocked   = AccountStateError("account locked")
+	InvalidState    = AccountStateError("invalid account state")
+)
+
+// CurrentState returns the user's lifecycle state, records written before states existed are active
+func (u *UserData) CurrentState() UserState {
+	if u.State == "" {
+		return StateActive
+	}
+	return u.State
+}
+
+// LoginError returns why the account can't log in in its current state, or nil if it can
+func (u *UserData) LoginError() error {
+	switch u.CurrentState() {
+	case StateDeleted:
+		return NotFound
+	case StateDisabled:
+		return AccountDisabled
+	case StateLocked:
+		return AccountLocked
+	case StatePendingVerification:
+		return EmailNotVerified
+	}
+	return nil
+}
+
+// ValidState reports whether s is one of the known lifecycle states
+func ValidState(s UserState) bool {
+	switch s {
+	case StateActive, StateDisabled, StateLocked, StatePendingVerification, StateDeleted:
+		return true
+	}
+	return false
+}
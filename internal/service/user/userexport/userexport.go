@@ -0,0 +1,91 @@
+// Package userexport gathers stored user data for operators: full exports and per-user subject access reports for
+// data protection requests.
+package userexport
+
+import (
+	"encoding/json"
+	"io"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/group"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"time"
+)
+
+// WriteJSONL writes every user to w as one JSON object per line, see user.ExportedUser, returning how many were written
+func WriteJSONL(userSVC user.UserSVC, w io.Writer, includeCredentials bool) (int, error) {
+	enc := json.NewEncoder(w)
+	written := 0
+	err := userSVC.ExportUsers(func(u *user.UserData) error {
+		err := enc.Encode(u.Export(includeCredentials))
+		if err == nil {
+			written++
+		}
+		return err
+	})
+	return written, err
+}
+
+// Sources are the services holding data about a user
+type Sources struct {
+	User    user.UserSVC
+	Session session.SessionSVC
+	Group   group.GroupSVC
+	Audit   audit.AuditSVC
+	Logins  loginhistory.LoginHistorySVC
+}
+
+// Report is everything stored about one user, credentials aside
+type Report struct {
+	GeneratedAt time.Time             `json:"generatedAt"`
+	Profile     user.ExportedUser     `json:"profile"`
+	Groups      []string              `json:"groups"`
+	Sessions    []session.SessionData `json:"sessions"`
+	AuditEvents []audit.Event         `json:"auditEvents"`
+	Logins      []loginhistory.Login  `json:"logins"`
+}
+
+// SubjectAccessReport gathers the profile, group memberships, live sessions, audit and login history of a user, returning
+// user.NotFound if there is no such user
+func SubjectAccessReport(src Sources, username string) (*Report, error) {
+	u, err := src.User.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		GeneratedAt: time.Now().UTC(),
+		Profile:     u.Export(false),
+		Sessions:    []session.SessionData{},
+	}
+	report.Groups, err = src.Group.GroupsForUser(u.Username)
+	if err != nil {
+		return nil, err
+	}
+	report.AuditEvents, err = src.Audit.EventsFor(u.Username)
+	if err != nil {
+		return nil, err
+	}
+	report.Logins, err = src.Logins.LoginsFor(u.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionIds, err := src.Session.GetSessionIdsForUser(u.Username)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sessionIds {
+		sess, err := src.Session.GetSessionById(id)
+		//sessions expire on their own, one may have gone since the ids were read
+		if err == session.SessionNotFoundError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Sessions = append(report.Sessions, *sess)
+	}
+	return report, nil
+}
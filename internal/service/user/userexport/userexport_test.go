@@ -0,0 +1,103 @@
+package userexport
+
+import (
+	"bytes"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sso-v2/gen/mocks/mock_audit"
+	"sso-v2/gen/mocks/mock_group"
+	"sso-v2/gen/mocks/mock_loginhistory"
+	"sso-v2/gen/mocks/mock_session"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/audit"
+	"sso-v2/internal/service/loginhistory"
+	"sso-v2/internal/service/session"
+	"sso-v2/internal/service/user"
+	"testing"
+)
+
+func TestWriteJSONL(t *testing.T) {
+	users := []*user.UserData{
+		{Username: "alice", HashedPass: "hash", TOTP: &user.TOTPSettings{Secret: "SECRET", Confirmed: true}},
+		{Username: "bob", HashedPass: "hash", State: user.StateDisabled},
+	}
+	tests := []struct {
+		name               string
+		includeCredentials bool
+		want               string
+	}{
+		{
+			name: "Without_Credentials",
+			want: `{"username":"alice","emailVerified":false,"state":"active","mfaEnabled":true}` + "\n" +
+				`{"username":"bob","emailVerified":false,"state":"disabled","mfaEnabled":false}` + "\n",
+		},
+		{
+			name:               "With_Credentials",
+			includeCredentials: true,
+			want: `{"username":"alice","emailVerified":false,"state":"active","mfaEnabled":true,"hashedPass":"hash","totpSecret":"SECRET"}` + "\n" +
+				`{"username":"bob","emailVerified":false,"state":"disabled","mfaEnabled":false,"hashedPass":"hash"}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			userSvc.EXPECT().ExportUsers(gomock.Any()).DoAndReturn(func(visit func(u *user.UserData) error) error {
+				for _, u := range users {
+					if err := visit(u); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			out := &bytes.Buffer{}
+			written, err := WriteJSONL(userSvc, out, tt.includeCredentials)
+			if err != nil || written != 2 {
+				t.Fatalf("WriteJSONL() = %v, %v, want 2, nil", written, err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("WriteJSONL() wrote %v, want %v", out.String(), tt.want)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestSubjectAccessReport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	userSvc := mock_user.NewMockUserSVC(ctrl)
+	sessionSvc := mock_session.NewMockSessionSVC(ctrl)
+	groupSvc := mock_group.NewMockGroupSVC(ctrl)
+	auditSvc := mock_audit.NewMockAuditSVC(ctrl)
+	loginSvc := mock_loginhistory.NewMockLoginHistorySVC(ctrl)
+
+	userSvc.EXPECT().GetUser("Joehrke").Return(&user.UserData{Username: "joehrke", HashedPass: "hash", Email: "joe@example.com"}, nil)
+	groupSvc.EXPECT().GroupsForUser("joehrke").Return([]string{"staff"}, nil)
+	auditSvc.EXPECT().EventsFor("joehrke").Return([]audit.Event{{Type: audit.EventLogin, Success: true, Status: 200}}, nil)
+	loginSvc.EXPECT().LoginsFor("joehrke").Return([]loginhistory.Login{{Result: loginhistory.ResultSuccess, Factor: loginhistory.FactorPassword}}, nil)
+	sessionSvc.EXPECT().GetSessionIdsForUser("joehrke").Return([]string{"s-1", "s-gone"}, nil)
+	sessionSvc.EXPECT().GetSessionById("s-1").Return(&session.SessionData{Id: "s-1", Username: "joehrke"}, nil)
+	sessionSvc.EXPECT().GetSessionById("s-gone").Return(nil, session.SessionNotFoundError)
+
+	report, err := SubjectAccessReport(Sources{User: userSvc, Session: sessionSvc, Group: groupSvc, Audit: auditSvc, Logins: loginSvc}, "Joehrke")
+	if err != nil {
+		t.Fatalf("SubjectAccessReport() unexpected error = %v", err)
+	}
+	if report.Profile.Username != "joehrke" || report.Profile.HashedPass != "" {
+		t.Errorf("SubjectAccessReport() profile = %+v, want joehrke without credentials", report.Profile)
+	}
+	if !reflect.DeepEqual(report.Groups, []string{"staff"}) {
+		t.Errorf("SubjectAccessReport() groups = %v", report.Groups)
+	}
+	if len(report.Sessions) != 1 || report.Sessions[0].Id != "s-1" {
+		t.Errorf("SubjectAccessReport() sessions = %v, want only s-1", report.Sessions)
+	}
+	if len(report.AuditEvents) != 1 {
+		t.Errorf("SubjectAccessReport() audit events = %v", report.AuditEvents)
+	}
+	if len(report.Logins) != 1 {
+		t.Errorf("SubjectAccessReport() logins = %v", report.Logins)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,225 @@
+// Package userimport reads accounts exported from other systems and creates them through the user service, keeping
+// their password hashes so people can log in with their existing passwords.
+package userimport
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sso-v2/internal/service/user"
+	"strconv"
+	"strings"
+)
+
+type Format string
+
+const (
+	// CSV needs a header row naming its columns: username, passwordHash, email, emailVerified and attr.<name> for
+	// profile attributes
+	CSV Format = "csv"
+	// JSONL is one user.ImportRecord JSON object per line
+	JSONL Format = "jsonl"
+	// Htpasswd is an Apache password file, one username:hash per line
+	Htpasswd Format = "htpasswd"
+
+	attributeColumnPrefix = "attr."
+)
+
+// ParseFormat maps a format name onto a Format, reporting false for anything unknown
+func ParseFormat(name string) (Format, bool) {
+	switch f := Format(strings.ToLower(name)); f {
+	case CSV, JSONL, Htpasswd:
+		return f, true
+	}
+	return "", false
+}
+
+// RowError describes why one row of an import was rejected
+type RowError struct {
+	// Row is the 1-based line of the row in the input, counting a CSV header
+	Row      int    `json:"row"`
+	Username string `json:"username,omitempty"`
+	Error    string `json:"error"`
+}
+
+// Report summarizes an import.  On a dry run Imported counts the rows that would have been created.
+type Report struct {
+	DryRun   bool       `json:"dryRun"`
+	Imported int        `json:"imported"`
+	Failed   int        `json:"failed"`
+	Errors   []RowError `json:"errors"`
+}
+
+type row struct {
+	line   int
+	record user.ImportRecord
+	err    error
+}
+
+// Run reads every row of r and imports it, carrying on past rows that fail so the report covers the whole input.  An
+// error is only returned if the input can't be read at all.
+func Run(userSVC user.UserSVC, format Format, r io.Reader, dryRun bool) (*Report, error) {
+	rows, err := parse(format, r)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{DryRun: dryRun, Errors: []RowError{}}
+	//a dry run writes nothing, so duplicates within the input have to be caught here
+	seenUsers := make(map[string]bool)
+	seenEmails := make(map[string]bool)
+	for _, rw := range rows {
+		err := rw.err
+		if err == nil && dryRun {
+			err = checkDuplicate(rw.record, seenUsers, seenEmails)
+		}
+		if err == nil {
+			err = userSVC.ImportUser(rw.record, dryRun)
+		}
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, RowError{Row: rw.line, Username: rw.record.Username, Error: err.Error()})
+			continue
+		}
+		report.Imported++
+	}
+	return report, nil
+}
+
+func checkDuplicate(record user.ImportRecord, seenUsers map[string]bool, seenEmails map[string]bool) error {
+	if username, err := user.NormalizeUsername(record.Username); err == nil {
+		if seenUsers[username] {
+			return user.UsernameTaken
+		}
+		seenUsers[username] = true
+	}
+	if email, err := user.NormalizeEmail(record.Email); err == nil && record.Email != "" {
+		if seenEmails[email] {
+			return user.EmailTaken
+		}
+		seenEmails[email] = true
+	}
+	return nil
+}
+
+func parse(format Format, r io.Reader) ([]row, error) {
+	switch format {
+	case CSV:
+		return parseCSV(r)
+	case JSONL:
+		return parseLines(r, parseJSONLine)
+	case Htpasswd:
+		return parseLines(r, parseHtpasswdLine)
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+func parseCSV(r io.Reader) ([]row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range header {
+		switch column {
+		case "username", "passwordHash", "email", "emailVerified":
+		default:
+			if !strings.HasPrefix(column, attributeColumnPrefix) {
+				return nil, fmt.Errorf("unknown column %q", column)
+			}
+		}
+	}
+
+	rows := []row{}
+	for line := 2; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if _, malformed := err.(*csv.ParseError); malformed {
+			rows = append(rows, row{line: line, err: err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != len(header) {
+			rows = append(rows, row{line: line, err: fmt.Errorf("expected %d fields, got %d", len(header), len(fields))})
+			continue
+		}
+		rows = append(rows, csvRow(line, header, fields))
+	}
+}
+
+func csvRow(line int, header []string, fields []string) row {
+	rw := row{line: line}
+	for i, column := range header {
+		value := fields[i]
+		switch column {
+		case "username":
+			rw.record.Username = value
+		case "passwordHash":
+			rw.record.PasswordHash = value
+		case "email":
+			rw.record.Email = value
+		case "emailVerified":
+			if value == "" {
+				continue
+			}
+			verified, err := strconv.ParseBool(value)
+			if err != nil {
+				rw.err = fmt.Errorf("invalid emailVerified %q", value)
+			}
+			rw.record.EmailVerified = verified
+		default:
+			//empty cells leave the attribute unset rather than setting it to an empty string
+			if value == "" {
+				continue
+			}
+			if rw.record.Attributes == nil {
+				rw.record.Attributes = make(map[string]interface{})
+			}
+			rw.record.Attributes[strings.TrimPrefix(column, attributeColumnPrefix)] = value
+		}
+	}
+	return rw
+}
+
+// parseLines feeds every non-blank line that isn't a # comment to parseLine
+func parseLines(r io.Reader, parseLine func(line string) (user.ImportRecord, error)) ([]row, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	rows := []row{}
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		record, err := parseLine(text)
+		rows = append(rows, row{line: line, record: record, err: err})
+	}
+	return rows, scanner.Err()
+}
+
+func parseJSONLine(line string) (user.ImportRecord, error) {
+	record := user.ImportRecord{}
+	err := json.Unmarshal([]byte(line), &record)
+	if err != nil {
+		return record, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return record, nil
+}
+
+func parseHtpasswdLine(line string) (user.ImportRecord, error) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return user.ImportRecord{}, fmt.Errorf("expected username:hash")
+	}
+	return user.ImportRecord{Username: parts[0], PasswordHash: parts[1]}, nil
+}
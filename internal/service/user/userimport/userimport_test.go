@@ -0,0 +1,96 @@
+package userimport
+
+import (
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"sso-v2/gen/mocks/mock_user"
+	"sso-v2/internal/service/user"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      Format
+		input       string
+		dryRun      bool
+		wantRecords []user.ImportRecord
+		importErr   error
+		wantReport  Report
+	}{
+		{
+			name:   "CSV",
+			format: CSV,
+			input:  "username,passwordHash,email,emailVerified,attr.department\njoehrke,{SHA}x,joe@example.com,true,sales\nbob,{SHA}y,,,\n",
+			wantRecords: []user.ImportRecord{
+				{Username: "joehrke", PasswordHash: "{SHA}x", Email: "joe@example.com", EmailVerified: true, Attributes: map[string]interface{}{"department": "sales"}},
+				{Username: "bob", PasswordHash: "{SHA}y"},
+			},
+			wantReport: Report{Imported: 2, Errors: []RowError{}},
+		},
+		{
+			name:   "CSV_Bad_Row",
+			format: CSV,
+			input:  "username,passwordHash,emailVerified\njoehrke,{SHA}x,maybe\nbob,{SHA}y\n",
+			wantReport: Report{Failed: 2, Errors: []RowError{
+				{Row: 2, Username: "joehrke", Error: `invalid emailVerified "maybe"`},
+				{Row: 3, Error: "expected 3 fields, got 2"},
+			}},
+		},
+		{
+			name:        "JSONL",
+			format:      JSONL,
+			input:       "{\"username\":\"joehrke\",\"passwordHash\":\"{SHA}x\"}\n\nnot json\n",
+			wantRecords: []user.ImportRecord{{Username: "joehrke", PasswordHash: "{SHA}x"}},
+			wantReport: Report{Imported: 1, Failed: 1, Errors: []RowError{
+				{Row: 3, Error: "invalid JSON: invalid character 'o' in literal null (expecting 'u')"},
+			}},
+		},
+		{
+			name:        "Htpasswd",
+			format:      Htpasswd,
+			input:       "# exported\njoehrke:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n",
+			wantRecords: []user.ImportRecord{{Username: "joehrke", PasswordHash: "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"}},
+			importErr:   user.UsernameTaken,
+			wantReport: Report{Failed: 1, Errors: []RowError{
+				{Row: 2, Username: "joehrke", Error: "username already taken"},
+			}},
+		},
+		{
+			name:        "Dry_Run_Duplicate",
+			format:      Htpasswd,
+			input:       "joehrke:{SHA}x\nJoehrke:{SHA}y\n",
+			dryRun:      true,
+			wantRecords: []user.ImportRecord{{Username: "joehrke", PasswordHash: "{SHA}x"}},
+			wantReport: Report{DryRun: true, Imported: 1, Failed: 1, Errors: []RowError{
+				{Row: 2, Username: "Joehrke", Error: "username already taken"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			userSvc := mock_user.NewMockUserSVC(ctrl)
+			for _, record := range tt.wantRecords {
+				userSvc.EXPECT().ImportUser(record, tt.dryRun).Return(tt.importErr)
+			}
+
+			got, err := Run(userSvc, tt.format, strings.NewReader(tt.input), tt.dryRun)
+			if err != nil {
+				t.Fatalf("Run() unexpected error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.wantReport) {
+				t.Errorf("Run() got = %+v, want %+v", *got, tt.wantReport)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestRun_UnknownColumn(t *testing.T) {
+	_, err := Run(nil, CSV, strings.NewReader("username,password\n"), false)
+	if err == nil || err.Error() != `unknown column "password"` {
+		t.Errorf("Run() error = %v, want unknown column", err)
+	}
+}
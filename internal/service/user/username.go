@@ -0,0 +1,65 @@
+package user
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinUsernameLength = 1
+	MaxUsernameLength = 64
+)
+
+type InvalidUsernameError string
+
+func (e InvalidUsernameError) Error() string {
+	return string(e)
+}
+
+const InvalidUsername = InvalidUsernameError("invalid username")
+
+var usernameFolder = cases.Fold()
+
+// NormalizeUsername maps a raw username onto the canonical form used for storage keys and sessions, so that
+// "Alice", "alice" and "alice " all resolve to the same account.  The pipeline is NFKC, trimming, case folding and
+// finally the PRECIS UsernameCaseMapped profile (RFC 8265), followed by our own length and charset restrictions.
+func NormalizeUsername(raw string) (string, error) {
+	name := norm.NFKC.String(raw)
+	name = strings.TrimSpace(name)
+	name = usernameFolder.String(name)
+
+	//PRECIS rejects spaces, control characters, symbols and bidi violations and re-normalizes the folded result
+	name, err := precis.UsernameCaseMapped.String(name)
+	if err != nil {
+		return "", InvalidUsername
+	}
+
+	length := utf8.RuneCountInString(name)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		return "", InvalidUsername
+	}
+	for _, r := range name {
+		if !validUsernameRune(r) {
+			return "", InvalidUsername
+		}
+	}
+
+	return name, nil
+}
+
+// validUsernameRune narrows the PRECIS identifier class down to letters, digits and a few separators that are
+// safe to embed in datastore keys and URL paths
+func validUsernameRune(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return true
+	}
+	switch r {
+	case '.', '_', '-', '@':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "already normalized",
+			raw:  "joehrke",
+			want: "joehrke",
+		},
+		{
+			name: "case folded",
+			raw:  "JOehrke",
+			want: "joehrke",
+		},
+		{
+			name: "surrounding whitespace trimmed",
+			raw:  "  joehrke\t",
+			want: "joehrke",
+		},
+		{
+			name: "fullwidth compatibility characters",
+			raw:  "ｊｏｅｈｒｋｅ",
+			want: "joehrke",
+		},
+		{
+			name: "unicode letters allowed",
+			raw:  "Jürgen",
+			want: "jürgen",
+		},
+		{
+			name: "allowed separators",
+			raw:  "j.oehrke_1-a@example",
+			want: "j.oehrke_1-a@example",
+		},
+		{
+			name:    "empty",
+			raw:     "   ",
+			wantErr: true,
+		},
+		{
+			name:    "inner space",
+			raw:     "j oehrke",
+			wantErr: true,
+		},
+		{
+			name:    "control character",
+			raw:     "joehrke\x00",
+			wantErr: true,
+		},
+		{
+			name:    "disallowed punctuation",
+			raw:     "joehrke!",
+			wantErr: true,
+		},
+		{
+			name:    "too long",
+			raw:     strings.Repeat("a", MaxUsernameLength+1),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeUsername(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NormalizeUsername() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil && err != InvalidUsername {
+				t.Errorf("NormalizeUsername() error = %v, want %v", err, InvalidUsername)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeUsername() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "lower cased",
+			raw:  " JOehrke@Example.com ",
+			want: "joehrke@example.com",
+		},
+		{
+			name:    "display name",
+			raw:     "Jeremy <joehrke@example.com>",
+			wantErr: true,
+		},
+		{
+			name:    "not an address",
+			raw:     "joehrke",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeEmail(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NormalizeEmail() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeEmail() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,107 @@
 package user
 
+import "time"
+
 //go:generate mockgen -source=usersvc.go -destination=../../../gen/mocks/mock_user/usersvc.go -self_package=../pkg/userhandlers
 
 type UserData struct {
-	Username   string
-	HashedPass string
+	Username      string        `json:"username"`
+	HashedPass    string        `json:"hashedPass"`
+	Email         string        `json:"email,omitempty"`
+	EmailVerified bool          `json:"emailVerified,omitempty"`
+	TOTP          *TOTPSettings `json:"totp,omitempty"`
+	// RecoveryCodes are sha256 hashes of the user's unused second factor recovery codes
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	// Attributes are the user's profile attributes, validated against the configured AttributeSchema
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	// State is the account's lifecycle state, see CurrentState
+	State UserState `json:"state,omitempty"`
+	// Roles are the names of the roles assigned to the user, the permissions they grant are resolved at login
+	Roles []string `json:"roles,omitempty"`
+	// Identities are the user's linked accounts at external identity providers, at most one per provider
+	Identities []FederatedIdentity `json:"identities,omitempty"`
+	// PasswordChangedAt is when the password was last set, see PasswordExpired
+	PasswordChangedAt *time.Time `json:"passwordChangedAt,omitempty"`
+	// PasswordHistory holds the hashes of the user's previous passwords, newest first, in whatever scheme each was
+	// stored with.  Only as many are kept as the password history check needs.
+	PasswordHistory []string `json:"passwordHistory,omitempty"`
+	// MustChangePassword is set by an admin to make the user choose a new password at their next login
+	MustChangePassword bool `json:"mustChangePassword,omitempty"`
+}
+
+// TOTPSettings holds a user's authenticator secret, it only counts as a second factor once Confirmed
+type TOTPSettings struct {
+	Secret    string `json:"secret"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// MFAEnabled reports whether authenticating as the user needs a second factor after the password
+func (u *UserData) MFAEnabled() bool {
+	return u.TOTP != nil && u.TOTP.Confirmed
 }
 
 type UserSVC interface {
 	EncryptPassword(pass string) (encryptedPass string, err error)
 	AuthUser(username string, pass string) (bool, error)
-	CreateUser(username string, pass string) error
+	CreateUser(username string, pass string, email string, attributes map[string]interface{}) error
+	// ImportUser creates a user from another system, keeping its password hash.  With dryRun every check CreateUser
+	// would make is made but nothing is written.
+	ImportUser(record ImportRecord, dryRun bool) error
+	// GetUser returns the user, following the alias a rename left behind if username is a former name
+	GetUser(username string) (*UserData, error)
+	// UpdateUser loads a user, applies update and stores the result.  If update returns an error nothing is stored.
+	UpdateUser(username string, update func(u *UserData) error) error
+	// CheckPasswordReuse returns PasswordReused if pass matches any of the user's recent passwords, the current one
+	// included, so it can be refused before it is hashed and set
+	CheckPasswordReuse(username string, pass string) error
+	// SetPassword replaces the user's password, restarting its maximum age and clearing a forced change.  The old hash
+	// is kept in the user's password history.
+	SetPassword(username string, encryptedPass string) error
+	// PasswordChangeRequired reports whether u has to change their password before getting a normal session
+	PasswordChangeRequired(u *UserData) bool
+	SetEmail(username string, email string) error
+	VerifyEmail(username string, email string) error
+	// UpdateAttributes merges patch into the user's profile attributes, see AttributeSchema.ApplyPatch
+	UpdateAttributes(username string, patch map[string]interface{}) (*UserData, error)
+	// SessionVars returns the attributes of u that should be copied into a new session
+	SessionVars(u *UserData) map[string]string
+	SetState(username string, state UserState) error
+	// FindUserByIdentity returns the user an external identity is linked to
+	FindUserByIdentity(identity FederatedIdentity) (*UserData, error)
+	// FindUserByEmail returns the user holding an email address
+	FindUserByEmail(email string) (*UserData, error)
+	// LinkIdentity links an external identity to the user, replacing any identity they had at the same provider.  An
+	// identity linked to somebody else is IdentityTaken.
+	LinkIdentity(username string, identity FederatedIdentity) error
+	UnlinkIdentity(username string, provider string) error
+	// RenameUser moves the user to newUsername along with their email address, unique attribute values and identities,
+	// returning the moved record.  The old name is kept as an alias of the new one for the configured grace period,
+	// during which nobody else can take it.
+	RenameUser(username string, newUsername string) (*UserData, error)
+	// DeleteUser removes the user record outright, releasing their email address, unique attribute values and identities
+	DeleteUser(username string) error
+	// DropAliases deletes every old name that leads to the user, directly or through later renames, returning how many
+	// were deleted
+	DropAliases(username string) (int, error)
+	// ListUsers pages through users in username order, see UserQuery
+	ListUsers(query UserQuery) (*UserPage, error)
+	// ExportUsers calls visit with every stored user in username order, stopping at the first error visit returns
+	ExportUsers(visit func(u *UserData) error) error
+	// IndexUsers adds every stored user to the username index ListUsers reads, returning how many were indexed
+	IndexUsers() (int, error)
+	MigrateUsernames(apply bool) (*UsernameMigrationReport, error)
+}
+
+// UsernameMigrationReport describes what a username normalization pass found (and, when applied, changed)
+type UsernameMigrationReport struct {
+	Applied bool `json:"applied"`
+	// Migrated maps each stored username to the normalized name it was (or would be) moved to
+	Migrated map[string]string `json:"migrated"`
+	// Collisions lists normalized names claimed by more than one stored username, these are left untouched
+	Collisions map[string][]string `json:"collisions"`
+	// Invalid lists stored usernames that cannot be normalized at all
+	Invalid   []string `json:"invalid"`
+	Unchanged int      `json:"unchanged"`
 }
 
 //Mapped Errors
@@ -21,3 +112,11 @@ func (e NotFoundError) Error() string {
 }
 
 const NotFound = NotFoundError("user not found")
+
+type UsernameTakenError string
+
+func (e UsernameTakenError) Error() string {
+	return string(e)
+}
+
+const UsernameTaken = UsernameTakenError("username already taken")
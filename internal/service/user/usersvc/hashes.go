@@ -0,0 +1,165 @@
+package usersvc
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"sso-v2/internal/service/user"
+	"strings"
+)
+
+const (
+	apr1Prefix = "$apr1$"
+	sha1Prefix = "{SHA}"
+
+	apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// checkPasswordHash reports whether hash is in a format comparePassword understands
+func (svc *UserSVCImpl) checkPasswordHash(hash string) error {
+	if hash == "" {
+		return user.MissingPasswordHash
+	}
+	switch {
+	case strings.HasPrefix(hash, pepperPrefix):
+		keyId, inner := splitPepperedHash(hash)
+		if _, ok := svc.cfg.Pepper.Keys[keyId]; !ok {
+			return user.UnsupportedPasswordHash
+		}
+		if _, err := bcrypt.Cost([]byte(inner)); err != nil {
+			return user.UnsupportedPasswordHash
+		}
+	case strings.HasPrefix(hash, apr1Prefix):
+		salt, digest := splitApr1(hash)
+		if salt == "" || len(digest) != 22 {
+			return user.UnsupportedPasswordHash
+		}
+	case strings.HasPrefix(hash, sha1Prefix):
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, sha1Prefix))
+		if err != nil || len(raw) != sha1.Size {
+			return user.UnsupportedPasswordHash
+		}
+	default:
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return user.UnsupportedPasswordHash
+		}
+	}
+	return nil
+}
+
+// isLegacyHash reports whether hash is an imported format that should be replaced with bcrypt once the password is known
+func isLegacyHash(hash string) bool {
+	return strings.HasPrefix(hash, apr1Prefix) || strings.HasPrefix(hash, sha1Prefix)
+}
+
+// needsRehash reports whether hash is weaker than what EncryptPassword makes now, either an imported format or not
+// peppered with the current key
+func (svc *UserSVCImpl) needsRehash(hash string) bool {
+	if isLegacyHash(hash) {
+		return true
+	}
+	if !svc.cfg.Pepper.enabled() {
+		return false
+	}
+	keyId, _ := splitPepperedHash(hash)
+	return keyId != svc.cfg.Pepper.Current
+}
+
+// comparePassword checks pass against a stored hash of any supported format, returning
+// bcrypt.ErrMismatchedHashAndPassword when it doesn't match.  A hash peppered with a key that's no longer configured
+// can't be checked at all and is user.UnsupportedPasswordHash.
+func (svc *UserSVCImpl) comparePassword(hash string, pass string) error {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, pepperPrefix):
+		keyId, inner := splitPepperedHash(hash)
+		mixed, ok := svc.cfg.Pepper.mix(keyId, pass)
+		if !ok {
+			return user.UnsupportedPasswordHash
+		}
+		return bcrypt.CompareHashAndPassword([]byte(inner), []byte(mixed))
+	case strings.HasPrefix(hash, apr1Prefix):
+		salt, _ := splitApr1(hash)
+		computed = apr1Hash(pass, salt)
+	case strings.HasPrefix(hash, sha1Prefix):
+		sum := sha1.Sum([]byte(pass))
+		computed = sha1Prefix + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	}
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+func splitApr1(hash string) (salt string, digest string) {
+	parts := strings.SplitN(strings.TrimPrefix(hash, apr1Prefix), "$", 2)
+	if len(parts) != 2 || len(parts[0]) > 8 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// apr1Hash is Apache's variant of the FreeBSD MD5 crypt, as written by htpasswd -m
+func apr1Hash(pass string, salt string) string {
+	alternate := md5.Sum([]byte(pass + salt + pass))
+
+	ctx := []byte(pass + apr1Prefix + salt)
+	for i := len(pass); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx = append(ctx, alternate[:n]...)
+	}
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, pass[0])
+		}
+	}
+	final := md5.Sum(ctx)
+
+	//the thousand rounds exist only to slow the hash down
+	for i := 0; i < 1000; i++ {
+		var round []byte
+		if i&1 != 0 {
+			round = append(round, pass...)
+		} else {
+			round = append(round, final[:]...)
+		}
+		if i%3 != 0 {
+			round = append(round, salt...)
+		}
+		if i%7 != 0 {
+			round = append(round, pass...)
+		}
+		if i&1 != 0 {
+			round = append(round, final[:]...)
+		} else {
+			round = append(round, pass...)
+		}
+		final = md5.Sum(round)
+	}
+
+	encoded := make([]byte, 0, 22)
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(final[group[0]])<<16 | uint(final[group[1]])<<8 | uint(final[group[2]])
+		encoded = appendApr1Chars(encoded, v, 4)
+	}
+	encoded = appendApr1Chars(encoded, uint(final[11]), 2)
+
+	return apr1Prefix + salt + "$" + string(encoded)
+}
+
+func appendApr1Chars(dst []byte, v uint, n int) []byte {
+	for ; n > 0; n-- {
+		dst = append(dst, apr1Alphabet[v&0x3f])
+		v >>= 6
+	}
+	return dst
+}
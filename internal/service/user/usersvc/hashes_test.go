@@ -0,0 +1,79 @@
+package usersvc
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"sso-v2/internal/service/user"
+	"testing"
+)
+
+func TestComparePassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		pass    string
+		wantErr error
+	}{
+		{
+			name: "Apr1",
+			hash: "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+			pass: "myPassword",
+		},
+		{
+			name:    "Apr1_Mismatch",
+			hash:    "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+			pass:    "wrong",
+			wantErr: bcrypt.ErrMismatchedHashAndPassword,
+		},
+		{
+			name: "Sha1",
+			hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+			pass: "secret",
+		},
+		{
+			name:    "Sha1_Mismatch",
+			hash:    "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+			pass:    "Secret",
+			wantErr: bcrypt.ErrMismatchedHashAndPassword,
+		},
+		{
+			name: "Bcrypt_2y",
+			hash: "$2y$04$HoOQndRy9E6lRHyHzq/xyO5nTmZp2x0L58ylsIKQXHoG7tMVI14/C",
+			pass: "password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &UserSVCImpl{}
+			if err := svc.comparePassword(tt.hash, tt.pass); err != tt.wantErr {
+				t.Errorf("comparePassword() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr error
+	}{
+		{name: "Bcrypt", hash: dummyHash},
+		{name: "Apr1", hash: "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{name: "Sha1", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+		{name: "Missing", wantErr: user.MissingPasswordHash},
+		{name: "Plaintext", hash: "hunter2", wantErr: user.UnsupportedPasswordHash},
+		{name: "Crypt", hash: "rl0uELqBNSxWA", wantErr: user.UnsupportedPasswordHash},
+		{name: "Short_Sha1", hash: "{SHA}abcd", wantErr: user.UnsupportedPasswordHash},
+		{name: "Peppered", hash: pepperedHash("k1", dummyHash)},
+		{name: "Unknown_Pepper_Key", hash: pepperedHash("k0", dummyHash), wantErr: user.UnsupportedPasswordHash},
+		{name: "Peppered_Plaintext", hash: pepperedHash("k1", "hunter2"), wantErr: user.UnsupportedPasswordHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &UserSVCImpl{cfg: Config{Pepper: testPepper}}
+			if err := svc.checkPasswordHash(tt.hash); err != tt.wantErr {
+				t.Errorf("checkPasswordHash() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
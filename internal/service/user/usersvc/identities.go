@@ -0,0 +1,132 @@
+package usersvc
+
+import (
+	"log"
+	"sso-v2/internal/service/user"
+)
+
+func (svc *UserSVCImpl) FindUserByIdentity(identity user.FederatedIdentity) (*user.UserData, error) {
+	return svc.findIndexed(generateIdentityKey(identity), func(u *user.UserData) bool {
+		linked := u.IdentityFor(identity.Provider)
+		return linked != nil && linked.Subject == identity.Subject
+	})
+}
+
+func (svc *UserSVCImpl) FindUserByEmail(email string) (*user.UserData, error) {
+	email, err := user.NormalizeEmail(email)
+	if err != nil {
+		return nil, user.NotFound
+	}
+	return svc.findIndexed(generateEmailKey(email), func(u *user.UserData) bool {
+		return u.Email == email
+	})
+}
+
+// findIndexed loads the user a uniqueness index key points at.  The index can outlive a change to the record, so the
+// user is only returned if holds confirms they still hold the indexed value.
+func (svc *UserSVCImpl) findIndexed(key string, holds func(u *user.UserData) bool) (*user.UserData, error) {
+	owner, err := svc.ds.GetKey(key)
+	if err != nil {
+		log.Printf("error checking index owner: %v", err.Error())
+		return nil, err
+	}
+	if owner == "" {
+		return nil, user.NotFound
+	}
+	userDat, err := svc.loadUser(owner)
+	if err != nil {
+		return nil, err
+	}
+	if !holds(userDat) {
+		return nil, user.NotFound
+	}
+	return userDat, nil
+}
+
+func (svc *UserSVCImpl) LinkIdentity(username string, identity user.FederatedIdentity) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+	previous := userDat.IdentityFor(identity.Provider)
+	if previous != nil && previous.Subject == identity.Subject {
+		return nil
+	}
+
+	claimed, err := svc.claimIndex(generateIdentityKey(identity), username)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return user.IdentityTaken
+	}
+
+	identities := []user.FederatedIdentity{identity}
+	for _, linked := range userDat.Identities {
+		if linked.Provider != identity.Provider {
+			identities = append(identities, linked)
+		}
+	}
+	userDat.Identities = identities
+	err = svc.storeUser(userDat)
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		err = svc.releaseIndex(generateIdentityKey(*previous), username)
+		if err != nil {
+			log.Printf("error releasing identity: %v", err.Error())
+		}
+	}
+	return nil
+}
+
+func (svc *UserSVCImpl) UnlinkIdentity(username string, provider string) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+	linked := userDat.IdentityFor(provider)
+	if linked == nil {
+		return user.IdentityNotLinked
+	}
+	unlinked := *linked
+
+	identities := []user.FederatedIdentity{}
+	for _, identity := range userDat.Identities {
+		if identity.Provider != provider {
+			identities = append(identities, identity)
+		}
+	}
+	userDat.Identities = identities
+	err = svc.storeUser(userDat)
+	if err != nil {
+		return err
+	}
+	return svc.releaseIndex(generateIdentityKey(unlinked), username)
+}
+
+// releaseIdentities drops every identity index entry the user holds, failures are only logged
+func (svc *UserSVCImpl) releaseIdentities(userDat *user.UserData) {
+	for _, identity := range userDat.Identities {
+		err := svc.releaseIndex(generateIdentityKey(identity), userDat.Username)
+		if err != nil {
+			log.Printf("error releasing identity: %v", err.Error())
+		}
+	}
+}
+
+func generateIdentityKey(identity user.FederatedIdentity) string {
+	return "identity_" + identity.Provider + "_" + identity.Subject
+}
@@ -0,0 +1,117 @@
+package usersvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/user"
+	"testing"
+	"time"
+)
+
+func TestUserSVCImpl_LinkIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		userFound string
+		claimed   bool
+		owner     string
+		released  string
+		wantErr   error
+		wantSaved string
+	}{
+		{
+			name:      "New_Identity",
+			userFound: `{"username":"joehrke","hashedPass":"hash"}`,
+			claimed:   true,
+			wantSaved: `{"username":"joehrke","hashedPass":"hash","identities":[{"provider":"corp","subject":"sub-2"}]}`,
+		},
+		{
+			name:      "Replaces_Provider_Identity",
+			userFound: `{"username":"joehrke","hashedPass":"hash","identities":[{"provider":"corp","subject":"sub-1"},{"provider":"other","subject":"x"}]}`,
+			claimed:   true,
+			released:  "identity_corp_sub-1",
+			wantSaved: `{"username":"joehrke","hashedPass":"hash","identities":[{"provider":"corp","subject":"sub-2"},{"provider":"other","subject":"x"}]}`,
+		},
+		{
+			name:      "Linked_Elsewhere",
+			userFound: `{"username":"joehrke","hashedPass":"hash"}`,
+			owner:     "someoneelse",
+			wantErr:   user.IdentityTaken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(tt.userFound, nil)
+			ds.EXPECT().SetKeyIfAbsent("identity_corp_sub-2", "joehrke", time.Duration(0)).Return(tt.claimed, nil)
+			if !tt.claimed {
+				ds.EXPECT().GetKey("identity_corp_sub-2").Return(tt.owner, nil)
+			}
+			if tt.wantSaved != "" {
+				ds.EXPECT().SetKey(generateUserKey("joehrke"), tt.wantSaved, time.Duration(0)).Return(nil)
+			}
+			if tt.released != "" {
+				ds.EXPECT().GetKey(tt.released).Return("joehrke", nil)
+				ds.EXPECT().DelKey(tt.released).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+			err := svc.LinkIdentity("joehrke", user.FederatedIdentity{Provider: "corp", Subject: "sub-2"})
+			if err != tt.wantErr {
+				t.Errorf("LinkIdentity() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_FindUserByIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		owner     string
+		userFound string
+		wantErr   error
+	}{
+		{
+			name:      "HappyPath",
+			owner:     "joehrke",
+			userFound: `{"username":"joehrke","identities":[{"provider":"corp","subject":"sub-1"}]}`,
+		},
+		{
+			name:    "Not_Linked",
+			wantErr: user.NotFound,
+		},
+		{
+			name:      "Stale_Index",
+			owner:     "joehrke",
+			userFound: `{"username":"joehrke","identities":[{"provider":"corp","subject":"sub-9"}]}`,
+			wantErr:   user.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey("identity_corp_sub-1").Return(tt.owner, nil)
+			if tt.owner != "" {
+				ds.EXPECT().GetKey(generateUserKey(tt.owner)).Return(tt.userFound, nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+			got, err := svc.FindUserByIdentity(user.FederatedIdentity{Provider: "corp", Subject: "sub-1"})
+			if err != tt.wantErr {
+				t.Errorf("FindUserByIdentity() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.Username != "joehrke" {
+				t.Errorf("FindUserByIdentity() got %v, want joehrke", got.Username)
+			}
+			ctrl.Finish()
+		})
+	}
+}
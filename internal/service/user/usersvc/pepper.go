@@ -0,0 +1,131 @@
+package usersvc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	pepperPrefix = "$pepper$"
+	// minPepperKeySize keeps keys long enough that guessing one is no easier than cracking the hashes without it
+	minPepperKeySize = 16
+)
+
+// Pepper is a server side secret mixed into every password before it is hashed, so the hashes in a dump of the
+// datastore can't be cracked offline without it.  Each hash records the id of the key it was made with, so keys can be
+// rotated: new hashes use Current and retired keys stay in Keys until every password hashed with them has been changed
+// or upgraded at login.  The zero Pepper leaves passwords unpeppered.
+type Pepper struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// ParsePepper reads a JSON object holding the current key id and the base64 encoded keys by id
+func ParsePepper(raw []byte) (Pepper, error) {
+	p := Pepper{}
+	err := json.Unmarshal(raw, &p)
+	if err != nil {
+		return Pepper{}, err
+	}
+	return p.validated()
+}
+
+// ParsePepperList reads a comma separated list of id:key pairs with base64 encoded keys, the first being current
+func ParsePepperList(list string) (Pepper, error) {
+	p := Pepper{Keys: make(map[string][]byte)}
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return Pepper{}, errors.New("pepper entries must be id:key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return Pepper{}, errors.New("pepper key " + parts[0] + " isn't valid base64")
+		}
+		if p.Current == "" {
+			p.Current = parts[0]
+		}
+		p.Keys[parts[0]] = key
+	}
+	return p.validated()
+}
+
+func (p Pepper) validated() (Pepper, error) {
+	if _, ok := p.Keys[p.Current]; !ok {
+		return Pepper{}, errors.New("current pepper key " + p.Current + " isn't one of the keys")
+	}
+	for id, key := range p.Keys {
+		if !validPepperKeyId(id) {
+			return Pepper{}, errors.New("pepper key ids may only contain letters, digits, - and _: " + id)
+		}
+		if len(key) < minPepperKeySize {
+			return Pepper{}, errors.New("pepper key " + id + " is shorter than 16 bytes")
+		}
+	}
+	return p, nil
+}
+
+func (p Pepper) enabled() bool {
+	return p.Current != ""
+}
+
+// withoutUnpeppered drops the hashes that weren't peppered once a pepper is in use.  The passwords behind them aren't
+// known so they can't be rehashed, and keeping them would leave hashes in the datastore that can be cracked without
+// the key.
+func (p Pepper) withoutUnpeppered(hashes []string) []string {
+	if !p.enabled() {
+		return hashes
+	}
+	var kept []string
+	for _, hash := range hashes {
+		if strings.HasPrefix(hash, pepperPrefix) {
+			kept = append(kept, hash)
+		}
+	}
+	return kept
+}
+
+// mix returns the HMAC of pass under the key with the given id.  It is base64 encoded so bcrypt never sees a NUL byte
+// and, unlike a long password, never truncates it.
+func (p Pepper) mix(keyId string, pass string) (string, bool) {
+	key, ok := p.Keys[keyId]
+	if !ok {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pass))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), true
+}
+
+// pepperedHash marks a hash of a peppered password with the id of the key that was used
+func pepperedHash(keyId string, hash string) string {
+	return pepperPrefix + keyId + "$" + hash
+}
+
+// splitPepperedHash returns the key id and inner hash of a peppered hash, or empty strings if hash isn't one
+func splitPepperedHash(hash string) (keyId string, inner string) {
+	if !strings.HasPrefix(hash, pepperPrefix) {
+		return "", ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(hash, pepperPrefix), "$", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+func validPepperKeyId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
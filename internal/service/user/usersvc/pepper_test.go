@@ -0,0 +1,137 @@
+package usersvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"golang.org/x/crypto/bcrypt"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPepper = Pepper{
+	Current: "k1",
+	Keys:    map[string][]byte{"k1": []byte("0123456789abcdef")},
+}
+
+func TestParsePepperList(t *testing.T) {
+	tests := []struct {
+		name        string
+		list        string
+		wantCurrent string
+		wantErr     bool
+	}{
+		{name: "Single", list: "k1:MDEyMzQ1Njc4OWFiY2RlZg==", wantCurrent: "k1"},
+		{name: "First_Is_Current", list: "k2:ZmVkY2JhOTg3NjU0MzIxMA==, k1:MDEyMzQ1Njc4OWFiY2RlZg==", wantCurrent: "k2"},
+		{name: "Missing_Id", list: "MDEyMzQ1Njc4OWFiY2RlZg==", wantErr: true},
+		{name: "Bad_Id", list: "k$1:MDEyMzQ1Njc4OWFiY2RlZg==", wantErr: true},
+		{name: "Not_Base64", list: "k1:not base64", wantErr: true},
+		{name: "Short_Key", list: "k1:c2hvcnQ=", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePepperList(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePepperList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Current != tt.wantCurrent {
+				t.Errorf("ParsePepperList() current = %v, want %v", got.Current, tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestParsePepper(t *testing.T) {
+	got, err := ParsePepper([]byte(`{"current":"k2","keys":{"k1":"MDEyMzQ1Njc4OWFiY2RlZg==","k2":"ZmVkY2JhOTg3NjU0MzIxMA=="}}`))
+	if err != nil || got.Current != "k2" || string(got.Keys["k1"]) != "0123456789abcdef" {
+		t.Errorf("ParsePepper() = %v, %v", got, err)
+	}
+	_, err = ParsePepper([]byte(`{"current":"k3","keys":{"k1":"MDEyMzQ1Njc4OWFiY2RlZg=="}}`))
+	if err == nil {
+		t.Error("ParsePepper() accepted a current key that doesn't exist")
+	}
+}
+
+func TestUserSVCImpl_AuthUser_Pepper(t *testing.T) {
+	rotated := Pepper{
+		Current: "k2",
+		Keys: map[string][]byte{
+			"k1": testPepper.Keys["k1"],
+			"k2": []byte("fedcba9876543210"),
+		},
+	}
+	peppered := func(keyId string) string {
+		mixed, _ := rotated.mix(keyId, "password")
+		hash, err := bcrypt.GenerateFromPassword([]byte(mixed), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pepperedHash(keyId, string(hash))
+	}
+	tests := []struct {
+		name        string
+		hash        string
+		wantUpgrade bool
+		wantErr     error
+	}{
+		{name: "Unpeppered", hash: "$2y$04$HoOQndRy9E6lRHyHzq/xyO5nTmZp2x0L58ylsIKQXHoG7tMVI14/C", wantUpgrade: true},
+		{name: "Retired_Key", hash: peppered("k1"), wantUpgrade: true},
+		{name: "Current_Key", hash: peppered("k2")},
+		{name: "Unknown_Key", hash: strings.Replace(peppered("k2"), "$k2$", "$k0$", 1), wantErr: user.UnsupportedPasswordHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"`+tt.hash+`","passwordChangedAt":"2020-01-01T00:00:00Z"}`, nil)
+			var saved string
+			if tt.wantUpgrade {
+				ds.EXPECT().SetKey(generateUserKey("joehrke"), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+					saved = val
+					return nil
+				})
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{Pepper: rotated},
+			}
+			authed, err := svc.AuthUser("joehrke", "password")
+			if err != tt.wantErr || authed != (tt.wantErr == nil) {
+				t.Fatalf("AuthUser() = %v, %v, wantErr %v", authed, err, tt.wantErr)
+			}
+			if tt.wantUpgrade && !strings.Contains(saved, `"hashedPass":"$pepper$k2$$2a$14$`) {
+				t.Errorf("AuthUser() stored %v, want a hash peppered with k2", saved)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_AuthUser_Pepper_DropsUnpepperedHistory(t *testing.T) {
+	const unpeppered = "$2y$04$HoOQndRy9E6lRHyHzq/xyO5nTmZp2x0L58ylsIKQXHoG7tMVI14/C"
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"`+unpeppered+`","passwordChangedAt":"2020-01-01T00:00:00Z","passwordHistory":["$pepper$k1$older","{SHA}b6X7vBbI+C6keOW5M7NF5G3Sheo=","`+unpeppered+`"]}`, nil)
+	var saved string
+	ds.EXPECT().SetKey(generateUserKey("joehrke"), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+		saved = val
+		return nil
+	})
+
+	svc := &UserSVCImpl{
+		ds:  ds,
+		now: fixedClock,
+		cfg: Config{Pepper: testPepper},
+	}
+	authed, err := svc.AuthUser("joehrke", "password")
+	if err != nil || !authed {
+		t.Fatalf("AuthUser() = %v, %v, want true", authed, err)
+	}
+	if !strings.Contains(saved, `"passwordHistory":["$pepper$k1$older"]`) {
+		t.Errorf("AuthUser() stored %v, want only the peppered history entry kept", saved)
+	}
+	ctrl.Finish()
+}
@@ -0,0 +1,193 @@
+package usersvc
+
+import (
+	"log"
+	"sso-v2/internal/datasource"
+	"sso-v2/internal/service/user"
+	"strings"
+)
+
+// maxAliasHops bounds how many renames in a row an old name is followed through
+const maxAliasHops = 8
+
+func (svc *UserSVCImpl) RenameUser(username string, newUsername string) (*user.UserData, error) {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return nil, user.NotFound
+	}
+	newUsername, err = user.NormalizeUsername(newUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if newUsername == username {
+		return nil, user.UsernameTaken
+	}
+	//an old name belongs to whoever was renamed away from it until its alias expires, unless that's this user going back
+	aliasOf, err := svc.resolveAlias(newUsername)
+	if err != nil {
+		return nil, err
+	}
+	if aliasOf != "" && aliasOf != username {
+		return nil, user.UsernameTaken
+	}
+
+	//moving the key claims the new name and releases the old one in one step, so two renames can't both win either
+	moved, err := svc.ds.RenameKeyIfAbsent(generateUserKey(username), generateUserKey(newUsername))
+	if err != nil {
+		log.Printf("error moving user: %v", err.Error())
+		return nil, err
+	}
+	if !moved {
+		return nil, user.UsernameTaken
+	}
+	userDat.Username = newUsername
+	err = svc.storeUser(userDat)
+	if err != nil {
+		return nil, err
+	}
+	if aliasOf != "" {
+		svc.dropAlias(newUsername)
+	}
+
+	//the reservations only name their holder, the record has already moved so a failure here is logged and skipped
+	for _, key := range svc.reservationKeys(userDat) {
+		err = svc.ds.SetKey(key, newUsername, 0)
+		if err != nil {
+			log.Printf("error moving reservation %v: %v", key, err.Error())
+		}
+	}
+	err = svc.ds.AddIndexMember(userIndexKey, newUsername)
+	if err == nil {
+		err = svc.ds.RemoveIndexMember(userIndexKey, username)
+	}
+	if err != nil {
+		log.Printf("error reindexing user: %v", err.Error())
+	}
+
+	if svc.cfg.UsernameAliasTTL > 0 {
+		err = svc.ds.SetKey(generateAliasKey(username), newUsername, svc.cfg.UsernameAliasTTL)
+		if err != nil {
+			log.Printf("error writing username alias: %v", err.Error())
+		}
+	}
+	return userDat, nil
+}
+
+// reservationKeys lists the index entries naming the user as the holder of their email address, unique attribute
+// values and identities, which have to follow the user to a new username
+func (svc *UserSVCImpl) reservationKeys(userDat *user.UserData) []string {
+	keys := []string{}
+	if userDat.Email != "" {
+		keys = append(keys, generateEmailKey(userDat.Email))
+	}
+	for _, name := range svc.changedUniqueAttributes(userDat.Attributes, nil) {
+		if userDat.Attributes[name] != nil {
+			keys = append(keys, generateAttributeKey(name, userDat.Attributes[name]))
+		}
+	}
+	for _, identity := range userDat.Identities {
+		keys = append(keys, generateIdentityKey(identity))
+	}
+	return keys
+}
+
+// lookupUser loads the user under an already normalized username, falling back to the user it is an alias of
+func (svc *UserSVCImpl) lookupUser(username string) (*user.UserData, error) {
+	userDat, err := svc.loadUser(username)
+	if err != user.NotFound {
+		return userDat, err
+	}
+	aliasOf, err := svc.resolveAlias(username)
+	if err != nil {
+		return nil, err
+	}
+	if aliasOf == "" {
+		return nil, user.NotFound
+	}
+	return svc.loadUser(aliasOf)
+}
+
+// resolveAlias follows the aliases left behind by renames from username to the user now holding it.  It returns an
+// empty name if username isn't an alias or the user it leads to no longer exists.
+func (svc *UserSVCImpl) resolveAlias(username string) (string, error) {
+	for hop := 0; hop < maxAliasHops; hop++ {
+		target, err := svc.ds.GetKey(generateAliasKey(username))
+		if err != nil {
+			log.Printf("error fetching username alias: %v", err.Error())
+			return "", err
+		}
+		if target == "" {
+			return "", nil
+		}
+		rawUser, err := svc.ds.GetKey(generateUserKey(target))
+		if err != nil {
+			log.Printf("error fetching user: %v", err.Error())
+			return "", err
+		}
+		if rawUser != "" {
+			return target, nil
+		}
+		username = target
+	}
+	return "", nil
+}
+
+func (svc *UserSVCImpl) DropAliases(username string) (int, error) {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return 0, user.NotFound
+	}
+
+	//aliases only point forward, so finding the names leading to a user means reading every alias
+	pointsTo := map[string][]string{}
+	err = datasource.ScanAll(svc.ds, generateAliasKey("*"), func(key string) error {
+		target, err := svc.ds.GetKey(key)
+		if err != nil {
+			return err
+		}
+		if target != "" {
+			pointsTo[target] = append(pointsTo[target], strings.TrimPrefix(key, generateAliasKey("")))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("error scanning username aliases: %v", err.Error())
+		return 0, err
+	}
+
+	dropped := 0
+	seen := map[string]bool{username: true}
+	pending := pointsTo[username]
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		pending = append(pending, pointsTo[name]...)
+		err = svc.ds.DelKey(generateAliasKey(name))
+		if err != nil {
+			log.Printf("error dropping username alias: %v", err.Error())
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+func (svc *UserSVCImpl) dropAlias(username string) {
+	err := svc.ds.DelKey(generateAliasKey(username))
+	if err != nil {
+		log.Printf("error dropping username alias: %v", err.Error())
+	}
+}
+
+func generateAliasKey(username string) string {
+	return "useralias_" + username
+}
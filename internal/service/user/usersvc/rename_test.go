@@ -0,0 +1,157 @@
+package usersvc
+
+import (
+	"github.com/golang/mock/gomock"
+	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/user"
+	"testing"
+	"time"
+)
+
+func TestUserSVCImpl_RenameUser(t *testing.T) {
+	const stored = `{"username":"joehrke","hashedPass":"hash","email":"joe@example.com","identities":[{"provider":"acme","subject":"123"}]}`
+	tests := []struct {
+		name      string
+		newName   string
+		aliasOf   string
+		moved     bool
+		aliasTTL  time.Duration
+		wantSaved string
+		wantErr   error
+	}{
+		{
+			name:      "Renamed",
+			newName:   "JHrke",
+			moved:     true,
+			aliasTTL:  time.Hour,
+			wantSaved: `{"username":"jhrke","hashedPass":"hash","email":"joe@example.com","identities":[{"provider":"acme","subject":"123"}]}`,
+		},
+		{
+			name:      "Back_To_Own_Alias",
+			newName:   "jhrke",
+			aliasOf:   "joehrke",
+			moved:     true,
+			wantSaved: `{"username":"jhrke","hashedPass":"hash","email":"joe@example.com","identities":[{"provider":"acme","subject":"123"}]}`,
+		},
+		{name: "Taken", newName: "jhrke", wantErr: user.UsernameTaken},
+		{name: "Alias_Of_Someone_Else", newName: "jhrke", aliasOf: "someone", wantErr: user.UsernameTaken},
+		{name: "Same_Name", newName: "JOEHRKE", wantErr: user.UsernameTaken},
+		{name: "Invalid_Name", newName: "j hrke", wantErr: user.InvalidUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.wantErr != user.InvalidUsername {
+				ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(stored, nil)
+			}
+			if tt.wantErr == nil || tt.name == "Taken" || tt.aliasOf != "" {
+				if tt.aliasOf != "" {
+					ds.EXPECT().GetKey(generateAliasKey("jhrke")).Return(tt.aliasOf, nil)
+					ds.EXPECT().GetKey(generateUserKey(tt.aliasOf)).Return(`{"username":"`+tt.aliasOf+`"}`, nil)
+				} else {
+					ds.EXPECT().GetKey(generateAliasKey("jhrke")).Return("", nil)
+				}
+			}
+			if tt.wantErr == nil || tt.name == "Taken" {
+				ds.EXPECT().RenameKeyIfAbsent(generateUserKey("joehrke"), generateUserKey("jhrke")).Return(tt.moved, nil)
+			}
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKey(generateUserKey("jhrke"), tt.wantSaved, time.Duration(0)).Return(nil)
+				ds.EXPECT().SetKey("email_joe@example.com", "jhrke", time.Duration(0)).Return(nil)
+				ds.EXPECT().SetKey("identity_acme_123", "jhrke", time.Duration(0)).Return(nil)
+				ds.EXPECT().AddIndexMember(userIndexKey, "jhrke").Return(nil)
+				ds.EXPECT().RemoveIndexMember(userIndexKey, "joehrke").Return(nil)
+			}
+			if tt.aliasOf == "joehrke" {
+				ds.EXPECT().DelKey(generateAliasKey("jhrke")).Return(nil)
+			}
+			if tt.wantErr == nil && tt.aliasTTL > 0 {
+				ds.EXPECT().SetKey(generateAliasKey("joehrke"), "jhrke", tt.aliasTTL).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				cfg: Config{UsernameAliasTTL: tt.aliasTTL},
+				now: fixedClock,
+			}
+			got, err := svc.RenameUser("joehrke", tt.newName)
+			if err != tt.wantErr {
+				t.Fatalf("RenameUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Username != "jhrke" {
+				t.Errorf("RenameUser() username = %v, want jhrke", got.Username)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_GetUser_Alias(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases map[string]string
+		users   map[string]bool
+		want    string
+		wantErr error
+	}{
+		{name: "One_Rename", aliases: map[string]string{"joehrke": "jhrke"}, users: map[string]bool{"jhrke": true}, want: "jhrke"},
+		{name: "Renamed_Twice", aliases: map[string]string{"joehrke": "jhrke", "jhrke": "joe"}, users: map[string]bool{"joe": true}, want: "joe"},
+		{name: "Since_Deleted", aliases: map[string]string{"joehrke": "jhrke"}, wantErr: user.NotFound},
+		{name: "No_Alias", wantErr: user.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(gomock.Any()).AnyTimes().DoAndReturn(func(key string) (string, error) {
+				for from, to := range tt.aliases {
+					if key == generateAliasKey(from) {
+						return to, nil
+					}
+				}
+				for name := range tt.users {
+					if key == generateUserKey(name) {
+						return `{"username":"` + name + `"}`, nil
+					}
+				}
+				return "", nil
+			})
+
+			svc := &UserSVCImpl{ds: ds, now: fixedClock}
+			got, err := svc.GetUser("joehrke")
+			if err != tt.wantErr {
+				t.Fatalf("GetUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Username != tt.want {
+				t.Errorf("GetUser() username = %v, want %v", got.Username, tt.want)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_DropAliases(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	//joe was renamed to jhrke and then to jh, bob's old name is someone else's
+	aliases := map[string]string{
+		generateAliasKey("joe"):    "jhrke",
+		generateAliasKey("jhrke"):  "jh",
+		generateAliasKey("robert"): "bob",
+	}
+	ds.EXPECT().ScanKeys(int64(0), "useralias_*", gomock.Any()).Return(int64(0), []string{generateAliasKey("joe"), generateAliasKey("jhrke"), generateAliasKey("robert")}, nil)
+	ds.EXPECT().GetKey(gomock.Any()).DoAndReturn(func(key string) (string, error) { return aliases[key], nil }).Times(3)
+	ds.EXPECT().DelKey(generateAliasKey("jhrke")).Return(nil)
+	ds.EXPECT().DelKey(generateAliasKey("joe")).Return(nil)
+
+	svc := &UserSVCImpl{ds: ds}
+	dropped, err := svc.DropAliases("JH")
+	if err != nil {
+		t.Fatalf("DropAliases() unexpected error = %v", err)
+	}
+	if dropped != 2 {
+		t.Errorf("DropAliases() dropped = %v, want 2", dropped)
+	}
+	ctrl.Finish()
+}
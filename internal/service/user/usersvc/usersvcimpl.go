@@ -2,52 +2,95 @@ package usersvc
 
 import (
 	"encoding/json"
-	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"sort"
 	"sso-v2/internal/datasource"
 	"sso-v2/internal/service/user"
+	"strings"
+	"time"
 )
 
-const ()
+const (
+	bcryptCost    = 14
+	scanBatchSize = 100
+
+	// userIndexKey is the sorted index of every username, ListUsers pages through it
+	userIndexKey = "userindex"
+
+	// dummyHash is compared against when a username doesn't exist so that the not found path costs the same
+	// bcrypt work as a real password check. It must be generated with bcryptCost to keep the timings matched.
+	dummyHash = "$2a$14$fO0OmXwSpwA094kSsI3iR.FhoGe688do4vqu4gFgxoocuWXlE/aL2"
+)
+
+type Config struct {
+	// RequireVerifiedEmail rejects authentication for users who haven't verified an email address
+	RequireVerifiedEmail bool
+	// Attributes is the schema user profile attributes are validated against
+	Attributes user.AttributeSchema
+	// Pepper is mixed into passwords before they are hashed, the zero Pepper turns it off
+	Pepper Pepper
+	// MaxPasswordAge is how long a password lasts before the user has to change it, 0 means passwords don't expire
+	MaxPasswordAge time.Duration
+	// PasswordHistory is how many of a user's most recent passwords, the current one included, can't be chosen again.
+	// 0 turns the check off.
+	PasswordHistory int
+	// UsernameAliasTTL is how long a renamed user's old name keeps leading to them, 0 drops it straight away
+	UsernameAliasTTL time.Duration
+}
 
 type UserSVCImpl struct {
-	ds datasource.Datasource
+	ds  datasource.Datasource
+	cfg Config
+	now func() time.Time
 }
 
-func NewUserSvc(ds datasource.Datasource) user.UserSVC {
-	return &UserSVCImpl{ds: ds}
+func NewUserSvc(ds datasource.Datasource, cfg Config) user.UserSVC {
+	return &UserSVCImpl{ds: ds, cfg: cfg, now: time.Now}
 }
 
 func (svc *UserSVCImpl) EncryptPassword(pass string) (encryptedPass string, err error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(pass), 14)
+	pepper := svc.cfg.Pepper
+	if pepper.enabled() {
+		pass, _ = pepper.mix(pepper.Current, pass)
+	}
+	bytes, err := bcrypt.GenerateFromPassword([]byte(pass), bcryptCost)
 	if err != nil {
 		log.Print("error generating bcrypt hash: " + err.Error())
 		return "", err
 	}
 
+	if pepper.enabled() {
+		return pepperedHash(pepper.Current, string(bytes)), nil
+	}
 	return string(bytes), nil
 }
 
 func (svc *UserSVCImpl) AuthUser(username string, pass string) (bool, error) {
-	foundUser, err := svc.ds.GetKey(generateUserKey(username))
+	username, err := user.NormalizeUsername(username)
 	if err != nil {
-		log.Print("error checking for existing username")
-		return false, err
-	}
-	if foundUser == "" {
+		//an unnormalizable name can never exist, treat it like any other unknown user
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(pass))
 		return false, user.NotFound
 	}
 
-	//Check passwords match
-	userDat := &user.UserData{}
-	err = json.Unmarshal([]byte(foundUser), userDat)
+	userDat, err := svc.lookupUser(username)
+	if err == user.NotFound {
+		//burn the same bcrypt time as a real comparison so response times don't reveal which usernames exist
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(pass))
+		return false, user.NotFound
+	}
 	if err != nil {
-		log.Printf("error unmarshaling userhandlers data: %v", err.Error())
 		return false, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(userDat.HashedPass), []byte(pass))
+	//Check passwords match
+	if userDat.CurrentState() == user.StateDeleted {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(pass))
+		return false, user.NotFound
+	}
+
+	err = svc.comparePassword(userDat.HashedPass, pass)
 	//if our passwords mismatch, its not a failure, just rejected
 	if err == bcrypt.ErrMismatchedHashAndPassword {
 		return false, nil
@@ -57,40 +100,795 @@ func (svc *UserSVCImpl) AuthUser(username string, pass string) (bool, error) {
 		return false, err
 	}
 
+	//the password is right, but the account may not be usable in its current state
+	err = userDat.LoginError()
+	if err != nil {
+		return false, err
+	}
+	//users created before states existed have no pending state, so check the address itself as well
+	if svc.cfg.RequireVerifiedEmail && !userDat.EmailVerified {
+		return false, user.EmailNotVerified
+	}
+
+	//imported hashes are weaker than bcrypt, older hashes may lack the current pepper and passwords set before they
+	//were dated have no age yet, all can be fixed now that the password is known to be right
+	if svc.needsRehash(userDat.HashedPass) || userDat.PasswordChangedAt == nil {
+		svc.upgradePassword(userDat, pass)
+	}
+
 	//If the check has made it this far, all's well
 	return true, nil
 }
 
-func (svc *UserSVCImpl) CreateUser(username string, encryptedPass string) error {
+// upgradePassword rehashes a legacy or outdated hash the way EncryptPassword does now and starts an undated password's
+// maximum age from now.  Failures are only logged since the login itself succeeded and the stored password still works.
+func (svc *UserSVCImpl) upgradePassword(userDat *user.UserData, pass string) {
+	if svc.needsRehash(userDat.HashedPass) {
+		hashedPass, err := svc.EncryptPassword(pass)
+		if err != nil {
+			return
+		}
+		userDat.HashedPass = hashedPass
+		userDat.PasswordHistory = svc.cfg.Pepper.withoutUnpeppered(userDat.PasswordHistory)
+	}
+	if userDat.PasswordChangedAt == nil {
+		changedAt := svc.now().UTC()
+		userDat.PasswordChangedAt = &changedAt
+	}
+	err := svc.storeUser(userDat)
+	if err != nil {
+		log.Printf("error upgrading password: %v", err.Error())
+	}
+}
+
+func (svc *UserSVCImpl) PasswordChangeRequired(u *user.UserData) bool {
+	return u.PasswordExpired(svc.cfg.MaxPasswordAge, svc.now())
+}
+
+func (svc *UserSVCImpl) CreateUser(username string, encryptedPass string, email string, attributes map[string]interface{}) error {
+	userData := &user.UserData{
+		Username:   username,
+		HashedPass: encryptedPass,
+		Email:      email,
+		Attributes: attributes,
+		State:      user.StateActive,
+	}
+	if svc.cfg.RequireVerifiedEmail {
+		userData.State = user.StatePendingVerification
+	}
+	return svc.createUser(userData, false)
+}
+
+func (svc *UserSVCImpl) ImportUser(record user.ImportRecord, dryRun bool) error {
+	err := svc.checkPasswordHash(record.PasswordHash)
+	if err != nil {
+		return err
+	}
+
+	userData := &user.UserData{
+		Username:      record.Username,
+		HashedPass:    record.PasswordHash,
+		Email:         record.Email,
+		EmailVerified: record.Email != "" && record.EmailVerified,
+		Attributes:    svc.cfg.Attributes.CoerceStrings(record.Attributes),
+		State:         user.StateActive,
+	}
+	if svc.cfg.RequireVerifiedEmail && !userData.EmailVerified {
+		userData.State = user.StatePendingVerification
+	}
+	return svc.createUser(userData, dryRun)
+}
+
+// createUser normalizes and validates a new user, claims its email address and unique attributes and stores it.  On
+// a dry run every check is made but nothing is claimed or written.
+func (svc *UserSVCImpl) createUser(userData *user.UserData, dryRun bool) error {
+	username, err := user.NormalizeUsername(userData.Username)
+	if err != nil {
+		return err
+	}
+	email := userData.Email
+	if email != "" {
+		email, err = user.NormalizeEmail(email)
+		if err != nil {
+			return err
+		}
+	}
+	attributes := compactAttributes(userData.Attributes)
+	err = svc.cfg.Attributes.Validate(attributes)
+	if err != nil {
+		return err
+	}
+
 	foundUser, err := svc.ds.GetKey(generateUserKey(username))
 	if err != nil && err != datasource.KeyNotFound {
 		log.Print("error checking for existing username")
 		return err
 	}
 	if foundUser != "" {
-		return errors.New("username already taken")
+		return user.UsernameTaken
+	}
+	//a renamed user's old name stays theirs until its alias expires
+	aliasOf, err := svc.resolveAlias(username)
+	if err != nil {
+		return err
+	}
+	if aliasOf != "" {
+		return user.UsernameTaken
 	}
 
-	userData := user.UserData{
-		Username:   username,
-		HashedPass: encryptedPass,
+	uniques := svc.changedUniqueAttributes(nil, attributes)
+	if dryRun {
+		return svc.checkAvailable(username, email, attributes, uniques)
+	}
+	err = svc.claimAttributes(username, attributes, uniques)
+	if err != nil {
+		return err
+	}
+	if email != "" {
+		err = svc.claimEmail(email, username)
+		if err != nil {
+			svc.releaseAttributes(username, attributes, uniques)
+			return err
+		}
 	}
 
+	userData.Username = username
+	userData.Email = email
+	userData.Attributes = attributes
+	changedAt := svc.now().UTC()
+	userData.PasswordChangedAt = &changedAt
 	rawUser, err := json.Marshal(userData)
 	if err != nil {
 		log.Printf("error marshaling userhandlers data: %v", err.Error())
 		return err
 	}
 
-	err = svc.ds.SetKey(generateUserKey(username), string(rawUser), 0)
+	//the check above is only a fast path, two creates of the same name can both get past it
+	created, err := svc.ds.SetKeyIfAbsent(generateUserKey(username), string(rawUser), 0)
 	if err != nil {
 		log.Printf("error writing userhandlers to datastore: %v", err.Error())
+		svc.releaseClaims(username, email, attributes, uniques, nil)
+		return err
+	}
+	if !created {
+		svc.releaseLostClaims(username, email, attributes, uniques)
+		return user.UsernameTaken
+	}
+
+	//the account exists at this point, a missing index entry only hides it from listings until IndexUsers runs
+	err = svc.ds.AddIndexMember(userIndexKey, username)
+	if err != nil {
+		log.Printf("error indexing user: %v", err.Error())
+	}
+	return nil
+}
+
+// releaseLostClaims undoes the claims of a create that lost the race for its username.  Claims are held by username, so
+// the ones the stored record also holds are the winner's and stay.
+func (svc *UserSVCImpl) releaseLostClaims(username string, email string, attrs map[string]interface{}, uniques []string) {
+	winner, err := svc.loadUser(username)
+	if err != nil {
+		//without the winner's record nothing can be released safely, the claims just stay reserved
+		log.Printf("error loading user after lost create: %v", err.Error())
+		return
+	}
+	svc.releaseClaims(username, email, attrs, uniques, winner)
+}
+
+// releaseClaims releases the email address and unique attribute values claimed for a user, except those keep holds
+func (svc *UserSVCImpl) releaseClaims(username string, email string, attrs map[string]interface{}, uniques []string, keep *user.UserData) {
+	if keep == nil {
+		keep = &user.UserData{}
+	}
+	if email != "" && email != keep.Email {
+		err := svc.releaseEmail(email, username)
+		if err != nil {
+			log.Printf("error releasing email: %v", err.Error())
+		}
+	}
+	var release []string
+	for _, name := range uniques {
+		if attrs[name] != keep.Attributes[name] {
+			release = append(release, name)
+		}
+	}
+	svc.releaseAttributes(username, attrs, release)
+}
+
+// checkAvailable reports the error createUser would hit claiming the email address and unique attributes, without
+// claiming anything
+func (svc *UserSVCImpl) checkAvailable(username string, email string, attrs map[string]interface{}, uniques []string) error {
+	for _, name := range uniques {
+		if attrs[name] == nil {
+			continue
+		}
+		owner, err := svc.ds.GetKey(generateAttributeKey(name, attrs[name]))
+		if err != nil {
+			log.Printf("error checking index owner: %v", err.Error())
+			return err
+		}
+		if owner != "" && owner != username {
+			return user.AttributeTakenError("attribute " + name + " already in use")
+		}
+	}
+	if email == "" {
+		return nil
+	}
+	owner, err := svc.ds.GetKey(generateEmailKey(email))
+	if err != nil {
+		log.Printf("error checking index owner: %v", err.Error())
+		return err
+	}
+	if owner != "" && owner != username {
+		return user.EmailTaken
+	}
+	return nil
+}
+
+func (svc *UserSVCImpl) SetEmail(username string, email string) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+	email, err = user.NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+	if userDat.Email == email {
+		return nil
+	}
+
+	err = svc.claimEmail(email, username)
+	if err != nil {
+		return err
+	}
+	if userDat.Email != "" {
+		err = svc.releaseEmail(userDat.Email, username)
+		if err != nil {
+			return err
+		}
+	}
+
+	userDat.Email = email
+	userDat.EmailVerified = false
+	return svc.storeUser(userDat)
+}
+
+func (svc *UserSVCImpl) VerifyEmail(username string, email string) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+	//a verification sent for a previous address mustn't verify whatever the user has switched to since
+	if userDat.Email == "" || userDat.Email != email {
+		return user.EmailChanged
+	}
+
+	userDat.EmailVerified = true
+	if userDat.CurrentState() == user.StatePendingVerification {
+		userDat.State = user.StateActive
+	}
+	return svc.storeUser(userDat)
+}
+
+func (svc *UserSVCImpl) UpdateAttributes(username string, patch map[string]interface{}) (*user.UserData, error) {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return nil, user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := svc.cfg.Attributes.ApplyPatch(userDat.Attributes, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	//new unique values are claimed before anything is stored, the old ones are only released once the user is written
+	changed := svc.changedUniqueAttributes(userDat.Attributes, updated)
+	err = svc.claimAttributes(username, updated, changed)
+	if err != nil {
+		return nil, err
+	}
+	previous := userDat.Attributes
+	userDat.Attributes = compactAttributes(updated)
+	err = svc.storeUser(userDat)
+	if err != nil {
+		return nil, err
+	}
+	svc.releaseAttributes(username, previous, changed)
+
+	return userDat, nil
+}
+
+func (svc *UserSVCImpl) SetState(username string, state user.UserState) error {
+	if !user.ValidState(state) {
+		return user.InvalidState
+	}
+	return svc.UpdateUser(username, func(u *user.UserData) error {
+		u.State = state
+		return nil
+	})
+}
+
+func (svc *UserSVCImpl) DeleteUser(username string) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+
+	//the record goes first, a failure releasing an index afterwards only leaves a stale reservation behind
+	err = svc.ds.DelKey(generateUserKey(username))
+	if err != nil {
+		log.Printf("error deleting user: %v", err.Error())
+		return err
+	}
+	if userDat.Email != "" {
+		err = svc.releaseEmail(userDat.Email, username)
+		if err != nil {
+			log.Printf("error releasing email: %v", err.Error())
+		}
+	}
+	svc.releaseAttributes(username, userDat.Attributes, svc.changedUniqueAttributes(userDat.Attributes, nil))
+	svc.releaseIdentities(userDat)
+	err = svc.ds.RemoveIndexMember(userIndexKey, username)
+	if err != nil {
+		log.Printf("error unindexing user: %v", err.Error())
+	}
+	return nil
+}
+
+func (svc *UserSVCImpl) ListUsers(query user.UserQuery) (*user.UserPage, error) {
+	for name := range query.Attributes {
+		if _, ok := svc.cfg.Attributes[name]; !ok {
+			return nil, user.AttributeError("unknown attribute " + name)
+		}
+	}
+	if query.State != "" && !user.ValidState(query.State) {
+		return nil, user.InvalidState
+	}
+
+	page := &user.UserPage{Users: []user.UserData{}}
+	prefix := ""
+	if query.Prefix != "" {
+		var err error
+		prefix, err = user.NormalizeUsername(query.Prefix)
+		if err != nil {
+			//no stored username can start with something that doesn't normalize
+			return page, nil
+		}
+	}
+
+	//filters are applied after loading, so keep reading batches from the index until the page fills or it runs out
+	size := query.PageSize()
+	after := query.Cursor
+	for {
+		names, err := svc.ds.RangeIndex(userIndexKey, prefix, after, scanBatchSize)
+		if err != nil {
+			log.Printf("error reading user index: %v", err.Error())
+			return nil, err
+		}
+		for _, name := range names {
+			after = name
+			userDat, err := svc.loadUser(name)
+			if err == user.NotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !query.Matches(userDat) {
+				continue
+			}
+			page.Users = append(page.Users, *userDat)
+			if len(page.Users) == size {
+				page.NextCursor = name
+				return page, nil
+			}
+		}
+		if len(names) < scanBatchSize {
+			return page, nil
+		}
+	}
+}
+
+func (svc *UserSVCImpl) ExportUsers(visit func(u *user.UserData) error) error {
+	//the keyspace is authoritative, unlike the index it can't be missing users created before the index existed
+	names, err := svc.scanUsernames()
+	if err != nil {
 		return err
 	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		userDat, err := svc.loadUser(name)
+		if err == user.NotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = visit(userDat)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *UserSVCImpl) IndexUsers() (int, error) {
+	names, err := svc.scanUsernames()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		err = svc.ds.AddIndexMember(userIndexKey, name)
+		if err != nil {
+			log.Printf("error indexing user: %v", err.Error())
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
+
+func (svc *UserSVCImpl) SessionVars(u *user.UserData) map[string]string {
+	return svc.cfg.Attributes.SessionVars(u.Attributes)
+}
+
+// compactAttributes drops nil values, returning nil rather than an empty map so users without attributes store none
+func compactAttributes(attrs map[string]interface{}) map[string]interface{} {
+	var compacted map[string]interface{}
+	for name, value := range attrs {
+		if value == nil {
+			continue
+		}
+		if compacted == nil {
+			compacted = make(map[string]interface{})
+		}
+		compacted[name] = value
+	}
+	return compacted
+}
+
+// changedUniqueAttributes lists the unique attributes whose value differs between before and after
+func (svc *UserSVCImpl) changedUniqueAttributes(before map[string]interface{}, after map[string]interface{}) []string {
+	changed := []string{}
+	for _, name := range svc.cfg.Attributes.Names() {
+		if svc.cfg.Attributes[name].Unique && before[name] != after[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// claimAttributes reserves the values of the named attributes for a user, if one is held by someone else anything
+// claimed so far is released and a user.AttributeTakenError returned
+func (svc *UserSVCImpl) claimAttributes(username string, attrs map[string]interface{}, names []string) error {
+	for i, name := range names {
+		if attrs[name] == nil {
+			continue
+		}
+		claimed, err := svc.claimIndex(generateAttributeKey(name, attrs[name]), username)
+		if err == nil && !claimed {
+			err = user.AttributeTakenError("attribute " + name + " already in use")
+		}
+		if err != nil {
+			svc.releaseAttributes(username, attrs, names[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAttributes drops the user's values of the named attributes from their uniqueness indexes.  Failures are
+// only logged, a stale index entry blocks the value for other users but doesn't lose data.
+func (svc *UserSVCImpl) releaseAttributes(username string, attrs map[string]interface{}, names []string) {
+	for _, name := range names {
+		if attrs[name] == nil {
+			continue
+		}
+		err := svc.releaseIndex(generateAttributeKey(name, attrs[name]), username)
+		if err != nil {
+			log.Printf("error releasing attribute %v: %v", name, err.Error())
+		}
+	}
+}
 
+// claimEmail reserves an address for a user in the email index, returning user.EmailTaken if someone else holds it
+func (svc *UserSVCImpl) claimEmail(email string, username string) error {
+	claimed, err := svc.claimIndex(generateEmailKey(email), username)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return user.EmailTaken
+	}
+	return nil
+}
+
+// releaseEmail drops an address from the email index as long as it still belongs to the user
+func (svc *UserSVCImpl) releaseEmail(email string, username string) error {
+	return svc.releaseIndex(generateEmailKey(email), username)
+}
+
+// claimIndex reserves a uniqueness index key for a user, reporting false if someone else already holds it
+func (svc *UserSVCImpl) claimIndex(key string, username string) (bool, error) {
+	claimed, err := svc.ds.SetKeyIfAbsent(key, username, 0)
+	if err != nil {
+		log.Printf("error claiming index key: %v", err.Error())
+		return false, err
+	}
+	if claimed {
+		return true, nil
+	}
+
+	owner, err := svc.ds.GetKey(key)
+	if err != nil {
+		log.Printf("error checking index owner: %v", err.Error())
+		return false, err
+	}
+	return owner == username, nil
+}
+
+// releaseIndex drops a uniqueness index key as long as it still belongs to the user
+func (svc *UserSVCImpl) releaseIndex(key string, username string) error {
+	owner, err := svc.ds.GetKey(key)
+	if err != nil {
+		log.Printf("error checking index owner: %v", err.Error())
+		return err
+	}
+	if owner != username {
+		return nil
+	}
+	return svc.ds.DelKey(key)
+}
+
+func (svc *UserSVCImpl) MigrateUsernames(apply bool) (*user.UsernameMigrationReport, error) {
+	report := &user.UsernameMigrationReport{
+		Applied:    apply,
+		Migrated:   make(map[string]string),
+		Collisions: make(map[string][]string),
+		Invalid:    []string{},
+	}
+
+	storedNames, err := svc.scanUsernames()
+	if err != nil {
+		return nil, err
+	}
+
+	//group every stored username under its normalized form so collisions can be spotted before anything moves
+	byNormalized := make(map[string][]string)
+	for _, stored := range storedNames {
+		normalized, err := user.NormalizeUsername(stored)
+		if err != nil {
+			report.Invalid = append(report.Invalid, stored)
+			continue
+		}
+		byNormalized[normalized] = append(byNormalized[normalized], stored)
+	}
+
+	for normalized, stored := range byNormalized {
+		if len(stored) > 1 {
+			sort.Strings(stored)
+			report.Collisions[normalized] = stored
+			continue
+		}
+		if stored[0] == normalized {
+			report.Unchanged++
+			continue
+		}
+
+		report.Migrated[stored[0]] = normalized
+		if !apply {
+			continue
+		}
+		err = svc.moveUser(stored[0], normalized)
+		if err != nil {
+			return report, err
+		}
+	}
+	sort.Strings(report.Invalid)
+
+	return report, nil
+}
+
+// scanUsernames returns the raw (possibly unnormalized) username behind every user key in the datastore
+func (svc *UserSVCImpl) scanUsernames() ([]string, error) {
+	seen := make(map[string]bool)
+	names := []string{}
+	var cursor int64
+	for {
+		next, keys, err := svc.ds.ScanKeys(cursor, generateUserKey("*"), scanBatchSize)
+		if err != nil {
+			log.Printf("error scanning user keys: %v", err.Error())
+			return nil, err
+		}
+		for _, key := range keys {
+			name := strings.TrimPrefix(key, generateUserKey(""))
+			//SCAN may return a key more than once
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if next == 0 {
+			return names, nil
+		}
+		cursor = next
+	}
+}
+
+// moveUser rewrites a stored user under a new username, the new key is written before the old one is removed.  Like a
+// rename, the user's email, unique attribute and identity reservations are pointed at the new name so the user still
+// holds them.
+func (svc *UserSVCImpl) moveUser(from string, to string) error {
+	userDat, err := svc.loadUser(from)
+	if err != nil {
+		return err
+	}
+
+	userDat.Username = to
+	err = svc.storeUser(userDat)
+	if err != nil {
+		return err
+	}
+
+	err = svc.ds.DelKey(generateUserKey(from))
+	if err != nil {
+		return err
+	}
+	for _, key := range svc.reservationKeys(userDat) {
+		err = svc.ds.SetKey(key, to, 0)
+		if err != nil {
+			return err
+		}
+	}
+	err = svc.ds.AddIndexMember(userIndexKey, to)
+	if err != nil {
+		return err
+	}
+	return svc.ds.RemoveIndexMember(userIndexKey, from)
+}
+
+func (svc *UserSVCImpl) GetUser(username string) (*user.UserData, error) {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return nil, user.NotFound
+	}
+	return svc.lookupUser(username)
+}
+
+func (svc *UserSVCImpl) UpdateUser(username string, update func(u *user.UserData) error) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+	err = update(userDat)
+	if err != nil {
+		return err
+	}
+	//the key is derived from the username, so it can't be changed through an update
+	userDat.Username = username
+	return svc.storeUser(userDat)
+}
+
+func (svc *UserSVCImpl) SetPassword(username string, encryptedPass string) error {
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+
+	changedAt := svc.now().UTC()
+	//the password being replaced becomes the newest history entry, the current one is always checked so one fewer
+	//is kept than the history covers
+	userDat.PasswordHistory = svc.cfg.Pepper.withoutUnpeppered(userDat.RecentPasswordHashes(svc.cfg.PasswordHistory - 1))
+	userDat.HashedPass = encryptedPass
+	userDat.PasswordChangedAt = &changedAt
+	userDat.MustChangePassword = false
+	return svc.storeUser(userDat)
+}
+
+func (svc *UserSVCImpl) CheckPasswordReuse(username string, pass string) error {
+	if svc.cfg.PasswordHistory <= 0 {
+		return nil
+	}
+	username, err := user.NormalizeUsername(username)
+	if err != nil {
+		return user.NotFound
+	}
+
+	userDat, err := svc.loadUser(username)
+	if err != nil {
+		return err
+	}
+	for _, hash := range userDat.RecentPasswordHashes(svc.cfg.PasswordHistory) {
+		err = svc.comparePassword(hash, pass)
+		if err == nil {
+			return user.PasswordReused
+		}
+		//an entry that can't be compared can't be matched either, it mustn't stop the user changing their password
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			log.Printf("error comparing password history: %v", err.Error())
+		}
+	}
+	return nil
+}
+
+// loadUser fetches the stored record for an already normalized username, returning user.NotFound if there is none
+func (svc *UserSVCImpl) loadUser(username string) (*user.UserData, error) {
+	rawUser, err := svc.ds.GetKey(generateUserKey(username))
+	if err != nil {
+		log.Printf("error fetching user: %v", err.Error())
+		return nil, err
+	}
+	if rawUser == "" {
+		return nil, user.NotFound
+	}
+
+	userDat := &user.UserData{}
+	err = json.Unmarshal([]byte(rawUser), userDat)
+	if err != nil {
+		log.Printf("error unmarshaling user data: %v", err.Error())
+		return nil, err
+	}
+	return userDat, nil
+}
+
+// storeUser writes a user record back under the key for its Username
+func (svc *UserSVCImpl) storeUser(userDat *user.UserData) error {
+	rawUser, err := json.Marshal(userDat)
+	if err != nil {
+		log.Printf("error marshaling user data: %v", err.Error())
+		return err
+	}
+
+	err = svc.ds.SetKey(generateUserKey(userDat.Username), string(rawUser), 0)
+	if err != nil {
+		log.Printf("error writing user to datastore: %v", err.Error())
+		return err
+	}
 	return nil
 }
 
 func generateUserKey(username string) string {
 	return "user_" + username
 }
+
+func generateEmailKey(email string) string {
+	return "email_" + email
+}
+
+// attributeNameEscaper escapes the separator out of attribute names so the first "_" after the prefix always ends the
+// name.  Parsed schemas only allow letters and digits, so the keys of valid names are unchanged.
+var attributeNameEscaper = strings.NewReplacer("%", "%25", "_", "%5F")
+
+func generateAttributeKey(name string, value interface{}) string {
+	return "attr_" + attributeNameEscaper.Replace(name) + "_" + user.AttributeString(value)
+}
@@ -4,11 +4,19 @@ import (
 	"errors"
 	"github.com/golang/mock/gomock"
 	"golang.org/x/crypto/bcrypt"
+	"reflect"
 	"sso-v2/gen/mocks/mock_datasource"
+	"sso-v2/internal/service/user"
+	"strings"
 	"testing"
 	"time"
 )
 
+// fixedClock is the service's clock in tests, so the times it stores are predictable
+func fixedClock() time.Time {
+	return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+}
+
 func TestUserSVCImpl_PasswordEncrypt(t *testing.T) {
 	type args struct {
 		pass string
@@ -27,7 +35,8 @@ func TestUserSVCImpl_PasswordEncrypt(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			svc := &UserSVCImpl{
-				ds: nil,
+				ds:  nil,
+				now: fixedClock,
 			}
 			gotEncryptedPass, err := svc.EncryptPassword(tt.args.pass)
 			if (err != nil) != tt.wantErr {
@@ -79,10 +88,11 @@ func TestUserSVCImpl_CreateUser_NameTaken(t *testing.T) {
 			ds.EXPECT().GetKey(generateUserKey(tt.args.username)).Return(`{"username":"joehrke", "encryptedPass":"sdgsdfsdfsdf"`, tt.dsErr)
 
 			svc := &UserSVCImpl{
-				ds: ds,
+				ds:  ds,
+				now: fixedClock,
 			}
 
-			if err := svc.CreateUser(tt.args.username, tt.args.pass); (err != nil) != tt.wantErr {
+			if err := svc.CreateUser(tt.args.username, tt.args.pass, "", nil); (err != nil) != tt.wantErr {
 				t.Errorf("CreateUser() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
@@ -125,13 +135,18 @@ func TestUserSVCImpl_CreateUser(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			ds := mock_datasource.NewMockDatasource(ctrl)
 			ds.EXPECT().GetKey(generateUserKey(tt.args.username)).Return("", nil)
-			ds.EXPECT().SetKey(generateUserKey(tt.args.username), gomock.Any(), time.Duration(0)).Return(tt.dsErr)
+			ds.EXPECT().GetKey(generateAliasKey(tt.args.username)).Return("", nil)
+			ds.EXPECT().SetKeyIfAbsent(generateUserKey(tt.args.username), gomock.Any(), time.Duration(0)).Return(tt.dsErr == nil, tt.dsErr)
+			if tt.dsErr == nil {
+				ds.EXPECT().AddIndexMember(userIndexKey, tt.args.username).Return(nil)
+			}
 
 			svc := &UserSVCImpl{
-				ds: ds,
+				ds:  ds,
+				now: fixedClock,
 			}
 
-			if err := svc.CreateUser(tt.args.username, tt.args.pass); (err != nil) != tt.wantErr {
+			if err := svc.CreateUser(tt.args.username, tt.args.pass, "", nil); (err != nil) != tt.wantErr {
 				t.Errorf("CreateUser() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
@@ -180,7 +195,7 @@ func TestUserSVCImpl_AuthUser(t *testing.T) {
 				username: "joehrke",
 				pass:     "abc1234",
 			},
-			userFound: `{"username":"joehrke", "hashedPass":"$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe"}`,
+			userFound: `{"username":"joehrke", "hashedPass":"$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe", "passwordChangedAt":"2020-01-01T00:00:00Z"}`,
 			dsError:   nil,
 			wantErr:   false,
 			want:      false,
@@ -191,7 +206,7 @@ func TestUserSVCImpl_AuthUser(t *testing.T) {
 				username: "joehrke",
 				pass:     "abc123",
 			},
-			userFound: `{"username":"joehrke", "hashedPass":"$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe"}`,
+			userFound: `{"username":"joehrke", "hashedPass":"$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe", "passwordChangedAt":"2020-01-01T00:00:00Z"}`,
 			dsError:   nil,
 			wantErr:   false,
 			want:      true,
@@ -202,9 +217,13 @@ func TestUserSVCImpl_AuthUser(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			ds := mock_datasource.NewMockDatasource(ctrl)
 			ds.EXPECT().GetKey(generateUserKey(tt.args.username)).Return(tt.userFound, tt.dsError)
+			if tt.userFound == "" && tt.dsError == nil {
+				ds.EXPECT().GetKey(generateAliasKey(tt.args.username)).Return("", nil)
+			}
 
 			svc := &UserSVCImpl{
-				ds: ds,
+				ds:  ds,
+				now: fixedClock,
 			}
 
 			got, err := svc.AuthUser(tt.args.username, tt.args.pass)
@@ -218,3 +237,851 @@ func TestUserSVCImpl_AuthUser(t *testing.T) {
 		})
 	}
 }
+
+func TestUserSVCImpl_CreateUser_LostRace(t *testing.T) {
+	tests := []struct {
+		name         string
+		winner       string
+		wantReleased bool
+	}{
+		{
+			name:   "Same_Email",
+			winner: `{"username":"joehrke","email":"joe@example.com"}`,
+		},
+		{
+			name:         "Other_Email",
+			winner:       `{"username":"joehrke","email":"jo@example.com"}`,
+			wantReleased: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			//another create of the name lands between the check and the write
+			gomock.InOrder(
+				ds.EXPECT().GetKey(generateUserKey("joehrke")).Return("", nil),
+				ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(tt.winner, nil),
+			)
+			ds.EXPECT().GetKey(generateAliasKey("joehrke")).Return("", nil)
+			ds.EXPECT().SetKeyIfAbsent(generateEmailKey("joe@example.com"), "joehrke", time.Duration(0)).Return(true, nil)
+			ds.EXPECT().SetKeyIfAbsent(generateUserKey("joehrke"), gomock.Any(), time.Duration(0)).Return(false, nil)
+			if tt.wantReleased {
+				ds.EXPECT().GetKey(generateEmailKey("joe@example.com")).Return("joehrke", nil)
+				ds.EXPECT().DelKey(generateEmailKey("joe@example.com")).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+			if err := svc.CreateUser("joehrke", "hash", "joe@example.com", nil); err != user.UsernameTaken {
+				t.Errorf("CreateUser() error = %v, want %v", err, user.UsernameTaken)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_CreateUser_Normalizes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey(generateUserKey("joehrke")).Return("", nil)
+	ds.EXPECT().GetKey(generateAliasKey("joehrke")).Return("", nil)
+	ds.EXPECT().SetKeyIfAbsent(generateUserKey("joehrke"), `{"username":"joehrke","hashedPass":"hash","state":"active","passwordChangedAt":"2020-01-02T03:04:05Z"}`, time.Duration(0)).Return(true, nil)
+	ds.EXPECT().AddIndexMember(userIndexKey, "joehrke").Return(nil)
+
+	svc := &UserSVCImpl{
+		ds:  ds,
+		now: fixedClock,
+	}
+
+	if err := svc.CreateUser(" JOehrke ", "hash", "", nil); err != nil {
+		t.Errorf("CreateUser() unexpected error = %v", err)
+	}
+
+	if err := svc.CreateUser("j oehrke", "hash", "", nil); err != user.InvalidUsername {
+		t.Errorf("CreateUser() error = %v, want %v", err, user.InvalidUsername)
+	}
+}
+
+func TestUserSVCImpl_MigrateUsernames(t *testing.T) {
+	tests := []struct {
+		name          string
+		apply         bool
+		wantMigrated  map[string]string
+		wantCollision map[string][]string
+		wantInvalid   []string
+		wantUnchanged int
+	}{
+		{
+			name:          "Dry_Run",
+			apply:         false,
+			wantMigrated:  map[string]string{"Bob": "bob"},
+			wantCollision: map[string][]string{"alice": {"Alice", "alice"}},
+			wantInvalid:   []string{"bad name"},
+			wantUnchanged: 1,
+		},
+		{
+			name:          "Apply",
+			apply:         true,
+			wantMigrated:  map[string]string{"Bob": "bob"},
+			wantCollision: map[string][]string{"alice": {"Alice", "alice"}},
+			wantInvalid:   []string{"bad name"},
+			wantUnchanged: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().ScanKeys(int64(0), "user_*", gomock.Any()).Return(int64(7), []string{"user_Alice", "user_alice", "user_Bob"}, nil)
+			ds.EXPECT().ScanKeys(int64(7), "user_*", gomock.Any()).Return(int64(0), []string{"user_carol", "user_bad name", "user_Bob"}, nil)
+			if tt.apply {
+				ds.EXPECT().GetKey("user_Bob").Return(`{"Username":"Bob","HashedPass":"hash"}`, nil)
+				ds.EXPECT().SetKey("user_bob", `{"username":"bob","hashedPass":"hash"}`, time.Duration(0)).Return(nil)
+				ds.EXPECT().DelKey("user_Bob").Return(nil)
+				ds.EXPECT().AddIndexMember(userIndexKey, "bob").Return(nil)
+				ds.EXPECT().RemoveIndexMember(userIndexKey, "Bob").Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+
+			got, err := svc.MigrateUsernames(tt.apply)
+			if err != nil {
+				t.Errorf("MigrateUsernames() unexpected error = %v", err)
+				return
+			}
+			if !reflect.DeepEqual(got.Migrated, tt.wantMigrated) {
+				t.Errorf("MigrateUsernames() migrated = %v, want %v", got.Migrated, tt.wantMigrated)
+			}
+			if !reflect.DeepEqual(got.Collisions, tt.wantCollision) {
+				t.Errorf("MigrateUsernames() collisions = %v, want %v", got.Collisions, tt.wantCollision)
+			}
+			if !reflect.DeepEqual(got.Invalid, tt.wantInvalid) {
+				t.Errorf("MigrateUsernames() invalid = %v, want %v", got.Invalid, tt.wantInvalid)
+			}
+			if got.Unchanged != tt.wantUnchanged {
+				t.Errorf("MigrateUsernames() unchanged = %v, want %v", got.Unchanged, tt.wantUnchanged)
+			}
+		})
+	}
+}
+
+func TestUserSVCImpl_MigrateUsernames_Reservations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	keys := map[string]string{
+		"user_Bob":              `{"username":"Bob","hashedPass":"hash","email":"bob@example.com","attributes":{"badge":"b-1"},"identities":[{"provider":"acme","subject":"123"}]}`,
+		"email_bob@example.com": "Bob",
+		"attr_badge_b-1":        "Bob",
+		"identity_acme_123":     "Bob",
+	}
+	ds.EXPECT().ScanKeys(int64(0), "user_*", gomock.Any()).Return(int64(0), []string{"user_Bob"}, nil)
+	ds.EXPECT().GetKey(gomock.Any()).DoAndReturn(func(key string) (string, error) { return keys[key], nil }).AnyTimes()
+	ds.EXPECT().SetKey(gomock.Any(), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, _ time.Duration) error {
+		keys[key] = val
+		return nil
+	}).AnyTimes()
+	ds.EXPECT().SetKeyIfAbsent(gomock.Any(), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, _ time.Duration) (bool, error) {
+		if keys[key] != "" {
+			return false, nil
+		}
+		keys[key] = val
+		return true, nil
+	}).AnyTimes()
+	ds.EXPECT().DelKey(gomock.Any()).DoAndReturn(func(key string) error {
+		delete(keys, key)
+		return nil
+	}).AnyTimes()
+	ds.EXPECT().AddIndexMember(userIndexKey, "bob").Return(nil)
+	ds.EXPECT().RemoveIndexMember(userIndexKey, "Bob").Return(nil)
+
+	svc := &UserSVCImpl{
+		ds:  ds,
+		now: fixedClock,
+		cfg: Config{Attributes: user.AttributeSchema{
+			"badge": {Type: user.StringAttribute, Unique: true},
+		}},
+	}
+	if _, err := svc.MigrateUsernames(true); err != nil {
+		t.Fatalf("MigrateUsernames() unexpected error = %v", err)
+	}
+
+	//the migrated user still holds their own email and badge, so saving them again mustn't report them taken
+	for _, key := range []string{"email_bob@example.com", "attr_badge_b-1", "identity_acme_123"} {
+		if keys[key] != "bob" {
+			t.Errorf("MigrateUsernames() left %v held by %q", key, keys[key])
+		}
+	}
+	if err := svc.claimEmail("bob@example.com", "bob"); err != nil {
+		t.Errorf("claimEmail() after migration error = %v", err)
+	}
+	if err := svc.claimAttributes("bob", map[string]interface{}{"badge": "b-1"}, []string{"badge"}); err != nil {
+		t.Errorf("claimAttributes() after migration error = %v", err)
+	}
+	ctrl.Finish()
+}
+
+func TestUserSVCImpl_SetPassword(t *testing.T) {
+	tests := []struct {
+		name      string
+		history   int
+		pepper    Pepper
+		userFound string
+		wantSaved string
+		wantErr   error
+	}{
+		{
+			name:      "HappyPath",
+			userFound: `{"Username":"joehrke","HashedPass":"old"}`,
+			wantSaved: `{"username":"joehrke","hashedPass":"new","passwordChangedAt":"2020-01-02T03:04:05Z"}`,
+			wantErr:   nil,
+		},
+		{
+			name:      "Keeps_History",
+			history:   3,
+			userFound: `{"username":"joehrke","hashedPass":"old","passwordHistory":["older","oldest"]}`,
+			wantSaved: `{"username":"joehrke","hashedPass":"new","passwordChangedAt":"2020-01-02T03:04:05Z","passwordHistory":["old","older"]}`,
+			wantErr:   nil,
+		},
+		{
+			name:      "History_Covers_Current_Only",
+			history:   1,
+			userFound: `{"username":"joehrke","hashedPass":"old","passwordHistory":["older"]}`,
+			wantSaved: `{"username":"joehrke","hashedPass":"new","passwordChangedAt":"2020-01-02T03:04:05Z"}`,
+			wantErr:   nil,
+		},
+		{
+			name:      "Pepper_Drops_Unpeppered_History",
+			history:   4,
+			pepper:    testPepper,
+			userFound: `{"username":"joehrke","hashedPass":"old","passwordHistory":["$pepper$k1$older","oldest"]}`,
+			wantSaved: `{"username":"joehrke","hashedPass":"new","passwordChangedAt":"2020-01-02T03:04:05Z","passwordHistory":["$pepper$k1$older"]}`,
+			wantErr:   nil,
+		},
+		{
+			name:      "User_Not_Found",
+			userFound: "",
+			wantErr:   user.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(tt.userFound, nil)
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKey(generateUserKey("joehrke"), tt.wantSaved, time.Duration(0)).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{PasswordHistory: tt.history, Pepper: tt.pepper},
+			}
+			if err := svc.SetPassword("joehrke", "new"); err != tt.wantErr {
+				t.Errorf("SetPassword() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_CheckPasswordReuse(t *testing.T) {
+	const (
+		bcryptAbc123 = "$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe"
+		sha1Abc123   = "{SHA}Y2fEjdGT1W6nsLqtJbGUVeUp9e4="
+		sha1Older    = "{SHA}b6X7vBbI+C6keOW5M7NF5G3Sheo="
+		apr1Abc123   = "$apr1$saltsalt$lmZAJhV3TV.p.wyeYXnJI."
+	)
+	tests := []struct {
+		name        string
+		history     int
+		userFound   string
+		expectFetch bool
+		wantErr     error
+	}{
+		{
+			name:    "History_Off",
+			history: 0,
+			wantErr: nil,
+		},
+		{
+			name:        "Matches_Current",
+			history:     1,
+			userFound:   `{"username":"joehrke","hashedPass":"` + sha1Abc123 + `"}`,
+			expectFetch: true,
+			wantErr:     user.PasswordReused,
+		},
+		{
+			name:        "Matches_Legacy_Entry",
+			history:     3,
+			userFound:   `{"username":"joehrke","hashedPass":"` + sha1Older + `","passwordHistory":["not-a-hash","` + apr1Abc123 + `"]}`,
+			expectFetch: true,
+			wantErr:     user.PasswordReused,
+		},
+		{
+			name:        "Matches_Bcrypt_Entry",
+			history:     2,
+			userFound:   `{"username":"joehrke","hashedPass":"` + sha1Older + `","passwordHistory":["` + bcryptAbc123 + `"]}`,
+			expectFetch: true,
+			wantErr:     user.PasswordReused,
+		},
+		{
+			name:        "Match_Beyond_History",
+			history:     2,
+			userFound:   `{"username":"joehrke","hashedPass":"` + sha1Older + `","passwordHistory":["` + sha1Older + `","` + sha1Abc123 + `"]}`,
+			expectFetch: true,
+			wantErr:     nil,
+		},
+		{
+			name:        "User_Not_Found",
+			history:     3,
+			userFound:   "",
+			expectFetch: true,
+			wantErr:     user.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.expectFetch {
+				ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(tt.userFound, nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{PasswordHistory: tt.history},
+			}
+			if err := svc.CheckPasswordReuse("joehrke", "abc123"); err != tt.wantErr {
+				t.Errorf("CheckPasswordReuse() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_AuthUser_RequireVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name      string
+		userFound string
+		want      bool
+		wantErr   error
+	}{
+		{
+			name:      "Unverified",
+			userFound: `{"username":"joehrke","hashedPass":"$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe","email":"joehrke@example.com","passwordChangedAt":"2020-01-01T00:00:00Z"}`,
+			want:      false,
+			wantErr:   user.EmailNotVerified,
+		},
+		{
+			name:      "Verified",
+			userFound: `{"username":"joehrke","hashedPass":"$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe","email":"joehrke@example.com","emailVerified":true,"passwordChangedAt":"2020-01-01T00:00:00Z"}`,
+			want:      true,
+			wantErr:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(tt.userFound, nil)
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{RequireVerifiedEmail: true},
+			}
+			got, err := svc.AuthUser("joehrke", "abc123")
+			if err != tt.wantErr {
+				t.Errorf("AuthUser() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("AuthUser() got = %v, want %v", got, tt.want)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_SetEmail(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		userFound string
+		claimed   bool
+		owner     string
+		wantErr   error
+		wantSaved string
+	}{
+		{
+			name:      "New_Address",
+			email:     "New@Example.com",
+			userFound: `{"username":"joehrke","hashedPass":"hash","email":"old@example.com","emailVerified":true}`,
+			claimed:   true,
+			wantSaved: `{"username":"joehrke","hashedPass":"hash","email":"new@example.com"}`,
+		},
+		{
+			name:      "Address_Taken",
+			email:     "new@example.com",
+			userFound: `{"username":"joehrke","hashedPass":"hash"}`,
+			claimed:   false,
+			owner:     "someoneelse",
+			wantErr:   user.EmailTaken,
+		},
+		{
+			name:    "Invalid_Address",
+			email:   "not an address",
+			wantErr: user.InvalidEmail,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.userFound != "" {
+				ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(tt.userFound, nil)
+				ds.EXPECT().SetKeyIfAbsent("email_new@example.com", "joehrke", time.Duration(0)).Return(tt.claimed, nil)
+			}
+			if !tt.claimed && tt.owner != "" {
+				ds.EXPECT().GetKey("email_new@example.com").Return(tt.owner, nil)
+			}
+			if tt.wantSaved != "" {
+				ds.EXPECT().GetKey("email_old@example.com").Return("joehrke", nil)
+				ds.EXPECT().DelKey("email_old@example.com").Return(nil)
+				ds.EXPECT().SetKey(generateUserKey("joehrke"), tt.wantSaved, time.Duration(0)).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+			if err := svc.SetEmail("joehrke", tt.email); err != tt.wantErr {
+				t.Errorf("SetEmail() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_VerifyEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		wantErr error
+	}{
+		{
+			name:    "Matching_Address",
+			email:   "joehrke@example.com",
+			wantErr: nil,
+		},
+		{
+			name:    "Address_Changed",
+			email:   "old@example.com",
+			wantErr: user.EmailChanged,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"hash","email":"joehrke@example.com","passwordChangedAt":"2020-01-01T00:00:00Z"}`, nil)
+			if tt.wantErr == nil {
+				ds.EXPECT().SetKey(generateUserKey("joehrke"), `{"username":"joehrke","hashedPass":"hash","email":"joehrke@example.com","emailVerified":true,"passwordChangedAt":"2020-01-01T00:00:00Z"}`, time.Duration(0)).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+			if err := svc.VerifyEmail("joehrke", tt.email); err != tt.wantErr {
+				t.Errorf("VerifyEmail() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_UpdateAttributes(t *testing.T) {
+	schema := user.AttributeSchema{
+		"displayName": {Type: user.StringAttribute},
+		"badge":       {Type: user.StringAttribute, Unique: true},
+	}
+	tests := []struct {
+		name      string
+		patch     map[string]interface{}
+		claimed   bool
+		wantErr   error
+		wantSaved string
+	}{
+		{
+			name:      "Plain_Attribute",
+			patch:     map[string]interface{}{"displayName": "Joe"},
+			wantSaved: `{"username":"joehrke","hashedPass":"hash","attributes":{"badge":"b-1","displayName":"Joe"}}`,
+		},
+		{
+			name:      "Unique_Attribute_Moves",
+			patch:     map[string]interface{}{"badge": "b-2"},
+			claimed:   true,
+			wantSaved: `{"username":"joehrke","hashedPass":"hash","attributes":{"badge":"b-2"}}`,
+		},
+		{
+			name:    "Unique_Attribute_Taken",
+			patch:   map[string]interface{}{"badge": "b-2"},
+			claimed: false,
+			wantErr: user.AttributeTakenError("attribute badge already in use"),
+		},
+		{
+			name:    "Unknown_Attribute",
+			patch:   map[string]interface{}{"shoeSize": 11.0},
+			wantErr: user.AttributeError("unknown attribute shoeSize"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"hash","attributes":{"badge":"b-1"}}`, nil)
+			if _, ok := tt.patch["badge"]; ok {
+				ds.EXPECT().SetKeyIfAbsent("attr_badge_b-2", "joehrke", time.Duration(0)).Return(tt.claimed, nil)
+				if !tt.claimed {
+					ds.EXPECT().GetKey("attr_badge_b-2").Return("someoneelse", nil)
+				} else {
+					ds.EXPECT().GetKey("attr_badge_b-1").Return("joehrke", nil)
+					ds.EXPECT().DelKey("attr_badge_b-1").Return(nil)
+				}
+			}
+			if tt.wantSaved != "" {
+				ds.EXPECT().SetKey(generateUserKey("joehrke"), tt.wantSaved, time.Duration(0)).Return(nil)
+			}
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{Attributes: schema},
+			}
+			_, err := svc.UpdateAttributes("joehrke", tt.patch)
+			if err != tt.wantErr {
+				t.Errorf("UpdateAttributes() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_AuthUser_States(t *testing.T) {
+	const hash = `$2a$14$qSVa3Pqd8DHQ2.U3KgWuAeB9ofed8ivKS3EkengCxEI1N1At.GuHe`
+	tests := []struct {
+		name    string
+		state   string
+		want    bool
+		wantErr error
+	}{
+		{
+			name:  "Active",
+			state: "active",
+			want:  true,
+		},
+		{
+			name:    "Disabled",
+			state:   "disabled",
+			wantErr: user.AccountDisabled,
+		},
+		{
+			name:    "Locked",
+			state:   "locked",
+			wantErr: user.AccountLocked,
+		},
+		{
+			name:    "Pending_Verification",
+			state:   "pendingVerification",
+			wantErr: user.EmailNotVerified,
+		},
+		{
+			name:    "Deleted",
+			state:   "deleted",
+			wantErr: user.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"`+hash+`","state":"`+tt.state+`","passwordChangedAt":"2020-01-01T00:00:00Z"}`, nil)
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+			}
+			got, err := svc.AuthUser("joehrke", "abc123")
+			if err != tt.wantErr {
+				t.Errorf("AuthUser() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("AuthUser() got = %v, want %v", got, tt.want)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_SetState(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"hash"}`, nil)
+	ds.EXPECT().SetKey(generateUserKey("joehrke"), `{"username":"joehrke","hashedPass":"hash","state":"disabled"}`, time.Duration(0)).Return(nil)
+
+	svc := &UserSVCImpl{
+		ds:  ds,
+		now: fixedClock,
+	}
+	if err := svc.SetState("joehrke", user.StateDisabled); err != nil {
+		t.Errorf("SetState() unexpected error = %v", err)
+	}
+	if err := svc.SetState("joehrke", user.UserState("asleep")); err != user.InvalidState {
+		t.Errorf("SetState() error = %v, want %v", err, user.InvalidState)
+	}
+	ctrl.Finish()
+}
+
+func TestUserSVCImpl_DeleteUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"hash","email":"joe@example.com","attributes":{"badge":"b-1","displayName":"Joe"}}`, nil)
+	ds.EXPECT().DelKey(generateUserKey("joehrke")).Return(nil)
+	ds.EXPECT().GetKey("email_joe@example.com").Return("joehrke", nil)
+	ds.EXPECT().DelKey("email_joe@example.com").Return(nil)
+	ds.EXPECT().GetKey("attr_badge_b-1").Return("joehrke", nil)
+	ds.EXPECT().DelKey("attr_badge_b-1").Return(nil)
+	ds.EXPECT().RemoveIndexMember(userIndexKey, "joehrke").Return(nil)
+
+	svc := &UserSVCImpl{
+		ds:  ds,
+		now: fixedClock,
+		cfg: Config{Attributes: user.AttributeSchema{
+			"badge":       {Type: user.StringAttribute, Unique: true},
+			"displayName": {Type: user.StringAttribute},
+		}},
+	}
+	if err := svc.DeleteUser("joehrke"); err != nil {
+		t.Errorf("DeleteUser() unexpected error = %v", err)
+	}
+	ctrl.Finish()
+}
+
+func TestUserSVCImpl_ListUsers(t *testing.T) {
+	stored := map[string]string{
+		"user_alice": `{"username":"alice","hashedPass":"hash","attributes":{"department":"sales"}}`,
+		"user_bob":   `{"username":"bob","hashedPass":"hash","attributes":{"department":"support"}}`,
+		"user_carol": `{"username":"carol","hashedPass":"hash","attributes":{"department":"sales"},"state":"disabled"}`,
+	}
+	tests := []struct {
+		name       string
+		query      user.UserQuery
+		index      []string
+		wantUsers  []string
+		wantCursor string
+		wantErr    error
+	}{
+		{
+			name:      "All",
+			index:     []string{"alice", "bob", "carol"},
+			wantUsers: []string{"alice", "bob", "carol"},
+		},
+		{
+			name:       "Page_Full",
+			query:      user.UserQuery{Limit: 2},
+			index:      []string{"alice", "bob", "carol"},
+			wantUsers:  []string{"alice", "bob"},
+			wantCursor: "bob",
+		},
+		{
+			name:      "Filtered",
+			query:     user.UserQuery{Attributes: map[string]string{"department": "sales"}, State: user.StateActive},
+			index:     []string{"alice", "bob", "carol"},
+			wantUsers: []string{"alice"},
+		},
+		{
+			name:      "Stale_Index_Entry",
+			index:     []string{"alice", "dave"},
+			wantUsers: []string{"alice"},
+		},
+		{
+			name:    "Unknown_Attribute",
+			query:   user.UserQuery{Attributes: map[string]string{"team": "x"}},
+			wantErr: user.AttributeError("unknown attribute team"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.index != nil {
+				ds.EXPECT().RangeIndex(userIndexKey, "", "", int64(scanBatchSize)).Return(tt.index, nil)
+			}
+			ds.EXPECT().GetKey(gomock.Any()).DoAndReturn(func(key string) (string, error) {
+				return stored[key], nil
+			}).AnyTimes()
+
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{Attributes: user.AttributeSchema{"department": {Type: user.StringAttribute}}},
+			}
+			got, err := svc.ListUsers(tt.query)
+			if err != tt.wantErr {
+				t.Fatalf("ListUsers() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			names := []string{}
+			for _, u := range got.Users {
+				names = append(names, u.Username)
+			}
+			if !reflect.DeepEqual(names, tt.wantUsers) {
+				t.Errorf("ListUsers() users = %v, want %v", names, tt.wantUsers)
+			}
+			if got.NextCursor != tt.wantCursor {
+				t.Errorf("ListUsers() cursor = %v, want %v", got.NextCursor, tt.wantCursor)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_ImportUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     user.ImportRecord
+		dryRun     bool
+		emailOwner string
+		wantSaved  string
+		wantErr    error
+	}{
+		{
+			name:      "HappyPath",
+			record:    user.ImportRecord{Username: "Joehrke", PasswordHash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", Email: "joe@example.com", EmailVerified: true, Attributes: map[string]interface{}{"level": "3"}},
+			wantSaved: `{"username":"joehrke","hashedPass":"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=","email":"joe@example.com","emailVerified":true,"attributes":{"level":3},"state":"active","passwordChangedAt":"2020-01-02T03:04:05Z"}`,
+		},
+		{
+			name:       "Dry_Run_Email_Taken",
+			record:     user.ImportRecord{Username: "joehrke", PasswordHash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", Email: "joe@example.com"},
+			dryRun:     true,
+			emailOwner: "bob",
+			wantErr:    user.EmailTaken,
+		},
+		{
+			name:   "Dry_Run_OK",
+			record: user.ImportRecord{Username: "joehrke", PasswordHash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", Email: "joe@example.com"},
+			dryRun: true,
+		},
+		{
+			name:    "Plaintext_Password",
+			record:  user.ImportRecord{Username: "joehrke", PasswordHash: "hunter2"},
+			wantErr: user.UnsupportedPasswordHash,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ds := mock_datasource.NewMockDatasource(ctrl)
+			if tt.wantErr != user.UnsupportedPasswordHash {
+				ds.EXPECT().GetKey(generateUserKey("joehrke")).Return("", nil)
+				ds.EXPECT().GetKey(generateAliasKey("joehrke")).Return("", nil)
+			}
+			if tt.dryRun {
+				ds.EXPECT().GetKey("email_joe@example.com").Return(tt.emailOwner, nil)
+			}
+			if tt.wantSaved != "" {
+				ds.EXPECT().SetKeyIfAbsent("email_joe@example.com", "joehrke", time.Duration(0)).Return(true, nil)
+				ds.EXPECT().SetKeyIfAbsent(generateUserKey("joehrke"), tt.wantSaved, time.Duration(0)).Return(true, nil)
+				ds.EXPECT().AddIndexMember(userIndexKey, "joehrke").Return(nil)
+			}
+
+			//an imported address that was already verified makes the user active even when verification is required
+			svc := &UserSVCImpl{
+				ds:  ds,
+				now: fixedClock,
+				cfg: Config{
+					RequireVerifiedEmail: true,
+					Attributes:           user.AttributeSchema{"level": {Type: user.NumberAttribute}},
+				},
+			}
+			if err := svc.ImportUser(tt.record, tt.dryRun); err != tt.wantErr {
+				t.Errorf("ImportUser() error = %v, want %v", err, tt.wantErr)
+			}
+			ctrl.Finish()
+		})
+	}
+}
+
+func TestUserSVCImpl_AuthUser_UpgradesLegacyHash(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ds := mock_datasource.NewMockDatasource(ctrl)
+	ds.EXPECT().GetKey(generateUserKey("joehrke")).Return(`{"username":"joehrke","hashedPass":"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}`, nil)
+	var saved string
+	ds.EXPECT().SetKey(generateUserKey("joehrke"), gomock.Any(), time.Duration(0)).DoAndReturn(func(key string, val string, timeout time.Duration) error {
+		saved = val
+		return nil
+	})
+
+	svc := &UserSVCImpl{
+		ds:  ds,
+		now: fixedClock,
+	}
+	authed, err := svc.AuthUser("joehrke", "secret")
+	if !authed || err != nil {
+		t.Fatalf("AuthUser() = %v, %v, want true, nil", authed, err)
+	}
+	if !strings.Contains(saved, `"hashedPass":"$2a$14$`) || !strings.Contains(saved, `"passwordChangedAt":"2020-01-02T03:04:05Z"`) {
+		t.Errorf("AuthUser() stored %v, want a dated bcrypt hash", saved)
+	}
+	ctrl.Finish()
+}
+
+func Test_generateAttributeKey(t *testing.T) {
+	type args struct {
+		name  string
+		value interface{}
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "Base",
+			args: args{name: "badge", value: "b-1"},
+			want: "attr_badge_b-1",
+		},
+		{
+			name: "Separator in name",
+			args: args{name: "a_b", value: "c"},
+			want: "attr_a%5Fb_c",
+		},
+		{
+			name: "Separator in value",
+			args: args{name: "a", value: "b_c"},
+			want: "attr_a_b_c",
+		},
+		{
+			name: "Escape in name",
+			args: args{name: "a%5Fb", value: "c"},
+			want: "attr_a%255Fb_c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := generateAttributeKey(tt.args.name, tt.args.value); got != tt.want {
+				t.Errorf("generateAttributeKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Package ldaptest is a minimal in-process LDAP server for tests.  It understands simple binds, searches with and, or,
+// not, equality and presence filters, and unbinds, which is all a search-then-bind login needs.
+package ldaptest
+
+import (
+	"github.com/go-asn1-ber/asn1-ber"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Entry is an object in the test directory.  An entry with a Password can be bound as.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Result codes the server answers with
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+	resultInsufficientAccess = 50
+	resultUnwillingToPerform = 53
+)
+
+// Protocol operation tags
+const (
+	applicationBindRequest   = 0
+	applicationBindResponse  = 1
+	applicationSearchRequest = 3
+	applicationSearchEntry   = 4
+	applicationSearchDone    = 5
+)
+
+// Filter choice tags
+const (
+	filterAnd           = 0
+	filterOr            = 1
+	filterNot           = 2
+	filterEqualityMatch = 3
+	filterPresent       = 7
+)
+
+// Positions of the search request fields the server reads
+const (
+	searchSizeLimitField = 3
+	searchFilterField    = 6
+)
+
+type Server struct {
+	// URL is the ldap:// address the server is listening on
+	URL string
+	// RequireBind rejects searches on connections that haven't bound, like a directory without anonymous access
+	RequireBind bool
+
+	listener net.Listener
+	entries  []Entry
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server holding entries on a loopback port
+func NewServer(entries ...Entry) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		URL:      "ldap://" + listener.Addr().String(),
+		listener: listener,
+		entries:  entries,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops accepting connections and waits for open ones to finish
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case applicationBindRequest:
+			code := s.bind(op)
+			bound = code == resultSuccess
+			writeResult(conn, messageId, applicationBindResponse, code)
+		case applicationSearchRequest:
+			if s.RequireBind && !bound {
+				writeResult(conn, messageId, applicationSearchDone, resultInsufficientAccess)
+				continue
+			}
+			s.search(conn, messageId, op)
+		default:
+			//unbind, and anything the server doesn't understand, ends the connection
+			return
+		}
+	}
+}
+
+// bind checks a simple bind, an empty DN and password is an anonymous bind
+func (s *Server) bind(op *ber.Packet) int {
+	if len(op.Children) < 3 {
+		return resultUnwillingToPerform
+	}
+	dn, _ := op.Children[1].Value.(string)
+	password := string(op.Children[2].Data.Bytes())
+	if dn == "" && password == "" {
+		return resultSuccess
+	}
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) && entry.Password != "" && entry.Password == password {
+			return resultSuccess
+		}
+	}
+	return resultInvalidCredentials
+}
+
+func (s *Server) search(conn net.Conn, messageId interface{}, op *ber.Packet) {
+	if len(op.Children) <= searchFilterField {
+		writeResult(conn, messageId, applicationSearchDone, resultUnwillingToPerform)
+		return
+	}
+	sizeLimit, _ := op.Children[searchSizeLimitField].Value.(int64)
+	filter := op.Children[searchFilterField]
+
+	sent := int64(0)
+	for _, entry := range s.entries {
+		if !matches(filter, entry) {
+			continue
+		}
+		if sizeLimit > 0 && sent == sizeLimit {
+			writeResult(conn, messageId, applicationSearchDone, resultSizeLimitExceeded)
+			return
+		}
+		writeEntry(conn, messageId, entry)
+		sent++
+	}
+	writeResult(conn, messageId, applicationSearchDone, resultSuccess)
+}
+
+func matches(filter *ber.Packet, entry Entry) bool {
+	switch filter.Tag {
+	case filterAnd:
+		for _, child := range filter.Children {
+			if !matches(child, entry) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range filter.Children {
+			if matches(child, entry) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return len(filter.Children) == 1 && !matches(filter.Children[0], entry)
+	case filterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		name, _ := filter.Children[0].Value.(string)
+		value, _ := filter.Children[1].Value.(string)
+		for _, candidate := range attributeValues(entry, name) {
+			if strings.EqualFold(candidate, value) {
+				return true
+			}
+		}
+		return false
+	case filterPresent:
+		return len(attributeValues(entry, string(filter.Data.Bytes()))) > 0
+	}
+	return false
+}
+
+// attributeValues looks an attribute up by name, attribute names are case insensitive
+func attributeValues(entry Entry, name string) []string {
+	for attrName, values := range entry.Attributes {
+		if strings.EqualFold(attrName, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func writeEntry(conn net.Conn, messageId interface{}, entry Entry) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationSearchEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+	attributes := ber.NewSequence("Attributes")
+	for name, values := range entry.Attributes {
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	writeMessage(conn, messageId, op)
+}
+
+func writeResult(conn net.Conn, messageId interface{}, application ber.Tag, code int) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	writeMessage(conn, messageId, op)
+}
+
+func writeMessage(conn net.Conn, messageId interface{}, op *ber.Packet) {
+	message := ber.NewSequence("LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
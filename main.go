@@ -1,30 +1,333 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"github.com/gin-gonic/gin"
 	_ "github.com/heroku/x/hmetrics/onload"
+	"io/ioutil"
 	"log"
 	"os"
+	"sso-v2/internal/commands"
 	"sso-v2/internal/datasource/redisdatasource"
 	"sso-v2/internal/handlers/routes"
+	"sso-v2/internal/service/audit/auditsvc"
+	"sso-v2/internal/service/erasure/erasuresvc"
+	"sso-v2/internal/service/group/groupsvc"
+	"sso-v2/internal/service/invitation"
+	"sso-v2/internal/service/invitation/invitationsvc"
+	"sso-v2/internal/service/loginhistory/loginhistorysvc"
+	"sso-v2/internal/service/mfa/mfasvc"
+	"sso-v2/internal/service/notify"
+	"sso-v2/internal/service/notify/asyncnotifier"
+	"sso-v2/internal/service/notify/lognotifier"
+	"sso-v2/internal/service/notify/outboxnotifier"
+	"sso-v2/internal/service/notify/smtpnotifier"
+	"sso-v2/internal/service/oidc"
+	"sso-v2/internal/service/oidc/oidcsvc"
+	"sso-v2/internal/service/rbac/rbacsvc"
+	"sso-v2/internal/service/rename/renamesvc"
+	"sso-v2/internal/service/serviceaccount/serviceaccountsvc"
 	"sso-v2/internal/service/session/sessionsvc"
+	"sso-v2/internal/service/token/tokensvc"
+	"sso-v2/internal/service/user"
+	"sso-v2/internal/service/user/ldapauth"
 	"sso-v2/internal/service/user/usersvc"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	/* Dependency Initialization */
+	redisUrl := os.Getenv("REDISCLOUD_URL")
+	ds := redisdatasource.NewRedisDatasource(redisUrl)
+	attributeSchema, err := loadAttributeSchema()
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxPasswordAge, err := envDays("PASSWORD_MAX_AGE_DAYS")
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwordHistory, err := envCount("PASSWORD_HISTORY")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pepper, err := loadPepper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	//renamed users' old names stay reserved for 30 days unless configured otherwise, 0 turns aliases off
+	usernameAliasTTL := 30 * 24 * time.Hour
+	if os.Getenv("USERNAME_ALIAS_DAYS") != "" {
+		usernameAliasTTL, err = envDays("USERNAME_ALIAS_DAYS")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	userSvc := usersvc.NewUserSvc(ds, usersvc.Config{
+		RequireVerifiedEmail: envBool("REQUIRE_VERIFIED_EMAIL"),
+		Attributes:           attributeSchema,
+		MaxPasswordAge:       maxPasswordAge,
+		PasswordHistory:      passwordHistory,
+		Pepper:               pepper,
+		UsernameAliasTTL:     usernameAliasTTL,
+	})
+	if os.Getenv("LDAP_URL") != "" {
+		ldapCfg, err := loadLdapConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		userSvc = ldapauth.NewLdapUserSvc(userSvc, attributeSchema, ldapCfg)
+	}
+	sessionSvc := sessionsvc.NewSessionSvc(ds)
+	tokenSvc := tokensvc.NewTokenSvc(ds)
+	mfaSvc := mfasvc.NewMfaSvc(ds, userSvc, envDefault("TOTP_ISSUER", "sso-v2"))
+	rbacSvc := rbacsvc.NewRbacSvc(ds, userSvc)
+	groupSvc := groupsvc.NewGroupSvc(ds, userSvc)
+	auditSvc := auditsvc.NewAuditSvc(ds)
+	loginHistorySvc := loginhistorysvc.NewLoginHistorySvc(ds)
+	erasureSvc := erasuresvc.NewErasureSvc(ds, erasuresvc.Services{
+		User:    userSvc,
+		Session: sessionSvc,
+		Group:   groupSvc,
+		Token:   tokenSvc,
+		Mfa:     mfaSvc,
+		Audit:   auditSvc,
+		Logins:  loginHistorySvc,
+	})
+	renameSvc := renamesvc.NewRenameSvc(renamesvc.Services{
+		User:    userSvc,
+		Session: sessionSvc,
+		Group:   groupSvc,
+		Token:   tokenSvc,
+		Mfa:     mfaSvc,
+		Audit:   auditSvc,
+		Logins:  loginHistorySvc,
+	})
+	oidcProviders, err := loadOidcProviders()
+	if err != nil {
+		log.Fatal(err)
+	}
+	oidcSvc := oidcsvc.NewOidcSvc(ds, userSvc, oidcProviders)
+	serviceAccountSvc := serviceaccountsvc.NewServiceAccountSvc(ds, sessionSvc)
+	invitationSvc := invitationsvc.NewInvitationSvc(ds, rbacSvc)
+	/* End Dependency Initialization */
+
+	//Any arguments run a one-off operator command instead of the server
+	if len(os.Args) > 1 {
+		deps := commands.Deps{
+			UserSvc:    userSvc,
+			SessionSvc: sessionSvc,
+			GroupSvc:   groupSvc,
+			AuditSvc:   auditSvc,
+			LoginSvc:   loginHistorySvc,
+		}
+		err := commands.Run(os.Args[1:], deps, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//reset, verification and login tokens are credentials, so they're never written to the log by default
+	notifier, err := buildNotifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+	//requests only queue their mail, waiting on the transport would show which accounts a message went to
+	notifier = asyncnotifier.NewAsyncNotifier(notifier, asyncnotifier.DefaultWorkers, asyncnotifier.DefaultQueueSize)
+
 	port := os.Getenv("PORT")
 
 	if port == "" {
 		log.Fatal("$PORT must be set")
 	}
 
-	/* Dependency Initialization */
-	redisUrl := os.Getenv("REDISCLOUD_URL")
-	ds := redisdatasource.NewRedisDatasource(redisUrl)
-	userSvc := usersvc.NewUserSvc(ds)
-	sessionSvc := sessionsvc.NewSessionSvc(ds)
-	/* End Dependency Initialization */
+	registrationMode := envDefault("REGISTRATION_MODE", invitation.RegistrationOpen)
+	if !invitation.ValidRegistrationMode(registrationMode) {
+		log.Fatal("REGISTRATION_MODE must be open, invite or closed")
+	}
 
-	router := routes.BuildRouter(gin.ReleaseMode, userSvc, sessionSvc)
+	routerCfg := routes.Config{
+		EnumerationProtection: envBool("ENUMERATION_PROTECTION"),
+		PasswordResetURL:      os.Getenv("PASSWORD_RESET_URL"),
+		LoginLinks:            envBool("LOGIN_LINKS"),
+		LoginLinkURL:          os.Getenv("LOGIN_LINK_URL"),
+		OidcReturnURL:         os.Getenv("OIDC_RETURN_URL"),
+		AdminToken:            os.Getenv("ADMIN_TOKEN"),
+		RegistrationMode:      registrationMode,
+	}
+	svcs := routes.Services{
+		User:           userSvc,
+		Session:        sessionSvc,
+		Token:          tokenSvc,
+		Notifier:       notifier,
+		Mfa:            mfaSvc,
+		Rbac:           rbacSvc,
+		Group:          groupSvc,
+		Audit:          auditSvc,
+		LoginHistory:   loginHistorySvc,
+		Erasure:        erasureSvc,
+		Rename:         renameSvc,
+		Oidc:           oidcSvc,
+		ServiceAccount: serviceAccountSvc,
+		Invitation:     invitationSvc,
+	}
+
+	router := routes.BuildRouter(gin.ReleaseMode, routerCfg, svcs)
 	router.Run(":" + port)
 }
+
+// envBool reads a boolean flag from the environment, treating anything unparseable as false
+func envBool(name string) bool {
+	val, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && val
+}
+
+// envDays reads a whole number of days from the environment, an unset variable is 0
+func envDays(name string) (time.Duration, error) {
+	days, err := envCount(name)
+	if err != nil {
+		return 0, errors.New(name + " must be a whole number of days")
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// envCount reads a non-negative whole number from the environment, 0 when it isn't set
+func envCount(name string) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, errors.New(name + " must be a whole number")
+	}
+	return n, nil
+}
+
+// envDefault reads a setting from the environment, falling back to def when it isn't set
+func envDefault(name string, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+// loadAttributeSchema reads the user profile attribute schema from the JSON file named by USER_ATTRIBUTE_SCHEMA.
+// Without one users can't carry any attributes.
+func loadAttributeSchema() (user.AttributeSchema, error) {
+	path := os.Getenv("USER_ATTRIBUTE_SCHEMA")
+	if path == "" {
+		return user.AttributeSchema{}, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return user.ParseAttributeSchema(raw)
+}
+
+// loadPepper reads the password pepper keys from the JSON file named by PASSWORD_PEPPER_FILE or the PASSWORD_PEPPER
+// list.  Without either passwords aren't peppered.
+func loadPepper() (usersvc.Pepper, error) {
+	if path := os.Getenv("PASSWORD_PEPPER_FILE"); path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return usersvc.Pepper{}, err
+		}
+		return usersvc.ParsePepper(raw)
+	}
+	if list := os.Getenv("PASSWORD_PEPPER"); list != "" {
+		return usersvc.ParsePepperList(list)
+	}
+	return usersvc.Pepper{}, nil
+}
+
+// loadOidcProviders reads the upstream OpenID Connect providers from the JSON file named by OIDC_PROVIDERS.  Without
+// one federated login is off.
+func loadOidcProviders() (map[string]oidc.ProviderConfig, error) {
+	path := os.Getenv("OIDC_PROVIDERS")
+	if path == "" {
+		return map[string]oidc.ProviderConfig{}, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return oidc.ParseProviders(raw)
+}
+
+// loadLdapConfig reads the directory settings for LDAP authentication, see the LDAP_* variables in the README
+func loadLdapConfig() (ldapauth.Config, error) {
+	cfg := ldapauth.Config{
+		URL:            os.Getenv("LDAP_URL"),
+		StartTLS:       envBool("LDAP_START_TLS"),
+		BindDN:         os.Getenv("LDAP_BIND_DN"),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         os.Getenv("LDAP_BASE_DN"),
+		UserFilter:     envDefault("LDAP_USER_FILTER", ldapauth.DefaultUserFilter),
+		EmailAttribute: envDefault("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		Attributes:     make(map[string]string),
+		AutoProvision:  envBool("LDAP_AUTO_PROVISION"),
+		LocalFallback:  envBool("LDAP_LOCAL_FALLBACK"),
+	}
+	if cfg.BaseDN == "" {
+		return cfg, errors.New("LDAP_BASE_DN must be set")
+	}
+
+	//LDAP_ATTRIBUTES is a comma separated list of local=directory attribute names
+	if mapping := os.Getenv("LDAP_ATTRIBUTES"); mapping != "" {
+		for _, pair := range strings.Split(mapping, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return cfg, errors.New("invalid LDAP_ATTRIBUTES entry " + pair)
+			}
+			cfg.Attributes[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if path := os.Getenv("LDAP_CA_CERT"); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return cfg, errors.New("no certificates found in LDAP_CA_CERT")
+		}
+		cfg.TLSConfig = &tls.Config{RootCAs: roots}
+	}
+	return cfg, nil
+}
+
+// buildNotifier sends mail over SMTP when SMTP_HOST is set, otherwise messages go to the MAIL_OUTBOX file, or stdout
+// when MAIL_OUTBOX is "-".  With neither set there is nowhere safe to deliver tokens, so messages are dropped with a
+// warning rather than printed, and deployments from before mail was configurable keep starting.
+func buildNotifier() (notify.Notifier, error) {
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return smtpnotifier.NewSMTPNotifier(smtpnotifier.Config{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}), nil
+	}
+	switch path := os.Getenv("MAIL_OUTBOX"); path {
+	case "":
+		log.Print("warning: neither SMTP_HOST nor MAIL_OUTBOX is set, password reset, verification and login link messages will be dropped")
+		return lognotifier.NewLogNotifier(), nil
+	case "-":
+		return outboxnotifier.NewOutboxNotifier(os.Stdout), nil
+	default:
+		return outboxnotifier.NewFileOutbox(path)
+	}
+}